@@ -1,11 +1,32 @@
 package main
 
 import (
+	"log"
+	"os"
+
+	"vddk-builder/pkg/builder"
 	"vddk-builder/pkg/config"
 	"vddk-builder/pkg/server"
 )
 
 func main() {
-	cfg := config.LoadConfig()
-	server.StartServer(cfg)
+	// Build Jobs of BUILD_MODE=job run the same binary and receive their configuration from the server
+	if len(os.Args) > 1 && os.Args[1] == "job" {
+		if err := server.RunBuildJob(builder.ExecRunner{}); err != nil {
+			log.Fatalf("Build failed: %v", err)
+		}
+		return
+	}
+
+	cfg, err := config.LoadConfig()
+	if err != nil {
+		log.Fatalf("Invalid configuration: %v", err)
+	}
+	if err := cfg.Validate(); err != nil {
+		log.Fatalf("Invalid configuration: %v", err)
+	}
+	for _, warning := range cfg.Warnings() {
+		log.Printf("WARNING: %s\n", warning)
+	}
+	server.StartServer(cfg, builder.ExecRunner{})
 }
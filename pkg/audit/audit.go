@@ -0,0 +1,162 @@
+package audit
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// queueSize is the number of entries that may wait for the writer before new ones are dropped.
+const queueSize = 1024
+
+// Entry is a single audit record. It never contains credentials.
+type Entry struct {
+	Time          time.Time `json:"time"`
+	Identity      string    `json:"identity"`
+	ClientIP      string    `json:"clientIP"`
+	Action        string    `json:"action"`
+	Image         string    `json:"image,omitempty"`
+	BuildID       string    `json:"buildID,omitempty"`
+	ArchiveDigest string    `json:"archiveDigest,omitempty"`
+	Outcome       string    `json:"outcome"`
+	Detail        string    `json:"detail,omitempty"`
+}
+
+// Logger appends audit entries as JSON lines to a file and keeps the most recent ones
+// in memory. Record never blocks: entries are handed to a background writer.
+type Logger struct {
+	queue chan Entry
+	done  chan struct{}
+	out   io.WriteCloser
+
+	mu      sync.Mutex
+	recent  []Entry
+	next    int
+	dropped int
+	closed  bool
+}
+
+// NewLogger opens path for appending (stderr when path is empty) and starts the background
+// writer. keep is the number of recent entries retained for Recent.
+func NewLogger(path string, keep int) (*Logger, error) {
+	var out io.WriteCloser = nopCloser{os.Stderr}
+	if path != "" {
+		f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+		if err != nil {
+			return nil, err
+		}
+		out = f
+	}
+
+	l := &Logger{
+		queue:  make(chan Entry, queueSize),
+		done:   make(chan struct{}),
+		out:    out,
+		recent: make([]Entry, 0, keep),
+	}
+	go l.run()
+	return l, nil
+}
+
+// Record queues e for writing, stamping it with the current time if unset.
+func (l *Logger) Record(e Entry) {
+	if l == nil {
+		return
+	}
+	if e.Time.IsZero() {
+		e.Time = time.Now().UTC()
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.closed {
+		return
+	}
+	if cap(l.recent) > 0 {
+		if len(l.recent) < cap(l.recent) {
+			l.recent = append(l.recent, e)
+		} else {
+			l.recent[l.next] = e
+		}
+		l.next = (l.next + 1) % cap(l.recent)
+	}
+
+	select {
+	case l.queue <- e:
+	default:
+		l.dropped++
+	}
+}
+
+// Recent returns up to n of the most recent entries, oldest first.
+func (l *Logger) Recent(n int) []Entry {
+	if l == nil {
+		return nil
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	ordered := make([]Entry, 0, len(l.recent))
+	if len(l.recent) < cap(l.recent) {
+		ordered = append(ordered, l.recent...)
+	} else {
+		ordered = append(ordered, l.recent[l.next:]...)
+		ordered = append(ordered, l.recent[:l.next]...)
+	}
+	if n > 0 && n < len(ordered) {
+		ordered = ordered[len(ordered)-n:]
+	}
+	return ordered
+}
+
+// Close writes every queued entry, flushes the file and closes it.
+func (l *Logger) Close() error {
+	if l == nil {
+		return nil
+	}
+	l.mu.Lock()
+	if l.closed {
+		l.mu.Unlock()
+		return nil
+	}
+	l.closed = true
+	close(l.queue)
+	l.mu.Unlock()
+	<-l.done
+
+	l.mu.Lock()
+	if l.dropped > 0 {
+		log.Printf("Audit log dropped %d entries because the writer fell behind\n", l.dropped)
+	}
+	l.mu.Unlock()
+	return l.out.Close()
+}
+
+// run writes queued entries until the queue is closed, flushing whenever it drains.
+func (l *Logger) run() {
+	defer close(l.done)
+
+	w := bufio.NewWriter(l.out)
+	enc := json.NewEncoder(w)
+	for e := range l.queue {
+		if err := enc.Encode(e); err != nil {
+			log.Printf("Failed to write audit entry: %v\n", err)
+		}
+		if len(l.queue) == 0 {
+			if err := w.Flush(); err != nil {
+				log.Printf("Failed to flush audit log: %v\n", err)
+			}
+		}
+	}
+	if err := w.Flush(); err != nil {
+		log.Printf("Failed to flush audit log: %v\n", err)
+	}
+}
+
+type nopCloser struct{ io.Writer }
+
+func (nopCloser) Close() error { return nil }
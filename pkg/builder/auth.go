@@ -0,0 +1,52 @@
+package builder
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"vddk-builder/pkg/registry"
+)
+
+// authFileUser is the user name paired with the bearer token in generated auth files. The
+// OpenShift registry accepts any name and authenticates the token given as the password.
+const authFileUser = "serviceaccount"
+
+// writeAuthFile writes a containers-auth.json granting authToken access to registryURL into
+// workDir, readable by the server user only, so the token never appears in the arguments
+// of skopeo or cosign. The caller removes the returned file when done.
+func writeAuthFile(workDir, registryURL, authToken string) (string, error) {
+	auth := base64.StdEncoding.EncodeToString([]byte(authFileUser + ":" + authToken))
+	content, err := json.Marshal(map[string]any{
+		"auths": map[string]any{registryURL: map[string]string{"auth": auth}},
+	})
+	if err != nil {
+		return "", err
+	}
+
+	file, err := os.CreateTemp(workDir, "auth-*.json")
+	if err != nil {
+		return "", fmt.Errorf("create auth file: %w", err)
+	}
+	defer file.Close()
+	if _, err := file.Write(content); err != nil {
+		os.Remove(file.Name())
+		return "", fmt.Errorf("write auth file: %w", err)
+	}
+	return file.Name(), nil
+}
+
+// authFileFor returns the auth file holding the credentials for registryURL: REGISTRY_AUTH_CONFIG
+// when it has credentials for the registry or authToken is empty, otherwise one written for
+// authToken. remove deletes a written file.
+func authFileFor(workDir, registryURL, authToken, authConfig string) (file string, remove func(), err error) {
+	if authToken == "" || registry.HasCredentials(registryURL) {
+		return authConfig, func() {}, nil
+	}
+	file, err = writeAuthFile(workDir, registryURL, authToken)
+	if err != nil {
+		return "", nil, err
+	}
+	return file, func() { os.Remove(file) }, nil
+}
@@ -0,0 +1,59 @@
+package builder
+
+import (
+	"fmt"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+var (
+	buildArgKeyPattern    = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+	secretBuildArgPattern = regexp.MustCompile(`(?i)(PASSWORD|PASSWD|SECRET|TOKEN|CREDENTIAL|AUTH|KEY)`)
+)
+
+// redactedValue replaces the value of build args whose key looks like a secret.
+const redactedValue = "REDACTED"
+
+// ValidateBuildArgs checks that each arg has the KEY=VALUE form and a key listed in allowed.
+func ValidateBuildArgs(args, allowed []string) error {
+	for _, arg := range args {
+		key, _, ok := strings.Cut(arg, "=")
+		if !ok || !buildArgKeyPattern.MatchString(key) {
+			return fmt.Errorf("%q is not of the form KEY=VALUE", arg)
+		}
+		if !slices.Contains(allowed, key) {
+			return fmt.Errorf("build arg %s is not allowed", key)
+		}
+	}
+	return nil
+}
+
+// MergeBuildArgs returns defaults with the args in overrides replacing those with the same key.
+func MergeBuildArgs(defaults, overrides []string) []string {
+	merged := make([]string, 0, len(defaults)+len(overrides))
+	index := map[string]int{}
+	for _, arg := range append(slices.Clone(defaults), overrides...) {
+		key, _, _ := strings.Cut(arg, "=")
+		if i, ok := index[key]; ok {
+			merged[i] = arg
+			continue
+		}
+		index[key] = len(merged)
+		merged = append(merged, arg)
+	}
+	return merged
+}
+
+// RedactBuildArgs returns a copy of args with the values of secret-looking keys replaced.
+func RedactBuildArgs(args []string) []string {
+	redacted := make([]string, len(args))
+	for i, arg := range args {
+		key, _, _ := strings.Cut(arg, "=")
+		if secretBuildArgPattern.MatchString(key) {
+			arg = key + "=" + redactedValue
+		}
+		redacted[i] = arg
+	}
+	return redacted
+}
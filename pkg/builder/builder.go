@@ -1,155 +1,943 @@
 package builder
 
 import (
-	"archive/tar"
-	"compress/gzip"
+	"context"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"os"
-	"os/exec"
 	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
 	"vddk-builder/pkg/config"
+	"vddk-builder/pkg/registry"
 )
 
 const dirPerm = 0755
 
+// cmdWaitDelay bounds how long a killed command may keep its output pipes open.
+const cmdWaitDelay = 10 * time.Second
+
+// ArchiveDigestLabel is the image label holding the digest of the archive it was built from.
+const ArchiveDigestLabel = "io.github.yaacov.vddk-builder.archive-digest"
+
+// workDirPrefix starts the name of every directory the builder creates in WORK_DIR.
+const workDirPrefix = "vddk-builder-"
+
+// retainedMarker is the file written into the work directory of a failed build that is kept.
+const retainedMarker = ".retained"
+
+// BuildRequest describes a single image build.
+type BuildRequest struct {
+	WorkDir    string   // Directory created by NewWorkDir for this build, removed when the build ends
+	BuildID    string   // ID of the build, passed to hooks as BUILD_ID
+	FilePath   string   // Path to the tar.gz file, empty when the archive was already extracted by ExtractStream
+	ImageName  string   // Name of the image to build, the default name from the configuration if empty
+	AuthToken  string   // Token for pushing to the registry, optional
+	ExtraFiles []string // Paths of additional files copied into the root of the build context
+	// Containerfile is the path of the Containerfile inside the archive, CONTAINERFILE_PATH if empty
+	Containerfile string
+	// ContainerfileOverride is an uploaded Containerfile outside the build context that is
+	// built with instead of any Containerfile in the archive
+	ContainerfileOverride string
+	// ContainerfileCopy is where the effective Containerfile is stored, not stored if empty
+	ContainerfileCopy string
+	// UnpackNested extracts archives found at the root of the extracted upload, such as the
+	// original VMware tarball inside a wrapper, up to MAX_NESTING_DEPTH levels
+	UnpackNested bool
+	// BuildArgs are passed to podman build as --build-arg KEY=VALUE flags
+	BuildArgs []string
+	// Platforms, when set, builds the image for each os/arch and pushes a manifest list
+	// instead of a single-platform image
+	Platforms []string
+	// Platform is the os/arch of a single-platform image, the builder's own platform if empty
+	Platform string
+	// ArchiveDigest is recorded in the ArchiveDigestLabel of the image, optional
+	ArchiveDigest  string
+	NoCache        bool         // Build without the layer cache, --no-cache
+	Squash         bool         // Squash the image into a single layer, --squash-all with podman
+	DryRun         bool         // Build the image and remove it again instead of pushing it
+	SBOMPath       string       // File the SPDX JSON SBOM of the image is written to, no SBOM is generated if empty
+	ScanReportPath string       // File the vulnerability scan report is written to, the image is not scanned if empty
+	UpdateRefs     bool         // Set the UPDATE_TARGET field to the pushed image
+	Progress       ProgressFunc // Receives the current phase and its progress, optional
+	Output         io.Writer    // Receives build engine and skopeo output line by line as it is produced, the server log if nil
+	Runner         Runner       // Runs the build engine and skopeo, an ExecRunner if nil
+}
+
+// BuildResult describes a pushed image.
+type BuildResult struct {
+	Image           string                   // Registry reference the image was pushed to
+	Tags            []string                 // Every registry reference pushed, Image first, unset on failure
+	Version         string                   // VDDK version detected in the archive, if any
+	Digest          string                   // Manifest digest of the pushed image, empty if skopeo cannot report it
+	PhaseDurations  map[string]time.Duration // Time spent in each phase that ran, keyed by phase name
+	Pushes          []PushResult             // Outcome of the push to each registry, primary first
+	Signature       string                   // SignatureSigned or SignatureFailed, empty when signing is disabled
+	SignErr         error                    // Why signing failed when SIGN_REQUIRED is disabled
+	SBOMDigest      string                   // Digest of the SBOM written to req.SBOMPath, empty without one
+	SBOMErr         error                    // Why the SBOM could not be generated or attached when SBOM_REQUIRED is disabled
+	ScanCounts      map[string]int           // Vulnerabilities found by the scanner by severity, nil without a scan
+	ImageIDs        []string                 // IDs of the images built locally, one per platform
+	ImageSize       int64                    // Total size of the images built locally, set for dry runs
+	Compression     string                   // Layer compression format the image was pushed with
+	OutputPath      string                   // OCI archive the image was written to in archive mode
+	Checksums       string                   // Outcome of the CHECKSUM_MANIFEST verification, ChecksumsVerified for example
+	Stats           BuildStats               // Work done in each phase, next to PhaseDurations
+	RetainedWorkDir string                   // Work directory kept after the failure with KEEP_WORKDIR_ON_FAILURE
+	ImageStreamErr  error                    // Why the ImageStreamTags could not be verified or annotated with IMAGESTREAM_ENABLED
+	UpdatedRef      string                   // Reference pinned by digest the UPDATE_TARGET field was set to
+	UpdateErr       error                    // Why the UPDATE_TARGET field could not be set
+}
+
+// PushResult describes the push of the built image to one registry.
+type PushResult struct {
+	Registry string // Registry host the image was pushed to
+	Image    string // Reference pushed in that registry
+	Digest   string // Manifest digest reported by skopeo, if known
+	Retries  int    // Push attempts repeated after transient failures
+	Err      error  // Why the push failed, nil on success
+}
+
+// BuildStats counts the work done in the phases of a build.
+type BuildStats struct {
+	ExtractedBytes   int64 `json:"extractedBytes"`   // Bytes of the extracted files, nested archives included
+	ExtractedEntries int   `json:"extractedEntries"` // Archive entries read, nested archives included
+	BuildSteps       int   `json:"buildSteps"`       // STEP markers printed by the build engine, over all platforms
+	PushedBytes      int64 `json:"pushedBytes"`      // Local image size times the registries pushed to, or the OCI archive size
+	PushRetries      int   `json:"pushRetries"`      // Push attempts repeated after transient failures
+}
+
 // BuildAndPushImage builds a Docker image from a tar.gz file and pushes it to a Docker registry.
 // It performs the following steps:
-// 1. Creates a temporary directory for extraction.
-// 2. Extracts the contents of the tar.gz file to the temporary directory.
-// 3. Builds a Docker image from the extracted contents.
-// 4. Pushes the Docker image to the specified registry.
-// 5. Cleans up the temporary directory and the tar.gz file.
+//  1. Creates the build context directory inside the build's work directory.
+//  2. Extracts the contents of the tar.gz file to the build context and copies the
+//     extra files uploaded alongside it on top, replacing archive entries of the same name.
+//  3. Builds a Docker image from the extracted contents, generates its SBOM and scans it for
+//     vulnerabilities if requested, and stops after removing it again for dry runs. Unless imageName carries a tag, the
+//     image is tagged with the VDDK version detected in the archive, and also as latest if
+//     TAG_LATEST is set.
+//  4. Pushes the Docker image to each registry in IMAGE_REGISTRIES, or writes it to OUTPUT_DIR as an
+//     OCI archive with OUTPUT_MODE=archive. With req.Platforms set, the image is built once per
+//     platform and pushed as a manifest list together with every image.
+//     PRE_BUILD_HOOK runs in the build context before the build and POST_PUSH_HOOK after the push.
+//  5. Signs the pushed digest with cosign when COSIGN_KEY_PATH is set, and attaches the SBOM
+//     generated with syft after the build when req.SBOMPath and SBOM_PUSH are set. With
+//     IMAGESTREAM_ENABLED, the OpenShift ImageStreamTags of the push are verified and annotated.
+//     The UPDATE_TARGET field is then set to the image pinned by digest if req.UpdateRefs is set.
+//  6. Removes the image from the local storage of the build engine unless KEEP_LOCAL_IMAGE is set.
+//  7. Removes the work directory and the tar.gz file.
+//
+// The podman and skopeo processes are killed when ctx is cancelled or its deadline expires.
+// Progress of the extract, build and push phases is reported through req.Progress.
 //
 // Parameters:
-// - cfg: Configuration object containing image registry and default image name.
-// - filePath: Path to the tar.gz file to be extracted and used for building the image.
-// - imageName: Name of the Docker image to be built. If empty, the default name from the configuration is used.
-// - authToken: The authentication token for the registry.
-func BuildAndPushImage(cfg *config.Config, filePath, imageName, authToken string) {
-	tmpDir := filepath.Join(".", "tmp")
-	if err := os.MkdirAll(tmpDir, dirPerm); err != nil {
-		log.Printf("Failed to create temporary directory: %v\n", err)
-		return
+//   - ctx: Context bounding the whole build.
+//   - cfg: Configuration object containing image registry and default image name.
+//   - req: The archive, image name, registry token and extra files of the build.
+//
+// Returns the pushed image and, on failure, an *ExtractError, *BuildError, *ScanError, *PushError, *SignError or *SBOMError
+// naming the failing phase and including the command output if any. The result carries
+// the durations of the phases that ran even when an error is returned.
+func BuildAndPushImage(ctx context.Context, cfg *config.Config, req BuildRequest) (result BuildResult, err error) {
+	result = BuildResult{
+		Image:          ImageReference(cfg, req.ImageName),
+		PhaseDurations: map[string]time.Duration{},
 	}
-
-	// Define the extracted directory under tmp
-	extractedDir := filepath.Join(tmpDir, "extracted")
-	if err := os.MkdirAll(extractedDir, dirPerm); err != nil {
-		log.Printf("Failed to create extraction directory: %v\n", err)
-		return
+	timePhase := func(phase string, start time.Time) {
+		result.PhaseDurations[phase] = time.Since(start)
 	}
 
-	// Defer cleanup for extractedDir and tar.gz file
+	// Defer cleanup for the work directory and tar.gz file, keeping the work directory of
+	// a failed build when KEEP_WORKDIR_ON_FAILURE is set
 	defer func() {
-		log.Println("Cleaning up...")
-		if err := os.RemoveAll(extractedDir); err != nil {
-			log.Printf("Failed to remove extracted directory: %v\n", err)
-		}
-		if err := os.Remove(filePath); err != nil {
-			log.Printf("Failed to remove tar.gz file: %v\n", err)
+		if err != nil && cfg.KeepWorkDirOnFailure && retainWorkDir(req.WorkDir) {
+			result.RetainedWorkDir = req.WorkDir
+			RemoveUpload(req.FilePath)
+			return
 		}
+		CleanupWorkspace(req.WorkDir, req.FilePath)
 	}()
 
-	// Extract the tar.gz file
-	log.Println("Extracting uploaded file...")
-	if err := extractTarGz(filePath, extractedDir); err != nil {
-		log.Printf("Failed to extract archive: %v\n", err)
-		return
+	// Incomplete uploads are never renamed to their final path
+	for _, path := range append([]string{req.FilePath}, req.ExtraFiles...) {
+		if strings.HasSuffix(path, PartialSuffix) {
+			return result, &ExtractError{Err: fmt.Errorf("refusing to build from incomplete upload %s", path)}
+		}
 	}
 
-	// Set image name and tag
-	if imageName == "" {
-		imageName = cfg.ImageName
+	contextDir := ContextDir(req.WorkDir)
+	if err := os.MkdirAll(contextDir, dirPerm); err != nil {
+		return result, fmt.Errorf("failed to create extraction directory: %w", err)
 	}
-	imageTag := fmt.Sprintf("%s/%s", cfg.ImageRegistry, imageName)
 
-	// Build the image
-	if err := buildImage(imageTag, extractedDir); err != nil {
-		log.Printf("Failed to build image: %v\n", err)
-		return
+	// Extract the tar.gz file, unless it was already extracted while streaming
+	start := time.Now()
+	limits := limitsFor(cfg)
+	if req.FilePath != "" {
+		log.Println("Extracting uploaded file...")
+		if err := extractTarGz(req.FilePath, contextDir, limits, req.Progress); err != nil {
+			timePhase(PhaseExtracting, start)
+			return result, &ExtractError{Err: err}
+		}
+	} else {
+		// Count the streamed extraction, also against the limits of nested archives
+		if err := limits.countExisting(contextDir); err != nil {
+			timePhase(PhaseExtracting, start)
+			return result, &ExtractError{Err: err}
+		}
+	}
+	// Check the archive against its own checksums before nested archives are unpacked
+	checksums, err := verifyChecksums(cfg, contextDir)
+	result.Checksums = checksums
+	if err != nil {
+		timePhase(PhaseExtracting, start)
+		return result, &ExtractError{Err: err}
+	}
+	if req.UnpackNested {
+		if err := unpackNested(contextDir, cfg.MaxNestingDepth, limits); err != nil {
+			timePhase(PhaseExtracting, start)
+			return result, &ExtractError{Err: err}
+		}
+	}
+	result.Stats.ExtractedBytes, result.Stats.ExtractedEntries = limits.bytes, limits.entries
+	for _, extra := range req.ExtraFiles {
+		if err := copyFile(extra, filepath.Join(contextDir, filepath.Base(extra))); err != nil {
+			timePhase(PhaseExtracting, start)
+			return result, &ExtractError{Err: fmt.Errorf("failed to add extra file: %w", err)}
+		}
 	}
+	timePhase(PhaseExtracting, start)
 
-	// Push the image to the registry
-	if err := pushImage(imageTag, authToken); err != nil {
-		log.Printf("Failed to push image: %v\n", err)
-		return
+	// Let the site adjust the build context
+	if cfg.PreBuildHook != "" {
+		start = time.Now()
+		err := runHook(ctx, cfg, req, cfg.PreBuildHook, hookEnv{contextDir: contextDir, image: result.Image, status: HookStatusBuilding})
+		timePhase(PhaseBuilding, start)
+		if err != nil {
+			return result, &BuildError{Err: fmt.Errorf("pre-build hook failed: %w", err)}
+		}
 	}
 
-	log.Println("Image build and push completed successfully.")
-}
+	start = time.Now()
+	containerfile, buildContext, err := resolveContainerfile(cfg, contextDir, req.Containerfile)
+	if req.ContainerfileOverride != "" {
+		// The uploaded Containerfile wins over any in the archive
+		containerfile, buildContext, err = req.ContainerfileOverride, contextDir, nil
+	}
+	if err == nil {
+		err = validateContent(cfg, buildContext)
+	}
+	result.PhaseDurations[PhaseExtracting] += time.Since(start)
+	if err != nil {
+		return result, &ExtractError{Err: err}
+	}
+	if err := ctx.Err(); err != nil {
+		return result, err
+	}
+
+	// Tag the image with the detected VDDK version unless the caller picked a tag
+	result.Version = detectVersion(buildContext)
+	tags := []string{result.Image}
+	if !HasTag(result.Image) {
+		if result.Version == "" {
+			log.Printf("Warning: could not detect the VDDK version, tagging %s as latest\n", result.Image)
+		} else {
+			tags = []string{result.Image + ":" + result.Version}
+			if cfg.TagLatest {
+				tags = append(tags, result.Image+":latest")
+			}
+			result.Image = tags[0]
+		}
+	}
+	var labels []string
+	if result.Version != "" {
+		labels = append(labels, "org.opencontainers.image.version="+result.Version)
+	}
+	if req.ArchiveDigest != "" {
+		labels = append(labels, ArchiveDigestLabel+"="+req.ArchiveDigest)
+	}
+	labels = append(labels, ChecksumsLabel+"="+result.Checksums)
 
-// extractTarGz extracts a .tar.gz file to a destination directory
-func extractTarGz(src, dest string) error {
-	file, err := os.Open(src)
+	// Build the image, generating a Containerfile if the archive has none
+	start = time.Now()
+	if containerfile == "" {
+		var content string
+		containerfile, content, err = generateContainerfile(cfg, req.WorkDir, contextDir)
+		if err != nil {
+			timePhase(PhaseBuilding, start)
+			return result, &BuildError{Err: err}
+		}
+		log.Println("Archive has no Containerfile, building with a generated one")
+		logContainerfile(outputSink(req.Output, "containerfile"), content)
+	}
+	if req.ContainerfileCopy != "" {
+		if err := copyFile(containerfile, req.ContainerfileCopy); err != nil {
+			log.Printf("Warning: failed to store the effective Containerfile: %v\n", err)
+		}
+	}
+	if err := checkBaseImages(cfg, containerfile, req.BuildArgs); err != nil {
+		timePhase(PhaseBuilding, start)
+		return result, &BuildError{Err: err}
+	}
+	eng := engineFor(cfg)
+	flags := buildFlags(labels, req.BuildArgs)
+	if req.NoCache {
+		flags = append(flags, "--no-cache")
+	}
+	if req.Squash {
+		flags = append(flags, eng.squashFlag())
+	}
+	if limits := LimitsFor(cfg); limits != nil {
+		log.Printf("Limiting build resources to %s\n", limits)
+		flags = append(flags, limits.flags()...)
+	}
+	multiArch := len(req.Platforms) > 0
+	var imageIDs []string
+	if multiArch {
+		imageIDs, err = buildManifest(ctx, req.Runner, eng, req.WorkDir, result.Image, req.Platforms, flags, containerfile, buildContext, &result.Stats.BuildSteps, req.Progress, req.Output)
+	} else {
+		iidFile := filepath.Join(req.WorkDir, "image.iid")
+		for _, tag := range tags {
+			flags = append(flags, "-t", tag)
+		}
+		if req.Platform != "" {
+			flags = append(flags, "--platform", req.Platform)
+		}
+		flags = append(flags, "--iidfile", iidFile)
+		err = emulationError(buildImage(ctx, req.Runner, eng, flags, containerfile, buildContext, &result.Stats.BuildSteps, req.Progress, req.Output), req.Platform)
+		if id := readImageID(iidFile); id != "" {
+			imageIDs = []string{id}
+		}
+	}
+	timePhase(PhaseBuilding, start)
+	result.ImageIDs = imageIDs
 	if err != nil {
-		return fmt.Errorf("failed to open tar.gz file: %v", err)
+		return result, &BuildError{Err: err}
 	}
-	defer file.Close()
 
-	gzipReader, err := gzip.NewReader(file)
+	// Describe and scan the image while it is still in local storage
+	inspected := tags[0]
+	if multiArch && len(imageIDs) > 0 {
+		// The manifest list only exists locally by name; inspect the first platform
+		inspected = eng.localImageByID(imageIDs[0])
+	}
+	if req.SBOMPath != "" {
+		start = time.Now()
+		result.SBOMDigest, err = generateSBOM(ctx, cfg, req, eng, inspected)
+		timePhase(PhaseSBOM, start)
+		if err != nil {
+			if cfg.SBOMRequired {
+				return result, &SBOMError{Err: err}
+			}
+			log.Printf("Warning: failed to generate SBOM of %s: %v\n", result.Image, err)
+			result.SBOMErr = err
+		}
+	}
+	if req.ScanReportPath != "" {
+		start = time.Now()
+		result.ScanCounts, err = scanImage(ctx, cfg, req, eng, inspected)
+		timePhase(PhaseScanning, start)
+		if err != nil {
+			return result, &ScanError{Err: err}
+		}
+	}
+
+	// A dry run only proves that the image builds
+	if req.DryRun {
+		result.ImageSize = localImageSize(ctx, req.Runner, eng, imageIDs)
+		manifest := ""
+		if multiArch {
+			manifest = result.Image
+		}
+		removeLocalImages(ctx, req.Runner, eng, manifest, imageIDs, req.Output)
+		log.Printf("Dry run built %d images of %d bytes, nothing was pushed.\n", len(imageIDs), result.ImageSize)
+		return result, nil
+	}
+
+	// Push the image to every registry, or leave it as an OCI archive in OUTPUT_DIR when
+	// there is no registry
+	start = time.Now()
+	if cfg.OutputMode == config.OutputModeArchive {
+		var path string
+		path, result.Digest, err = writeOutputArchive(ctx, cfg, req, eng, result.Image, multiArch, imageIDs)
+		result.OutputPath = path
+		if info, statErr := os.Stat(path); err == nil && statErr == nil {
+			result.Stats.PushedBytes = info.Size()
+		}
+	} else {
+		err = pushToRegistries(ctx, cfg, req, eng, tags, multiArch, &result)
+		pushed := 0
+		for _, push := range result.Pushes {
+			result.Stats.PushRetries += push.Retries
+			if push.Err == nil {
+				pushed++
+			}
+		}
+		if pushed > 0 {
+			result.Stats.PushedBytes = int64(pushed) * localImageSize(ctx, req.Runner, eng, imageIDs)
+		}
+	}
+	timePhase(PhasePushing, start)
+
+	// Tell the site about the push, whatever its outcome
+	if cfg.PostPushHook != "" {
+		env := hookEnv{contextDir: contextDir, image: result.Image, digest: result.Digest, status: HookStatusSucceeded}
+		if err != nil {
+			env.status = HookStatusFailed
+		}
+		start = time.Now()
+		hookErr := runHook(ctx, cfg, req, cfg.PostPushHook, env)
+		result.PhaseDurations[PhasePushing] += time.Since(start)
+		if hookErr != nil {
+			if err == nil && cfg.PostPushHookRequired {
+				return result, &PushError{Err: fmt.Errorf("post-push hook failed: %w", hookErr)}
+			}
+			log.Printf("Warning: post-push hook failed: %v\n", hookErr)
+		}
+	}
 	if err != nil {
-		return fmt.Errorf("failed to create gzip reader: %v", err)
+		return result, &PushError{Err: err}
 	}
-	defer gzipReader.Close()
 
-	tarReader := tar.NewReader(gzipReader)
-	for {
-		hdr, err := tarReader.Next()
+	// Sign the digest pushed to the primary registry
+	if cfg.CosignKeyPath != "" {
+		start = time.Now()
+		err = signImage(ctx, cfg, req, result.Pushes[0].Image, result.Digest)
+		timePhase(PhaseSigning, start)
+		result.Signature = SignatureSigned
 		if err != nil {
-			if err == io.EOF {
-				break
+			result.Signature = SignatureFailed
+			if cfg.SignRequired {
+				return result, &SignError{Err: err}
 			}
-			return fmt.Errorf("error reading tar.gz file: %v", err)
+			log.Printf("Warning: failed to sign %s: %v\n", result.Image, err)
+			result.SignErr = err
 		}
+	}
 
-		target := filepath.Join(dest, hdr.Name)
-		switch hdr.Typeflag {
-		case tar.TypeDir:
-			if err := os.MkdirAll(target, 0755); err != nil {
-				return fmt.Errorf("failed to create directory: %v", err)
+	// Refer the SBOM to the digest pushed to the primary registry
+	if cfg.SBOMPush && result.SBOMDigest != "" {
+		start = time.Now()
+		err = attachSBOM(ctx, cfg, req, result.Pushes[0].Image, result.Digest)
+		result.PhaseDurations[PhaseSBOM] += time.Since(start)
+		if err != nil {
+			if cfg.SBOMRequired {
+				return result, &SBOMError{Err: err}
 			}
-		case tar.TypeReg:
-			outFile, err := os.Create(target)
-			if err != nil {
-				return fmt.Errorf("failed to create file: %v", err)
+			log.Printf("Warning: failed to attach SBOM to %s: %v\n", result.Image, err)
+			result.SBOMErr = err
+		}
+	}
+
+	// Check that OpenShift recorded the push and tell it where the image came from
+	if cfg.ImageStreamEnabled {
+		if err = annotateImageStreamTags(ctx, cfg, req, result, tags); err != nil {
+			log.Printf("Warning: failed to annotate the image stream of %s: %v\n", result.Image, err)
+			result.ImageStreamErr = err
+		}
+	}
+
+	// Point the consumers of the VDDK image at the digest just pushed
+	if cfg.UpdateTarget != "" && req.UpdateRefs {
+		if result.UpdatedRef, err = updateTarget(ctx, cfg, result); err != nil {
+			log.Printf("Warning: failed to update UPDATE_TARGET with %s: %v\n", result.Image, err)
+			result.UpdateErr = err
+		}
+	}
+
+	// The registry holds the image now, unless it must stay around for exports
+	if !cfg.KeepLocalImage {
+		manifest := ""
+		if multiArch {
+			manifest = result.Image
+		}
+		removeLocalImages(ctx, req.Runner, eng, manifest, imageIDs, req.Output)
+	}
+
+	result.Tags = tags
+	log.Println("Image build and push completed successfully.")
+	return result, nil
+}
+
+// pushToRegistries pushes the image built as tags to each registry in IMAGE_REGISTRIES, the
+// primary one first, recording every push and the primary digest in result.
+func pushToRegistries(ctx context.Context, cfg *config.Config, req BuildRequest, eng engine, tags []string, multiArch bool, result *BuildResult) error {
+	var err error
+	result.Compression = cfg.PushCompression
+	copyOpts := copyOptions{
+		eng:              eng,
+		all:              multiArch,
+		platform:         req.Platform,
+		tlsVerify:        cfg.RegistryTLSVerify,
+		compression:      cfg.PushCompression,
+		compressionLevel: cfg.PushCompressionLevel,
+	}
+	if cfg.RegistryTLSVerify && cfg.RegistryCABundle != "" && !eng.remote() {
+		copyOpts.certDir, err = prepareCertDir(req.WorkDir, cfg.RegistryCABundle)
+		if err != nil {
+			return err
+		}
+	}
+	for _, registryURL := range cfg.ImageRegistries {
+		push := pushToRegistry(ctx, cfg, req, registryURL, tags, copyOpts)
+		result.Pushes = append(result.Pushes, push)
+		if registryURL == cfg.ImageRegistry {
+			result.Digest = push.Digest
+			err = push.Err
+		} else if push.Err != nil {
+			log.Printf("Failed to push %s: %v\n", push.Image, push.Err)
+			if cfg.PushAllRequired {
+				err = push.Err
 			}
-			if _, err := io.Copy(outFile, tarReader); err != nil {
-				outFile.Close()
-				return fmt.Errorf("failed to write file: %v", err)
+		}
+		if err != nil {
+			break
+		}
+	}
+	return err
+}
+
+// pushToRegistry pushes the image built as tags, which reference the primary registry, to
+// the same repository and tags in registryURL. The request token is only sent to the
+// primary registry, through an auth file, and only if REGISTRY_AUTH_CONFIG has no
+// credentials for it; other registries use the credentials in REGISTRY_AUTH_CONFIG.
+func pushToRegistry(ctx context.Context, cfg *config.Config, req BuildRequest, registryURL string, tags []string, opts copyOptions) PushResult {
+	primary := registryURL == cfg.ImageRegistry
+	dests := make([]string, len(tags))
+	for i, tag := range tags {
+		dests[i] = registryURL + strings.TrimPrefix(tag, cfg.ImageRegistry)
+	}
+	push := PushResult{Registry: registryURL, Image: dests[0]}
+	if registry.IsInsecure(registryURL) {
+		opts.tlsVerify = false
+	}
+
+	authToken := req.AuthToken
+	if !primary {
+		authToken = ""
+	}
+	authFile, removeAuthFile, err := authFileFor(req.WorkDir, registryURL, authToken, cfg.RegistryAuthConfig)
+	if err != nil {
+		push.Err = err
+		return push
+	}
+	defer removeAuthFile()
+	opts.authFile = authFile
+
+	err = retryPush(ctx, cfg, dests[0], &push.Retries, func() error {
+		var pushErr error
+		push.Digest, pushErr = pushImage(ctx, req.Runner, req.WorkDir, tags[0], dests[0], opts, req.Progress, req.Output)
+		if pushErr != nil || push.Digest == "" || !cfg.VerifyPush {
+			return pushErr
+		}
+		// Catch pushes the registry, or a proxy in front of it, did not store as sent
+		if verifyErr := verifyPushedDigest(ctx, registryURL, dests[0], authToken, push.Digest); verifyErr != nil {
+			return &VerifyPushError{Err: verifyErr}
+		}
+		return nil
+	})
+	for _, dest := range dests[1:] {
+		if err != nil {
+			break
+		}
+		err = retryPush(ctx, cfg, dest, &push.Retries, func() error {
+			if pushErr := copyImage(ctx, req.Runner, outputSink(req.Output, opts.eng.pusher()), tags[0], dest, opts); pushErr != nil {
+				return fmt.Errorf("push image: %w", pushErr)
 			}
-			outFile.Close()
+			return nil
+		})
+	}
+	err = explainCompressionError(registryURL, opts.compression, explainCertError(registryURL, err))
+	if err != nil && !primary {
+		err = fmt.Errorf("registry %s: %w", registryURL, err)
+	}
+	push.Err = err
+	return push
+}
+
+// prepareCertDir copies the CA bundle into a directory of its own in workDir, where skopeo
+// picks up every *.crt file as a trusted CA.
+func prepareCertDir(workDir, caBundle string) (string, error) {
+	if _, err := registry.LoadCABundle(caBundle); err != nil {
+		return "", err
+	}
+	certDir := filepath.Join(workDir, "certs")
+	if err := os.MkdirAll(certDir, dirPerm); err != nil {
+		return "", fmt.Errorf("failed to create certificate directory: %w", err)
+	}
+	if err := copyFile(caBundle, filepath.Join(certDir, "ca.crt")); err != nil {
+		return "", fmt.Errorf("failed to copy CA bundle: %w", err)
+	}
+	return certDir, nil
+}
+
+// explainCertError replaces a skopeo failure caused by an untrusted registry certificate
+// with an error naming the settings to check and the x509 message, and returns any other
+// err unchanged.
+func explainCertError(registryURL string, err error) error {
+	var cmdErr *CommandError
+	if !errors.As(err, &cmdErr) {
+		return err
+	}
+	for _, line := range strings.Split(cmdErr.Tail, "\n") {
+		if i := strings.Index(line, "x509: "); i >= 0 {
+			return fmt.Errorf("certificate of registry %s could not be verified, check REGISTRY_CA_BUNDLE and REGISTRY_TLS_VERIFY: %s", registryURL, strings.TrimSpace(line[i:]))
+		}
+	}
+	return err
+}
+
+// explainCompressionError replaces the error of a registry rejecting zstd-compressed layers
+// with a hint to fall back to gzip.
+func explainCompressionError(registryURL, compression string, err error) error {
+	var cmdErr *CommandError
+	if !strings.HasPrefix(compression, config.CompressionZstd) || !errors.As(err, &cmdErr) {
+		return err
+	}
+	tail := strings.ToLower(cmdErr.Tail)
+	for _, marker := range []string{"unsupported media type", "manifest invalid", "manifest_invalid", "unknown media type", "+zstd"} {
+		if strings.Contains(tail, marker) {
+			return fmt.Errorf("registry %s rejected the %s-compressed image, set PUSH_COMPRESSION=gzip for registries without zstd support: %w", registryURL, compression, err)
+		}
+	}
+	return err
+}
+
+// verifyPushedDigest checks that registryURL serves the pushed reference with the digest
+// skopeo reported.
+func verifyPushedDigest(ctx context.Context, registryURL, reference, authToken, digest string) error {
+	imageName := strings.TrimPrefix(reference, registryURL+"/")
+	remote, exists, err := registry.ImageDigest(ctx, imageName, registryURL, authToken)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return fmt.Errorf("image %s not found in registry %s after push", imageName, registryURL)
+	}
+	if remote != digest {
+		return fmt.Errorf("registry %s reports digest %s for %s, pushed %s", registryURL, remote, imageName, digest)
+	}
+	return nil
+}
+
+// ImageReference returns the registry reference for imageName, falling back to the
+// default image name from the configuration when imageName is empty. Names without a
+// namespace are pushed to DEFAULT_NAMESPACE when it is set.
+func ImageReference(cfg *config.Config, imageName string) string {
+	if imageName == "" {
+		imageName = cfg.ImageName
+	}
+	return fmt.Sprintf("%s/%s", cfg.ImageRegistry, cfg.QualifiedImageName(imageName))
+}
+
+// PartialSuffix marks uploads that are still being written or were interrupted.
+const PartialSuffix = ".partial"
+
+// NewWorkDir creates a private working directory for the build with the given ID in
+// WORK_DIR. Nothing outside it is written during the build.
+func NewWorkDir(cfg *config.Config, buildID string) (string, error) {
+	if err := os.MkdirAll(cfg.WorkDir, dirPerm); err != nil {
+		return "", err
+	}
+	return os.MkdirTemp(cfg.WorkDir, workDirPrefix+buildID+"-")
+}
+
+// ContextDir returns the build context directory inside workDir.
+func ContextDir(workDir string) string {
+	return filepath.Join(workDir, "context")
+}
+
+// SweepWorkDirs removes the working directories left in WORK_DIR by a previous process
+// that did not shut down cleanly, except those of failed builds kept while
+// KEEP_WORKDIR_ON_FAILURE is set. It must run before any build starts.
+func SweepWorkDirs(cfg *config.Config) {
+	orphans, err := filepath.Glob(filepath.Join(cfg.WorkDir, workDirPrefix+"*"))
+	if err != nil {
+		log.Printf("Failed to list orphaned work directories: %v\n", err)
+		return
+	}
+	for _, dir := range orphans {
+		if _, kept := retainedAt(dir); kept && cfg.KeepWorkDirOnFailure {
+			continue
+		}
+		if err := os.RemoveAll(dir); err != nil {
+			log.Printf("Failed to remove orphaned work directory %s: %v\n", dir, err)
+			continue
+		}
+		log.Printf("Removed orphaned work directory %s\n", dir)
+	}
+}
+
+// CleanupWorkspace removes the work directory, the uploaded archive at filePath and its
+// extra files. Empty paths are skipped. It is safe to call more than once.
+func CleanupWorkspace(workDir, filePath string) {
+	log.Println("Cleaning up...")
+	if workDir != "" {
+		if err := os.RemoveAll(workDir); err != nil {
+			log.Printf("Failed to remove work directory: %v\n", err)
+		}
+	}
+	RemoveUpload(filePath)
+}
+
+// retainWorkDir marks workDir as kept after a failed build so the startup sweep leaves it
+// alone and SweepRetainedWorkDirs can expire it. It reports whether the mark was written.
+func retainWorkDir(workDir string) bool {
+	if workDir == "" {
+		return false
+	}
+	if err := os.WriteFile(filepath.Join(workDir, retainedMarker), nil, 0644); err != nil {
+		log.Printf("Failed to keep work directory %s: %v\n", workDir, err)
+		return false
+	}
+	log.Printf("Keeping work directory %s of the failed build\n", workDir)
+	return true
+}
+
+// retainedAt returns when dir was kept after a failed build, if it was.
+func retainedAt(dir string) (time.Time, bool) {
+	info, err := os.Stat(filepath.Join(dir, retainedMarker))
+	if err != nil {
+		return time.Time{}, false
+	}
+	return info.ModTime(), true
+}
+
+// SweepRetainedWorkDirs removes the work directories of failed builds kept for longer than
+// WORKDIR_RETENTION and returns their paths.
+func SweepRetainedWorkDirs(cfg *config.Config) []string {
+	if cfg.WorkDirRetention <= 0 {
+		return nil
+	}
+	dirs, err := filepath.Glob(filepath.Join(cfg.WorkDir, workDirPrefix+"*"))
+	if err != nil {
+		log.Printf("Failed to list kept work directories: %v\n", err)
+		return nil
+	}
+	var removed []string
+	for _, dir := range dirs {
+		keptAt, kept := retainedAt(dir)
+		if !kept || time.Since(keptAt) < cfg.WorkDirRetention {
+			continue
 		}
+		if err := os.RemoveAll(dir); err != nil {
+			log.Printf("Failed to remove kept work directory %s: %v\n", dir, err)
+			continue
+		}
+		log.Printf("Removed kept work directory %s\n", dir)
+		removed = append(removed, dir)
+	}
+	return removed
+}
+
+// RemoveUpload removes the uploaded archive at filePath and its extra files.
+func RemoveUpload(filePath string) {
+	if filePath == "" {
+		return
+	}
+	if err := os.Remove(filePath); err != nil && !os.IsNotExist(err) {
+		log.Printf("Failed to remove tar.gz file: %v\n", err)
+	}
+	if err := os.RemoveAll(ExtrasDir(filePath)); err != nil {
+		log.Printf("Failed to remove extra files: %v\n", err)
+	}
+}
+
+// ExtrasDir returns the directory holding the extra files uploaded with the archive at filePath.
+func ExtrasDir(filePath string) string {
+	return filePath + ".extras"
+}
+
+// copyFile copies the regular file src to dst, replacing dst if it exists. A symlink at
+// dst, such as one extracted from the archive, is replaced rather than written through.
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return fmt.Errorf("failed to open %s: %v", src, err)
+	}
+	defer in.Close()
+
+	if err := removeExisting(dst); err != nil {
+		return err
 	}
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL|syscall.O_NOFOLLOW, 0666)
+	if err != nil {
+		return fmt.Errorf("failed to create %s: %v", dst, err)
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return fmt.Errorf("failed to write %s: %v", dst, err)
+	}
+	return out.Close()
+}
 
+// ExtractStream extracts a .tar.gz stream, such as an upload still being received, into
+// the build context in workDir, enforcing the archive limits of cfg. The partial
+// extraction is removed if the stream fails.
+func ExtractStream(cfg *config.Config, r io.Reader, workDir string) error {
+	contextDir := ContextDir(workDir)
+	if err := os.MkdirAll(contextDir, dirPerm); err != nil {
+		return fmt.Errorf("failed to create extraction directory: %w", err)
+	}
+
+	log.Println("Extracting streamed upload...")
+	if err := extractTarGzReader(r, contextDir, limitsFor(cfg)); err != nil {
+		if rmErr := os.RemoveAll(contextDir); rmErr != nil {
+			log.Printf("Failed to remove partial extraction: %v\n", rmErr)
+		}
+		return err
+	}
 	return nil
 }
 
-// buildImage is an internal method to build the image using podman
-func buildImage(imageTag, contextDir string) error {
-	cmd := exec.Command("podman", "build", "-f", "Containerfile.vddk", "-t", imageTag, contextDir)
-	output, err := cmd.CombinedOutput()
+// buildFlags returns the podman build flags setting labels and build args.
+func buildFlags(labels, buildArgs []string) []string {
+	var flags []string
+	for _, label := range labels {
+		flags = append(flags, "--label", label)
+	}
+	for _, buildArg := range buildArgs {
+		flags = append(flags, "--build-arg", buildArg)
+	}
+	return flags
+}
+
+// buildImage is an internal method to build the image using the build engine, passing flags to its build command
+// and counting the STEP markers it prints in steps
+func buildImage(ctx context.Context, runner Runner, eng engine, flags []string, containerfile, contextDir string, steps *int, report ProgressFunc, out io.Writer) error {
+	args := append(eng.buildCommand(containerfile), flags...)
+	args = append(args, contextDir)
+
+	sink := outputSink(out, eng.name)
+	report.report(PhaseBuilding, 0)
+	err := runCommand(ctx, runner, func(line string) {
+		sink(line)
+		if reportStep(report, line) {
+			*steps++
+		}
+	}, eng.name, eng.command(args...)...)
 	if err != nil {
-		return fmt.Errorf("build image: %w\n%s", err, output)
+		return fmt.Errorf("build image: %w", err)
 	}
 	return nil
 }
 
-// pushImage is an internal method to push the image to the registry
-func pushImage(imageTag, authToken string) error {
+// pushImage is an internal method to push the local image to the dest reference in a
+// registry as described by opts. It returns the digest of the pushed manifest, or an empty
+// digest if skopeo does not support --digestfile.
+func pushImage(ctx context.Context, runner Runner, workDir, source, dest string, opts copyOptions, report ProgressFunc, out io.Writer) (string, error) {
+	digestFile, err := os.CreateTemp(workDir, "digest-")
+	if err != nil {
+		return "", fmt.Errorf("create digest file: %w", err)
+	}
+	digestFile.Close()
+	defer os.Remove(digestFile.Name())
+
+	stop := make(chan struct{})
+	go estimatePush(report, stop)
+	defer close(stop)
+	start := time.Now()
+
+	sink := outputSink(out, opts.eng.pusher())
+	opts.digestFile = digestFile.Name()
+	pushErr := copyImage(ctx, runner, sink, source, dest, opts)
+	var cmdErr *CommandError
+	if errors.As(pushErr, &cmdErr) && strings.Contains(cmdErr.Tail, "--digestfile") {
+		// Older skopeo releases lack --digestfile; push without learning the digest
+		log.Println("skopeo does not support --digestfile, the pushed digest will be unknown")
+		opts.digestFile = ""
+		pushErr = copyImage(ctx, runner, sink, source, dest, opts)
+	}
+	if pushErr != nil {
+		return "", fmt.Errorf("push image: %w", pushErr)
+	}
+	recordPushDuration(time.Since(start))
+
+	digest, err := os.ReadFile(digestFile.Name())
+	if err != nil {
+		return "", fmt.Errorf("read digest file: %w", err)
+	}
+	return strings.TrimSpace(string(digest)), nil
+}
+
+// copyOptions tunes how copyImage copies an image.
+type copyOptions struct {
+	eng        engine // Build engine holding the local image
+	digestFile string // File the manifest digest is written to, optional
+	all        bool   // Copy a manifest list together with every image it lists
+	platform   string // os/arch[/variant] selected from the source, the host platform if empty
+	authFile   string // containers-auth.json holding the destination credentials, optional
+	tlsVerify  bool   // Verify the registry certificate
+	certDir    string // Directory with the CA certificates the registry is verified against, optional
+
+	compression      string // Layer compression format, the tool's default if empty
+	compressionLevel int    // Layer compression level, the format's default if 0
+}
+
+// runSkopeoCopy copies the source image from local storage to the dest reference in the
+// registry as described by opts.
+func runSkopeoCopy(ctx context.Context, runner Runner, sink func(line string), source, dest string, opts copyOptions) error {
 	// Construct the skopeo command
-	args := []string{"copy", "--dest-tls-verify=false"}
-	if authToken != "" {
-		args = append(args, "--dest-registry-token", fmt.Sprintf(":%s", authToken))
+	args := []string{"copy", fmt.Sprintf("--dest-tls-verify=%t", opts.tlsVerify)}
+	if opts.certDir != "" {
+		args = append(args, "--dest-cert-dir", opts.certDir)
+	}
+	if opts.all {
+		args = append(args, "--all")
+	} else if opts.platform != "" {
+		args = append(args, platformOverrides(opts.platform)...)
 	}
-	args = append(args, fmt.Sprintf("containers-storage:%s", imageTag), fmt.Sprintf("docker://%s", imageTag))
+	if opts.authFile != "" {
+		args = append(args, "--dest-authfile", opts.authFile)
+	}
+	if opts.digestFile != "" {
+		args = append(args, "--digestfile", opts.digestFile)
+	}
+	if opts.compression != "" {
+		args = append(args, "--dest-compress-format", opts.compression)
+	}
+	if opts.compressionLevel > 0 {
+		args = append(args, "--dest-compress-level", strconv.Itoa(opts.compressionLevel))
+	}
+	args = append(args, opts.eng.transport()+source, fmt.Sprintf("docker://%s", dest))
 
 	// Use skopeo to push the image to the registry
-	pushCmd := exec.Command("skopeo", args...)
-	pushOutput, pushErr := pushCmd.CombinedOutput()
-	if pushErr != nil {
-		return fmt.Errorf("push image: %w\n%s", pushErr, pushOutput)
+	return runCommand(ctx, runner, sink, "skopeo", args...)
+}
+
+// copyImage pushes the source image to the dest reference, with skopeo unless the image
+// lives on a remote podman service.
+func copyImage(ctx context.Context, runner Runner, sink func(line string), source, dest string, opts copyOptions) error {
+	if opts.eng.remote() {
+		return runRemotePush(ctx, runner, sink, source, dest, opts)
 	}
-	return nil
+	return runSkopeoCopy(ctx, runner, sink, source, dest, opts)
+}
+
+// runRemotePush has the remote podman service push the source image, or manifest list when
+// opts.all is set, to dest. The service verifies the registry with its own trusted CAs.
+func runRemotePush(ctx context.Context, runner Runner, sink func(line string), source, dest string, opts copyOptions) error {
+	args := []string{"push"}
+	if opts.all {
+		args = []string{"manifest", "push", "--all"}
+	}
+	args = append(args, fmt.Sprintf("--tls-verify=%t", opts.tlsVerify))
+	if opts.authFile != "" {
+		args = append(args, "--authfile", opts.authFile)
+	}
+	if opts.digestFile != "" {
+		args = append(args, "--digestfile", opts.digestFile)
+	}
+	if opts.compression != "" {
+		args = append(args, "--compression-format", opts.compression)
+	}
+	if opts.compressionLevel > 0 {
+		args = append(args, "--compression-level", strconv.Itoa(opts.compressionLevel))
+	}
+	args = append(args, source, fmt.Sprintf("docker://%s", dest))
+	return opts.eng.run(ctx, runner, sink, args...)
 }
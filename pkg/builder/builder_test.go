@@ -0,0 +1,267 @@
+package builder
+
+import (
+	"archive/tar"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+
+	"vddk-builder/pkg/config"
+)
+
+// command is one command run through a fakeRunner.
+type command struct {
+	name string
+	args []string
+	env  []string
+}
+
+// exitError is the error of a command exiting non-zero.
+type exitError struct{ code int }
+
+func (e *exitError) Error() string { return fmt.Sprintf("exit status %d", e.code) }
+func (e *exitError) ExitCode() int { return e.code }
+
+// fakeRunner records the commands of a build instead of running them. A command for which
+// fail returns true exits with status 1 after writing "failed" to stderr. Builds write an
+// image ID to their --iidfile and pushes a digest to their --digestfile, like podman and
+// skopeo do.
+type fakeRunner struct {
+	fail     func(cmd command) bool
+	onRun    func(cmd command) // Called before the command runs, optional
+	mu       sync.Mutex
+	commands []command
+}
+
+func (r *fakeRunner) Run(ctx context.Context, name string, args, env []string, stdout, stderr io.Writer) error {
+	cmd := command{name: name, args: slices.Clone(args), env: slices.Clone(env)}
+	r.mu.Lock()
+	r.commands = append(r.commands, cmd)
+	r.mu.Unlock()
+	if r.onRun != nil {
+		r.onRun(cmd)
+	}
+	if r.fail != nil && r.fail(cmd) {
+		io.WriteString(stderr, "failed\n")
+		return &exitError{code: 1}
+	}
+	for _, out := range []struct{ flag, content string }{
+		{"--iidfile", "sha256:" + strings.Repeat("1", 64)},
+		{"--digestfile", "sha256:" + strings.Repeat("2", 64)},
+	} {
+		if file := argValue(cmd.args, out.flag); file != "" {
+			if err := os.WriteFile(file, []byte(out.content), 0600); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// recorded returns the commands run so far.
+func (r *fakeRunner) recorded() []command {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return slices.Clone(r.commands)
+}
+
+// argValue returns the argument following flag in args, empty if flag is missing.
+func argValue(args []string, flag string) string {
+	if i := slices.Index(args, flag); i >= 0 && i+1 < len(args) {
+		return args[i+1]
+	}
+	return ""
+}
+
+// isBuild reports whether cmd builds an image.
+func isBuild(cmd command) bool {
+	return slices.Contains(cmd.args, "build")
+}
+
+// isPush reports whether cmd pushes an image.
+func isPush(cmd command) bool {
+	return cmd.name == "skopeo" && slices.Contains(cmd.args, "copy")
+}
+
+// testConfig returns the defaults of the builder pushing to registry.test, with a work
+// directory of its own and without the steps that reach a real registry.
+func testConfig(t *testing.T) *config.Config {
+	t.Helper()
+	t.Setenv("CONFIG_FILE", "")
+	cfg, err := config.LoadConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.WorkDir = t.TempDir()
+	cfg.ImageRegistry = "registry.test"
+	cfg.ImageRegistries = []string{cfg.ImageRegistry}
+	cfg.BuildEngine = "podman"
+	cfg.ValidateContent = false
+	cfg.VerifyPush = false
+	cfg.PushRetries = 1
+	cfg.PushRetryBackoff = 0
+	cfg.RegistryAuthConfig = ""
+	cfg.KeepWorkDirOnFailure = false
+	return cfg
+}
+
+// testRequest returns a build of an uploaded archive holding a Containerfile, run by runner.
+func testRequest(t *testing.T, cfg *config.Config, runner Runner) BuildRequest {
+	t.Helper()
+	workDir, err := NewWorkDir(cfg, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	filePath := filepath.Join(t.TempDir(), "vddk.tar.gz")
+	archive := tarGz(t,
+		tarEntry{name: "Containerfile", typeflag: tar.TypeReg, body: "FROM registry.test/base\nCOPY . /\n"},
+		tarEntry{name: "vmware-vix-disklib-distrib/", typeflag: tar.TypeDir},
+		tarEntry{name: "vmware-vix-disklib-distrib/README", typeflag: tar.TypeReg, body: "vddk"},
+	)
+	if err := os.WriteFile(filePath, archive.Bytes(), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return BuildRequest{
+		WorkDir:   workDir,
+		BuildID:   "test",
+		FilePath:  filePath,
+		ImageName: "ns/vddk:8.0.3",
+		Runner:    runner,
+		Output:    io.Discard,
+	}
+}
+
+// assertCleanedUp fails unless the work directory and the uploaded archive of req are gone.
+func assertCleanedUp(t *testing.T, req BuildRequest) {
+	t.Helper()
+	for _, path := range []string{req.WorkDir, req.FilePath} {
+		if _, err := os.Stat(path); !os.IsNotExist(err) {
+			t.Errorf("%s was not removed: %v", path, err)
+		}
+	}
+}
+
+func TestBuildAndPushImageBuildFails(t *testing.T) {
+	cfg := testConfig(t)
+	runner := &fakeRunner{fail: isBuild}
+	req := testRequest(t, cfg, runner)
+
+	_, err := BuildAndPushImage(context.Background(), cfg, req)
+	var buildErr *BuildError
+	if !errors.As(err, &buildErr) {
+		t.Fatalf("BuildAndPushImage() error = %v, want a BuildError", err)
+	}
+	var cmdErr *CommandError
+	if !errors.As(err, &cmdErr) || cmdErr.ExitCode != 1 || !strings.Contains(cmdErr.Tail, "failed") {
+		t.Errorf("BuildAndPushImage() error = %v, want the exit code and output of the build", err)
+	}
+	if slices.ContainsFunc(runner.recorded(), isPush) {
+		t.Error("the image was pushed after the build failed")
+	}
+	assertCleanedUp(t, req)
+}
+
+func TestBuildAndPushImagePushFails(t *testing.T) {
+	cfg := testConfig(t)
+	runner := &fakeRunner{fail: isPush}
+	req := testRequest(t, cfg, runner)
+
+	result, err := BuildAndPushImage(context.Background(), cfg, req)
+	var pushErr *PushError
+	if !errors.As(err, &pushErr) {
+		t.Fatalf("BuildAndPushImage() error = %v, want a PushError", err)
+	}
+	if result.Digest != "" {
+		t.Errorf("BuildAndPushImage() digest = %q after a failed push", result.Digest)
+	}
+	if !slices.ContainsFunc(runner.recorded(), isBuild) {
+		t.Error("the image was not built")
+	}
+	assertCleanedUp(t, req)
+}
+
+func TestBuildAndPushImage(t *testing.T) {
+	cfg := testConfig(t)
+	runner := &fakeRunner{}
+	req := testRequest(t, cfg, runner)
+
+	result, err := BuildAndPushImage(context.Background(), cfg, req)
+	if err != nil {
+		t.Fatalf("BuildAndPushImage() error = %v", err)
+	}
+	if want := "sha256:" + strings.Repeat("2", 64); result.Digest != want {
+		t.Errorf("BuildAndPushImage() digest = %q, want %q", result.Digest, want)
+	}
+
+	image := cfg.ImageRegistry + "/" + req.ImageName
+	var built, pushed bool
+	for _, cmd := range runner.recorded() {
+		switch {
+		case isBuild(cmd):
+			built = true
+			if got := argValue(cmd.args, "-t"); got != image {
+				t.Errorf("built tag %q, want %q", got, image)
+			}
+			if got := cmd.args[len(cmd.args)-1]; got != ContextDir(req.WorkDir) {
+				t.Errorf("built context %q, want %q", got, ContextDir(req.WorkDir))
+			}
+		case isPush(cmd):
+			pushed = true
+			if got, want := cmd.args[len(cmd.args)-1], "docker://"+image; got != want {
+				t.Errorf("pushed to %q, want %q", got, want)
+			}
+		}
+	}
+	if !built || !pushed {
+		t.Errorf("built = %t, pushed = %t; want both", built, pushed)
+	}
+	assertCleanedUp(t, req)
+}
+
+func TestPushToRegistryKeepsTokenOutOfArgs(t *testing.T) {
+	const token = "sha256~secret-token"
+	cfg := testConfig(t)
+	var authFile string
+	runner := &fakeRunner{onRun: func(cmd command) {
+		if !isPush(cmd) {
+			return
+		}
+		authFile = argValue(cmd.args, "--dest-authfile")
+		data, err := os.ReadFile(authFile)
+		want := base64.StdEncoding.EncodeToString([]byte(authFileUser + ":" + token))
+		if err != nil || !strings.Contains(string(data), want) {
+			t.Errorf("auth file %q holds %q, %v; want the credentials of the token", authFile, data, err)
+		}
+	}}
+	req := BuildRequest{WorkDir: t.TempDir(), AuthToken: token, Runner: runner, Output: io.Discard}
+	image := cfg.ImageRegistry + "/ns/vddk:8.0.3"
+
+	push := pushToRegistry(context.Background(), cfg, req, cfg.ImageRegistry, []string{image}, copyOptions{eng: engineFor(cfg), tlsVerify: true})
+	if push.Err != nil {
+		t.Fatalf("pushToRegistry() error = %v", push.Err)
+	}
+	if authFile == "" {
+		t.Fatal("the push was not given an auth file")
+	}
+	for _, cmd := range runner.recorded() {
+		for _, arg := range cmd.args {
+			if strings.Contains(arg, token) {
+				t.Errorf("%s was run with the token in argument %q", cmd.name, arg)
+			}
+		}
+	}
+	if _, err := os.Stat(authFile); !os.IsNotExist(err) {
+		t.Errorf("auth file %s was not removed: %v", authFile, err)
+	}
+	if left, _ := filepath.Glob(filepath.Join(req.WorkDir, "auth-*.json")); len(left) > 0 {
+		t.Errorf("auth files left in the work directory: %q", left)
+	}
+}
@@ -0,0 +1,83 @@
+package builder
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"vddk-builder/pkg/config"
+)
+
+// Outcomes of the CHECKSUM_MANIFEST verification.
+const (
+	ChecksumsVerified   = "verified"
+	ChecksumsNotPresent = "not-present"
+	ChecksumsFailed     = "failed"
+)
+
+// ChecksumsLabel is the image label holding the outcome of the CHECKSUM_MANIFEST verification.
+const ChecksumsLabel = "io.github.yaacov.vddk-builder.checksums"
+
+// verifyChecksums checks every file listed in the CHECKSUM_MANIFEST file at the root of
+// contextDir, in the format written by sha256sum, and returns the outcome. A missing
+// manifest is not an error, and files left out by EXTRACT_INCLUDE_GLOBS are not checked. The returned error lists every file that is missing, outside
+// the archive or does not match its digest.
+func verifyChecksums(cfg *config.Config, contextDir string) (string, error) {
+	manifest := filepath.Join(contextDir, cfg.ChecksumManifest)
+	f, err := os.Open(manifest)
+	if os.IsNotExist(err) {
+		return ChecksumsNotPresent, nil
+	}
+	if err != nil {
+		return ChecksumsFailed, fmt.Errorf("failed to open %s: %v", cfg.ChecksumManifest, err)
+	}
+	defer f.Close()
+
+	limits := limitsFor(cfg)
+	var offenders []string
+	listed := 0
+	scanner := bufio.NewScanner(f)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		sum, name, ok := strings.Cut(line, " ")
+		name = strings.TrimPrefix(strings.TrimLeft(name, " "), "*")
+		if !ok || len(sum) != 64 || name == "" {
+			offenders = append(offenders, fmt.Sprintf("line %d (malformed)", lineNo))
+			continue
+		}
+		listed++
+		if !limits.wanted(name) {
+			continue // Left out by EXTRACT_INCLUDE_GLOBS
+		}
+
+		path, err := safeJoin(filepath.Dir(manifest), name)
+		if err != nil {
+			offenders = append(offenders, name+" (outside the archive)")
+			continue
+		}
+		digest, err := fileDigest(path)
+		switch {
+		case os.IsNotExist(err):
+			offenders = append(offenders, name+" (missing)")
+		case err != nil:
+			offenders = append(offenders, fmt.Sprintf("%s (%v)", name, err))
+		case digest != "sha256:"+strings.ToLower(sum):
+			offenders = append(offenders, name+" (mismatch)")
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return ChecksumsFailed, fmt.Errorf("failed to read %s: %v", cfg.ChecksumManifest, err)
+	}
+	if len(offenders) > 0 {
+		return ChecksumsFailed, fmt.Errorf("%s verification failed: %s", cfg.ChecksumManifest, strings.Join(offenders, ", "))
+	}
+	if listed == 0 {
+		return ChecksumsFailed, fmt.Errorf("%s lists no files", cfg.ChecksumManifest)
+	}
+	return ChecksumsVerified, nil
+}
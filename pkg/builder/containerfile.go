@@ -0,0 +1,339 @@
+package builder
+
+import (
+	"bytes"
+	_ "embed"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"text/template"
+
+	"vddk-builder/pkg/config"
+)
+
+// distribDirName is the top-level directory of the VDDK tarball distributed by VMware.
+const distribDirName = "vmware-vix-disklib-distrib"
+
+// archiveContainerfiles are the names looked up at the root of the archive when no
+// Containerfile path is configured.
+var archiveContainerfiles = []string{"Containerfile.vddk", "Containerfile", "Dockerfile"}
+
+// defaultTemplate builds an image that copies the VDDK distribution to the paths CDI expects.
+//
+//go:embed Containerfile.vddk.tmpl
+var defaultTemplate string
+
+// templateData is the data available to a Containerfile template.
+type templateData struct {
+	BaseImage  string // Base image, CONTAINERFILE_BASE_IMAGE
+	DistribDir string // VDDK distribution directory relative to the build context
+}
+
+// ValidateContainerfilePath checks that path is a relative path to a file that stays
+// inside the build context.
+func ValidateContainerfilePath(path string) error {
+	if !filepath.IsLocal(path) || filepath.Clean(path) == "." {
+		return fmt.Errorf("%q is not a relative path inside the build context", path)
+	}
+	return nil
+}
+
+// resolveContainerfile returns the Containerfile inside the archive to build with and the
+// directory to pass to podman as the build context. A Containerfile named by requested or
+// else by CONTAINERFILE_PATH must exist after extraction, and its directory becomes the
+// build context. Without either, a Containerfile at the root of the archive is used if
+// present; otherwise the returned path is empty and one has to be generated.
+func resolveContainerfile(cfg *config.Config, contextDir, requested string) (string, string, error) {
+	path := requested
+	if path == "" {
+		path = cfg.ContainerfilePath
+	}
+	if path == "" {
+		for _, name := range archiveContainerfiles {
+			if info, err := os.Lstat(filepath.Join(contextDir, name)); err == nil && info.Mode().IsRegular() {
+				return filepath.Join(contextDir, name), contextDir, nil
+			}
+		}
+		return "", contextDir, nil
+	}
+
+	full, err := safeJoin(contextDir, path)
+	if err != nil {
+		return "", "", err
+	}
+	// A symlinked Containerfile or directory could name a file outside the build context
+	if err := checkNoSymlinkParents(contextDir, full); err != nil {
+		return "", "", err
+	}
+	info, err := os.Lstat(full)
+	if err != nil || !info.Mode().IsRegular() {
+		return "", "", fmt.Errorf("Containerfile not found at %s", path)
+	}
+	return full, filepath.Dir(full), nil
+}
+
+// generateContainerfile renders the CONTAINERFILE_TEMPLATE file, or the embedded template
+// if unset, into workDir and returns its path and content. The file is kept outside the
+// build context so it is not copied into the image.
+func generateContainerfile(cfg *config.Config, workDir, contextDir string) (string, string, error) {
+	text := defaultTemplate
+	if cfg.ContainerfileTemplate != "" {
+		data, err := os.ReadFile(cfg.ContainerfileTemplate)
+		if err != nil {
+			return "", "", fmt.Errorf("failed to read Containerfile template: %v", err)
+		}
+		text = string(data)
+	}
+	tmpl, err := template.New("Containerfile").Option("missingkey=error").Parse(text)
+	if err != nil {
+		return "", "", fmt.Errorf("failed to parse Containerfile template: %v", err)
+	}
+
+	var out bytes.Buffer
+	data := templateData{BaseImage: cfg.ContainerfileBaseImage, DistribDir: findDistribDir(contextDir)}
+	if err := tmpl.Execute(&out, data); err != nil {
+		return "", "", fmt.Errorf("failed to render Containerfile template: %v", err)
+	}
+
+	path := filepath.Join(workDir, "Containerfile.generated")
+	if err := os.WriteFile(path, out.Bytes(), 0644); err != nil {
+		return "", "", fmt.Errorf("failed to write generated Containerfile: %v", err)
+	}
+	return path, out.String(), nil
+}
+
+// findDistribDir returns the VDDK distribution directory relative to contextDir, looking
+// at the root and one level below. It falls back to the directory's usual name.
+func findDistribDir(contextDir string) string {
+	candidates := []string{filepath.Join(contextDir, distribDirName)}
+	if nested, err := filepath.Glob(filepath.Join(contextDir, "*", distribDirName)); err == nil {
+		candidates = append(candidates, nested...)
+	}
+	for _, candidate := range candidates {
+		if info, err := os.Lstat(candidate); err == nil && info.IsDir() {
+			rel, _ := filepath.Rel(contextDir, candidate)
+			return filepath.ToSlash(rel)
+		}
+	}
+	return distribDirName
+}
+
+// logContainerfile writes the content of a generated Containerfile to sink, line by line.
+func logContainerfile(sink func(line string), content string) {
+	for _, line := range strings.Split(strings.TrimRight(content, "\n"), "\n") {
+		sink(line)
+	}
+}
+
+// validateContent checks that every glob in CONTENT_REQUIRED_PATHS, relative to the build
+// context, matches at least one file, so an archive that is not a VDDK distribution fails
+// before an unusable image is pushed.
+func validateContent(cfg *config.Config, buildContext string) error {
+	if !cfg.ValidateContent {
+		return nil
+	}
+	for _, pattern := range cfg.ContentRequiredPaths {
+		matches, err := filepath.Glob(filepath.Join(buildContext, pattern))
+		if err != nil {
+			return fmt.Errorf("invalid content validation pattern %q: %v", pattern, err)
+		}
+		if len(matches) == 0 {
+			return fmt.Errorf("archive does not look like a VDDK distribution: nothing matches %s", pattern)
+		}
+	}
+	return nil
+}
+
+// ContainerfileError reports a Containerfile instruction rejected by policy.
+type ContainerfileError struct {
+	Line        int    // Line the instruction starts on, counting from 1
+	Instruction string // The instruction, with continuation lines joined
+	Reason      string
+}
+
+func (e *ContainerfileError) Error() string {
+	return fmt.Sprintf("Containerfile line %d: %s: %s", e.Line, e.Instruction, e.Reason)
+}
+
+// instruction is one logical Containerfile instruction.
+type instruction struct {
+	line int
+	text string
+}
+
+// parseInstructions splits content into instructions, joining lines that end in a
+// backslash and skipping comments and blank lines.
+func parseInstructions(content string) []instruction {
+	var instructions []instruction
+	var current strings.Builder
+	start := 0
+	for i, line := range strings.Split(content, "\n") {
+		trimmed := strings.TrimSpace(line)
+		if current.Len() == 0 && (trimmed == "" || strings.HasPrefix(trimmed, "#")) {
+			continue
+		}
+		if current.Len() == 0 {
+			start = i + 1
+		} else if strings.HasPrefix(trimmed, "#") {
+			continue
+		}
+		if continued, ok := strings.CutSuffix(trimmed, "\\"); ok {
+			current.WriteString(strings.TrimSpace(continued) + " ")
+			continue
+		}
+		current.WriteString(trimmed)
+		instructions = append(instructions, instruction{line: start, text: strings.TrimSpace(current.String())})
+		current.Reset()
+	}
+	if current.Len() > 0 {
+		instructions = append(instructions, instruction{line: start, text: strings.TrimSpace(current.String())})
+	}
+	return instructions
+}
+
+// ValidateContainerfile rejects the first instruction of content matching one of the
+// CONTAINERFILE_DENIED_PATTERNS with a *ContainerfileError.
+func ValidateContainerfile(cfg *config.Config, content string) error {
+	denied := make([]*regexp.Regexp, 0, len(cfg.ContainerfileDeniedPatterns))
+	for _, pattern := range cfg.ContainerfileDeniedPatterns {
+		re, err := regexp.Compile("(?i)" + pattern)
+		if err != nil {
+			return fmt.Errorf("invalid CONTAINERFILE_DENIED_PATTERNS entry %q: %w", pattern, err)
+		}
+		denied = append(denied, re)
+	}
+	for _, inst := range parseInstructions(content) {
+		for _, re := range denied {
+			if re.MatchString(inst.text) {
+				return &ContainerfileError{Line: inst.line, Instruction: inst.text, Reason: fmt.Sprintf("denied by pattern %q", strings.TrimPrefix(re.String(), "(?i)"))}
+			}
+		}
+	}
+	return nil
+}
+
+// baseImage is the image a FROM instruction builds on.
+type baseImage struct {
+	line int
+	raw  string // Reference as written
+	ref  string // Reference with build args substituted
+}
+
+// parseBaseImages returns the base image of each FROM instruction in content. Variables
+// are resolved from the ARG instructions before the first FROM, with values overridden by
+// buildArgs. FROM lines naming an earlier stage and FROM scratch are left out.
+func parseBaseImages(content string, buildArgs []string) []baseImage {
+	overrides := map[string]string{}
+	for _, arg := range buildArgs {
+		if key, value, ok := strings.Cut(arg, "="); ok {
+			overrides[key] = value
+		}
+	}
+
+	args := map[string]string{}
+	stages := map[string]bool{}
+	var images []baseImage
+	seenFrom := false
+	for _, inst := range parseInstructions(content) {
+		fields := strings.Fields(inst.text)
+		switch strings.ToUpper(fields[0]) {
+		case "ARG":
+			// Only global args, declared before the first stage, apply to FROM
+			if seenFrom {
+				continue
+			}
+			for _, decl := range fields[1:] {
+				key, value, _ := strings.Cut(decl, "=")
+				if override, ok := overrides[key]; ok {
+					value = override
+				}
+				args[key] = strings.Trim(value, `"'`)
+			}
+		case "FROM":
+			seenFrom = true
+			rest := fields[1:]
+			for len(rest) > 0 && strings.HasPrefix(rest[0], "--") {
+				rest = rest[1:]
+			}
+			if len(rest) == 0 {
+				continue
+			}
+			ref := expandArgs(rest[0], args)
+			if ref != "scratch" && !stages[strings.ToLower(ref)] {
+				images = append(images, baseImage{line: inst.line, raw: rest[0], ref: ref})
+			}
+			if len(rest) >= 3 && strings.EqualFold(rest[1], "AS") {
+				stages[strings.ToLower(rest[2])] = true
+			}
+		}
+	}
+	return images
+}
+
+// expandArgs substitutes $VAR, ${VAR}, ${VAR:-word} and ${VAR:+word} in s from args.
+// Unknown variables expand to nothing.
+func expandArgs(s string, args map[string]string) string {
+	return os.Expand(s, func(name string) string {
+		if key, word, ok := strings.Cut(name, ":-"); ok {
+			if value := args[key]; value != "" {
+				return value
+			}
+			return word
+		}
+		if key, word, ok := strings.Cut(name, ":+"); ok {
+			if args[key] != "" {
+				return word
+			}
+			return ""
+		}
+		return args[name]
+	})
+}
+
+// checkBaseImages enforces ALLOWED_BASE_IMAGES and BASE_IMAGE_ALLOW_LATEST on every FROM
+// of containerfile, listing each violating FROM in the returned error.
+func checkBaseImages(cfg *config.Config, containerfile string, buildArgs []string) error {
+	if len(cfg.AllowedBaseImages) == 0 && cfg.BaseImageAllowLatest {
+		return nil
+	}
+	data, err := os.ReadFile(containerfile)
+	if err != nil {
+		return fmt.Errorf("failed to read Containerfile: %v", err)
+	}
+
+	var violations []string
+	for _, image := range parseBaseImages(string(data), buildArgs) {
+		reason := baseImageViolation(cfg, image.ref)
+		if reason == "" {
+			continue
+		}
+		from := "FROM " + image.ref
+		if image.raw != image.ref {
+			from += fmt.Sprintf(" (from %s)", image.raw)
+		}
+		violations = append(violations, fmt.Sprintf("line %d: %s %s", image.line, from, reason))
+	}
+	if len(violations) > 0 {
+		return fmt.Errorf("Containerfile violates the base image policy: %s", strings.Join(violations, "; "))
+	}
+	return nil
+}
+
+// baseImageViolation returns why ref may not be used as a base image, or an empty string.
+func baseImageViolation(cfg *config.Config, ref string) string {
+	if !cfg.BaseImageAllowLatest && !strings.Contains(ref, "@") && (!HasTag(ref) || strings.HasSuffix(ref, ":latest")) {
+		return "uses the latest tag"
+	}
+	if len(cfg.AllowedBaseImages) == 0 {
+		return ""
+	}
+	for _, pattern := range cfg.AllowedBaseImages {
+		if ok, _ := path.Match(pattern, ref); ok {
+			return ""
+		}
+	}
+	return "does not match ALLOWED_BASE_IMAGES"
+}
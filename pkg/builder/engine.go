@@ -0,0 +1,142 @@
+package builder
+
+import (
+	"context"
+	"fmt"
+	"os/exec"
+
+	"vddk-builder/pkg/config"
+)
+
+// engine maps the image operations of a build to the CLI of the BUILD_ENGINE.
+type engine struct {
+	name string // config.EnginePodman, config.EngineDocker or config.EngineBuildah
+	url  string // CONTAINER_HOST of a remote podman service, local storage if empty
+}
+
+// engineFor returns the build engine selected in cfg, podman if none is.
+func engineFor(cfg *config.Config) engine {
+	if cfg.BuildEngine == "" {
+		return engine{name: config.EnginePodman, url: cfg.ContainerHost}
+	}
+	return engine{name: cfg.BuildEngine, url: cfg.ContainerHost}
+}
+
+// remote reports whether images are built and stored by a remote podman service, where
+// skopeo cannot read them.
+func (e engine) remote() bool {
+	return e.url != ""
+}
+
+// command returns args prefixed with the connection to the remote service, if any.
+func (e engine) command(args ...string) []string {
+	if !e.remote() {
+		return args
+	}
+	return append([]string{"--url", e.url}, args...)
+}
+
+// run runs the engine with args through runner, see runCommand.
+func (e engine) run(ctx context.Context, runner Runner, onLine func(line string), args ...string) error {
+	return runCommand(ctx, runner, onLine, e.name, e.command(args...)...)
+}
+
+// pusher returns the tool pushing built images: skopeo, or podman itself when the
+// images live on a remote service.
+func (e engine) pusher() string {
+	if e.remote() {
+		return e.name
+	}
+	return "skopeo"
+}
+
+// PingEngine verifies that the build engine answers, which includes connecting to the
+// remote podman service when CONTAINER_HOST is set.
+func PingEngine(ctx context.Context, cfg *config.Config) error {
+	eng := engineFor(cfg)
+	cmd := exec.CommandContext(ctx, eng.name, eng.command("version")...)
+	cmd.WaitDelay = cmdWaitDelay
+	if output, err := cmd.CombinedOutput(); err != nil {
+		if eng.remote() {
+			return fmt.Errorf("connect to %s: %w\n%s", eng.url, err, output)
+		}
+		return fmt.Errorf("%s version: %w\n%s", eng.name, err, output)
+	}
+	return nil
+}
+
+// CheckEngine verifies that the binary of the selected build engine is installed.
+func CheckEngine(cfg *config.Config) error {
+	name := engineFor(cfg).name
+	if _, err := exec.LookPath(name); err != nil {
+		return fmt.Errorf("BUILD_ENGINE %s is not installed: %w", name, err)
+	}
+	return nil
+}
+
+// buildCommand returns the arguments starting a build of containerfile.
+func (e engine) buildCommand(containerfile string) []string {
+	if e.name == config.EngineBuildah {
+		return []string{"bud", "-f", containerfile}
+	}
+	return []string{"build", "-f", containerfile}
+}
+
+// squashFlag returns the build flag squashing the image into a single layer.
+func (e engine) squashFlag() string {
+	if e.name == config.EnginePodman {
+		return "--squash-all"
+	}
+	return "--squash"
+}
+
+// transport returns the skopeo transport prefix under which the engine stores built images.
+func (e engine) transport() string {
+	if e.name == config.EngineDocker {
+		return "docker-daemon:"
+	}
+	return "containers-storage:"
+}
+
+// exportCommand returns the command writing the local image to dest as an OCI archive:
+// skopeo, or podman save for images on a remote podman service.
+func (e engine) exportCommand(image, dest string) (string, []string) {
+	if e.remote() {
+		return e.name, e.command("save", "--format", "oci-archive", "-o", dest, image)
+	}
+	return "skopeo", []string{"copy", e.transport() + image, fmt.Sprintf("oci-archive:%s", dest)}
+}
+
+// supportsManifests reports whether the engine can assemble manifest lists.
+func (e engine) supportsManifests() bool {
+	return e.name != config.EngineDocker
+}
+
+// imageExistsCommand returns the arguments of a command exiting 0 if image is stored locally.
+func (e engine) imageExistsCommand(image string) []string {
+	switch e.name {
+	case config.EngineDocker:
+		return []string{"image", "inspect", "--format", "{{.Id}}", image}
+	case config.EngineBuildah:
+		return []string{"inspect", "--type", "image", "--format", "{{.FromImageID}}", image}
+	}
+	return []string{"image", "exists", image}
+}
+
+// imageSizeCommand returns the arguments of a command printing the size of image in bytes,
+// or nil if the engine cannot report it.
+func (e engine) imageSizeCommand(image string) []string {
+	if e.name == config.EngineBuildah {
+		return nil
+	}
+	return []string{"image", "inspect", "--format", "{{.Size}}", image}
+}
+
+// pruneCommand returns the arguments removing unused images created before until, or an
+// error if the engine cannot filter images by age.
+func (e engine) pruneCommand(until string) ([]string, error) {
+	if e.name == config.EngineBuildah {
+		return nil, fmt.Errorf("buildah cannot prune images by age")
+	}
+	return []string{"image", "prune", "--all", "--force", "--filter", "until=" + until}, nil
+}
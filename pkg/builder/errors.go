@@ -0,0 +1,69 @@
+package builder
+
+// ExtractError reports that the build context could not be prepared, usually because the
+// uploaded archive is corrupt or malformed. Retrying with the same archive will not help.
+type ExtractError struct {
+	Err error
+}
+
+func (e *ExtractError) Error() string { return "failed to extract archive: " + e.Err.Error() }
+
+func (e *ExtractError) Unwrap() error { return e.Err }
+
+// BuildError reports that podman failed to build the image from the extracted archive.
+type BuildError struct {
+	Err error
+}
+
+func (e *BuildError) Error() string { return "failed to build image: " + e.Err.Error() }
+
+func (e *BuildError) Unwrap() error { return e.Err }
+
+// PushError reports that the image could not be pushed to, or verified in, the registry.
+// It is often transient, and the build can be retried from the same archive.
+type PushError struct {
+	Err error
+}
+
+func (e *PushError) Error() string { return "failed to push image: " + e.Err.Error() }
+
+func (e *PushError) Unwrap() error { return e.Err }
+
+// VerifyPushError reports that the registry does not serve the pushed reference with the
+// digest skopeo reported. It is retried like a transient push failure.
+type VerifyPushError struct {
+	Err error
+}
+
+func (e *VerifyPushError) Error() string { return "post-push verification failed: " + e.Err.Error() }
+
+func (e *VerifyPushError) Unwrap() error { return e.Err }
+
+// SignError reports that cosign could not sign the pushed image. The image itself is
+// already in the registry.
+type SignError struct {
+	Err error
+}
+
+func (e *SignError) Error() string { return "failed to sign image: " + e.Err.Error() }
+
+func (e *SignError) Unwrap() error { return e.Err }
+
+// ScanError reports that the vulnerability scan failed or found more vulnerabilities than
+// SCAN_MAX_FINDINGS allows. Nothing was pushed.
+type ScanError struct {
+	Err error
+}
+
+func (e *ScanError) Error() string { return "vulnerability scan: " + e.Err.Error() }
+
+func (e *ScanError) Unwrap() error { return e.Err }
+
+// SBOMError reports that the SBOM of the image could not be generated or attached.
+type SBOMError struct {
+	Err error
+}
+
+func (e *SBOMError) Error() string { return "failed to produce SBOM: " + e.Err.Error() }
+
+func (e *SBOMError) Unwrap() error { return e.Err }
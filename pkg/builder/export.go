@@ -0,0 +1,42 @@
+package builder
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os/exec"
+
+	"vddk-builder/pkg/config"
+)
+
+// LocalImageExists reports whether imageTag is still present in the local storage of the build engine.
+func LocalImageExists(ctx context.Context, cfg *config.Config, imageTag string) (bool, error) {
+	eng := engineFor(cfg)
+	cmd := exec.CommandContext(ctx, eng.name, eng.command(eng.imageExistsCommand(imageTag)...)...)
+	cmd.WaitDelay = cmdWaitDelay
+	err := cmd.Run()
+
+	var exitErr *exec.ExitError
+	switch {
+	case err == nil:
+		return true, nil
+	case errors.As(err, &exitErr) && exitErr.ExitCode() == 1:
+		return false, nil
+	default:
+		return false, fmt.Errorf("check local image: %w", err)
+	}
+}
+
+// ExportImage writes the locally built imageTag to dest as an OCI archive. Images on a
+// remote podman service are streamed back with podman save.
+func ExportImage(ctx context.Context, cfg *config.Config, imageTag, dest string) error {
+	name, args := engineFor(cfg).exportCommand(imageTag, dest)
+	cmd := exec.CommandContext(ctx, name, args...)
+	cmd.WaitDelay = cmdWaitDelay
+
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("export image: %w\n%s", err, output)
+	}
+	return nil
+}
@@ -0,0 +1,430 @@
+package builder
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"vddk-builder/pkg/config"
+)
+
+// ErrArchiveLimits is wrapped by extraction errors caused by an archive that expands to
+// more bytes or entries than MAX_EXTRACTED_BYTES and MAX_ARCHIVE_ENTRIES allow.
+var ErrArchiveLimits = errors.New("archive exceeds limits")
+
+// extractLimits caps what an upload may expand to, counted across the outer archive and
+// any nested ones; zero disables a limit. Entries not matching include are skipped.
+type extractLimits struct {
+	maxBytes   int64
+	maxEntries int
+	include    []string // EXTRACT_INCLUDE_GLOBS, every entry is extracted if empty
+	keep       string   // Entry extracted whatever include says, the CHECKSUM_MANIFEST
+	bytes      int64    // Bytes extracted so far
+	entries    int      // Entries extracted so far
+}
+
+// limitsFor returns fresh extraction limits as configured in cfg.
+func limitsFor(cfg *config.Config) *extractLimits {
+	return &extractLimits{maxBytes: cfg.MaxExtractedBytes, maxEntries: cfg.MaxArchiveEntries, include: cfg.ExtractIncludeGlobs, keep: cfg.ChecksumManifest}
+}
+
+// wanted reports whether the archive entry name is extracted. The checksum manifest and
+// archives at the root, which unpacking nested archives needs, are always extracted.
+func (l *extractLimits) wanted(name string) bool {
+	if len(l.include) == 0 {
+		return true
+	}
+	name = strings.TrimPrefix(path.Clean("/"+strings.ReplaceAll(name, "\\", "/")), "/")
+	if name == l.keep || includedEntry(nestedArchivePatterns, name) {
+		return true
+	}
+	return includedEntry(l.include, name)
+}
+
+// includedEntry reports whether the slash-separated name matches one of the globs in
+// include, where a ** segment matches any number of path segments, none included.
+func includedEntry(include []string, name string) bool {
+	for _, pattern := range include {
+		if matchSegments(strings.Split(pattern, "/"), strings.Split(name, "/")) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchSegments matches the path segments of name against those of a glob pattern.
+func matchSegments(pattern, name []string) bool {
+	for len(pattern) > 0 {
+		if pattern[0] == "**" {
+			for i := 0; i <= len(name); i++ {
+				if matchSegments(pattern[1:], name[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+		if len(name) == 0 {
+			return false
+		}
+		if ok, _ := path.Match(pattern[0], name[0]); !ok {
+			return false
+		}
+		pattern, name = pattern[1:], name[1:]
+	}
+	return len(name) == 0
+}
+
+// countExisting charges the files already below dir, such as a streamed extraction,
+// against the limits.
+func (l *extractLimits) countExisting(dir string) error {
+	return filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || path == dir {
+			return err
+		}
+		l.entries++
+		if d.Type().IsRegular() {
+			info, err := d.Info()
+			if err != nil {
+				return err
+			}
+			l.bytes += info.Size()
+		}
+		return nil
+	})
+}
+
+// extractTarGz extracts a .tar.gz file to a destination directory, reporting the
+// fraction of the compressed file read so far.
+func extractTarGz(src, dest string, limits *extractLimits, report ProgressFunc) error {
+	file, err := os.Open(src)
+	if err != nil {
+		return fmt.Errorf("failed to open tar.gz file: %v", err)
+	}
+	defer file.Close()
+
+	var size int64
+	if info, err := file.Stat(); err == nil {
+		size = info.Size()
+	}
+	report.report(PhaseExtracting, 0)
+	return extractTarGzReader(&progressReader{r: file, size: size, phase: PhaseExtracting, report: report}, dest, limits)
+}
+
+// extractTarGzReader extracts a .tar.gz stream to a destination directory. Directories,
+// regular files, symbolic links and hard links are recreated with their permission bits;
+// other entry types are skipped. Links must resolve inside dest, and no entry is ever
+// written through a symbolic link. Extraction stops with an error wrapping ErrArchiveLimits
+// as soon as the archive exceeds limits.
+func extractTarGzReader(r io.Reader, dest string, limits *extractLimits) error {
+	gzipReader, err := gzip.NewReader(r)
+	if err != nil {
+		return fmt.Errorf("failed to create gzip reader: %v", err)
+	}
+	defer gzipReader.Close()
+
+	tarReader := tar.NewReader(gzipReader)
+	skipped := 0
+	for {
+		hdr, err := tarReader.Next()
+		if err != nil {
+			if err == io.EOF {
+				break
+			}
+			return fmt.Errorf("error reading tar.gz file: %v", err)
+		}
+
+		limits.entries++
+		if limits.maxEntries > 0 && limits.entries > limits.maxEntries {
+			return fmt.Errorf("%w: more than %d entries", ErrArchiveLimits, limits.maxEntries)
+		}
+
+		target, err := safeJoin(dest, hdr.Name)
+		if err != nil {
+			return err
+		}
+		if target == filepath.Clean(dest) {
+			continue // The archive's "./" entry
+		}
+		if !limits.wanted(hdr.Name) {
+			if hdr.Typeflag != tar.TypeDir {
+				skipped++
+			}
+			continue
+		}
+		if err := checkNoSymlinkParents(dest, target); err != nil {
+			return err
+		}
+		if hdr.Typeflag != tar.TypeDir {
+			if err := os.MkdirAll(filepath.Dir(target), dirPerm); err != nil {
+				return fmt.Errorf("failed to create directory: %v", err)
+			}
+			if err := removeExisting(target); err != nil {
+				return err
+			}
+		}
+		mode := os.FileMode(hdr.Mode).Perm()
+
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(target, dirPerm); err != nil {
+				return fmt.Errorf("failed to create directory: %v", err)
+			}
+			if err := os.Chmod(target, mode|0700); err != nil {
+				return fmt.Errorf("failed to set directory mode: %v", err)
+			}
+		case tar.TypeReg:
+			outFile, err := os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_EXCL, mode)
+			if err != nil {
+				return fmt.Errorf("failed to create file: %v", err)
+			}
+			var src io.Reader = tarReader
+			if limits.maxBytes > 0 {
+				src = io.LimitReader(tarReader, max(limits.maxBytes-limits.bytes, 0)+1)
+			}
+			n, err := io.Copy(outFile, src)
+			limits.bytes += n
+			if err != nil {
+				outFile.Close()
+				return fmt.Errorf("failed to write file: %v", err)
+			}
+			if limits.maxBytes > 0 && limits.bytes > limits.maxBytes {
+				outFile.Close()
+				return fmt.Errorf("%w: more than %d extracted bytes", ErrArchiveLimits, limits.maxBytes)
+			}
+			if err := outFile.Close(); err != nil {
+				return fmt.Errorf("failed to write file: %v", err)
+			}
+			// The umask may have cleared bits of the requested mode
+			if err := os.Chmod(target, mode); err != nil {
+				return fmt.Errorf("failed to set file mode: %v", err)
+			}
+		case tar.TypeSymlink:
+			if err := checkSymlinkTarget(dest, target, hdr.Name, hdr.Linkname); err != nil {
+				return err
+			}
+			if err := os.Symlink(hdr.Linkname, target); err != nil {
+				return fmt.Errorf("failed to create symlink: %v", err)
+			}
+		case tar.TypeLink:
+			source, err := safeJoin(dest, hdr.Linkname)
+			if err != nil {
+				return fmt.Errorf("hard link %q: %v", hdr.Name, err)
+			}
+			if err := checkNoSymlinkParents(dest, source); err != nil {
+				return err
+			}
+			info, err := os.Lstat(source)
+			if err != nil || !info.Mode().IsRegular() {
+				return fmt.Errorf("hard link %q must point to a regular file extracted earlier, not %q", hdr.Name, hdr.Linkname)
+			}
+			if err := os.Link(source, target); err != nil {
+				return fmt.Errorf("failed to create hard link: %v", err)
+			}
+		}
+	}
+
+	if skipped > 0 {
+		log.Printf("Skipped %d archive entries not matching EXTRACT_INCLUDE_GLOBS\n", skipped)
+	}
+	// A later entry may have replaced a link another link resolves through
+	return checkSymlinks(dest)
+}
+
+// nestedArchivePatterns match the archives at the root of the build context that are unpacked.
+var nestedArchivePatterns = []string{"*.tar.gz", "*.tgz"}
+
+// unpackNested extracts the .tar.gz and .tgz files found at the root of contextDir in
+// place and removes them, repeating for archives those contain until maxDepth archive
+// levels, the uploaded one included, have been unpacked.
+func unpackNested(contextDir string, maxDepth int, limits *extractLimits) error {
+	for depth := 2; ; depth++ {
+		var archives []string
+		for _, pattern := range nestedArchivePatterns {
+			matches, err := filepath.Glob(filepath.Join(contextDir, pattern))
+			if err != nil {
+				return err
+			}
+			for _, match := range matches {
+				if info, err := os.Lstat(match); err == nil && info.Mode().IsRegular() {
+					archives = append(archives, match)
+				}
+			}
+		}
+		if len(archives) == 0 {
+			return nil
+		}
+		if depth > maxDepth {
+			log.Printf("Leaving %d nested archives packed, MAX_NESTING_DEPTH is %d\n", len(archives), maxDepth)
+			return nil
+		}
+
+		for _, archive := range archives {
+			log.Printf("Unpacking nested archive %s...\n", filepath.Base(archive))
+			if err := extractTarGz(archive, contextDir, limits, nil); err != nil {
+				return fmt.Errorf("nested archive %s: %w", filepath.Base(archive), err)
+			}
+			if err := os.Remove(archive); err != nil {
+				return fmt.Errorf("failed to remove nested archive: %v", err)
+			}
+		}
+	}
+}
+
+// safeJoin joins the archive entry name onto dest, rejecting absolute names, names
+// containing NUL and names that would resolve outside dest.
+func safeJoin(dest, name string) (string, error) {
+	if strings.ContainsRune(name, 0) {
+		return "", fmt.Errorf("archive entry %q contains a NUL byte", name)
+	}
+	if filepath.IsAbs(name) || strings.HasPrefix(name, "/") || strings.HasPrefix(name, `\`) {
+		return "", fmt.Errorf("archive entry %q has an absolute path", name)
+	}
+
+	target := filepath.Join(dest, name)
+	if !within(dest, target) {
+		return "", fmt.Errorf("archive entry %q escapes the extraction directory", name)
+	}
+	return target, nil
+}
+
+// maxSymlinkHops bounds the links followed while resolving one link, as the kernel does.
+const maxSymlinkHops = 40
+
+// checkSymlinkTarget verifies that the symlink at target, created for the archive entry
+// name, points inside dest. The target is resolved against the links already extracted,
+// since a lexical check lets a/b/s/../x escape when a/b/s is itself a link.
+func checkSymlinkTarget(dest, target, name, linkname string) error {
+	if linkname == "" || strings.ContainsRune(linkname, 0) || filepath.IsAbs(linkname) {
+		return fmt.Errorf("symlink %q has a disallowed target %q", name, linkname)
+	}
+	hops := 0
+	if _, err := resolveInside(filepath.Clean(dest), filepath.Dir(target), linkname, &hops); err != nil {
+		return fmt.Errorf("symlink %q points outside the extraction directory: %q: %v", name, linkname, err)
+	}
+	return nil
+}
+
+// checkSymlinks verifies that every symlink below dest still resolves inside it.
+func checkSymlinks(dest string) error {
+	dest = filepath.Clean(dest)
+	return filepath.WalkDir(dest, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.Type()&fs.ModeSymlink == 0 {
+			return err
+		}
+		linkname, err := os.Readlink(path)
+		if err != nil {
+			return fmt.Errorf("failed to read symlink: %v", err)
+		}
+		name := strings.TrimPrefix(path, dest+string(filepath.Separator))
+		return checkSymlinkTarget(dest, path, name, linkname)
+	})
+}
+
+// resolveInside resolves linkname from dir, a real directory below dest, component by
+// component, following the symlinks it passes through. It fails as soon as the path
+// leaves dest, and for a ".." after a component that does not exist yet, since a later
+// entry could make that component a link.
+func resolveInside(dest, dir, linkname string, hops *int) (string, error) {
+	current, missing := dir, false
+	for _, part := range strings.Split(filepath.ToSlash(linkname), "/") {
+		switch part {
+		case "", ".":
+			continue
+		case "..":
+			if missing {
+				return "", fmt.Errorf("%s does not exist", current)
+			}
+			if current == dest {
+				return "", errors.New("it leaves the extraction directory")
+			}
+			current = filepath.Dir(current)
+			continue
+		}
+		current = filepath.Join(current, part)
+		if missing {
+			continue
+		}
+		info, err := os.Lstat(current)
+		if os.IsNotExist(err) {
+			missing = true
+			continue
+		}
+		if err != nil {
+			return "", fmt.Errorf("failed to inspect %s: %v", current, err)
+		}
+		if info.Mode()&os.ModeSymlink == 0 {
+			continue
+		}
+		if *hops++; *hops > maxSymlinkHops {
+			return "", errors.New("too many levels of symbolic links")
+		}
+		next, err := os.Readlink(current)
+		if err != nil {
+			return "", fmt.Errorf("failed to read symlink: %v", err)
+		}
+		if filepath.IsAbs(next) {
+			return "", fmt.Errorf("%s is an absolute symlink", current)
+		}
+		if current, err = resolveInside(dest, filepath.Dir(current), next, hops); err != nil {
+			return "", err
+		}
+		if _, err := os.Lstat(current); os.IsNotExist(err) {
+			missing = true
+		}
+	}
+	return current, nil
+}
+
+// checkNoSymlinkParents fails if any directory between dest and target is a symlink, so
+// a link extracted earlier cannot redirect later entries.
+func checkNoSymlinkParents(dest, target string) error {
+	rel, err := filepath.Rel(dest, filepath.Dir(target))
+	if err != nil || rel == "." {
+		return err
+	}
+	path := dest
+	for _, part := range strings.Split(rel, string(filepath.Separator)) {
+		path = filepath.Join(path, part)
+		info, err := os.Lstat(path)
+		if os.IsNotExist(err) {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("failed to inspect %s: %v", path, err)
+		}
+		if info.Mode()&os.ModeSymlink != 0 {
+			return fmt.Errorf("archive entry %q is nested below a symlink", strings.TrimPrefix(target, dest+string(filepath.Separator)))
+		}
+	}
+	return nil
+}
+
+// removeExisting removes a file or link left at target by an earlier entry of the same
+// name, so that the new entry replaces it instead of writing through it.
+func removeExisting(target string) error {
+	info, err := os.Lstat(target)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to inspect %s: %v", target, err)
+	}
+	if info.IsDir() {
+		return fmt.Errorf("archive entry %s replaces a directory", target)
+	}
+	return os.Remove(target)
+}
+
+// within reports whether path is dest or lies below it.
+func within(dest, path string) bool {
+	rel, err := filepath.Rel(dest, path)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
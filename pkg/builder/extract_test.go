@@ -0,0 +1,188 @@
+package builder
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// tarEntry is one entry of a crafted archive.
+type tarEntry struct {
+	name     string
+	typeflag byte
+	linkname string
+	body     string
+}
+
+// tarGz returns the entries as a .tar.gz stream.
+func tarGz(t *testing.T, entries ...tarEntry) *bytes.Buffer {
+	t.Helper()
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gz)
+	for _, e := range entries {
+		hdr := &tar.Header{Name: e.name, Typeflag: e.typeflag, Linkname: e.linkname, Mode: 0644, Size: int64(len(e.body))}
+		if e.typeflag == tar.TypeDir {
+			hdr.Mode = 0755
+		}
+		if e.typeflag != tar.TypeReg {
+			hdr.Size = 0
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		if e.typeflag == tar.TypeReg {
+			if _, err := tw.Write([]byte(e.body)); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := gz.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return &buf
+}
+
+// extractDirs returns an empty extraction directory inside a parent holding a secret file
+// that no archive may reach.
+func extractDirs(t *testing.T) (dest, secret string) {
+	t.Helper()
+	parent := t.TempDir()
+	secret = filepath.Join(parent, "secret")
+	if err := os.WriteFile(secret, []byte("token"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	dest = filepath.Join(parent, "work", "context")
+	if err := os.MkdirAll(dest, 0700); err != nil {
+		t.Fatal(err)
+	}
+	return dest, secret
+}
+
+func TestExtractRejectsMaliciousArchives(t *testing.T) {
+	tests := []struct {
+		name    string
+		entries []tarEntry
+		want    string
+	}{
+		{
+			name:    "parent traversal",
+			entries: []tarEntry{{name: "../x", typeflag: tar.TypeReg, body: "x"}},
+			want:    "escapes the extraction directory",
+		},
+		{
+			name:    "absolute path",
+			entries: []tarEntry{{name: "/etc/x", typeflag: tar.TypeReg, body: "x"}},
+			want:    "absolute path",
+		},
+		{
+			name:    "symlink escaping the root",
+			entries: []tarEntry{{name: "l", typeflag: tar.TypeSymlink, linkname: "../../secret"}},
+			want:    "points outside the extraction directory",
+		},
+		{
+			name:    "absolute symlink",
+			entries: []tarEntry{{name: "l", typeflag: tar.TypeSymlink, linkname: "/etc/passwd"}},
+			want:    "disallowed target",
+		},
+		{
+			name:    "hard link outside",
+			entries: []tarEntry{{name: "h", typeflag: tar.TypeLink, linkname: "../../secret"}},
+			want:    "escapes the extraction directory",
+		},
+		{
+			name: "hard link to a symlink",
+			entries: []tarEntry{
+				{name: "s", typeflag: tar.TypeSymlink, linkname: "."},
+				{name: "h", typeflag: tar.TypeLink, linkname: "s"},
+			},
+			want: "must point to a regular file",
+		},
+		{
+			name: "chained symlinks",
+			entries: []tarEntry{
+				{name: "a/b/", typeflag: tar.TypeDir},
+				{name: "a/b/s", typeflag: tar.TypeSymlink, linkname: "../.."},
+				{name: "l", typeflag: tar.TypeSymlink, linkname: "a/b/s/../secret"},
+			},
+			want: "points outside the extraction directory",
+		},
+		{
+			name: "entry below a symlink",
+			entries: []tarEntry{
+				{name: "d", typeflag: tar.TypeSymlink, linkname: "."},
+				{name: "d/x", typeflag: tar.TypeReg, body: "x"},
+			},
+			want: "nested below a symlink",
+		},
+		{
+			name: "replaced link another link resolves through",
+			entries: []tarEntry{
+				{name: "sub/", typeflag: tar.TypeDir},
+				{name: "x", typeflag: tar.TypeSymlink, linkname: "sub"},
+				{name: "l", typeflag: tar.TypeSymlink, linkname: "x/../secret"},
+				{name: "x", typeflag: tar.TypeSymlink, linkname: "."},
+			},
+			want: "points outside the extraction directory",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dest, secret := extractDirs(t)
+			err := extractTarGzReader(tarGz(t, tt.entries...), dest, &extractLimits{})
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Fatalf("extractTarGzReader() error = %v, want one containing %q", err, tt.want)
+			}
+			if data, err := os.ReadFile(filepath.Join(dest, "l")); err == nil && string(data) == "token" {
+				t.Fatalf("the archive reached %s", secret)
+			}
+		})
+	}
+}
+
+func TestExtractAllowsLinksInside(t *testing.T) {
+	dest, _ := extractDirs(t)
+	archive := tarGz(t,
+		tarEntry{name: "lib/", typeflag: tar.TypeDir},
+		tarEntry{name: "lib/libvixDiskLib.so.8", typeflag: tar.TypeReg, body: "elf"},
+		tarEntry{name: "lib/libvixDiskLib.so", typeflag: tar.TypeSymlink, linkname: "libvixDiskLib.so.8"},
+		tarEntry{name: "bin/", typeflag: tar.TypeDir},
+		tarEntry{name: "bin/lib", typeflag: tar.TypeSymlink, linkname: "../lib"},
+		tarEntry{name: "copy", typeflag: tar.TypeLink, linkname: "lib/libvixDiskLib.so.8"},
+	)
+	if err := extractTarGzReader(archive, dest, &extractLimits{}); err != nil {
+		t.Fatalf("extractTarGzReader() error = %v", err)
+	}
+	for _, name := range []string{"lib/libvixDiskLib.so", "bin/lib/libvixDiskLib.so.8", "copy"} {
+		if data, err := os.ReadFile(filepath.Join(dest, name)); err != nil || string(data) != "elf" {
+			t.Errorf("reading %s = %q, %v; want %q", name, data, err, "elf")
+		}
+	}
+}
+
+func TestCopyFileReplacesSymlink(t *testing.T) {
+	dest, secret := extractDirs(t)
+	if err := os.Symlink("../../secret", filepath.Join(dest, "extra.txt")); err != nil {
+		t.Fatal(err)
+	}
+	src := filepath.Join(t.TempDir(), "extra.txt")
+	if err := os.WriteFile(src, []byte("extra"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := copyFile(src, filepath.Join(dest, "extra.txt")); err != nil {
+		t.Fatalf("copyFile() error = %v", err)
+	}
+	if data, _ := os.ReadFile(secret); string(data) != "token" {
+		t.Fatalf("copyFile wrote through the symlink: secret holds %q", data)
+	}
+	if info, err := os.Lstat(filepath.Join(dest, "extra.txt")); err != nil || !info.Mode().IsRegular() {
+		t.Fatalf("copyFile left %v, %v; want a regular file", info, err)
+	}
+}
@@ -0,0 +1,62 @@
+package builder
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+
+	"vddk-builder/pkg/config"
+)
+
+// Values of the STATUS variable passed to hooks.
+const (
+	HookStatusBuilding  = "building"
+	HookStatusSucceeded = "succeeded"
+	HookStatusFailed    = "failed"
+)
+
+// hookEnv describes the build to a hook command.
+type hookEnv struct {
+	contextDir string
+	image      string
+	digest     string
+	status     string
+}
+
+// runHook runs the executable at path in the build context with BUILD_ID, CONTEXT_DIR,
+// IMAGE_REF, IMAGE_DIGEST and STATUS set, killing it after HOOK_TIMEOUT or when ctx ends.
+// Its output goes to req.Output.
+func runHook(ctx context.Context, cfg *config.Config, req BuildRequest, path string, env hookEnv) error {
+	if cfg.HookTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, cfg.HookTimeout)
+		defer cancel()
+	}
+
+	cmd := exec.CommandContext(ctx, path)
+	cmd.WaitDelay = cmdWaitDelay
+	cmd.Dir = env.contextDir
+	cmd.Env = append(os.Environ(),
+		"BUILD_ID="+req.BuildID,
+		"CONTEXT_DIR="+env.contextDir,
+		"IMAGE_REF="+env.image,
+		"IMAGE_DIGEST="+env.digest,
+		"STATUS="+env.status,
+	)
+	tail := &tailBuffer{max: outputTailSize}
+	lines := &lineWriter{onLine: outputSink(req.Output, "hook")}
+	out := io.MultiWriter(tail, lines)
+	cmd.Stdout, cmd.Stderr = out, out
+
+	err := cmd.Run()
+	lines.flush()
+	if ctx.Err() == context.DeadlineExceeded {
+		return fmt.Errorf("hook %s timed out after %s\n%s", path, cfg.HookTimeout, tail.buf)
+	}
+	if err != nil {
+		return fmt.Errorf("hook %s: %w\n%s", path, err, tail.buf)
+	}
+	return nil
+}
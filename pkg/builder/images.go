@@ -0,0 +1,83 @@
+package builder
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"vddk-builder/pkg/config"
+)
+
+// readImageID returns the image ID podman wrote to iidFile, or an empty string.
+func readImageID(iidFile string) string {
+	id, err := os.ReadFile(iidFile)
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(id))
+}
+
+// removeLocalImages removes the images built with the given IDs, and the manifest list
+// holding them unless manifest is empty, from the local storage of eng. Failures are
+// logged and otherwise ignored since the image is already in the registry.
+func removeLocalImages(ctx context.Context, runner Runner, eng engine, manifest string, imageIDs []string, out io.Writer) {
+	sink := outputSink(out, eng.name)
+	if manifest != "" {
+		if err := eng.run(ctx, runner, sink, "manifest", "rm", manifest); err != nil {
+			log.Printf("Warning: failed to remove local manifest list %s: %v\n", manifest, err)
+		}
+	}
+	if len(imageIDs) == 0 {
+		return
+	}
+	args := append([]string{"rmi", "--force"}, imageIDs...)
+	if err := eng.run(ctx, runner, sink, args...); err != nil {
+		log.Printf("Warning: failed to remove local images: %v\n", err)
+		return
+	}
+	log.Printf("Removed %d local images\n", len(imageIDs))
+}
+
+// localImageSize returns the total size of the local images with the given IDs, or 0 if
+// the build engine cannot report it.
+func localImageSize(ctx context.Context, runner Runner, eng engine, imageIDs []string) int64 {
+	var total int64
+	for _, id := range imageIDs {
+		args := eng.imageSizeCommand(id)
+		if args == nil {
+			return 0
+		}
+		var size string
+		err := eng.run(ctx, runner, func(line string) { size = line }, args...)
+		if err != nil {
+			log.Printf("Warning: failed to inspect local image %s: %v\n", id, err)
+			return 0
+		}
+		n, err := strconv.ParseInt(strings.TrimSpace(size), 10, 64)
+		if err != nil {
+			log.Printf("Warning: unexpected size %q of local image %s\n", size, id)
+			return 0
+		}
+		total += n
+	}
+	return total
+}
+
+// PruneLocalImages removes every image in the local storage of the build engine that was
+// created more than LOCAL_IMAGE_RETENTION ago and is not used by a container.
+func PruneLocalImages(ctx context.Context, cfg *config.Config, runner Runner) error {
+	eng := engineFor(cfg)
+	args, err := eng.pruneCommand(cfg.LocalImageRetention.Round(time.Second).String())
+	if err != nil {
+		return err
+	}
+	if err := eng.run(ctx, runner, outputSink(nil, eng.name), args...); err != nil {
+		return fmt.Errorf("prune local images: %w", err)
+	}
+	return nil
+}
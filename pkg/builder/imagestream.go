@@ -0,0 +1,105 @@
+package builder
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"vddk-builder/pkg/config"
+	"vddk-builder/pkg/k8spermissions"
+	"vddk-builder/pkg/registry"
+)
+
+// imageStreamAnnotationPrefix starts the name of every annotation set on ImageStreamTags.
+const imageStreamAnnotationPrefix = "io.github.yaacov.vddk-builder/"
+
+// imageStreamWait bounds how long OpenShift may take to create the ImageStreamTag of a push.
+const imageStreamWait = 30 * time.Second
+
+// imageStreamPoll is the delay between two reads of a missing ImageStreamTag.
+const imageStreamPoll = 2 * time.Second
+
+// annotateImageStreamTags checks that the ImageStreamTag of each of tags, pushed to the
+// OpenShift internal registry, points to result.Digest and annotates it with the VDDK
+// version, build ID and archive digest. The tags are read with the request token, or with
+// the builder's service account when IMAGESTREAM_USE_SERVICE_ACCOUNT is set or the request
+// has no token.
+func annotateImageStreamTags(ctx context.Context, cfg *config.Config, req BuildRequest, result BuildResult, tags []string) error {
+	if result.Digest == "" {
+		return fmt.Errorf("the pushed digest of %s is unknown", result.Image)
+	}
+
+	token := req.AuthToken
+	if cfg.ImageStreamServiceAccount {
+		token = ""
+	}
+	annotations := map[string]string{imageStreamAnnotationPrefix + "build-id": req.BuildID}
+	if result.Version != "" {
+		annotations[imageStreamAnnotationPrefix+"vddk-version"] = result.Version
+	}
+	if req.ArchiveDigest != "" {
+		annotations[imageStreamAnnotationPrefix+"archive-digest"] = req.ArchiveDigest
+	}
+
+	for _, tag := range tags {
+		namespace, name, err := imageStreamTagName(tag)
+		if err != nil {
+			return err
+		}
+		ist, err := waitForImageStreamTag(ctx, token, namespace, name)
+		if err != nil {
+			return err
+		}
+		if ist.Digest != result.Digest {
+			return fmt.Errorf("ImageStreamTag %s/%s points to %s instead of the pushed %s", namespace, name, ist.Digest, result.Digest)
+		}
+		if err := k8spermissions.AnnotateImageStreamTag(ctx, token, namespace, name, annotations); err != nil {
+			return err
+		}
+		log.Printf("Annotated ImageStreamTag %s/%s\n", namespace, name)
+	}
+	return nil
+}
+
+// imageStreamTagName returns the namespace and the stream:tag name of the ImageStreamTag
+// OpenShift creates for a push to image.
+func imageStreamTagName(image string) (string, string, error) {
+	ref, err := registry.ParseReference(image)
+	if err != nil {
+		return "", "", err
+	}
+	namespace, stream, found := strings.Cut(ref.Repository, "/")
+	if !found || strings.Contains(stream, "/") {
+		return "", "", fmt.Errorf("%s is not of the form namespace/stream as OpenShift image streams are", ref.Repository)
+	}
+	tag := ref.Tag
+	if tag == "" {
+		tag = "latest"
+	}
+	return namespace, stream + ":" + tag, nil
+}
+
+// waitForImageStreamTag reads the ImageStreamTag name in namespace, waiting up to
+// imageStreamWait for OpenShift to create it.
+func waitForImageStreamTag(ctx context.Context, token, namespace, name string) (k8spermissions.ImageStreamTag, error) {
+	deadline := time.Now().Add(imageStreamWait)
+	for {
+		ist, found, err := k8spermissions.GetImageStreamTag(ctx, token, namespace, name)
+		if err != nil {
+			return ist, err
+		}
+		if found {
+			return ist, nil
+		}
+		if time.Now().After(deadline) {
+			return ist, fmt.Errorf("ImageStreamTag %s/%s was not created by the push, IMAGE_REGISTRY may not be the OpenShift internal registry", namespace, name)
+		}
+		select {
+		case <-ctx.Done():
+			return ist, ctx.Err()
+		case <-time.After(imageStreamPoll):
+		}
+	}
+}
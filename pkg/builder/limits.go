@@ -0,0 +1,64 @@
+package builder
+
+import (
+	"fmt"
+	"strconv"
+
+	"vddk-builder/pkg/config"
+)
+
+// cpuPeriod is the CFS period, in microseconds, BUILD_CPU_LIMIT is converted against.
+const cpuPeriod = 100000
+
+// ResourceLimits are the resources the containers of a build may use.
+type ResourceLimits struct {
+	Memory  string   `json:"memory,omitempty"`  // Memory limit such as "4g"
+	CPUs    float64  `json:"cpus,omitempty"`    // Number of CPUs
+	Pids    int      `json:"pids,omitempty"`    // Maximum number of processes
+	Ulimits []string `json:"ulimits,omitempty"` // name=soft[:hard] ulimits
+}
+
+// LimitsFor returns the resource limits configured in cfg, or nil if none is.
+func LimitsFor(cfg *config.Config) *ResourceLimits {
+	limits := &ResourceLimits{
+		Memory:  cfg.BuildMemoryLimit,
+		Pids:    cfg.BuildPidsLimit,
+		Ulimits: cfg.BuildUlimits,
+	}
+	if cfg.BuildCPULimit != "" {
+		// Validate already rejected limits that do not parse
+		limits.CPUs, _ = config.ParseCPUs(cfg.BuildCPULimit)
+	}
+	if limits.Memory == "" && limits.CPUs == 0 && limits.Pids == 0 && len(limits.Ulimits) == 0 {
+		return nil
+	}
+	return limits
+}
+
+// flags returns the build flags enforcing the limits, none for nil limits.
+func (l *ResourceLimits) flags() []string {
+	if l == nil {
+		return nil
+	}
+	var flags []string
+	if l.Memory != "" {
+		flags = append(flags, "--memory", l.Memory)
+	}
+	if l.CPUs > 0 {
+		flags = append(flags,
+			"--cpu-period", strconv.Itoa(cpuPeriod),
+			"--cpu-quota", strconv.Itoa(int(l.CPUs*cpuPeriod)))
+	}
+	if l.Pids > 0 {
+		flags = append(flags, "--pids-limit", strconv.Itoa(l.Pids))
+	}
+	for _, ulimit := range l.Ulimits {
+		flags = append(flags, "--ulimit", ulimit)
+	}
+	return flags
+}
+
+// String summarizes the limits for the build log.
+func (l *ResourceLimits) String() string {
+	return fmt.Sprintf("memory=%q cpus=%g pids=%d ulimits=%v", l.Memory, l.CPUs, l.Pids, l.Ulimits)
+}
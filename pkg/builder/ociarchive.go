@@ -0,0 +1,113 @@
+package builder
+
+import (
+	"archive/tar"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"vddk-builder/pkg/config"
+)
+
+// writeOutputArchive writes the locally built image to OUTPUT_DIR as an OCI archive named
+// after the image, its tag and the build ID, and returns the archive path and the manifest
+// digest recorded in its index. Manifest lists are written with every platform image. The
+// archive is written to a partial file first, so an interrupted export never looks complete.
+func writeOutputArchive(ctx context.Context, cfg *config.Config, req BuildRequest, eng engine, image string, multiArch bool, imageIDs []string) (string, string, error) {
+	path := filepath.Join(cfg.OutputDir, outputArchiveName(cfg, image, req.BuildID))
+	if err := checkFreeSpace(cfg.OutputDir, localImageSize(ctx, req.Runner, eng, imageIDs)); err != nil {
+		return "", "", err
+	}
+
+	partial := path + PartialSuffix
+	tool, args := eng.exportCommand(image, partial)
+	if multiArch {
+		if eng.remote() {
+			return "", "", fmt.Errorf("multi-platform images cannot be written to an OCI archive by a remote podman service")
+		}
+		tool, args = eng.name, eng.command("manifest", "push", "--all", image, "oci-archive:"+partial)
+	}
+	if err := runCommand(ctx, req.Runner, outputSink(req.Output, tool), tool, args...); err != nil {
+		os.Remove(partial)
+		return "", "", fmt.Errorf("write OCI archive: %w", err)
+	}
+	digest, err := ociArchiveDigest(partial)
+	if err != nil {
+		os.Remove(partial)
+		return "", "", err
+	}
+	if err := os.Rename(partial, path); err != nil {
+		os.Remove(partial)
+		return "", "", fmt.Errorf("failed to move OCI archive into place: %w", err)
+	}
+	return path, digest, nil
+}
+
+// outputArchiveName returns <image>-<tag>-<buildID>.tar for the image reference, with the
+// registry left out and slashes in the repository replaced.
+func outputArchiveName(cfg *config.Config, image, buildID string) string {
+	name, _, _ := strings.Cut(strings.TrimPrefix(image, cfg.ImageRegistry+"/"), "@")
+	tag := "latest"
+	if i := strings.LastIndex(name, ":"); i > strings.LastIndex(name, "/") {
+		name, tag = name[:i], name[i+1:]
+	}
+	return fmt.Sprintf("%s-%s-%s.tar", strings.ReplaceAll(name, "/", "_"), tag, buildID)
+}
+
+// ociArchiveDigest returns the digest of the first manifest listed in the index.json of
+// the OCI archive at path.
+func ociArchiveDigest(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", fmt.Errorf("failed to open OCI archive: %w", err)
+	}
+	defer f.Close()
+
+	tr := tar.NewReader(f)
+	for {
+		header, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			return "", fmt.Errorf("OCI archive has no index.json")
+		}
+		if err != nil {
+			return "", fmt.Errorf("failed to read OCI archive: %w", err)
+		}
+		if strings.TrimPrefix(header.Name, "./") != "index.json" {
+			continue
+		}
+		var index struct {
+			Manifests []struct {
+				Digest string `json:"digest"`
+			} `json:"manifests"`
+		}
+		if err := json.NewDecoder(tr).Decode(&index); err != nil {
+			return "", fmt.Errorf("failed to parse index.json of OCI archive: %w", err)
+		}
+		if len(index.Manifests) == 0 || index.Manifests[0].Digest == "" {
+			return "", fmt.Errorf("index.json of OCI archive lists no manifest")
+		}
+		return index.Manifests[0].Digest, nil
+	}
+}
+
+// checkFreeSpace fails when the file system holding dir has less than need bytes
+// available. An unknown need, or a file system that cannot be queried, is not checked.
+func checkFreeSpace(dir string, need int64) error {
+	if need <= 0 {
+		return nil
+	}
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(dir, &stat); err != nil {
+		return nil
+	}
+	if free := uint64(stat.Bavail) * uint64(stat.Bsize); free < uint64(need) {
+		return fmt.Errorf("not enough space in %s for the OCI archive: %d bytes free, about %d needed", dir, free, need)
+	}
+	return nil
+}
@@ -0,0 +1,124 @@
+package builder
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+)
+
+// outputTailSize is how much of a command's output is kept for error messages.
+const outputTailSize = 16 << 10
+
+// CommandError reports a failed podman or skopeo invocation together with the end of
+// its output.
+type CommandError struct {
+	Name     string // Command that failed
+	ExitCode int    // Exit code, -1 if the process was killed or did not start
+	Err      error
+	Tail     string // Last outputTailSize bytes of combined stdout and stderr
+}
+
+func (e *CommandError) Error() string {
+	if e.ExitCode < 0 {
+		return fmt.Sprintf("%s failed: %v\n%s", e.Name, e.Err, e.Tail)
+	}
+	return fmt.Sprintf("%s exited with code %d\n%s", e.Name, e.ExitCode, e.Tail)
+}
+
+func (e *CommandError) Unwrap() error { return e.Err }
+
+// runCommand runs name with args through runner, passing every output line to onLine as
+// it is produced and keeping only a bounded tail in memory for the returned *CommandError.
+func runCommand(ctx context.Context, runner Runner, onLine func(line string), name string, args ...string) error {
+	return runCommandEnv(ctx, runner, nil, onLine, name, args...)
+}
+
+// runCommandEnv is runCommand with env added to the environment of the command.
+func runCommandEnv(ctx context.Context, runner Runner, env []string, onLine func(line string), name string, args ...string) error {
+	return runCommandStdout(ctx, runner, env, nil, onLine, name, args...)
+}
+
+// runCommandStdout is runCommandEnv writing the standard output of the command to stdout
+// instead of onLine, unless stdout is nil.
+func runCommandStdout(ctx context.Context, runner Runner, env []string, stdout io.Writer, onLine func(line string), name string, args ...string) error {
+	if runner == nil {
+		runner = ExecRunner{}
+	}
+	tail := &tailBuffer{max: outputTailSize}
+	lines := &lineWriter{onLine: onLine}
+	out := io.MultiWriter(tail, lines)
+	if stdout == nil {
+		stdout = out
+	}
+
+	err := runner.Run(ctx, name, args, env, stdout, out)
+	lines.flush()
+	if err == nil {
+		return nil
+	}
+
+	exitCode := -1
+	var exitErr interface{ ExitCode() int }
+	if errors.As(err, &exitErr) {
+		exitCode = exitErr.ExitCode()
+	}
+	return &CommandError{Name: name, ExitCode: exitCode, Err: err, Tail: string(tail.buf)}
+}
+
+// outputSink returns a line handler that writes command output to w, or to the server
+// log when w is nil, prefixed with the command name.
+func outputSink(w io.Writer, name string) func(line string) {
+	if w == nil {
+		return func(line string) { log.Printf("%s: %s\n", name, line) }
+	}
+	return func(line string) { fmt.Fprintf(w, "%s: %s\n", name, line) }
+}
+
+// tailBuffer keeps the last max bytes written to it.
+type tailBuffer struct {
+	buf []byte
+	max int
+}
+
+func (t *tailBuffer) Write(p []byte) (int, error) {
+	t.buf = append(t.buf, p...)
+	if len(t.buf) > t.max {
+		t.buf = append(t.buf[:0], t.buf[len(t.buf)-t.max:]...)
+	}
+	return len(p), nil
+}
+
+// lineWriter splits its input into lines and hands each one to onLine.
+type lineWriter struct {
+	partial []byte
+	onLine  func(line string)
+}
+
+func (l *lineWriter) Write(p []byte) (int, error) {
+	l.partial = append(l.partial, p...)
+	for {
+		i := bytes.IndexByte(l.partial, '\n')
+		if i < 0 {
+			break
+		}
+		l.onLine(string(bytes.TrimRight(l.partial[:i], "\r")))
+		l.partial = l.partial[i+1:]
+	}
+	// A progress bar without newlines must not grow the buffer without bound
+	if len(l.partial) > outputTailSize {
+		l.onLine(string(l.partial))
+		l.partial = l.partial[:0]
+	}
+	return len(p), nil
+}
+
+// flush passes a final line without a trailing newline to onLine.
+func (l *lineWriter) flush() {
+	if len(l.partial) > 0 {
+		l.onLine(string(l.partial))
+		l.partial = nil
+	}
+}
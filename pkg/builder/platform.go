@@ -0,0 +1,83 @@
+package builder
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// platformPattern matches an os/arch[/variant] platform such as linux/arm64.
+var platformPattern = regexp.MustCompile(`^[a-z0-9]+/[a-z0-9_]+(/[a-z0-9]+)?$`)
+
+// ValidatePlatforms checks that each entry of platforms is of the form os/arch[/variant]
+// and appears only once.
+func ValidatePlatforms(platforms []string) error {
+	for i, platform := range platforms {
+		if !platformPattern.MatchString(platform) {
+			return fmt.Errorf("%q is not of the form os/arch[/variant]", platform)
+		}
+		if slices.Contains(platforms[:i], platform) {
+			return fmt.Errorf("platform %s is listed twice", platform)
+		}
+	}
+	return nil
+}
+
+// buildManifest builds the image once per platform and adds each build to the local
+// manifest list named manifest, replacing a list of that name left by an earlier build.
+// flags are passed to every podman build. It returns the IDs of the images built so far.
+func buildManifest(ctx context.Context, runner Runner, eng engine, workDir, manifest string, platforms, flags []string, containerfile, contextDir string, steps *int, report ProgressFunc, out io.Writer) ([]string, error) {
+	if !eng.supportsManifests() {
+		return nil, fmt.Errorf("multi-arch builds need podman or buildah, BUILD_ENGINE is %s", eng.name)
+	}
+	sink := outputSink(out, eng.name)
+	if err := eng.run(ctx, runner, sink, "manifest", "exists", manifest); err == nil {
+		if err := eng.run(ctx, runner, sink, "manifest", "rm", manifest); err != nil {
+			return nil, fmt.Errorf("remove previous manifest list: %w", err)
+		}
+	}
+	if err := eng.run(ctx, runner, sink, "manifest", "create", manifest); err != nil {
+		return nil, fmt.Errorf("create manifest list: %w", err)
+	}
+
+	var imageIDs []string
+	for i, platform := range platforms {
+		log.Printf("Building image for %s (%d/%d)...\n", platform, i+1, len(platforms))
+		iidFile := filepath.Join(workDir, fmt.Sprintf("image-%d.iid", i))
+		platformFlags := append(slices.Clone(flags), "--platform", platform, "--manifest", manifest, "--iidfile", iidFile)
+		err := emulationError(buildImage(ctx, runner, eng, platformFlags, containerfile, contextDir, steps, report, out), platform)
+		if id := readImageID(iidFile); id != "" {
+			imageIDs = append(imageIDs, id)
+		}
+		if err != nil {
+			return imageIDs, fmt.Errorf("platform %s: %w", platform, err)
+		}
+	}
+	return imageIDs, nil
+}
+
+// platformOverrides returns the skopeo flags selecting platform from a multi-platform source.
+func platformOverrides(platform string) []string {
+	parts := strings.Split(platform, "/")
+	flags := []string{"--override-os", parts[0], "--override-arch", parts[1]}
+	if len(parts) == 3 {
+		flags = append(flags, "--override-variant", parts[2])
+	}
+	return flags
+}
+
+// emulationError explains a podman build failure for a foreign platform caused by missing
+// qemu-user-static emulation, and returns any other err unchanged.
+func emulationError(err error, platform string) error {
+	var cmdErr *CommandError
+	if platform == "" || !errors.As(err, &cmdErr) || !strings.Contains(cmdErr.Tail, "exec format error") {
+		return err
+	}
+	return fmt.Errorf("building for %s requires qemu-user-static emulation on the builder, the build failed with \"exec format error\": %w", platform, err)
+}
@@ -0,0 +1,110 @@
+package builder
+
+import (
+	"io"
+	"regexp"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Build phases reported through a ProgressFunc.
+const (
+	PhaseExtracting = "extracting"
+	PhaseBuilding   = "building"
+	PhasePushing    = "pushing"
+	PhaseSigning    = "signing"
+	PhaseSBOM       = "sbom"
+	PhaseScanning   = "scanning"
+)
+
+// ProgressFunc receives the current build phase and the completed fraction of that
+// phase, between 0 and 1. It is called from the build goroutine and must not block.
+type ProgressFunc func(phase string, progress float64)
+
+// report calls fn if it is set.
+func (fn ProgressFunc) report(phase string, progress float64) {
+	if fn != nil {
+		fn(phase, min(max(progress, 0), 1))
+	}
+}
+
+// pushEstimateInterval is how often the push progress estimate is refreshed.
+const pushEstimateInterval = 2 * time.Second
+
+var (
+	lastPushLock     sync.Mutex
+	lastPushDuration time.Duration // Duration of the previous successful push, the basis of the estimate
+)
+
+// stepPattern matches the "STEP x/y" markers podman prints for each Containerfile instruction.
+var stepPattern = regexp.MustCompile(`^STEP (\d+)/(\d+)`)
+
+// reportStep reports build progress if line is a STEP marker, and whether it is one.
+func reportStep(report ProgressFunc, line string) bool {
+	m := stepPattern.FindStringSubmatch(line)
+	if m == nil {
+		return false
+	}
+	step, _ := strconv.Atoi(m[1])
+	total, _ := strconv.Atoi(m[2])
+	if total > 0 {
+		report.report(PhaseBuilding, float64(step-1)/float64(total))
+	}
+	return true
+}
+
+// progressReader reports the fraction of size read through it, in steps of at least 1%.
+type progressReader struct {
+	r        io.Reader
+	size     int64
+	read     int64
+	reported float64
+	phase    string
+	report   ProgressFunc
+}
+
+func (p *progressReader) Read(buf []byte) (int, error) {
+	n, err := p.r.Read(buf)
+	p.read += int64(n)
+	if p.size > 0 {
+		if fraction := float64(p.read) / float64(p.size); fraction-p.reported >= 0.01 {
+			p.reported = fraction
+			p.report.report(p.phase, fraction)
+		}
+	}
+	return n, err
+}
+
+// estimatePush reports push progress as the elapsed time against the duration of the
+// previous push until stop is closed. skopeo prints no usable progress without a
+// terminal, so the estimate is capped below completion.
+func estimatePush(report ProgressFunc, stop <-chan struct{}) {
+	lastPushLock.Lock()
+	expected := lastPushDuration
+	lastPushLock.Unlock()
+
+	report.report(PhasePushing, 0)
+	if expected <= 0 || report == nil {
+		return
+	}
+
+	start := time.Now()
+	ticker := time.NewTicker(pushEstimateInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			report.report(PhasePushing, min(float64(time.Since(start))/float64(expected), 0.95))
+		}
+	}
+}
+
+// recordPushDuration remembers d as the basis for the next push estimate.
+func recordPushDuration(d time.Duration) {
+	lastPushLock.Lock()
+	lastPushDuration = d
+	lastPushLock.Unlock()
+}
@@ -0,0 +1,139 @@
+package builder
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"vddk-builder/pkg/config"
+	"vddk-builder/pkg/registry"
+)
+
+// PromoteRequest describes the copy of an image from one registry to another.
+type PromoteRequest struct {
+	WorkDir     string       // Private work directory holding the auth files and certificates
+	Source      string       // Reference of the image to copy, tagged or pinned by digest
+	Destination string       // Tagged reference the image is copied to
+	AuthToken   string       // Token of the caller, only offered to the primary registry
+	Progress    ProgressFunc // Receives the pushing phase, optional
+	Output      io.Writer    // Receives skopeo output line by line, the server log if nil
+	Runner      Runner       // Runs skopeo, an ExecRunner if nil
+}
+
+// PromoteResult reports the outcome of a promotion.
+type PromoteResult struct {
+	Digest  string // Manifest digest of the destination image, empty if skopeo cannot report it
+	Retries int    // Repeated copy attempts after transient failures
+}
+
+// PromoteImage copies req.Source to req.Destination with skopeo, together with every image
+// of a manifest list, so the destination serves the digest that was validated. Each
+// registry is reached with its own credentials from REGISTRY_AUTH_CONFIG and its TLS
+// settings; the caller's token is only sent to the primary registry. Failures are
+// retried like pushes and the copied digest is verified when VERIFY_PUSH is set.
+func PromoteImage(ctx context.Context, cfg *config.Config, req PromoteRequest) (PromoteResult, error) {
+	var result PromoteResult
+	source, err := registry.ParseReference(req.Source)
+	if err != nil {
+		return result, fmt.Errorf("invalid source: %w", err)
+	}
+	dest, err := registry.ParseReference(req.Destination)
+	if err != nil {
+		return result, fmt.Errorf("invalid destination: %w", err)
+	}
+
+	args := []string{"copy", "--all"}
+	for _, side := range []struct {
+		prefix string
+		host   string
+	}{{"--src-", source.Registry}, {"--dest-", dest.Registry}} {
+		flags, remove, err := promoteFlags(cfg, req, side.prefix, side.host)
+		if err != nil {
+			return result, &PushError{Err: err}
+		}
+		defer remove()
+		args = append(args, flags...)
+	}
+
+	digestFile, err := os.CreateTemp(req.WorkDir, "digest-")
+	if err != nil {
+		return result, fmt.Errorf("create digest file: %w", err)
+	}
+	digestFile.Close()
+	defer os.Remove(digestFile.Name())
+
+	sink := outputSink(req.Output, "skopeo")
+	err = retryPush(ctx, cfg, req.Destination, &result.Retries, func() error {
+		stop := make(chan struct{})
+		go estimatePush(req.Progress, stop)
+		defer close(stop)
+		start := time.Now()
+
+		copyArgs := append(args, "--digestfile", digestFile.Name(), "docker://"+req.Source, "docker://"+req.Destination)
+		copyErr := runCommand(ctx, req.Runner, sink, "skopeo", copyArgs...)
+		var cmdErr *CommandError
+		if errors.As(copyErr, &cmdErr) && strings.Contains(cmdErr.Tail, "--digestfile") {
+			// Older skopeo releases lack --digestfile; copy without learning the digest
+			log.Println("skopeo does not support --digestfile, the promoted digest will be unknown")
+			copyArgs = append(args, "docker://"+req.Source, "docker://"+req.Destination)
+			copyErr = runCommand(ctx, req.Runner, sink, "skopeo", copyArgs...)
+		}
+		if copyErr != nil {
+			return explainCertError(dest.Registry, explainCertError(source.Registry, copyErr))
+		}
+		recordPushDuration(time.Since(start))
+
+		digest, err := os.ReadFile(digestFile.Name())
+		if err != nil {
+			return fmt.Errorf("read digest file: %w", err)
+		}
+		result.Digest = strings.TrimSpace(string(digest))
+		if result.Digest == "" || !cfg.VerifyPush {
+			return nil
+		}
+		authToken := ""
+		if dest.Registry == cfg.ImageRegistry {
+			authToken = req.AuthToken
+		}
+		if verifyErr := verifyPushedDigest(ctx, dest.Registry, req.Destination, authToken, result.Digest); verifyErr != nil {
+			return &VerifyPushError{Err: verifyErr}
+		}
+		return nil
+	})
+	if err != nil {
+		return result, &PushError{Err: err}
+	}
+	return result, nil
+}
+
+// promoteFlags returns the skopeo flags, each starting with prefix, that authenticate to and
+// verify host as described by the configuration. remove deletes the files they refer to.
+func promoteFlags(cfg *config.Config, req PromoteRequest, prefix, host string) (flags []string, remove func(), err error) {
+	tlsVerify := cfg.RegistryTLSVerify && !registry.IsInsecure(host)
+	flags = []string{fmt.Sprintf("%stls-verify=%t", prefix, tlsVerify)}
+	if tlsVerify && cfg.RegistryCABundle != "" {
+		certDir, err := prepareCertDir(req.WorkDir, cfg.RegistryCABundle)
+		if err != nil {
+			return nil, nil, err
+		}
+		flags = append(flags, prefix+"cert-dir", certDir)
+	}
+
+	authToken := ""
+	if host == cfg.ImageRegistry {
+		authToken = req.AuthToken
+	}
+	authFile, remove, err := authFileFor(req.WorkDir, host, authToken, cfg.RegistryAuthConfig)
+	if err != nil {
+		return nil, nil, err
+	}
+	if authFile != "" {
+		flags = append(flags, prefix+"authfile", authFile)
+	}
+	return flags, remove, nil
+}
@@ -0,0 +1,72 @@
+package builder
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand/v2"
+	"regexp"
+	"time"
+
+	"vddk-builder/pkg/config"
+)
+
+var (
+	// transientPattern matches skopeo output of failures worth retrying: network errors
+	// and 5xx answers, such as those seen while the registry pod restarts.
+	transientPattern = regexp.MustCompile(`(?i)(connection refused|connection reset|broken pipe|i/o timeout|TLS handshake timeout|unexpected EOF|no such host|\b50[0-4]\b|bad gateway|service unavailable|gateway timeout|internal server error)`)
+	// permanentPattern matches authentication and authorization failures, never retried.
+	permanentPattern = regexp.MustCompile(`(?i)(unauthorized|authentication required|denied|forbidden|\b40[13]\b)`)
+)
+
+// isTransient reports whether err from a skopeo copy looks like it may succeed on retry. A
+// failed post-push verification always may.
+func isTransient(err error) bool {
+	var verifyErr *VerifyPushError
+	if errors.As(err, &verifyErr) {
+		return true
+	}
+	var cmdErr *CommandError
+	if !errors.As(err, &cmdErr) {
+		return false
+	}
+	return transientPattern.MatchString(cmdErr.Tail) && !permanentPattern.MatchString(cmdErr.Tail)
+}
+
+// retryPush runs push up to PUSH_RETRIES times while it fails with transient errors,
+// waiting PUSH_RETRY_BACKOFF, doubled after every attempt and with up to 50% jitter added,
+// between attempts. Every repeated attempt is counted in retries. The returned error
+// includes the errors of every attempt.
+func retryPush(ctx context.Context, cfg *config.Config, what string, retries *int, push func() error) error {
+	attempts := max(cfg.PushRetries, 1)
+	backoff := cfg.PushRetryBackoff
+	var errs []error
+	for attempt := 1; ; attempt++ {
+		err := push()
+		if err == nil {
+			return nil
+		}
+		errs = append(errs, fmt.Errorf("attempt %d: %w", attempt, err))
+		if attempt == attempts || !isTransient(err) {
+			break
+		}
+
+		wait := backoff
+		if backoff > 0 {
+			wait += rand.N(backoff/2 + 1)
+		}
+		log.Printf("Attempt %d/%d to push %s failed, retrying in %s: %v\n", attempt, attempts, what, wait.Round(time.Millisecond), err)
+		*retries++
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return errors.Join(append(errs, ctx.Err())...)
+		}
+		backoff *= 2
+	}
+	if len(errs) == 1 {
+		return errors.Unwrap(errs[0])
+	}
+	return fmt.Errorf("push failed after %d attempts: %w", len(errs), errors.Join(errs...))
+}
@@ -0,0 +1,32 @@
+package builder
+
+import (
+	"context"
+	"io"
+	"os"
+	"os/exec"
+)
+
+// Runner runs the external commands of a build, podman, skopeo and cosign. env holds
+// KEY=VALUE pairs added to the environment of the command, used for secrets that must not
+// appear in args. Implementations return an error with an ExitCode() int method when the
+// command exits non-zero.
+type Runner interface {
+	Run(ctx context.Context, name string, args, env []string, stdout, stderr io.Writer) error
+}
+
+// ExecRunner runs commands as local processes, killed when ctx is done.
+type ExecRunner struct{}
+
+// Run starts name with args, in the server's environment extended with env, and waits
+// for it to exit.
+func (ExecRunner) Run(ctx context.Context, name string, args, env []string, stdout, stderr io.Writer) error {
+	cmd := exec.CommandContext(ctx, name, args...)
+	cmd.WaitDelay = cmdWaitDelay
+	if len(env) > 0 {
+		cmd.Env = append(os.Environ(), env...)
+	}
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+	return cmd.Run()
+}
@@ -0,0 +1,101 @@
+package builder
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"vddk-builder/pkg/config"
+	"vddk-builder/pkg/registry"
+)
+
+// SPDXMediaType is the media type of the SBOMs generated by syft and attached to images.
+const SPDXMediaType = "application/spdx+json"
+
+// generateSBOM writes an SPDX JSON SBOM of the local image to req.SBOMPath with syft and
+// returns the digest of the SBOM file. The image is exported to an OCI archive first so
+// syft does not need to know about the build engine.
+func generateSBOM(ctx context.Context, cfg *config.Config, req BuildRequest, eng engine, image string) (string, error) {
+	req.Progress.report(PhaseSBOM, 0)
+	archive, err := exportLocalImage(ctx, req, eng, image, "sbom-image.tar")
+	if err != nil {
+		return "", fmt.Errorf("export image for syft: %w", err)
+	}
+	defer os.Remove(archive)
+
+	args := []string{"scan", "oci-archive:" + archive, "-o", "spdx-json=" + req.SBOMPath}
+	if err := runCommand(ctx, req.Runner, outputSink(req.Output, "syft"), cfg.SyftPath, args...); err != nil {
+		return "", fmt.Errorf("generate SBOM: %w", err)
+	}
+	return fileDigest(req.SBOMPath)
+}
+
+// attachSBOM pushes the SBOM at req.SBOMPath with oras as an OCI artifact referring to the
+// manifest digest pushed as image.
+func attachSBOM(ctx context.Context, cfg *config.Config, req BuildRequest, image, digest string) error {
+	if digest == "" {
+		return fmt.Errorf("the pushed digest of %s is unknown", image)
+	}
+
+	args := []string{"attach", "--artifact-type", SPDXMediaType, "--disable-path-validation"}
+	if registry.IsPlainHTTP(cfg.ImageRegistry) {
+		args = append(args, "--plain-http")
+	} else if !cfg.RegistryTLSVerify || registry.IsInsecure(cfg.ImageRegistry) {
+		args = append(args, "--insecure")
+	} else if cfg.RegistryCABundle != "" {
+		args = append(args, "--ca-file", cfg.RegistryCABundle)
+	}
+	authFile, removeAuthFile, err := authFileFor(req.WorkDir, cfg.ImageRegistry, req.AuthToken, cfg.RegistryAuthConfig)
+	if err != nil {
+		return err
+	}
+	defer removeAuthFile()
+	if authFile != "" {
+		args = append(args, "--registry-config", authFile)
+	}
+	args = append(args, digestReference(image, digest), req.SBOMPath+":"+SPDXMediaType)
+
+	if err := runCommand(ctx, req.Runner, outputSink(req.Output, "oras"), cfg.OrasPath, args...); err != nil {
+		return fmt.Errorf("attach SBOM: %w", err)
+	}
+	return nil
+}
+
+// fileDigest returns the sha256 digest of the file at path.
+func fileDigest(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return "sha256:" + hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// exportLocalImage writes the local image to an OCI archive of the given name in the work
+// directory, for tools that inspect images without access to the engine's storage.
+func exportLocalImage(ctx context.Context, req BuildRequest, eng engine, image, name string) (string, error) {
+	archive := filepath.Join(req.WorkDir, name)
+	tool, args := eng.exportCommand(image, archive)
+	if err := runCommand(ctx, req.Runner, outputSink(req.Output, tool), tool, args...); err != nil {
+		os.Remove(archive)
+		return "", err
+	}
+	return archive, nil
+}
+
+// localImageByID returns how the engine's storage refers to the local image with id.
+func (e engine) localImageByID(id string) string {
+	if e.remote() {
+		return id
+	}
+	return "@" + strings.TrimPrefix(id, "sha256:")
+}
@@ -0,0 +1,98 @@
+package builder
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+
+	"vddk-builder/pkg/config"
+)
+
+// Severities ranked from least to most severe, as named in SCAN_FAIL_ON and scan counts.
+var severities = []string{"unknown", "low", "medium", "high", "critical"}
+
+// scanReport is the part of a trivy JSON report the gate reads.
+type scanReport struct {
+	Results []struct {
+		Vulnerabilities []struct {
+			Severity string `json:"Severity"`
+		} `json:"Vulnerabilities"`
+	} `json:"Results"`
+}
+
+// scanImage runs SCAN_COMMAND against an OCI archive of the local image, appended as its
+// last argument, and writes the JSON report it prints to req.ScanReportPath. It returns
+// the vulnerability counts by severity, and an error when the findings at or above
+// SCAN_FAIL_ON exceed SCAN_MAX_FINDINGS.
+func scanImage(ctx context.Context, cfg *config.Config, req BuildRequest, eng engine, image string) (map[string]int, error) {
+	req.Progress.report(PhaseScanning, 0)
+	archive, err := exportLocalImage(ctx, req, eng, image, "scan-image.tar")
+	if err != nil {
+		return nil, fmt.Errorf("export image for the scanner: %w", err)
+	}
+	defer os.Remove(archive)
+
+	report, err := os.OpenFile(req.ScanReportPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("create scan report: %w", err)
+	}
+	defer report.Close()
+
+	command := strings.Fields(cfg.ScanCommand)
+	args := append(command[1:], archive)
+	if err := runCommandStdout(ctx, req.Runner, nil, report, outputSink(req.Output, command[0]), command[0], args...); err != nil {
+		return nil, fmt.Errorf("run scanner: %w", err)
+	}
+	if err := report.Sync(); err != nil {
+		return nil, fmt.Errorf("write scan report: %w", err)
+	}
+
+	counts, err := countFindings(req.ScanReportPath)
+	if err != nil {
+		return nil, err
+	}
+	threshold := severityRank(cfg.ScanFailOn)
+	found := 0
+	for _, severity := range severities[threshold:] {
+		found += counts[severity]
+	}
+	if found > cfg.ScanMaxFindings {
+		return counts, fmt.Errorf("found %d vulnerabilities of severity %s or higher, at most %d are allowed", found, cfg.ScanFailOn, cfg.ScanMaxFindings)
+	}
+	return counts, nil
+}
+
+// countFindings returns the number of vulnerabilities in the report at path by severity.
+func countFindings(path string) (map[string]int, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read scan report: %w", err)
+	}
+	var report scanReport
+	if err := json.Unmarshal(data, &report); err != nil {
+		return nil, fmt.Errorf("parse scan report: %w", err)
+	}
+	counts := map[string]int{}
+	for _, result := range report.Results {
+		for _, vuln := range result.Vulnerabilities {
+			severity := strings.ToLower(vuln.Severity)
+			if severityRank(severity) == 0 {
+				severity = "unknown"
+			}
+			counts[severity]++
+		}
+	}
+	return counts, nil
+}
+
+// severityRank returns the index of severity in severities, 0 for unknown ones.
+func severityRank(severity string) int {
+	for i, s := range severities {
+		if s == severity {
+			return i
+		}
+	}
+	return 0
+}
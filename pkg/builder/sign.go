@@ -0,0 +1,69 @@
+package builder
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+
+	"vddk-builder/pkg/config"
+	"vddk-builder/pkg/registry"
+)
+
+// Signature states recorded in BuildResult.Signature.
+const (
+	SignatureSigned = "signed"
+	SignatureFailed = "failed"
+)
+
+// signImage signs the manifest digest pushed as image with cosign, using the key at
+// COSIGN_KEY_PATH, and uploads the signature next to it. The key password is read from
+// COSIGN_PASSWORD_FILE and handed to cosign through its environment only.
+func signImage(ctx context.Context, cfg *config.Config, req BuildRequest, image, digest string) error {
+	if digest == "" {
+		return fmt.Errorf("the pushed digest of %s is unknown", image)
+	}
+
+	var env []string
+	if cfg.CosignPasswordFile != "" {
+		password, err := os.ReadFile(cfg.CosignPasswordFile)
+		if err != nil {
+			return fmt.Errorf("failed to read cosign password file: %w", err)
+		}
+		env = append(env, "COSIGN_PASSWORD="+strings.TrimRight(string(password), "\r\n"))
+	} else {
+		// An unencrypted key still makes cosign ask for a password unless one is set
+		env = append(env, "COSIGN_PASSWORD=")
+	}
+
+	args := []string{"sign", "--yes", "--key", cfg.CosignKeyPath}
+	if !cfg.RegistryTLSVerify || registry.IsInsecure(cfg.ImageRegistry) {
+		args = append(args, "--allow-insecure-registry")
+	} else if cfg.RegistryCABundle != "" {
+		env = append(env, "SSL_CERT_FILE="+cfg.RegistryCABundle)
+	}
+	authFile, removeAuthFile, err := authFileFor(req.WorkDir, cfg.ImageRegistry, req.AuthToken, cfg.RegistryAuthConfig)
+	if err != nil {
+		return err
+	}
+	defer removeAuthFile()
+	if authFile != "" {
+		env = append(env, "REGISTRY_AUTH_FILE="+authFile)
+	}
+	args = append(args, digestReference(image, digest))
+
+	req.Progress.report(PhaseSigning, 0)
+	if err := runCommandEnv(ctx, req.Runner, env, outputSink(req.Output, "cosign"), "cosign", args...); err != nil {
+		return fmt.Errorf("sign image: %w", err)
+	}
+	return nil
+}
+
+// digestReference replaces the tag of image, if any, with digest.
+func digestReference(image, digest string) string {
+	name := image
+	if i := strings.LastIndex(image, ":"); i > strings.LastIndex(image, "/") {
+		name = image[:i]
+	}
+	return name + "@" + digest
+}
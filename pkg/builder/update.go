@@ -0,0 +1,33 @@
+package builder
+
+import (
+	"context"
+	"fmt"
+	"log"
+
+	"vddk-builder/pkg/config"
+	"vddk-builder/pkg/k8spermissions"
+	"vddk-builder/pkg/registry"
+)
+
+// updateTarget applies the reference of the image pushed to the primary registry, pinned by
+// its digest, to the UPDATE_TARGET field and returns that reference.
+func updateTarget(ctx context.Context, cfg *config.Config, result BuildResult) (string, error) {
+	if result.Digest == "" {
+		return "", fmt.Errorf("the pushed digest of %s is unknown", result.Image)
+	}
+	target, err := k8spermissions.ParseUpdateTarget(cfg.UpdateTarget)
+	if err != nil {
+		return "", err
+	}
+	ref, err := registry.ParseReference(result.Pushes[0].Image)
+	if err != nil {
+		return "", err
+	}
+	ref.Tag, ref.Digest = "", result.Digest
+	if err := k8spermissions.ApplyImageReference(ctx, target, ref.String()); err != nil {
+		return "", err
+	}
+	log.Printf("Set %s to %s\n", target, ref)
+	return ref.String(), nil
+}
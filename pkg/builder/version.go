@@ -0,0 +1,46 @@
+package builder
+
+import (
+	"io/fs"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// versionSearchDepth bounds how deep below the build context version markers are searched.
+const versionSearchDepth = 3
+
+// versionPatterns match file and directory names that carry the VDDK release, such as
+// vmware-vix-disklib-8.0.2-22115066 or libvixDiskLib.so.8.0.2.
+var versionPatterns = []*regexp.Regexp{
+	regexp.MustCompile(`^(?i)vmware-vix-disklib-(\d+\.\d+\.\d+)`),
+	regexp.MustCompile(`^libvixDiskLib\.so\.(\d+\.\d+\.\d+)$`),
+}
+
+// detectVersion returns the VDDK release found in the names below contextDir, or an
+// empty string.
+func detectVersion(contextDir string) string {
+	var version string
+	filepath.WalkDir(contextDir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, _ := filepath.Rel(contextDir, path)
+		if d.IsDir() && rel != "." && strings.Count(rel, string(filepath.Separator)) >= versionSearchDepth {
+			return filepath.SkipDir
+		}
+		for _, pattern := range versionPatterns {
+			if m := pattern.FindStringSubmatch(d.Name()); m != nil {
+				version = m[1]
+				return filepath.SkipAll
+			}
+		}
+		return nil
+	})
+	return version
+}
+
+// HasTag reports whether imageName carries an explicit tag or digest.
+func HasTag(imageName string) bool {
+	return strings.ContainsAny(imageName[strings.LastIndex(imageName, "/")+1:], ":@")
+}
@@ -1,56 +1,1042 @@
 package config
 
 import (
+	"errors"
+	"fmt"
+	"net/netip"
+	"net/url"
 	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"slices"
 	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	memoryQuantity = regexp.MustCompile(`^[0-9]+[bkmgBKMG]?$`)
+	ulimitSpec     = regexp.MustCompile(`^[a-z]+=-?[0-9]+(:-?[0-9]+)?$`)
+
+	// statusNamePrefix leaves room for the build ID in a 253 character object name
+	statusNamePrefix = regexp.MustCompile(`^[a-z0-9][-a-z0-9.]{0,200}$`)
+)
+
+// Layer compression formats accepted by PUSH_COMPRESSION.
+const (
+	CompressionGzip        = "gzip"
+	CompressionZstd        = "zstd"
+	CompressionZstdChunked = "zstd:chunked"
+)
+
+// Build engines accepted by BUILD_ENGINE.
+const (
+	EnginePodman  = "podman"
+	EngineDocker  = "docker"
+	EngineBuildah = "buildah"
+)
+
+// Build modes accepted by BUILD_MODE.
+const (
+	BuildModeLocal = "local"
+	BuildModeJob   = "job"
+)
+
+// Status objects accepted by STATUS_REPORTING.
+const (
+	StatusReportingConfigMap = "configmap"
+	StatusReportingResource  = "resource"
+)
+
+// Output modes accepted by OUTPUT_MODE.
+const (
+	OutputModeRegistry = "registry"
+	OutputModeArchive  = "archive"
+)
+
+// Push credential modes accepted by PUSH_CREDENTIALS_MODE.
+const (
+	PushCredentialsCaller         = "caller"
+	PushCredentialsServiceAccount = "serviceaccount"
+	PushCredentialsAuthFile       = "authfile"
+)
+
+// Authentication modes accepted by AUTH_MODE.
+const (
+	AuthModeNone       = "none"
+	AuthModeToken      = "token"
+	AuthModeKubernetes = "kubernetes"
+
+	AuthPolicyAllowList = "allowlist"
+	AuthPolicyAny       = "any"
+	AuthPolicyAll       = "all"
 )
 
 type Config struct {
-	ImageName     string
-	CAPublicKey   string
-	PrivateKey    string
-	ServerPort    string
-	UploadDir     string
-	ImageRegistry string
-	RequireAuth   bool
+	ImageName        string
+	DefaultNamespace string
+	CAPublicKey      string
+	PrivateKey       string
+	ServerPort       string
+	UploadDir        string
+	WorkDir          string
+	ImageRegistry    string
+	ImageRegistries  []string
+	RequireAuth      bool
+	AuthMode         string
+	AuthTokensFile   string
+	AuthExemptPaths  []string
+
+	Kubeconfig    string
+	KubeAPIServer string
+	KubeCABundle  string
+	KubeTLSVerify bool
+
+	AuthSARVerb        string
+	AuthSARResource    string
+	AuthSARGroup       string
+	AuthSARSubresource string
+	AuthSARNamespace   string
+	AuthSARChecks      []string
+	AuthCacheTTL       time.Duration
+
+	AuthAllowedSubjects []string
+	AuthAllowedGroups   []string
+	AuthPolicy          string
+
+	AuthRequiredAudience string
+
+	EventsEnabled bool
+	EventsTarget  string
+
+	HAEnabled        bool
+	HALeaseName      string
+	HALeaseNamespace string
+	HAAdvertiseURL   string
+
+	AllowedImagePrefixes []string
+	PolicyConfigMap      string
+
+	StatusReporting  string
+	StatusNamespace  string
+	StatusNamePrefix string
+	StatusRetention  int
+
+	RedirectHTTPPort string
+	AdminPort        string
+
+	CORSAllowedOrigins   []string
+	CORSAllowCredentials bool
+
+	AdminToken string
+
+	BuildTimeout time.Duration
+
+	ServeUI bool
+
+	StartupChecks     bool
+	StartupChecksSkip []string
+
+	TrustedProxies     []string
+	UploadAllowedCIDRs []string
+
+	ExportEnabled bool
+
+	AllowOverwrite bool
+	SkipIfExists   bool
+
+	AuditLogFile       string
+	AuditRecentEntries int
+
+	StateDir string
+
+	LogDir       string
+	LogRetention time.Duration
+	LogMaxSize   int64
+
+	OutputMode      string
+	OutputDir       string
+	OutputRetention time.Duration
+
+	QuotaUploadsPerDay    int
+	QuotaBytesPerDay      int64
+	QuotaExemptIdentities []string
+
+	StreamUploads bool
+
+	ContainerfilePath      string
+	ContainerfileTemplate  string
+	ContainerfileBaseImage string
+
+	ContainerfileDeniedPatterns []string
+
+	AllowedBaseImages    []string
+	BaseImageAllowLatest bool
+
+	TagLatest bool
+
+	BuildEngine   string
+	ContainerHost string
+
+	BuildMode         string
+	JobImage          string
+	JobServiceAccount string
+	JobNamespace      string
+	JobCPU            string
+	JobMemory         string
+	JobNodeSelector   []string
+	JobPrivileged     bool
+	JobBuilderURL     string
+
+	NoCache bool
+	Squash  bool
+
+	BuildMemoryLimit string
+	BuildCPULimit    string
+	BuildPidsLimit   int
+	BuildUlimits     []string
+
+	DryRunAllowed bool
+
+	BuildArgs        []string
+	BuildArgsAllowed []string
+
+	Platforms              []string
+	TargetPlatform         string
+	TargetPlatformsAllowed []string
+
+	ValidateContent      bool
+	ContentRequiredPaths []string
+
+	ChecksumManifest string
+
+	MaxExtractedBytes int64
+	MaxArchiveEntries int
+	MaxNestingDepth   int
+
+	ExtractIncludeGlobs []string
+
+	KeepUploads     bool
+	UploadRetention time.Duration
+
+	KeepWorkDirOnFailure bool
+	WorkDirRetention     time.Duration
+
+	RegistryAuthConfig string
+	PushAllRequired    bool
+	VerifyPush         bool
+	PushRetries        int
+	PushRetryBackoff   time.Duration
+	RegistryTLSVerify  bool
+	RegistryCABundle   string
+
+	PushCredentialsMode    string
+	PushDockercfgPath      string
+	PushCredentialsRefresh time.Duration
+
+	RegistryTimeout      time.Duration
+	RegistryRetries      int
+	RegistryRetryBackoff time.Duration
+	RegistryRateLimitMax time.Duration
+	InsecureRegistries   []string
+	RegistryInfoCatalog  bool
+	PromoteRegistries    []string
+
+	PushCompression      string
+	PushCompressionLevel int
+
+	CosignKeyPath      string
+	CosignPasswordFile string
+	SignRequired       bool
+
+	SBOMEnabled  bool
+	SyftPath     string
+	SBOMPush     bool
+	OrasPath     string
+	SBOMRequired bool
+
+	ImageStreamEnabled        bool
+	ImageStreamServiceAccount bool
+
+	UpdateTarget string
+
+	ScanEnabled     bool
+	ScanCommand     string
+	ScanFailOn      string
+	ScanMaxFindings int
+
+	PreBuildHook         string
+	PostPushHook         string
+	PostPushHookRequired bool
+	HookTimeout          time.Duration
+
+	KeepLocalImage      bool
+	PruneLocalImages    bool
+	LocalImageRetention time.Duration
+
+	fileWarnings []string // Keys of CONFIG_FILE that name no setting
 }
 
-// LoadConfig loads the configuration for the application from environment variables.
+// LoadConfig loads the configuration for the application from environment variables and
+// the YAML file named by CONFIG_FILE, if set, whose keys are the variable names in lowercase.
+// A variable set to a non-empty value overrides the file, which overrides the defaults. It
+// fails when the file cannot be read or parsed, or a value is not of the type of its
+// setting; keys of the file that name no setting are reported by Warnings.
 // It returns a pointer to a Config struct populated with the following fields:
 // - ImageName: The name of the image, defaults to "vddk" if not set.
+// - DefaultNamespace: Namespace prepended to image names without one, such as "vddk:8.0", none if not set.
 // - CAPublicKey: The path to the CA public key, defaults to "/etc/tls/server.crt" if not set.
 // - PrivateKey: The path to the private key, defaults to "/etc/tls/server.key" if not set.
 // - ServerPort: The port on which the server will run, defaults to "8443" if not set.
 // - UploadDir: The directory where uploads will be stored, defaults to "/tmp/uploads" if not set.
+// - WorkDir: The directory holding the per-build working directories, defaults to the system temporary directory if not set.
 // - ImageRegistry: The image registry URL, defaults to "image-registry.openshift-image-registry.svc:5000" if not set.
+// - ImageRegistries: Comma-separated registries the image is pushed to, the first one replacing ImageRegistry, defaults to ImageRegistry if not set.
 // - RequireAuth: Whether authentication is required, defaults to false if not set.
-func LoadConfig() *Config {
-	return &Config{
-		ImageName:     getEnv("IMAGE_NAME", "vddk"),
-		CAPublicKey:   getEnv("CA_PUBLIC_KEY", "/etc/tls/server.crt"),
-		PrivateKey:    getEnv("PRIVATE_KEY", "/etc/tls/server.key"),
-		ServerPort:    getEnv("SERVER_PORT", "8443"),
-		UploadDir:     getEnv("UPLOAD_DIR", "/tmp/uploads"),
-		ImageRegistry: getEnv("IMAGE_REGISTRY", "image-registry.openshift-image-registry.svc:5000"),
-		RequireAuth:   getEnvAsBool("REQUIRE_AUTH", false),
+// - AuthMode: One of none, token or kubernetes; defaults to kubernetes when RequireAuth is set and none otherwise.
+// - AuthTokensFile: File listing the bearer tokens accepted in token mode, one per line, defaults to "/etc/vddk-builder/tokens" if not set.
+// - AuthExemptPaths: Comma-separated endpoint paths served without authentication; every endpoint is protected if not set.
+// - Kubeconfig: Kubeconfig files used outside a cluster, separated by ':', defaults to ~/.kube/config if it exists.
+// - KubeAPIServer: Kubernetes API server the access reviews of the kubernetes auth mode go to outside a cluster without a kubeconfig, defaults to "https://kubernetes.default.svc" if not set.
+// - KubeCABundle: PEM file with the CAs the Kubernetes API server is verified against outside a cluster, the system roots if not set.
+// - KubeTLSVerify: Whether the Kubernetes API server certificate is verified, defaults to true if not set.
+// - AuthSARVerb: Verb of the access review the kubernetes auth mode requires, defaults to "create" if not set.
+// - AuthSARResource: Resource of the required access review, defaults to "imagestreammappings" if not set.
+// - AuthSARGroup: API group of the required access review, defaults to "image.openshift.io" if not set; empty names the core group.
+// - AuthSARSubresource: Subresource of the required access review, none if not set.
+// - AuthSARNamespace: Namespace of the required access review outside pushes, defaults to the namespace of IMAGE_NAME if not set; empty, or an IMAGE_NAME without a namespace, makes it cluster-wide. Pushes are reviewed in the namespace of their image.
+// - AuthSARChecks: Comma-separated further access reviews that must all pass, each "verb resource[.group][/subresource][@namespace]", none if not set.
+// - AuthCacheTTL: How long an allowed kubernetes authorization is cached, defaults to 2m if not set; 0 disables the cache.
+// - AuthAllowedSubjects: Comma-separated user names, such as system:serviceaccount:ns:name, allowed in kubernetes mode, none if not set.
+// - AuthAllowedGroups: Comma-separated groups whose members are allowed in kubernetes mode, none if not set.
+// - AuthPolicy: How the allow-lists combine with the access reviews when set: allowlist (the allow-lists alone), any or all; defaults to allowlist if not set.
+// - AuthRequiredAudience: Audience the bound tokens of the kubernetes auth mode must be issued for, checked with the TokenReview, any if not set.
+// - EventsEnabled: Whether build lifecycle Events are emitted with the builder's service account, defaults to false if not set.
+// - EventsTarget: Object the Events are about as "kind/name" in the builder's namespace, defaults to the builder's Pod if not set.
+// - HAEnabled: Whether replicas elect a leader with a Lease and only the leader accepts builds, defaults to false if not set.
+// - HALeaseName: Name of the Lease of the leader election, defaults to "vddk-builder" if not set.
+// - HALeaseNamespace: Namespace of the Lease, defaults to the builder's namespace if not set.
+// - HAAdvertiseURL: URL of this replica the others redirect builds to while it leads, such as https://$(POD_IP):8443, none if not set.
+// - AllowedImagePrefixes: Comma-separated prefixes, such as "team-a/", one of which the namespaced image names built or promoted must start with, any image if not set.
+// - PolicyConfigMap: ConfigMap as "namespace/name" whose policy.json overrides the image prefixes, promote registries, quotas and auth allow-lists while it exists, none if not set.
+// - StatusReporting: Kubernetes object the status of each build is written to: configmap or resource, a VDDKBuild custom resource; disabled if not set.
+// - StatusNamespace: Namespace of the status objects, defaults to the builder's namespace if not set.
+// - StatusNamePrefix: Prefix of the status object names, followed by the build ID, defaults to "vddk-build-" if not set.
+// - StatusRetention: Number of status objects kept, the oldest being deleted, defaults to 100 if not set; 0 keeps all.
+// - RedirectHTTPPort: Optional plain HTTP port that redirects to HTTPS, disabled if not set.
+// - AdminPort: Optional plain HTTP port serving metrics, health checks, version and pprof, disabled if not set.
+// - CORSAllowedOrigins: Comma-separated origins allowed to make cross-origin requests, CORS is disabled if not set.
+// - CORSAllowCredentials: Whether cross-origin requests may carry credentials, defaults to false if not set.
+// - AdminToken: Static bearer token for the /admin endpoints, falls back to a cluster-admin access review if not set.
+// - BuildTimeout: Maximum duration of a single build, defaults to 1h if not set; 0 disables the limit.
+// - ServeUI: Whether the HTML upload form is served at /, defaults to true if not set.
+// - StartupChecks: Whether to verify podman, skopeo, directories and the registry at startup, defaults to true if not set.
+// - StartupChecksSkip: Comma-separated names of individual startup checks to skip.
+// - TrustedProxies: Comma-separated CIDRs of proxies whose X-Forwarded-For header is honored.
+// - UploadAllowedCIDRs: Comma-separated CIDRs of clients allowed to start builds, every client is allowed if not set.
+// - ExportEnabled: Whether built images can be downloaded as OCI archives, defaults to false if not set.
+// - AllowOverwrite: Whether uploads may replace an existing tag with overwrite=true, defaults to true if not set.
+// - SkipIfExists: Whether uploads of an archive the registry already holds an image of are not rebuilt, defaults to true if not set.
+// - AuditLogFile: File the audit log is appended to, audit entries go to stderr if not set.
+// - AuditRecentEntries: Number of audit entries kept in memory for /admin/audit, defaults to 1000 if not set.
+// - StateDir: Directory persisting build history and quota counters across restarts, state is kept in memory only if not set.
+// - LogDir: Directory the output of every build is written to as <build ID>.log, build output only goes to the server log if not set.
+// - LogRetention: How long build logs are kept, defaults to 168h if not set; 0 keeps logs forever.
+// - LogMaxSize: Maximum size of a build log in bytes, defaults to 10 MiB if not set; 0 disables the cap.
+// - OutputMode: registry to push images, or archive to write them to OutputDir as OCI archives, defaults to "registry" if not set, or to "archive" when IMAGE_REGISTRY is set empty.
+// - OutputDir: Directory the OCI archives are written to in archive mode, defaults to "/tmp/output" if not set.
+// - OutputRetention: How long OCI archives are kept, defaults to 168h if not set; 0 keeps them forever.
+// - QuotaUploadsPerDay: Maximum uploads per identity and UTC day, unlimited if not set.
+// - QuotaBytesPerDay: Maximum uploaded bytes per identity and UTC day, unlimited if not set.
+// - QuotaExemptIdentities: Comma-separated identities not subject to quotas.
+// - StreamUploads: Whether archives are extracted while being uploaded instead of stored first, defaults to false if not set.
+// - ContainerfilePath: Path of the Containerfile inside the archive; a Containerfile at the archive root, or else a generated one, is used if not set.
+// - ContainerfileTemplate: Template file for the generated Containerfile, an embedded template is used if not set.
+// - ContainerfileBaseImage: Base image of the generated Containerfile, defaults to "registry.access.redhat.com/ubi8/ubi-minimal" if not set.
+// - ContainerfileDeniedPatterns: Comma-separated regular expressions rejecting instructions of uploaded Containerfiles, defaults to "--mount=type=secret,^ADD\s+(--\S+\s+)*https?://" if not set.
+// - AllowedBaseImages: Comma-separated glob patterns every FROM of the Containerfile must match, any base image is allowed if not set.
+// - BaseImageAllowLatest: Whether a FROM may use the latest tag or no tag at all, defaults to true if not set.
+// - TagLatest: Whether images tagged with the detected VDDK version are also pushed as latest, defaults to true if not set.
+// - BuildEngine: One of podman, docker or buildah, defaults to "podman" if not set.
+// - ContainerHost: URL of a remote podman service that runs the builds, taken from CONTAINER_HOST or PODMAN_HOST, local podman if not set.
+// - BuildMode: Where builds run: local (in the server) or job (in a Kubernetes Job per build); defaults to local if not set.
+// - JobImage: Image of the build Jobs, defaults to the image of the builder pod if not set.
+// - JobServiceAccount: Service account of the build Jobs, the namespace default if not set.
+// - JobNamespace: Namespace the build Jobs are created in, defaults to the builder's namespace if not set.
+// - JobCPU: CPU request and limit of the build Jobs such as "2" or "500m", none if not set.
+// - JobMemory: Memory request and limit of the build Jobs such as "4Gi", none if not set.
+// - JobNodeSelector: Comma-separated key=value node labels the build Jobs are scheduled on, any node if not set.
+// - JobPrivileged: Whether the build container of the Jobs runs privileged, defaults to false if not set.
+// - JobBuilderURL: URL of this server the build Jobs download their inputs from, defaults to HA_ADVERTISE_URL if not set.
+// - NoCache: Whether images are built without the layer cache, defaults to false if not set.
+// - Squash: Whether images are squashed into a single layer, defaults to false if not set.
+// - BuildMemoryLimit: Memory limit of the build containers such as "4g", unlimited if not set.
+// - BuildCPULimit: CPUs the build containers may use such as "2" or "500m", unlimited if not set.
+// - BuildPidsLimit: Maximum number of processes in a build container, unlimited if not set.
+// - BuildUlimits: Comma-separated name=soft[:hard] ulimits of the build containers, none if not set.
+// - DryRunAllowed: Whether uploads may build without pushing with dry_run=true, defaults to true if not set.
+// - BuildArgs: Comma-separated KEY=VALUE build args passed to every build, none if not set.
+// - BuildArgsAllowed: Comma-separated build arg keys callers may set, defaults to "BASE_IMAGE,HTTP_PROXY,HTTPS_PROXY,NO_PROXY" if not set.
+// - Platforms: Comma-separated os/arch platforms built into a pushed manifest list, a single-platform image is built if not set.
+// - TargetPlatform: os/arch of single-platform images, the builder's own platform if not set.
+// - TargetPlatformsAllowed: Comma-separated platforms callers may request, defaults to "linux/amd64,linux/arm64" if not set.
+// - ValidateContent: Whether the build context is checked for a VDDK distribution before building, defaults to true if not set.
+// - ContentRequiredPaths: Comma-separated globs, relative to the build context, that must each match a file, defaults to "vmware-vix-disklib-distrib/lib64/libvixDiskLib.so*" if not set.
+// - ChecksumManifest: sha256sum file at the root of the extracted archive whose listed files are verified, defaults to "SHA256SUMS" if not set.
+// - MaxExtractedBytes: Maximum total size of the files extracted from one archive, defaults to 10 GiB if not set; 0 disables the limit.
+// - MaxArchiveEntries: Maximum number of entries in one archive, defaults to 100000 if not set; 0 disables the limit.
+// - MaxNestingDepth: Number of archive levels unpacked, the upload included, defaults to 2 if not set.
+// - ExtractIncludeGlobs: Comma-separated globs, where ** matches any number of directories, naming the archive entries that are extracted, every entry is extracted if not set.
+// - KeepUploads: Whether uploads are kept in a content-addressed store for rebuilds, defaults to false if not set.
+// - UploadRetention: How long an unused stored upload is kept, defaults to 168h if not set; 0 keeps uploads forever.
+// - KeepWorkDirOnFailure: Whether the work directory of a failed build is kept for debugging, defaults to false if not set.
+// - WorkDirRetention: How long a kept work directory stays, defaults to 24h if not set; 0 keeps them until purged.
+// - RegistryAuthConfig: containers-auth.json with credentials per registry, used instead of the request token for the registries it lists, read from REGISTRY_AUTH_CONFIG or REGISTRY_AUTH_FILE, none if not set.
+// - PushAllRequired: Whether a failed push to a secondary registry fails the build, defaults to true if not set.
+// - VerifyPush: Whether the digest the registry serves for a pushed image is compared with the pushed one, defaults to true if not set.
+// - PushRetries: Number of attempts for a push failing with transient errors, defaults to 3 if not set.
+// - PushRetryBackoff: Wait before the second push attempt, doubled for each further one, defaults to 5s if not set.
+// - RegistryTLSVerify: Whether registry certificates are verified when pushing and querying, read from REGISTRY_TLS_VERIFY or the older PUSH_TLS_VERIFY, defaults to true if not set.
+// - PushCompression: Layer compression of pushed images, one of gzip, zstd, zstd:chunked, defaults to "gzip" if not set.
+// - PushCompressionLevel: Compression level of pushed layers, the format's default if not set.
+// - RegistryCABundle: PEM file with CAs trusted for registry certificates in addition to the system roots, none if not set.
+// - PushCredentialsMode: Whose credentials push images: caller (the request token), serviceaccount (the mounted dockercfg secret) or authfile (REGISTRY_AUTH_CONFIG); defaults to caller if not set.
+// - PushDockercfgPath: Mounted dockercfg secret, a .dockerconfigjson or .dockercfg file or a directory holding one, defaults to "/var/run/secrets/openshift.io/push" if not set.
+// - PushCredentialsRefresh: How often the dockercfg secret is re-read in serviceaccount mode, defaults to 5m if not set; 0 reads it only at startup.
+// - RegistryTimeout: Overall limit of a single registry query made by the server, defaults to 30s if not set; 0 disables it.
+// - RegistryRetries: Number of attempts for a registry query failing with a network error or a 5xx answer, defaults to 3 if not set.
+// - RegistryRetryBackoff: Wait before the second registry query attempt, doubled for each further one, defaults to 500ms if not set.
+// - RegistryRateLimitMax: Total wait for a registry answering 429 to a query before giving up, defaults to 30s if not set.
+// - InsecureRegistries: Comma-separated hosts, host:ports or CIDRs of registries reached without certificate verification and over plain HTTP if HTTPS fails, none if not set.
+// - RegistryInfoCatalog: Whether /registry/info may list the repositories of the registry, defaults to false if not set.
+// - PromoteRegistries: Comma-separated registries /promote may copy images between, defaults to ImageRegistries if not set.
+// - CosignKeyPath: cosign private key used to sign pushed images, images are not signed if not set.
+// - CosignPasswordFile: File holding the password of the cosign key, the key is assumed unencrypted if not set.
+// - SignRequired: Whether a signing failure fails the build, defaults to true if not set.
+// - SBOMEnabled: Whether an SPDX SBOM of every built image is generated into LOG_DIR, defaults to false if not set.
+// - SyftPath: syft binary generating SBOMs, defaults to "syft" if not set.
+// - SBOMPush: Whether SBOMs are attached to pushed images as OCI referrers, defaults to false if not set.
+// - OrasPath: oras binary attaching SBOMs, defaults to "oras" if not set.
+// - SBOMRequired: Whether an SBOM failure fails the build, defaults to false if not set.
+// - ImageStreamEnabled: Whether the OpenShift ImageStreamTags of images pushed to IMAGE_REGISTRY are verified and annotated, defaults to false if not set.
+// - ImageStreamServiceAccount: Whether ImageStreamTags are read and annotated with the builder's service account instead of the caller's token, defaults to false if not set.
+// - UpdateTarget: Object field set to each pushed image pinned by digest, "configmap:namespace/name:key" or "group/version/resource:namespace/name:field.path", disabled if not set.
+// - ScanEnabled: Whether built images are scanned for vulnerabilities before the push, defaults to false if not set.
+// - ScanCommand: Scanner printing a trivy JSON report for the OCI archive appended as last argument, defaults to "trivy image --quiet --format json --input" if not set.
+// - ScanFailOn: Lowest severity counted against SCAN_MAX_FINDINGS, one of unknown, low, medium, high, critical, defaults to "critical" if not set.
+// - ScanMaxFindings: Number of findings at or above SCAN_FAIL_ON tolerated before the push is refused, defaults to 0 if not set.
+// - PreBuildHook: Executable run in the build context before every build, none if not set.
+// - PostPushHook: Executable run after every push, none if not set.
+// - PostPushHookRequired: Whether a failing post-push hook fails the build, defaults to false if not set.
+// - HookTimeout: Maximum duration of a hook, defaults to 5m if not set; 0 disables the limit.
+// - KeepLocalImage: Whether pushed images stay in the local containers-storage, defaults to ExportEnabled if not set.
+// - PruneLocalImages: Whether local images are pruned hourly, defaults to false if not set.
+// - LocalImageRetention: Age after which unused local images are pruned, defaults to 168h if not set.
+func LoadConfig() (*Config, error) {
+	src, err := newConfigSource(os.Getenv("CONFIG_FILE"))
+	if err != nil {
+		return nil, err
+	}
+
+	cfg := &Config{
+		ImageName:        src.getEnv("IMAGE_NAME", "vddk"),
+		DefaultNamespace: src.getEnv("DEFAULT_NAMESPACE", ""),
+		CAPublicKey:      src.getEnv("CA_PUBLIC_KEY", "/etc/tls/server.crt"),
+		PrivateKey:       src.getEnv("PRIVATE_KEY", "/etc/tls/server.key"),
+		ServerPort:       src.getEnv("SERVER_PORT", "8443"),
+		UploadDir:        src.getEnv("UPLOAD_DIR", "/tmp/uploads"),
+		WorkDir:          src.getEnv("WORK_DIR", os.TempDir()),
+		ImageRegistry:    src.getEnv("IMAGE_REGISTRY", "image-registry.openshift-image-registry.svc:5000"),
+		RequireAuth:      src.getEnvAsBool("REQUIRE_AUTH", false),
+		AuthTokensFile:   src.getEnv("AUTH_TOKENS_FILE", "/etc/vddk-builder/tokens"),
+		AuthExemptPaths:  src.getEnvAsList("AUTH_EXEMPT_PATHS", nil),
+
+		Kubeconfig:    src.getEnv("KUBECONFIG", ""),
+		KubeAPIServer: src.getEnv("KUBE_API_SERVER", "https://kubernetes.default.svc"),
+		KubeCABundle:  src.getEnv("KUBE_CA_BUNDLE", ""),
+		KubeTLSVerify: src.getEnvAsBool("KUBE_TLS_VERIFY", true),
+
+		AuthSARVerb:        src.getEnv("AUTH_SAR_VERB", "create"),
+		AuthSARResource:    src.getEnv("AUTH_SAR_RESOURCE", "imagestreammappings"),
+		AuthSARSubresource: src.getEnv("AUTH_SAR_SUBRESOURCE", ""),
+		AuthSARChecks:      src.getEnvAsList("AUTH_SAR_CHECKS", nil),
+		AuthCacheTTL:       src.getEnvAsDuration("AUTH_CACHE_TTL", 2*time.Minute),
+
+		AuthAllowedSubjects: src.getEnvAsList("AUTH_ALLOWED_SUBJECTS", nil),
+		AuthAllowedGroups:   src.getEnvAsList("AUTH_ALLOWED_GROUPS", nil),
+		AuthPolicy:          src.getEnv("AUTH_POLICY", AuthPolicyAllowList),
+
+		AuthRequiredAudience: src.getEnv("AUTH_REQUIRED_AUDIENCE", ""),
+
+		EventsEnabled: src.getEnvAsBool("EVENTS_ENABLED", false),
+		EventsTarget:  src.getEnv("EVENTS_TARGET", ""),
+
+		HAEnabled:        src.getEnvAsBool("HA_ENABLED", false),
+		HALeaseName:      src.getEnv("HA_LEASE_NAME", "vddk-builder"),
+		HALeaseNamespace: src.getEnv("HA_LEASE_NAMESPACE", ""),
+		HAAdvertiseURL:   src.getEnv("HA_ADVERTISE_URL", ""),
+
+		AllowedImagePrefixes: src.getEnvAsList("ALLOWED_IMAGE_PREFIXES", nil),
+		PolicyConfigMap:      src.getEnv("POLICY_CONFIGMAP", ""),
+
+		StatusReporting:  src.getEnv("STATUS_REPORTING", ""),
+		StatusNamespace:  src.getEnv("STATUS_NAMESPACE", ""),
+		StatusNamePrefix: src.getEnv("STATUS_NAME_PREFIX", "vddk-build-"),
+		StatusRetention:  src.getEnvAsInt("STATUS_RETENTION", 100),
+
+		RedirectHTTPPort: src.getEnv("REDIRECT_HTTP_PORT", ""),
+		AdminPort:        src.getEnv("ADMIN_PORT", ""),
+
+		CORSAllowedOrigins:   src.getEnvAsList("CORS_ALLOWED_ORIGINS", nil),
+		CORSAllowCredentials: src.getEnvAsBool("CORS_ALLOW_CREDENTIALS", false),
+
+		AdminToken: src.getEnv("ADMIN_TOKEN", ""),
+
+		BuildTimeout: src.getEnvAsDuration("BUILD_TIMEOUT", time.Hour),
+
+		ServeUI: src.getEnvAsBool("SERVE_UI", true),
+
+		StartupChecks:     src.getEnvAsBool("STARTUP_CHECKS", true),
+		StartupChecksSkip: src.getEnvAsList("STARTUP_CHECKS_SKIP", nil),
+
+		TrustedProxies:     src.getEnvAsList("TRUSTED_PROXIES", nil),
+		UploadAllowedCIDRs: src.getEnvAsList("UPLOAD_ALLOWED_CIDRS", nil),
+
+		ExportEnabled: src.getEnvAsBool("EXPORT_ENABLED", false),
+
+		AllowOverwrite: src.getEnvAsBool("ALLOW_OVERWRITE", true),
+		SkipIfExists:   src.getEnvAsBool("SKIP_IF_EXISTS", true),
+
+		AuditLogFile:       src.getEnv("AUDIT_LOG_FILE", ""),
+		AuditRecentEntries: src.getEnvAsInt("AUDIT_RECENT_ENTRIES", 1000),
+
+		StateDir: src.getEnv("STATE_DIR", ""),
+
+		LogDir:       src.getEnv("LOG_DIR", ""),
+		LogRetention: src.getEnvAsDuration("LOG_RETENTION", 7*24*time.Hour),
+		LogMaxSize:   src.getEnvAsInt64("LOG_MAX_SIZE", 10<<20),
+
+		OutputMode:      src.getEnv("OUTPUT_MODE", OutputModeRegistry),
+		OutputDir:       src.getEnv("OUTPUT_DIR", "/tmp/output"),
+		OutputRetention: src.getEnvAsDuration("OUTPUT_RETENTION", 7*24*time.Hour),
+
+		QuotaUploadsPerDay:    src.getEnvAsInt("QUOTA_UPLOADS_PER_DAY", 0),
+		QuotaBytesPerDay:      src.getEnvAsInt64("QUOTA_BYTES_PER_DAY", 0),
+		QuotaExemptIdentities: src.getEnvAsList("QUOTA_EXEMPT_IDENTITIES", nil),
+
+		StreamUploads: src.getEnvAsBool("STREAM_UPLOADS", false),
+
+		ContainerfilePath:      src.getEnv("CONTAINERFILE_PATH", ""),
+		ContainerfileTemplate:  src.getEnv("CONTAINERFILE_TEMPLATE", ""),
+		ContainerfileBaseImage: src.getEnv("CONTAINERFILE_BASE_IMAGE", "registry.access.redhat.com/ubi8/ubi-minimal"),
+
+		ContainerfileDeniedPatterns: src.getEnvAsList("CONTAINERFILE_DENIED_PATTERNS", []string{`--mount=type=secret`, `^ADD\s+(--\S+\s+)*https?://`}),
+
+		AllowedBaseImages:    src.getEnvAsList("ALLOWED_BASE_IMAGES", nil),
+		BaseImageAllowLatest: src.getEnvAsBool("BASE_IMAGE_ALLOW_LATEST", true),
+
+		TagLatest: src.getEnvAsBool("TAG_LATEST", true),
+
+		BuildEngine:   src.getEnv("BUILD_ENGINE", EnginePodman),
+		ContainerHost: src.getEnv("CONTAINER_HOST", src.getEnv("PODMAN_HOST", "")),
+
+		BuildMode:         src.getEnv("BUILD_MODE", BuildModeLocal),
+		JobImage:          src.getEnv("BUILD_JOB_IMAGE", ""),
+		JobServiceAccount: src.getEnv("BUILD_JOB_SERVICE_ACCOUNT", ""),
+		JobNamespace:      src.getEnv("BUILD_JOB_NAMESPACE", ""),
+		JobCPU:            src.getEnv("BUILD_JOB_CPU", ""),
+		JobMemory:         src.getEnv("BUILD_JOB_MEMORY", ""),
+		JobNodeSelector:   src.getEnvAsList("BUILD_JOB_NODE_SELECTOR", nil),
+		JobPrivileged:     src.getEnvAsBool("BUILD_JOB_PRIVILEGED", false),
+		JobBuilderURL:     src.getEnv("BUILD_JOB_BUILDER_URL", src.getEnv("HA_ADVERTISE_URL", "")),
+
+		NoCache: src.getEnvAsBool("NO_CACHE", false),
+		Squash:  src.getEnvAsBool("SQUASH", false),
+
+		BuildMemoryLimit: src.getEnv("BUILD_MEMORY_LIMIT", ""),
+		BuildCPULimit:    src.getEnv("BUILD_CPU_LIMIT", ""),
+		BuildPidsLimit:   src.getEnvAsInt("BUILD_PIDS_LIMIT", 0),
+		BuildUlimits:     src.getEnvAsList("BUILD_ULIMITS", nil),
+
+		DryRunAllowed: src.getEnvAsBool("DRY_RUN_ALLOWED", true),
+
+		BuildArgs:        src.getEnvAsList("BUILD_ARGS", nil),
+		BuildArgsAllowed: src.getEnvAsList("BUILD_ARGS_ALLOWED", []string{"BASE_IMAGE", "HTTP_PROXY", "HTTPS_PROXY", "NO_PROXY"}),
+
+		Platforms:              src.getEnvAsList("PLATFORMS", nil),
+		TargetPlatform:         src.getEnv("TARGET_PLATFORM", ""),
+		TargetPlatformsAllowed: src.getEnvAsList("TARGET_PLATFORMS_ALLOWED", []string{"linux/amd64", "linux/arm64"}),
+
+		ValidateContent:      src.getEnvAsBool("VALIDATE_CONTENT", true),
+		ContentRequiredPaths: src.getEnvAsList("CONTENT_REQUIRED_PATHS", []string{"vmware-vix-disklib-distrib/lib64/libvixDiskLib.so*"}),
+
+		ChecksumManifest: src.getEnv("CHECKSUM_MANIFEST", "SHA256SUMS"),
+
+		MaxExtractedBytes: src.getEnvAsInt64("MAX_EXTRACTED_BYTES", 10<<30),
+		MaxArchiveEntries: src.getEnvAsInt("MAX_ARCHIVE_ENTRIES", 100000),
+		MaxNestingDepth:   src.getEnvAsInt("MAX_NESTING_DEPTH", 2),
+
+		ExtractIncludeGlobs: src.getEnvAsList("EXTRACT_INCLUDE_GLOBS", nil),
+
+		KeepUploads:     src.getEnvAsBool("KEEP_UPLOADS", false),
+		UploadRetention: src.getEnvAsDuration("UPLOAD_RETENTION", 7*24*time.Hour),
+
+		KeepWorkDirOnFailure: src.getEnvAsBool("KEEP_WORKDIR_ON_FAILURE", false),
+		WorkDirRetention:     src.getEnvAsDuration("WORKDIR_RETENTION", 24*time.Hour),
+
+		RegistryAuthConfig: src.getEnv("REGISTRY_AUTH_CONFIG", src.getEnv("REGISTRY_AUTH_FILE", "")),
+		PushAllRequired:    src.getEnvAsBool("PUSH_ALL_REQUIRED", true),
+		VerifyPush:         src.getEnvAsBool("VERIFY_PUSH", true),
+		PushRetries:        src.getEnvAsInt("PUSH_RETRIES", 3),
+		PushRetryBackoff:   src.getEnvAsDuration("PUSH_RETRY_BACKOFF", 5*time.Second),
+		RegistryTLSVerify:  src.getEnvAsBool("REGISTRY_TLS_VERIFY", src.getEnvAsBool("PUSH_TLS_VERIFY", true)),
+		RegistryCABundle:   src.getEnv("REGISTRY_CA_BUNDLE", ""),
+
+		PushCredentialsMode:    src.getEnv("PUSH_CREDENTIALS_MODE", PushCredentialsCaller),
+		PushDockercfgPath:      src.getEnv("PUSH_DOCKERCFG_PATH", "/var/run/secrets/openshift.io/push"),
+		PushCredentialsRefresh: src.getEnvAsDuration("PUSH_CREDENTIALS_REFRESH", 5*time.Minute),
+
+		RegistryTimeout:      src.getEnvAsDuration("REGISTRY_TIMEOUT", 30*time.Second),
+		RegistryRetries:      src.getEnvAsInt("REGISTRY_RETRIES", 3),
+		RegistryRetryBackoff: src.getEnvAsDuration("REGISTRY_RETRY_BACKOFF", 500*time.Millisecond),
+		RegistryRateLimitMax: src.getEnvAsDuration("REGISTRY_RATE_LIMIT_MAX_WAIT", 30*time.Second),
+		InsecureRegistries:   src.getEnvAsList("INSECURE_REGISTRIES", nil),
+		RegistryInfoCatalog:  src.getEnvAsBool("REGISTRY_INFO_CATALOG", false),
+
+		PushCompression:      src.getEnv("PUSH_COMPRESSION", CompressionGzip),
+		PushCompressionLevel: src.getEnvAsInt("PUSH_COMPRESSION_LEVEL", 0),
+
+		CosignKeyPath:      src.getEnv("COSIGN_KEY_PATH", ""),
+		CosignPasswordFile: src.getEnv("COSIGN_PASSWORD_FILE", ""),
+		SignRequired:       src.getEnvAsBool("SIGN_REQUIRED", true),
+
+		SBOMEnabled:  src.getEnvAsBool("SBOM_ENABLED", false),
+		SyftPath:     src.getEnv("SYFT_PATH", "syft"),
+		SBOMPush:     src.getEnvAsBool("SBOM_PUSH", false),
+		OrasPath:     src.getEnv("ORAS_PATH", "oras"),
+		SBOMRequired: src.getEnvAsBool("SBOM_REQUIRED", false),
+
+		ImageStreamEnabled:        src.getEnvAsBool("IMAGESTREAM_ENABLED", false),
+		ImageStreamServiceAccount: src.getEnvAsBool("IMAGESTREAM_USE_SERVICE_ACCOUNT", false),
+
+		UpdateTarget: src.getEnv("UPDATE_TARGET", ""),
+
+		ScanEnabled:     src.getEnvAsBool("SCAN_ENABLED", false),
+		ScanCommand:     src.getEnv("SCAN_COMMAND", "trivy image --quiet --format json --input"),
+		ScanFailOn:      strings.ToLower(src.getEnv("SCAN_FAIL_ON", "critical")),
+		ScanMaxFindings: src.getEnvAsInt("SCAN_MAX_FINDINGS", 0),
+
+		PreBuildHook:         src.getEnv("PRE_BUILD_HOOK", ""),
+		PostPushHook:         src.getEnv("POST_PUSH_HOOK", ""),
+		PostPushHookRequired: src.getEnvAsBool("POST_PUSH_HOOK_REQUIRED", false),
+		HookTimeout:          src.getEnvAsDuration("HOOK_TIMEOUT", 5*time.Minute),
+
+		PruneLocalImages:    src.getEnvAsBool("PRUNE_LOCAL_IMAGES", false),
+		LocalImageRetention: src.getEnvAsDuration("LOCAL_IMAGE_RETENTION", 7*24*time.Hour),
 	}
+
+	// REQUIRE_AUTH predates AUTH_MODE and selects the Kubernetes access review
+	cfg.AuthMode = AuthModeNone
+	if cfg.RequireAuth {
+		cfg.AuthMode = AuthModeKubernetes
+	}
+	cfg.AuthMode = src.getEnv("AUTH_MODE", cfg.AuthMode)
+	cfg.RequireAuth = cfg.AuthMode != AuthModeNone
+
+	// An empty AUTH_SAR_GROUP names the core group and an empty AUTH_SAR_NAMESPACE a
+	// cluster-wide check; image streams live in the first segment of the image name
+	cfg.AuthSARGroup = "image.openshift.io"
+	if value, set := src.lookupEnv("AUTH_SAR_GROUP"); set {
+		cfg.AuthSARGroup = value
+	}
+	cfg.AuthSARNamespace = ImageNamespace(cfg.QualifiedImageName(cfg.ImageName))
+	if value, set := src.lookupEnv("AUTH_SAR_NAMESPACE"); set {
+		cfg.AuthSARNamespace = value
+	}
+
+	// Exports read the image from local storage, so keep it by default when they are enabled
+	cfg.KeepLocalImage = src.getEnvAsBool("KEEP_LOCAL_IMAGE", cfg.ExportEnabled)
+
+	// IMAGE_REGISTRY predates IMAGE_REGISTRIES and names the primary registry
+	cfg.ImageRegistries = src.getEnvAsList("IMAGE_REGISTRIES", nil)
+	if value, set := src.lookupEnv("IMAGE_REGISTRY"); set && value == "" && len(cfg.ImageRegistries) == 0 {
+		// Without a registry images can only be written to OUTPUT_DIR, named like local podman images
+		cfg.ImageRegistry = "localhost"
+		cfg.OutputMode = OutputModeArchive
+	}
+	if len(cfg.ImageRegistries) > 0 {
+		cfg.ImageRegistry = cfg.ImageRegistries[0]
+	} else {
+		cfg.ImageRegistries = []string{cfg.ImageRegistry}
+	}
+	cfg.PromoteRegistries = src.getEnvAsList("PROMOTE_REGISTRIES", cfg.ImageRegistries)
+
+	if err := errors.Join(src.errs...); err != nil {
+		return nil, err
+	}
+	for _, key := range src.unknownKeys() {
+		cfg.fileWarnings = append(cfg.fileWarnings, fmt.Sprintf("CONFIG_FILE %s sets unknown setting %s, ignored", src.path, key))
+	}
+	return cfg, nil
 }
 
-func getEnv(key, fallback string) string {
-	if value := os.Getenv(key); value != "" {
-		return value
+// Warnings returns settings that are valid but likely wrong, for logging at startup.
+func (c *Config) Warnings() []string {
+	warnings := slices.Clone(c.fileWarnings)
+	if apiServer, err := url.Parse(c.KubeAPIServer); err == nil && c.AuthMode == AuthModeKubernetes {
+		registryHost := c.ImageRegistry
+		if host, _, found := strings.Cut(registryHost, ":"); found {
+			registryHost = host
+		}
+		if strings.EqualFold(apiServer.Hostname(), registryHost) {
+			warnings = append(warnings, fmt.Sprintf("KUBE_API_SERVER %s is on the same host as IMAGE_REGISTRY %s; access reviews are sent to the Kubernetes API server, not the registry", c.KubeAPIServer, c.ImageRegistry))
+		}
 	}
-	return fallback
+	return warnings
 }
 
-func getEnvAsBool(name string, defaultVal bool) bool {
-	valStr := os.Getenv(name)
-	if valStr == "" {
-		return defaultVal
+// Validate checks the configuration for invalid or conflicting settings.
+func (c *Config) Validate() error {
+	switch c.AuthMode {
+	case AuthModeNone, AuthModeKubernetes:
+	case AuthModeToken:
+		if c.AuthTokensFile == "" {
+			return fmt.Errorf("AUTH_TOKENS_FILE is required when AUTH_MODE=token")
+		}
+	default:
+		return fmt.Errorf("invalid AUTH_MODE %q: must be one of none, token, kubernetes", c.AuthMode)
 	}
-	val, err := strconv.ParseBool(valStr)
-	if err != nil {
-		return defaultVal
+
+	for _, origin := range c.CORSAllowedOrigins {
+		if origin == "*" && c.CORSAllowCredentials {
+			return fmt.Errorf("CORS_ALLOWED_ORIGINS must not contain '*' when CORS_ALLOW_CREDENTIALS is enabled")
+		}
+	}
+	if _, err := ParseCIDRs(c.TrustedProxies); err != nil {
+		return fmt.Errorf("TRUSTED_PROXIES: %w", err)
+	}
+	if _, err := ParseCIDRs(c.UploadAllowedCIDRs); err != nil {
+		return fmt.Errorf("UPLOAD_ALLOWED_CIDRS: %w", err)
+	}
+	for _, pattern := range c.ContainerfileDeniedPatterns {
+		if _, err := regexp.Compile(pattern); err != nil {
+			return fmt.Errorf("invalid CONTAINERFILE_DENIED_PATTERNS entry %q: %w", pattern, err)
+		}
+	}
+	for _, pattern := range c.AllowedBaseImages {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid ALLOWED_BASE_IMAGES pattern %q: %w", pattern, err)
+		}
+	}
+	if c.ContainerfilePath != "" && (!filepath.IsLocal(c.ContainerfilePath) || filepath.Clean(c.ContainerfilePath) == ".") {
+		return fmt.Errorf("CONTAINERFILE_PATH must be a relative path inside the build context")
+	}
+	for _, pattern := range c.ExtractIncludeGlobs {
+		if !path.IsAbs(pattern) && !slices.Contains(strings.Split(pattern, "/"), "..") {
+			if _, err := path.Match(strings.ReplaceAll(pattern, "**", "*"), ""); err == nil {
+				continue
+			}
+		}
+		return fmt.Errorf("invalid EXTRACT_INCLUDE_GLOBS pattern %q: must be a relative glob inside the archive", pattern)
+	}
+	if !filepath.IsLocal(c.ChecksumManifest) {
+		return fmt.Errorf("CHECKSUM_MANIFEST must be a relative path inside the archive")
+	}
+	if c.BuildMemoryLimit != "" && !memoryQuantity.MatchString(c.BuildMemoryLimit) {
+		return fmt.Errorf("invalid BUILD_MEMORY_LIMIT %q: must be a number with an optional b, k, m or g suffix", c.BuildMemoryLimit)
+	}
+	if c.BuildCPULimit != "" {
+		if _, err := ParseCPUs(c.BuildCPULimit); err != nil {
+			return fmt.Errorf("BUILD_CPU_LIMIT: %w", err)
+		}
+	}
+	if c.BuildPidsLimit < 0 {
+		return fmt.Errorf("BUILD_PIDS_LIMIT must not be negative")
+	}
+	for _, ulimit := range c.BuildUlimits {
+		if !ulimitSpec.MatchString(ulimit) {
+			return fmt.Errorf("BUILD_ULIMITS entry %q is not of the form name=soft[:hard]", ulimit)
+		}
+	}
+	for _, arg := range c.BuildArgs {
+		if key, _, ok := strings.Cut(arg, "="); !ok || key == "" {
+			return fmt.Errorf("BUILD_ARGS entry %q is not of the form KEY=VALUE", arg)
+		}
+	}
+	for _, platform := range c.Platforms {
+		if parts := strings.Split(platform, "/"); len(parts) < 2 || len(parts) > 3 || slices.Contains(parts, "") {
+			return fmt.Errorf("PLATFORMS entry %q is not of the form os/arch[/variant]", platform)
+		}
+	}
+	if c.TargetPlatform != "" {
+		if len(c.Platforms) > 0 {
+			return fmt.Errorf("TARGET_PLATFORM cannot be combined with PLATFORMS")
+		}
+		if !slices.Contains(c.TargetPlatformsAllowed, c.TargetPlatform) {
+			return fmt.Errorf("TARGET_PLATFORM %q is not listed in TARGET_PLATFORMS_ALLOWED", c.TargetPlatform)
+		}
+	}
+	for i, registryURL := range c.ImageRegistries {
+		if slices.Contains(c.ImageRegistries[:i], registryURL) {
+			return fmt.Errorf("IMAGE_REGISTRIES lists %s twice", registryURL)
+		}
+	}
+	switch c.BuildEngine {
+	case EnginePodman, EngineBuildah:
+	case EngineDocker:
+		if len(c.Platforms) > 0 {
+			return fmt.Errorf("PLATFORMS needs BUILD_ENGINE=podman or buildah, docker cannot assemble manifest lists")
+		}
+	default:
+		return fmt.Errorf("invalid BUILD_ENGINE %q: must be one of podman, docker, buildah", c.BuildEngine)
+	}
+	if c.PolicyConfigMap != "" {
+		namespace, name, found := strings.Cut(c.PolicyConfigMap, "/")
+		if !found || namespace == "" || name == "" || strings.Contains(name, "/") {
+			return fmt.Errorf("POLICY_CONFIGMAP %q is not of the form namespace/name", c.PolicyConfigMap)
+		}
+	}
+	switch c.StatusReporting {
+	case "", StatusReportingConfigMap, StatusReportingResource:
+	default:
+		return fmt.Errorf("invalid STATUS_REPORTING %q: must be one of configmap, resource", c.StatusReporting)
+	}
+	if !statusNamePrefix.MatchString(c.StatusNamePrefix) {
+		return fmt.Errorf("STATUS_NAME_PREFIX %q must start with a lowercase letter or digit and hold only lowercase letters, digits, '-' and '.'", c.StatusNamePrefix)
+	}
+	if c.StatusRetention < 0 {
+		return fmt.Errorf("STATUS_RETENTION must not be negative")
+	}
+	switch c.BuildMode {
+	case BuildModeLocal:
+	case BuildModeJob:
+		if err := c.validateJobMode(); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("invalid BUILD_MODE %q: must be one of local, job", c.BuildMode)
+	}
+	for name, hook := range map[string]string{"PRE_BUILD_HOOK": c.PreBuildHook, "POST_PUSH_HOOK": c.PostPushHook} {
+		if hook == "" {
+			continue
+		}
+		if info, err := os.Stat(hook); err != nil || info.IsDir() || info.Mode()&0111 == 0 {
+			return fmt.Errorf("%s %q is not an executable file", name, hook)
+		}
+	}
+	maxLevel := 20
+	switch c.PushCompression {
+	case CompressionGzip:
+		maxLevel = 9
+	case CompressionZstd, CompressionZstdChunked:
+	default:
+		return fmt.Errorf("invalid PUSH_COMPRESSION %q: must be one of gzip, zstd, zstd:chunked", c.PushCompression)
+	}
+	if c.PushCompressionLevel < 0 || c.PushCompressionLevel > maxLevel {
+		return fmt.Errorf("PUSH_COMPRESSION_LEVEL %d is out of range for %s, must be between 1 and %d", c.PushCompressionLevel, c.PushCompression, maxLevel)
+	}
+	switch c.OutputMode {
+	case OutputModeRegistry:
+	case OutputModeArchive:
+		if c.CosignKeyPath != "" {
+			return fmt.Errorf("COSIGN_KEY_PATH signs pushed images and cannot be used with OUTPUT_MODE=archive")
+		}
+		if c.SBOMPush {
+			return fmt.Errorf("SBOM_PUSH attaches SBOMs in the registry and cannot be used with OUTPUT_MODE=archive")
+		}
+		if c.ImageStreamEnabled {
+			return fmt.Errorf("IMAGESTREAM_ENABLED annotates pushed images and cannot be used with OUTPUT_MODE=archive")
+		}
+		if c.UpdateTarget != "" {
+			return fmt.Errorf("UPDATE_TARGET refers to pushed images and cannot be used with OUTPUT_MODE=archive")
+		}
+	default:
+		return fmt.Errorf("invalid OUTPUT_MODE %q: must be one of registry, archive", c.OutputMode)
+	}
+	if c.SBOMEnabled && c.LogDir == "" {
+		return fmt.Errorf("SBOM_ENABLED needs LOG_DIR to store the SBOMs in")
+	}
+	if c.ScanEnabled {
+		if c.LogDir == "" {
+			return fmt.Errorf("SCAN_ENABLED needs LOG_DIR to store the scan reports in")
+		}
+		if len(strings.Fields(c.ScanCommand)) == 0 {
+			return fmt.Errorf("SCAN_COMMAND must not be empty when SCAN_ENABLED is set")
+		}
+		if !slices.Contains([]string{"unknown", "low", "medium", "high", "critical"}, c.ScanFailOn) {
+			return fmt.Errorf("invalid SCAN_FAIL_ON %q: must be one of unknown, low, medium, high, critical", c.ScanFailOn)
+		}
+		if c.ScanMaxFindings < 0 {
+			return fmt.Errorf("SCAN_MAX_FINDINGS must not be negative")
+		}
+	}
+	if c.ContainerHost != "" && c.BuildEngine != EnginePodman {
+		return fmt.Errorf("CONTAINER_HOST needs BUILD_ENGINE=podman, got %s", c.BuildEngine)
+	}
+	if c.KeepUploads && c.StreamUploads {
+		return fmt.Errorf("KEEP_UPLOADS cannot be combined with STREAM_UPLOADS, streamed archives are never stored")
+	}
+	switch c.PushCredentialsMode {
+	case PushCredentialsCaller, PushCredentialsServiceAccount:
+	case PushCredentialsAuthFile:
+		if c.RegistryAuthConfig == "" {
+			return fmt.Errorf("PUSH_CREDENTIALS_MODE=authfile needs REGISTRY_AUTH_CONFIG")
+		}
+	default:
+		return fmt.Errorf("invalid PUSH_CREDENTIALS_MODE %q: must be one of caller, serviceaccount, authfile", c.PushCredentialsMode)
+	}
+	if _, err := c.AccessChecks(); err != nil {
+		return err
+	}
+	switch c.AuthPolicy {
+	case AuthPolicyAllowList, AuthPolicyAny, AuthPolicyAll:
+	default:
+		return fmt.Errorf("invalid AUTH_POLICY %q: must be one of allowlist, any, all", c.AuthPolicy)
+	}
+	if (len(c.AuthAllowedSubjects) > 0 || len(c.AuthAllowedGroups) > 0) && c.AuthMode != AuthModeKubernetes {
+		return fmt.Errorf("AUTH_ALLOWED_SUBJECTS and AUTH_ALLOWED_GROUPS need AUTH_MODE=kubernetes")
+	}
+	if c.AuthRequiredAudience != "" && c.AuthMode != AuthModeKubernetes {
+		return fmt.Errorf("AUTH_REQUIRED_AUDIENCE needs AUTH_MODE=kubernetes")
+	}
+	return nil
+}
+
+// validateJobMode checks the settings of BUILD_MODE=job, which leaves nothing of a build
+// on the server but its record and log.
+func (c *Config) validateJobMode() error {
+	if c.JobBuilderURL == "" {
+		return fmt.Errorf("BUILD_MODE=job needs BUILD_JOB_BUILDER_URL or HA_ADVERTISE_URL for the Jobs to download their inputs from")
+	}
+	if u, err := url.Parse(c.JobBuilderURL); err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+		return fmt.Errorf("BUILD_JOB_BUILDER_URL %q is not an http or https URL", c.JobBuilderURL)
+	}
+	if _, err := ParseNodeSelector(c.JobNodeSelector); err != nil {
+		return err
+	}
+	if c.JobCPU != "" {
+		if _, err := ParseCPUs(c.JobCPU); err != nil {
+			return fmt.Errorf("invalid BUILD_JOB_CPU %q: %w", c.JobCPU, err)
+		}
+	}
+	for name, set := range map[string]bool{
+		"STREAM_UPLOADS":      c.StreamUploads,
+		"OUTPUT_MODE=archive": c.OutputMode == OutputModeArchive,
+		"EXPORT_ENABLED":      c.ExportEnabled,
+		"CONTAINER_HOST":      c.ContainerHost != "",
+		"SBOM_ENABLED":        c.SBOMEnabled,
+		"SCAN_ENABLED":        c.ScanEnabled,
+		"PRUNE_LOCAL_IMAGES":  c.PruneLocalImages,
+		"PUSH_CREDENTIALS_MODE=" + c.PushCredentialsMode: c.PushCredentialsMode != PushCredentialsCaller,
+	} {
+		if set {
+			return fmt.Errorf("%s needs the build to run in the server and cannot be used with BUILD_MODE=job", name)
+		}
+	}
+	return nil
+}
+
+// ParseNodeSelector parses the key=value entries of BUILD_JOB_NODE_SELECTOR.
+func ParseNodeSelector(entries []string) (map[string]string, error) {
+	selector := make(map[string]string, len(entries))
+	for _, entry := range entries {
+		key, value, found := strings.Cut(entry, "=")
+		if !found || key == "" {
+			return nil, fmt.Errorf("BUILD_JOB_NODE_SELECTOR entry %q is not of the form key=value", entry)
+		}
+		selector[key] = value
+	}
+	return selector, nil
+}
+
+// AccessCheck is an access review the caller's token must pass in the kubernetes auth mode.
+type AccessCheck struct {
+	Verb        string
+	Group       string
+	Resource    string
+	Subresource string
+	Namespace   string // Empty for a cluster-wide check
+}
+
+// accessCheckPattern matches an AUTH_SAR_CHECKS entry: verb resource[.group][/subresource][@namespace].
+var accessCheckPattern = regexp.MustCompile(`^([a-z*]+)\s+([a-z0-9*-]+)((?:\.[a-z0-9-]+)*)(?:/([a-z0-9-]+))?(?:@([a-z0-9-]+))?$`)
+
+// AccessChecks returns the access reviews required in the kubernetes auth mode: the one
+// described by the AUTH_SAR_* settings, followed by those listed in AUTH_SAR_CHECKS.
+func (c *Config) AccessChecks() ([]AccessCheck, error) {
+	if c.AuthSARVerb == "" || c.AuthSARResource == "" {
+		return nil, fmt.Errorf("AUTH_SAR_VERB and AUTH_SAR_RESOURCE must not be empty")
+	}
+	checks := []AccessCheck{{
+		Verb:        c.AuthSARVerb,
+		Group:       c.AuthSARGroup,
+		Resource:    c.AuthSARResource,
+		Subresource: c.AuthSARSubresource,
+		Namespace:   c.AuthSARNamespace,
+	}}
+	for _, entry := range c.AuthSARChecks {
+		m := accessCheckPattern.FindStringSubmatch(entry)
+		if m == nil {
+			return nil, fmt.Errorf("AUTH_SAR_CHECKS entry %q is not of the form verb resource[.group][/subresource][@namespace]", entry)
+		}
+		checks = append(checks, AccessCheck{
+			Verb:        m[1],
+			Resource:    m[2],
+			Group:       strings.TrimPrefix(m[3], "."),
+			Subresource: m[4],
+			Namespace:   m[5],
+		})
+	}
+	return checks, nil
+}
+
+// QualifiedImageName returns imageName in DEFAULT_NAMESPACE when it names no namespace of
+// its own, and imageName unchanged otherwise.
+func (c *Config) QualifiedImageName(imageName string) string {
+	if c.DefaultNamespace == "" || strings.Contains(imageName, "/") {
+		return imageName
+	}
+	return c.DefaultNamespace + "/" + imageName
+}
+
+// ImageNamespace returns the namespace of imageName, its first path segment, or "" for an
+// image name of a single segment.
+func ImageNamespace(imageName string) string {
+	namespace, _, found := strings.Cut(imageName, "/")
+	if !found {
+		return ""
+	}
+	return namespace
+}
+
+// ParseCPUs parses a CPU quantity, either a number of CPUs such as "1.5" or millicores
+// such as "500m".
+func ParseCPUs(s string) (float64, error) {
+	scale := 1.0
+	if milli, ok := strings.CutSuffix(s, "m"); ok {
+		s, scale = milli, 0.001
+	}
+	cpus, err := strconv.ParseFloat(s, 64)
+	if err != nil || cpus <= 0 {
+		return 0, fmt.Errorf("invalid CPU quantity %q", s)
+	}
+	return cpus * scale, nil
+}
+
+// ParseCIDRs parses a list of CIDRs; bare addresses are treated as single-host prefixes.
+func ParseCIDRs(list []string) ([]netip.Prefix, error) {
+	prefixes := make([]netip.Prefix, 0, len(list))
+	for _, item := range list {
+		if addr, err := netip.ParseAddr(item); err == nil {
+			prefixes = append(prefixes, netip.PrefixFrom(addr.Unmap(), addr.Unmap().BitLen()))
+			continue
+		}
+		prefix, err := netip.ParsePrefix(item)
+		if err != nil {
+			return nil, fmt.Errorf("invalid CIDR %q", item)
+		}
+		prefixes = append(prefixes, prefix.Masked())
 	}
-	return val
+	return prefixes, nil
 }
@@ -0,0 +1,44 @@
+package config
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestWarningsKubeAPIServerOnRegistryHost(t *testing.T) {
+	tests := []struct {
+		name                      string
+		apiServer, registry, mode string
+		wantWarning               bool
+	}{
+		{name: "same host", apiServer: "https://reg.example:6443", registry: "reg.example:5000", mode: AuthModeKubernetes, wantWarning: true},
+		{name: "same host without ports", apiServer: "https://REG.example", registry: "reg.example", mode: AuthModeKubernetes, wantWarning: true},
+		{name: "other host", apiServer: "https://api.example:6443", registry: "reg.example:5000", mode: AuthModeKubernetes},
+		{name: "in-cluster default", registry: "image-registry.openshift-image-registry.svc:5000", mode: AuthModeKubernetes},
+		{name: "no access reviews", apiServer: "https://reg.example:6443", registry: "reg.example:5000", mode: AuthModeNone},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("CONFIG_FILE", "")
+			t.Setenv("IMAGE_REGISTRY", tt.registry)
+			t.Setenv("AUTH_MODE", tt.mode)
+			if tt.apiServer != "" {
+				t.Setenv("KUBE_API_SERVER", tt.apiServer)
+			}
+			cfg, err := LoadConfig()
+			if err != nil {
+				t.Fatalf("LoadConfig() error = %v", err)
+			}
+
+			var warned bool
+			for _, warning := range cfg.Warnings() {
+				if strings.Contains(warning, "KUBE_API_SERVER") && strings.Contains(warning, "same host as IMAGE_REGISTRY "+tt.registry) {
+					warned = true
+				}
+			}
+			if warned != tt.wantWarning {
+				t.Errorf("Warnings() = %q, want a same-host warning: %t", cfg.Warnings(), tt.wantWarning)
+			}
+		})
+	}
+}
@@ -0,0 +1,240 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// fileValue is a setting read from CONFIG_FILE and the line it was set on.
+type fileValue struct {
+	value string
+	line  int
+}
+
+// configSource resolves each setting from its environment variable, then from CONFIG_FILE,
+// then from its default, and collects the values that could not be parsed.
+type configSource struct {
+	path string               // CONFIG_FILE, empty without a file
+	file map[string]fileValue // Settings of the file by environment variable name
+	used map[string]bool      // Settings LoadConfig looked up
+	errs []error              // Values that could not be parsed
+}
+
+// newConfigSource reads the YAML file at path, none if empty. Its keys are the names of the
+// environment variables in lowercase, such as image_registries. A list is read as the
+// comma-separated value of its variable and a mapping as its key=value entries.
+func newConfigSource(path string) (*configSource, error) {
+	src := &configSource{path: path, file: map[string]fileValue{}, used: map[string]bool{}}
+	if path == "" {
+		return src, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("CONFIG_FILE: %w", err)
+	}
+	var doc yaml.Node
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return nil, fmt.Errorf("CONFIG_FILE %s: %w", path, err)
+	}
+	if len(doc.Content) == 0 {
+		return src, nil
+	}
+	root := doc.Content[0]
+	if root.Kind != yaml.MappingNode {
+		return nil, fmt.Errorf("CONFIG_FILE %s: line %d: the file must be a mapping of settings", path, root.Line)
+	}
+	for i := 0; i+1 < len(root.Content); i += 2 {
+		key, node := root.Content[i], root.Content[i+1]
+		name := strings.ToUpper(key.Value)
+		if previous, found := src.file[name]; found {
+			return nil, fmt.Errorf("CONFIG_FILE %s: line %d: %s is already set on line %d", path, key.Line, key.Value, previous.line)
+		}
+		value, err := settingValue(node)
+		if err != nil {
+			return nil, fmt.Errorf("CONFIG_FILE %s: %s: %w", path, key.Value, err)
+		}
+		src.file[name] = fileValue{value: value, line: key.Line}
+	}
+	return src, nil
+}
+
+// settingValue returns node as the value of an environment variable.
+func settingValue(node *yaml.Node) (string, error) {
+	if node.Kind == yaml.AliasNode {
+		node = node.Alias
+	}
+	switch node.Kind {
+	case yaml.ScalarNode:
+		if node.Tag == "!!null" {
+			return "", nil
+		}
+		return node.Value, nil
+	case yaml.SequenceNode:
+		var items []string
+		for _, item := range node.Content {
+			value, err := listItem(item)
+			if err != nil {
+				return "", err
+			}
+			items = append(items, value)
+		}
+		return strings.Join(items, ","), nil
+	case yaml.MappingNode:
+		var entries []string
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			key, err := listItem(node.Content[i])
+			if err != nil {
+				return "", err
+			}
+			value, err := listItem(node.Content[i+1])
+			if err != nil {
+				return "", err
+			}
+			entries = append(entries, key+"="+value)
+		}
+		return strings.Join(entries, ","), nil
+	}
+	return "", fmt.Errorf("line %d: unsupported value", node.Line)
+}
+
+// listItem returns the scalar node as an entry of a comma-separated list.
+func listItem(node *yaml.Node) (string, error) {
+	if node.Kind == yaml.AliasNode {
+		node = node.Alias
+	}
+	if node.Kind != yaml.ScalarNode {
+		return "", fmt.Errorf("line %d: lists and mappings may only hold plain values", node.Line)
+	}
+	if strings.Contains(node.Value, ",") {
+		return "", fmt.Errorf("line %d: entry %q must not contain a comma", node.Line, node.Value)
+	}
+	return node.Value, nil
+}
+
+// lookupEnv returns the value of the setting name and whether it is set, by the environment,
+// even to an empty value, or by the file.
+func (s *configSource) lookupEnv(name string) (string, bool) {
+	s.used[name] = true
+	if value, set := os.LookupEnv(name); set {
+		return value, true
+	}
+	if value, found := s.file[name]; found {
+		return value.value, true
+	}
+	return "", false
+}
+
+// value returns the non-empty value of the setting name, preferring the environment to the
+// file, and whether it came from the file.
+func (s *configSource) value(name string) (string, bool) {
+	s.used[name] = true
+	if value := os.Getenv(name); value != "" {
+		return value, false
+	}
+	if value, found := s.file[name]; found && value.value != "" {
+		return value.value, true
+	}
+	return "", false
+}
+
+// invalid records that value, the value of the setting name, could not be parsed.
+func (s *configSource) invalid(name, value string, fromFile bool, err error) {
+	if fromFile {
+		err = fmt.Errorf("CONFIG_FILE %s: line %d: invalid %s %q: %w", s.path, s.file[name].line, strings.ToLower(name), value, err)
+	} else {
+		err = fmt.Errorf("invalid %s %q: %w", name, value, err)
+	}
+	s.errs = append(s.errs, err)
+}
+
+// unknownKeys returns the keys of the file that name no setting.
+func (s *configSource) unknownKeys() []string {
+	var keys []string
+	for name, value := range s.file {
+		if !s.used[name] {
+			keys = append(keys, fmt.Sprintf("%s (line %d)", strings.ToLower(name), value.line))
+		}
+	}
+	slices.Sort(keys)
+	return keys
+}
+
+func (s *configSource) getEnv(key, fallback string) string {
+	if value, _ := s.value(key); value != "" {
+		return value
+	}
+	return fallback
+}
+
+func (s *configSource) getEnvAsBool(name string, defaultVal bool) bool {
+	valStr, fromFile := s.value(name)
+	if valStr == "" {
+		return defaultVal
+	}
+	val, err := strconv.ParseBool(valStr)
+	if err != nil {
+		s.invalid(name, valStr, fromFile, err)
+		return defaultVal
+	}
+	return val
+}
+
+// getEnvAsList reads a comma-separated list, trimming whitespace and dropping empty items.
+func (s *configSource) getEnvAsList(name string, defaultVal []string) []string {
+	valStr, _ := s.value(name)
+	if valStr == "" {
+		return defaultVal
+	}
+	var list []string
+	for _, item := range strings.Split(valStr, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+func (s *configSource) getEnvAsInt(name string, defaultVal int) int {
+	valStr, fromFile := s.value(name)
+	if valStr == "" {
+		return defaultVal
+	}
+	val, err := strconv.Atoi(valStr)
+	if err != nil {
+		s.invalid(name, valStr, fromFile, err)
+		return defaultVal
+	}
+	return val
+}
+
+func (s *configSource) getEnvAsInt64(name string, defaultVal int64) int64 {
+	valStr, fromFile := s.value(name)
+	if valStr == "" {
+		return defaultVal
+	}
+	val, err := strconv.ParseInt(valStr, 10, 64)
+	if err != nil {
+		s.invalid(name, valStr, fromFile, err)
+		return defaultVal
+	}
+	return val
+}
+
+func (s *configSource) getEnvAsDuration(name string, defaultVal time.Duration) time.Duration {
+	valStr, fromFile := s.value(name)
+	if valStr == "" {
+		return defaultVal
+	}
+	val, err := time.ParseDuration(valStr)
+	if err != nil {
+		s.invalid(name, valStr, fromFile, err)
+		return defaultVal
+	}
+	return val
+}
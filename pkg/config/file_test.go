@@ -0,0 +1,153 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// loadFile returns the configuration of the CONFIG_FILE path.
+func loadFile(t *testing.T, path string) (*Config, error) {
+	t.Helper()
+	t.Setenv("CONFIG_FILE", path)
+	return LoadConfig()
+}
+
+// writeConfigFile writes content to a CONFIG_FILE of its own and returns its path.
+func writeConfigFile(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadConfigFile(t *testing.T) {
+	cfg, err := loadFile(t, "testdata/config.yaml")
+	if err != nil {
+		t.Fatalf("LoadConfig() error = %v", err)
+	}
+
+	if cfg.ImageName != "vddk-test" {
+		t.Errorf("ImageName = %q, want %q", cfg.ImageName, "vddk-test")
+	}
+	for _, list := range []struct {
+		name      string
+		got, want []string
+	}{
+		{"ImageRegistries", cfg.ImageRegistries, []string{"registry.example.com:5000", "quay.example.com"}},
+		{"PromoteRegistries", cfg.PromoteRegistries, []string{"quay.example.com", "registry.prod.example.com"}},
+		{"AuthAllowedGroups", cfg.AuthAllowedGroups, []string{"vddk-builders", "system:serviceaccounts:ci"}},
+		{"BuildArgs", cfg.BuildArgs, []string{"HTTP_PROXY=http://proxy.example.com:3128", "NO_PROXY=.svc"}},
+		{"JobNodeSelector", cfg.JobNodeSelector, []string{"kubernetes.io/arch=amd64", "node-role.kubernetes.io/worker="}},
+	} {
+		if !slices.Equal(list.got, list.want) {
+			t.Errorf("%s = %q, want %q", list.name, list.got, list.want)
+		}
+	}
+	if cfg.ImageRegistry != "registry.example.com:5000" {
+		t.Errorf("ImageRegistry = %q, want the first of the image registries", cfg.ImageRegistry)
+	}
+	if cfg.QuotaBytesPerDay != 10737418240 {
+		t.Errorf("QuotaBytesPerDay = %d, want %d", cfg.QuotaBytesPerDay, int64(10737418240))
+	}
+	if cfg.BuildTimeout != 45*time.Minute {
+		t.Errorf("BuildTimeout = %s, want %s", cfg.BuildTimeout, 45*time.Minute)
+	}
+	if !cfg.KeepUploads {
+		t.Error("KeepUploads = false, want true")
+	}
+}
+
+func TestLoadConfigFileEnvironmentWins(t *testing.T) {
+	t.Setenv("IMAGE_NAME", "from-env")
+	t.Setenv("IMAGE_REGISTRIES", "env.example.com")
+	t.Setenv("BUILD_TIMEOUT", "10m")
+	t.Setenv("KEEP_UPLOADS", "")
+	cfg, err := loadFile(t, "testdata/config.yaml")
+	if err != nil {
+		t.Fatalf("LoadConfig() error = %v", err)
+	}
+
+	if cfg.ImageName != "from-env" {
+		t.Errorf("ImageName = %q, want the environment's %q", cfg.ImageName, "from-env")
+	}
+	if want := []string{"env.example.com"}; !slices.Equal(cfg.ImageRegistries, want) {
+		t.Errorf("ImageRegistries = %q, want the environment's %q", cfg.ImageRegistries, want)
+	}
+	if cfg.BuildTimeout != 10*time.Minute {
+		t.Errorf("BuildTimeout = %s, want the environment's %s", cfg.BuildTimeout, 10*time.Minute)
+	}
+	// An empty variable does not hide the file
+	if !cfg.KeepUploads {
+		t.Error("KeepUploads = false, want the file's true")
+	}
+}
+
+func TestLoadConfigFileErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		want    string
+	}{
+		{
+			name:    "invalid value",
+			content: "image_name: vddk\nbuild_timeout: soon\n",
+			want:    `line 2: invalid build_timeout "soon"`,
+		},
+		{
+			name:    "invalid YAML",
+			content: "image_name: vddk\nimage_registries:\n\t- quay.example.com\n",
+			want:    "yaml: line 3",
+		},
+		{
+			name:    "duplicate key",
+			content: "image_name: vddk\nimage_name: other\n",
+			want:    "line 2: image_name is already set on line 1",
+		},
+		{
+			name:    "nested list",
+			content: "image_registries:\n  - [quay.example.com]\n",
+			want:    "line 2: lists and mappings may only hold plain values",
+		},
+		{
+			name:    "comma in an entry",
+			content: "build_args:\n  NO_PROXY: .svc,.cluster.local\n",
+			want:    `line 2: entry ".svc,.cluster.local" must not contain a comma`,
+		},
+		{
+			name:    "not a mapping",
+			content: "- image_name\n",
+			want:    "line 1: the file must be a mapping of settings",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := writeConfigFile(t, tt.content)
+			_, err := loadFile(t, path)
+			if err == nil || !strings.Contains(err.Error(), tt.want) || !strings.Contains(err.Error(), path) {
+				t.Fatalf("LoadConfig() error = %v, want one naming %s and containing %q", err, path, tt.want)
+			}
+		})
+	}
+}
+
+func TestLoadConfigFileUnknownKeys(t *testing.T) {
+	cfg, err := loadFile(t, "testdata/config.yaml")
+	if err != nil {
+		t.Fatalf("LoadConfig() error = %v", err)
+	}
+	want := "CONFIG_FILE testdata/config.yaml sets unknown setting image_regsitry (line 20), ignored"
+	if !slices.Contains(cfg.Warnings(), want) {
+		t.Errorf("Warnings() = %q, want it to contain %q", cfg.Warnings(), want)
+	}
+	for _, warning := range cfg.Warnings() {
+		if strings.Contains(warning, "unknown setting") && warning != want {
+			t.Errorf("unexpected warning %q", warning)
+		}
+	}
+}
@@ -0,0 +1,49 @@
+package k8spermissions
+
+import (
+	"context"
+	"errors"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/tools/cache"
+)
+
+// WatchConfigMap calls onChange with the ConfigMap name in namespace, read with the builder's
+// service account, whenever it is created or changed, and with nil when it is deleted. A
+// ConfigMap that does not exist when the watch starts is not reported. The watch runs in
+// the background until ctx is done and needs get, list and watch on configmaps.
+func WatchConfigMap(ctx context.Context, namespace, name string, onChange func(*corev1.ConfigMap)) error {
+	clientLock.Lock()
+	client := serviceClient
+	clientLock.Unlock()
+	if client == nil {
+		return errors.New("watching a ConfigMap needs the builder to run in a cluster or with a kubeconfig")
+	}
+
+	factory := informers.NewSharedInformerFactoryWithOptions(client, 0,
+		informers.WithNamespace(namespace),
+		informers.WithTweakListOptions(func(opts *metav1.ListOptions) {
+			opts.FieldSelector = "metadata.name=" + name
+		}))
+	informer := factory.Core().V1().ConfigMaps().Informer()
+	_, err := informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc: func(obj any) {
+			if cm, ok := obj.(*corev1.ConfigMap); ok {
+				onChange(cm)
+			}
+		},
+		UpdateFunc: func(old, obj any) {
+			if cm, ok := obj.(*corev1.ConfigMap); ok && cm.ResourceVersion != old.(*corev1.ConfigMap).ResourceVersion {
+				onChange(cm)
+			}
+		},
+		DeleteFunc: func(any) { onChange(nil) },
+	})
+	if err != nil {
+		return err
+	}
+	factory.Start(ctx.Done())
+	return nil
+}
@@ -0,0 +1,131 @@
+package k8spermissions
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/scheme"
+	typedcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/client-go/tools/record"
+)
+
+// eventComponent is the source component of every Event the builder emits.
+const eventComponent = "vddk-builder"
+
+// namespaceFile holds the namespace of the pod's service account.
+const namespaceFile = "/var/run/secrets/kubernetes.io/serviceaccount/namespace"
+
+// Rate limit of the Events emitted for the target object. The burst covers a few builds,
+// after which one Event per eventQPS interval passes and similar ones are aggregated.
+const (
+	eventBurst = 25
+	eventQPS   = 1.0 / 60
+)
+
+var (
+	eventLock        sync.Mutex
+	eventBroadcaster record.EventBroadcaster
+	eventRecorder    record.EventRecorder
+	eventTarget      *corev1.ObjectReference
+)
+
+// ConfigureEvents starts recording Events with the builder's service account. target names
+// the involved object as kind/name in the builder's namespace, the builder's own Pod if
+// empty. Configure must have been called in a pod first.
+func ConfigureEvents(target string) error {
+	clientLock.Lock()
+	client := serviceClient
+	clientLock.Unlock()
+	if client == nil {
+		return errors.New("events can only be emitted by a builder running in a cluster")
+	}
+
+	namespace, err := ownNamespace()
+	if err != nil {
+		return err
+	}
+	ref := &corev1.ObjectReference{Namespace: namespace}
+	if target == "" {
+		ref.Kind, ref.APIVersion = "Pod", "v1"
+		if ref.Name, err = ownPodName(); err != nil {
+			return err
+		}
+		// The UID lets 'oc describe pod' list the Events, but reading it needs 'get pods'
+		if pod, err := client.CoreV1().Pods(namespace).Get(context.Background(), ref.Name, metav1.GetOptions{}); err == nil {
+			ref.UID = pod.UID
+		}
+	} else {
+		kind, name, found := strings.Cut(target, "/")
+		if !found || kind == "" || name == "" || strings.Contains(name, "/") {
+			return fmt.Errorf("EVENTS_TARGET %q is not of the form kind/name", target)
+		}
+		ref.Kind, ref.Name = kind, name
+	}
+
+	broadcaster := record.NewBroadcaster(record.WithCorrelatorOptions(record.CorrelatorOptions{BurstSize: eventBurst, QPS: eventQPS}))
+	broadcaster.StartRecordingToSink(&typedcorev1.EventSinkImpl{Interface: client.CoreV1().Events(namespace)})
+
+	eventLock.Lock()
+	eventBroadcaster = broadcaster
+	eventRecorder = broadcaster.NewRecorder(scheme.Scheme, corev1.EventSource{Component: eventComponent})
+	eventTarget = ref
+	eventLock.Unlock()
+	log.Printf("Emitting Events for %s %s/%s\n", ref.Kind, namespace, ref.Name)
+	return nil
+}
+
+// RecordEvent emits an Event of eventType, corev1.EventTypeNormal or EventTypeWarning, with
+// reason and message for the target of ConfigureEvents. It does nothing when Events are not
+// configured and never blocks: Events are sent in the background and dropped when the API
+// server cannot keep up or the rate limit is exceeded.
+func RecordEvent(eventType, reason, message string) {
+	eventLock.Lock()
+	defer eventLock.Unlock()
+	if eventRecorder == nil {
+		return
+	}
+	eventRecorder.Event(eventTarget, eventType, reason, message)
+}
+
+// ownNamespace returns the namespace of the builder pod, POD_NAMESPACE or the namespace of
+// its service account.
+func ownNamespace() (string, error) {
+	if namespace := os.Getenv("POD_NAMESPACE"); namespace != "" {
+		return namespace, nil
+	}
+	raw, err := os.ReadFile(namespaceFile)
+	if err != nil {
+		return "", fmt.Errorf("failed to read the namespace of the builder: %w", err)
+	}
+	return strings.TrimSpace(string(raw)), nil
+}
+
+// ownPodName returns the name of the builder pod, POD_NAME or the hostname.
+func ownPodName() (string, error) {
+	if name := os.Getenv("POD_NAME"); name != "" {
+		return name, nil
+	}
+	name, err := os.Hostname()
+	if err != nil {
+		return "", fmt.Errorf("failed to determine the name of the builder pod: %w", err)
+	}
+	return name, nil
+}
+
+// StopEvents stops recording Events, dropping any still queued.
+func StopEvents() {
+	eventLock.Lock()
+	broadcaster := eventBroadcaster
+	eventBroadcaster, eventRecorder = nil, nil
+	eventLock.Unlock()
+	if broadcaster != nil {
+		broadcaster.Shutdown()
+	}
+}
@@ -0,0 +1,90 @@
+package k8spermissions
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+)
+
+// ImageStreamTag is the part of an OpenShift ImageStreamTag the builder reads.
+type ImageStreamTag struct {
+	Digest      string            // Digest of the image the tag points to
+	Annotations map[string]string // Annotations of the tag
+}
+
+// imageStreamTagPath returns the API path of the ImageStreamTag stream:tag in namespace.
+func imageStreamTagPath(namespace, name string) string {
+	return fmt.Sprintf("/apis/image.openshift.io/v1/namespaces/%s/imagestreamtags/%s", namespace, name)
+}
+
+// imageClient returns the client and context for a request made with token, or with the
+// builder's service account when token is empty.
+func imageClient(ctx context.Context, token string) (kubernetes.Interface, context.Context, error) {
+	clientLock.Lock()
+	defer clientLock.Unlock()
+	if token == "" {
+		if serviceClient == nil {
+			return nil, nil, errors.New("the builder has no service account outside a cluster")
+		}
+		return serviceClient, ctx, nil
+	}
+	if userClient == nil {
+		return nil, nil, errors.New("kubernetes client is not configured")
+	}
+	return userClient, context.WithValue(ctx, tokenKey{}, token), nil
+}
+
+// GetImageStreamTag reads the ImageStreamTag name, as stream:tag, in namespace with token, or
+// with the builder's service account when token is empty. It reports false if the tag does
+// not exist.
+func GetImageStreamTag(ctx context.Context, token, namespace, name string) (ImageStreamTag, bool, error) {
+	client, ctx, err := imageClient(ctx, token)
+	if err != nil {
+		return ImageStreamTag{}, false, err
+	}
+	raw, err := client.Discovery().RESTClient().Get().AbsPath(imageStreamTagPath(namespace, name)).DoRaw(ctx)
+	if apierrors.IsNotFound(err) {
+		return ImageStreamTag{}, false, nil
+	}
+	if err != nil {
+		return ImageStreamTag{}, false, fmt.Errorf("failed to get ImageStreamTag %s/%s: %w", namespace, name, err)
+	}
+
+	var tag struct {
+		Metadata struct {
+			Annotations map[string]string `json:"annotations"`
+		} `json:"metadata"`
+		Image struct {
+			Metadata struct {
+				Name string `json:"name"`
+			} `json:"metadata"`
+		} `json:"image"`
+	}
+	if err := json.Unmarshal(raw, &tag); err != nil {
+		return ImageStreamTag{}, false, fmt.Errorf("failed to decode ImageStreamTag %s/%s: %w", namespace, name, err)
+	}
+	return ImageStreamTag{Digest: tag.Image.Metadata.Name, Annotations: tag.Metadata.Annotations}, true, nil
+}
+
+// AnnotateImageStreamTag merges annotations into the ImageStreamTag name in namespace, with
+// the credentials chosen as for GetImageStreamTag.
+func AnnotateImageStreamTag(ctx context.Context, token, namespace, name string, annotations map[string]string) error {
+	client, ctx, err := imageClient(ctx, token)
+	if err != nil {
+		return err
+	}
+	patch, err := json.Marshal(map[string]any{"metadata": map[string]any{"annotations": annotations}})
+	if err != nil {
+		return err
+	}
+	err = client.Discovery().RESTClient().Patch(types.MergePatchType).AbsPath(imageStreamTagPath(namespace, name)).Body(patch).Do(ctx).Error()
+	if err != nil {
+		return fmt.Errorf("failed to annotate ImageStreamTag %s/%s: %w", namespace, name, err)
+	}
+	return nil
+}
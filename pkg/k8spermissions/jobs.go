@@ -0,0 +1,305 @@
+package k8spermissions
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"strings"
+
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// BuildIDLabel labels every build Job and its pod with the ID of the build.
+const BuildIDLabel = "io.github.yaacov.vddk-builder/build-id"
+
+// jobContainer is the name of the container running the build in a Job pod.
+const jobContainer = "build"
+
+// jobTTL is how long a finished build Job is kept for inspection before it is garbage collected.
+const jobTTL = int32(3600)
+
+// Volumes of the Job pod holding the build's files and the image storage of the build engine.
+const (
+	JobWorkDir       = "/var/tmp/vddk-builder"
+	jobStorageDir    = "/var/lib/containers"
+	jobWorkVolume    = "work"
+	jobStorageVolume = "storage"
+)
+
+// imagePullFailures are waiting reasons of a container that will not start by waiting longer.
+var imagePullFailures = []string{"ErrImagePull", "ImagePullBackOff", "InvalidImageName", "CreateContainerConfigError", "CreateContainerError"}
+
+// BuildJob describes the Job that runs a single build.
+type BuildJob struct {
+	Name           string            // Name of the Job
+	Namespace      string            // Namespace of the Job, the builder's namespace if empty
+	BuildID        string            // ID of the build, set as the BuildIDLabel
+	Image          string            // Image of the build container, the builder's own image if empty
+	ServiceAccount string            // Service account of the pod, the namespace default if empty
+	CPU            string            // CPU request and limit, none if empty
+	Memory         string            // Memory request and limit, none if empty
+	NodeSelector   map[string]string // Node labels the pod is scheduled on
+	Privileged     bool              // Run the build container privileged
+	Deadline       int64             // Seconds the Job may run, unlimited if 0
+	Args           []string          // Arguments of the build container
+	Env            map[string]string // Environment of the build container
+}
+
+// JobPod is the state of the pod of a build Job.
+type JobPod struct {
+	Name     string // Name of the pod, empty until the Job created it
+	Running  bool   // The build container started
+	Finished bool   // The build container exited, or the pod will never run
+	ExitCode int32  // Exit code of the build container once it finished
+	Message  string // Termination message of the build container once it finished
+	Reason   string // Why the pod is waiting or failed, such as Unschedulable or OOMKilled
+}
+
+// CheckJobResources verifies that cpu and memory, either of which may be empty, are
+// Kubernetes quantities.
+func CheckJobResources(cpu, memory string) error {
+	if _, err := jobResources(cpu, memory); err != nil {
+		return err
+	}
+	return nil
+}
+
+// jobResources returns cpu and memory as the requests and limits of the build container.
+func jobResources(cpu, memory string) (corev1.ResourceRequirements, error) {
+	list := corev1.ResourceList{}
+	for name, value := range map[corev1.ResourceName]string{corev1.ResourceCPU: cpu, corev1.ResourceMemory: memory} {
+		if value == "" {
+			continue
+		}
+		quantity, err := resource.ParseQuantity(value)
+		if err != nil {
+			return corev1.ResourceRequirements{}, fmt.Errorf("invalid %s quantity %q: %w", name, value, err)
+		}
+		list[name] = quantity
+	}
+	if len(list) == 0 {
+		return corev1.ResourceRequirements{}, nil
+	}
+	return corev1.ResourceRequirements{Requests: list, Limits: list}, nil
+}
+
+// CreateJob creates the Job described by job with the builder's service account and returns
+// its namespace. The pod mounts the Secret and ConfigMap volumes of the builder's own
+// container at the same paths, so files named by the configuration are found in the Job,
+// and gets empty directories for the build and the image storage.
+func CreateJob(ctx context.Context, job BuildJob) (string, error) {
+	client, err := jobClient()
+	if err != nil {
+		return "", err
+	}
+	namespace := job.Namespace
+	if namespace == "" {
+		if namespace, err = ownNamespace(); err != nil {
+			return "", err
+		}
+	}
+	resources, err := jobResources(job.CPU, job.Memory)
+	if err != nil {
+		return "", err
+	}
+
+	container := corev1.Container{
+		Name:                     jobContainer,
+		Image:                    job.Image,
+		Args:                     job.Args,
+		Resources:                resources,
+		TerminationMessagePolicy: corev1.TerminationMessageReadFile,
+		VolumeMounts: []corev1.VolumeMount{
+			{Name: jobWorkVolume, MountPath: JobWorkDir},
+			{Name: jobStorageVolume, MountPath: jobStorageDir},
+		},
+	}
+	for name, value := range job.Env {
+		container.Env = append(container.Env, corev1.EnvVar{Name: name, Value: value})
+	}
+	if job.Privileged {
+		privileged := true
+		container.SecurityContext = &corev1.SecurityContext{Privileged: &privileged}
+	}
+	volumes := []corev1.Volume{
+		{Name: jobWorkVolume, VolumeSource: corev1.VolumeSource{EmptyDir: &corev1.EmptyDirVolumeSource{}}},
+		{Name: jobStorageVolume, VolumeSource: corev1.VolumeSource{EmptyDir: &corev1.EmptyDirVolumeSource{}}},
+	}
+
+	// The builder's own container provides the default image and the mounted secrets
+	if own, err := ownContainer(ctx, client); err != nil {
+		if job.Image == "" {
+			return "", fmt.Errorf("BUILD_JOB_IMAGE must be set when the builder cannot read its own pod: %w", err)
+		}
+		log.Printf("Build Job %s does not mount the builder's secrets: %v\n", job.Name, err)
+	} else {
+		if container.Image == "" {
+			container.Image = own.container.Image
+		}
+		mounted := map[string]bool{}
+		for _, volume := range own.volumes {
+			if volume.Secret != nil || volume.ConfigMap != nil {
+				volumes = append(volumes, volume)
+				mounted[volume.Name] = true
+			}
+		}
+		for _, mount := range own.container.VolumeMounts {
+			if mounted[mount.Name] {
+				container.VolumeMounts = append(container.VolumeMounts, mount)
+			}
+		}
+	}
+
+	labels := map[string]string{BuildIDLabel: job.BuildID, "app.kubernetes.io/managed-by": FieldManager}
+	backoffLimit, ttl := int32(0), jobTTL
+	spec := &batchv1.Job{
+		ObjectMeta: metav1.ObjectMeta{Name: job.Name, Namespace: namespace, Labels: labels},
+		Spec: batchv1.JobSpec{
+			BackoffLimit:            &backoffLimit,
+			TTLSecondsAfterFinished: &ttl,
+			Template: corev1.PodTemplateSpec{
+				ObjectMeta: metav1.ObjectMeta{Labels: labels},
+				Spec: corev1.PodSpec{
+					RestartPolicy:      corev1.RestartPolicyNever,
+					ServiceAccountName: job.ServiceAccount,
+					NodeSelector:       job.NodeSelector,
+					Containers:         []corev1.Container{container},
+					Volumes:            volumes,
+				},
+			},
+		},
+	}
+	if job.Deadline > 0 {
+		spec.Spec.ActiveDeadlineSeconds = &job.Deadline
+	}
+	if _, err := client.BatchV1().Jobs(namespace).Create(ctx, spec, metav1.CreateOptions{FieldManager: FieldManager}); err != nil {
+		return "", fmt.Errorf("failed to create Job %s/%s: %w", namespace, job.Name, err)
+	}
+	return namespace, nil
+}
+
+// GetJobPod returns the state of the pod of the build Job name in namespace. A Job that failed
+// without a pod, such as one rejected by a quota or past its deadline, is reported finished.
+func GetJobPod(ctx context.Context, namespace, name string) (JobPod, error) {
+	client, err := jobClient()
+	if err != nil {
+		return JobPod{}, err
+	}
+	pods, err := client.CoreV1().Pods(namespace).List(ctx, metav1.ListOptions{LabelSelector: "job-name=" + name})
+	if err != nil {
+		return JobPod{}, fmt.Errorf("failed to list the pods of Job %s/%s: %w", namespace, name, err)
+	}
+	if len(pods.Items) == 0 {
+		job, err := client.BatchV1().Jobs(namespace).Get(ctx, name, metav1.GetOptions{})
+		if err != nil {
+			return JobPod{}, fmt.Errorf("failed to read Job %s/%s: %w", namespace, name, err)
+		}
+		for _, condition := range job.Status.Conditions {
+			if condition.Type == batchv1.JobFailed && condition.Status == corev1.ConditionTrue {
+				return JobPod{Finished: true, Reason: condition.Reason + ": " + condition.Message}, nil
+			}
+		}
+		return JobPod{}, nil
+	}
+
+	pod := pods.Items[0]
+	state := JobPod{Name: pod.Name}
+	for _, condition := range pod.Status.Conditions {
+		if condition.Type == corev1.PodScheduled && condition.Status == corev1.ConditionFalse {
+			state.Reason = condition.Reason
+		}
+	}
+	for _, status := range pod.Status.ContainerStatuses {
+		if status.Name != jobContainer {
+			continue
+		}
+		switch {
+		case status.State.Terminated != nil:
+			terminated := status.State.Terminated
+			state.Running, state.Finished = true, true
+			state.ExitCode, state.Message, state.Reason = terminated.ExitCode, terminated.Message, terminated.Reason
+		case status.State.Running != nil:
+			state.Running = true
+		case status.State.Waiting != nil:
+			state.Reason = status.State.Waiting.Reason
+			for _, failure := range imagePullFailures {
+				if state.Reason == failure {
+					state.Finished = true
+					state.Reason += ": " + status.State.Waiting.Message
+				}
+			}
+		}
+	}
+	if pod.Status.Phase == corev1.PodFailed && !state.Finished {
+		state.Finished = true
+		state.Reason = strings.TrimPrefix(pod.Status.Reason+": "+pod.Status.Message, ": ")
+	}
+	return state, nil
+}
+
+// OpenPodLogs follows the output of the build container of pod in namespace until it exits.
+func OpenPodLogs(ctx context.Context, namespace, pod string) (io.ReadCloser, error) {
+	client, err := jobClient()
+	if err != nil {
+		return nil, err
+	}
+	return client.CoreV1().Pods(namespace).GetLogs(pod, &corev1.PodLogOptions{Container: jobContainer, Follow: true}).Stream(ctx)
+}
+
+// DeleteJob deletes the Job name in namespace together with its pod, which kills a running
+// build. A Job that is already gone is not an error.
+func DeleteJob(ctx context.Context, namespace, name string) error {
+	client, err := jobClient()
+	if err != nil {
+		return err
+	}
+	propagation := metav1.DeletePropagationBackground
+	err = client.BatchV1().Jobs(namespace).Delete(ctx, name, metav1.DeleteOptions{PropagationPolicy: &propagation})
+	if err != nil && !apierrors.IsNotFound(err) {
+		return fmt.Errorf("failed to delete Job %s/%s: %w", namespace, name, err)
+	}
+	return nil
+}
+
+// jobClient returns the client build Jobs are managed with, the builder's service account.
+func jobClient() (*kubernetes.Clientset, error) {
+	clientLock.Lock()
+	defer clientLock.Unlock()
+	if serviceClient == nil {
+		return nil, errors.New("build Jobs need the builder to run in a cluster or with a kubeconfig")
+	}
+	return serviceClient, nil
+}
+
+// podContainer is the builder's own container and the volumes of its pod.
+type podContainer struct {
+	container corev1.Container
+	volumes   []corev1.Volume
+}
+
+// ownContainer reads the builder's own pod and returns its first container.
+func ownContainer(ctx context.Context, client *kubernetes.Clientset) (podContainer, error) {
+	namespace, err := ownNamespace()
+	if err != nil {
+		return podContainer{}, err
+	}
+	name, err := ownPodName()
+	if err != nil {
+		return podContainer{}, err
+	}
+	pod, err := client.CoreV1().Pods(namespace).Get(ctx, name, metav1.GetOptions{})
+	if err != nil {
+		return podContainer{}, fmt.Errorf("failed to read pod %s/%s: %w", namespace, name, err)
+	}
+	if len(pod.Spec.Containers) == 0 {
+		return podContainer{}, fmt.Errorf("pod %s/%s has no containers", namespace, name)
+	}
+	return podContainer{container: pod.Spec.Containers[0], volumes: pod.Spec.Volumes}, nil
+}
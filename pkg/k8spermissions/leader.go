@@ -0,0 +1,94 @@
+package k8spermissions
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/leaderelection"
+	"k8s.io/client-go/tools/leaderelection/resourcelock"
+)
+
+// Timing of the leader election: a leader that cannot renew the Lease for leaseRenewDeadline
+// steps down, and a new one takes over at most leaseDuration after the last renewal.
+const (
+	leaseDuration      = 15 * time.Second
+	leaseRenewDeadline = 10 * time.Second
+	leaseRetryPeriod   = 2 * time.Second
+)
+
+// leaderURLSeparator separates the pod name from the advertised URL in a holder identity.
+const leaderURLSeparator = "|"
+
+// LeaderOptions selects the Lease of the leader election and how the replica advertises itself.
+type LeaderOptions struct {
+	LeaseName      string // Name of the Lease
+	LeaseNamespace string // Namespace of the Lease, the builder's namespace if empty
+	AdvertiseURL   string // URL the other replicas send requests to while this one leads, optional
+}
+
+// RunLeaderElection campaigns for the Lease of opts with the builder's service account until
+// ctx is done, then releases it. onChange is called with whether this replica leads and the
+// identity of the holder whenever they change; the replica campaigns again after losing the
+// Lease. It blocks until ctx is done.
+func RunLeaderElection(ctx context.Context, opts LeaderOptions, onChange func(leading bool, holder string)) error {
+	clientLock.Lock()
+	client := serviceClient
+	clientLock.Unlock()
+	if client == nil {
+		return errors.New("leader election needs the builder to run in a cluster")
+	}
+	namespace := opts.LeaseNamespace
+	if namespace == "" {
+		var err error
+		if namespace, err = ownNamespace(); err != nil {
+			return err
+		}
+	}
+	identity, err := ownPodName()
+	if err != nil {
+		return err
+	}
+	if opts.AdvertiseURL != "" {
+		identity += leaderURLSeparator + opts.AdvertiseURL
+	}
+
+	lock := &resourcelock.LeaseLock{
+		LeaseMeta:  metav1.ObjectMeta{Name: opts.LeaseName, Namespace: namespace},
+		Client:     client.CoordinationV1(),
+		LockConfig: resourcelock.ResourceLockConfig{Identity: identity},
+	}
+	for ctx.Err() == nil {
+		elector, err := leaderelection.NewLeaderElector(leaderelection.LeaderElectionConfig{
+			Lock:            lock,
+			Name:            opts.LeaseName,
+			LeaseDuration:   leaseDuration,
+			RenewDeadline:   leaseRenewDeadline,
+			RetryPeriod:     leaseRetryPeriod,
+			ReleaseOnCancel: true,
+			Callbacks: leaderelection.LeaderCallbacks{
+				OnStartedLeading: func(context.Context) { onChange(true, identity) },
+				OnStoppedLeading: func() { onChange(false, "") },
+				OnNewLeader: func(holder string) {
+					if holder != identity {
+						onChange(false, holder)
+					}
+				},
+			},
+		})
+		if err != nil {
+			return err
+		}
+		elector.Run(ctx)
+	}
+	return nil
+}
+
+// SplitLeaderIdentity returns the pod name and the advertised URL, empty if none, of a
+// holder identity passed to the onChange callback of RunLeaderElection.
+func SplitLeaderIdentity(identity string) (pod, url string) {
+	pod, url, _ = strings.Cut(identity, leaderURLSeparator)
+	return pod, url
+}
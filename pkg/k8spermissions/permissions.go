@@ -2,41 +2,301 @@ package k8spermissions
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
 
+	authenticationv1 "k8s.io/api/authentication/v1"
 	v1 "k8s.io/api/authorization/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/dynamic"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/clientcmd"
 )
 
-// CreateClientWithToken creates a Kubernetes clientset using the provided token.
-func CreateClientWithToken(apiServer, token string) (*kubernetes.Clientset, error) {
-	config := &rest.Config{
-		Host:        apiServer,
-		BearerToken: token,
-		TLSClientConfig: rest.TLSClientConfig{
-			Insecure: true, // Adjust if using a trusted CA
-		},
-	}
-	return kubernetes.NewForConfig(config)
-}
-
-// CheckAccessWithToken checks if the token can perform the specified action.
-func CheckAccessWithToken(clientset *kubernetes.Clientset, verb, resource string) (bool, error) {
-	sar := &v1.SelfSubjectAccessReview{
-		Spec: v1.SelfSubjectAccessReviewSpec{
-			ResourceAttributes: &v1.ResourceAttributes{
-				Verb:     verb,
-				Resource: resource,
-			},
-		},
+// Limits of the clients shared by every access and token review.
+const (
+	clientQPS     = 20
+	clientBurst   = 40
+	clientTimeout = 10 * time.Second
+)
+
+// Options selects the Kubernetes API server the clients talk to and how it is verified.
+type Options struct {
+	Kubeconfig string // Kubeconfig files used outside a cluster, separated like KUBECONFIG, ~/.kube/config if it exists when empty
+	APIServer  string // API server used outside a cluster without a kubeconfig
+	CABundle   string // PEM file with the CAs APIServer is verified against, the system roots if empty
+	TLSVerify  bool   // Verify the API server certificate
+}
+
+var (
+	clientLock     sync.Mutex
+	userClient     *kubernetes.Clientset // Client authenticating with the token in the request context
+	serviceClient  *kubernetes.Clientset // Client with the builder's own service account or kubeconfig user, nil without either
+	serviceDynamic dynamic.Interface     // Dynamic client with the credentials of serviceClient, nil without them
+)
+
+// tokenKey is the context key of the token userClient authenticates with.
+type tokenKey struct{}
+
+// tokenTransport authenticates each request with the token in its context, so a single
+// client and its connections serve every caller.
+type tokenTransport struct {
+	next http.RoundTripper
+}
+
+func (t tokenTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	token, _ := req.Context().Value(tokenKey{}).(string)
+	if token == "" {
+		return nil, errors.New("no token to authenticate with")
+	}
+	req = req.Clone(req.Context())
+	req.Header.Set("Authorization", "Bearer "+token)
+	return t.next.RoundTrip(req)
+}
+
+// Configure sets up the clients of CheckAccessWithToken and ReviewToken. In a pod the
+// in-cluster configuration is used, otherwise the current context of opts.Kubeconfig or
+// ~/.kube/config, and without either opts.APIServer and opts.CABundle. Certificates are
+// verified unless opts.TLSVerify is false. The service account of the pod, or the user of
+// the kubeconfig, makes the reviews of ReviewToken; access reviews only ever carry the
+// caller's token.
+func Configure(opts Options) error {
+	var serviceConfig *rest.Config
+	config, err := rest.InClusterConfig()
+	switch {
+	case err == nil:
+		log.Printf("Using the in-cluster Kubernetes API server %s\n", config.Host)
+		serviceConfig = rest.CopyConfig(config)
+		config = &rest.Config{Host: config.Host, TLSClientConfig: rest.TLSClientConfig{CAFile: config.TLSClientConfig.CAFile}}
+	case errors.Is(err, rest.ErrNotInCluster):
+		kubeconfig, source, err := loadKubeconfig(opts.Kubeconfig)
+		if err != nil {
+			return err
+		}
+		if kubeconfig != nil {
+			log.Printf("Using the Kubernetes API server %s of the kubeconfig %s\n", kubeconfig.Host, source)
+			serviceConfig = kubeconfig
+			tls := kubeconfig.TLSClientConfig
+			config = &rest.Config{Host: kubeconfig.Host, TLSClientConfig: rest.TLSClientConfig{
+				Insecure: tls.Insecure, ServerName: tls.ServerName, CAFile: tls.CAFile, CAData: tls.CAData,
+			}}
+			break
+		}
+		log.Printf("Using the Kubernetes API server %s of KUBE_API_SERVER\n", opts.APIServer)
+		config = &rest.Config{Host: opts.APIServer, TLSClientConfig: rest.TLSClientConfig{CAFile: opts.CABundle}}
+		if opts.CABundle != "" {
+			if _, err := os.Stat(opts.CABundle); err != nil {
+				return fmt.Errorf("KUBE_CA_BUNDLE: %w", err)
+			}
+		}
+	default:
+		return fmt.Errorf("failed to read the in-cluster configuration: %w", err)
 	}
 
-	result, err := clientset.AuthorizationV1().SelfSubjectAccessReviews().Create(context.TODO(), sar, metav1.CreateOptions{})
+	var service *kubernetes.Clientset
+	var serviceDyn dynamic.Interface
+	if serviceConfig != nil {
+		serviceConfig.QPS, serviceConfig.Burst, serviceConfig.Timeout = clientQPS, clientBurst, clientTimeout
+		if service, err = kubernetes.NewForConfig(serviceConfig); err != nil {
+			return fmt.Errorf("failed to create the service account client: %w", err)
+		}
+		if serviceDyn, err = dynamic.NewForConfig(serviceConfig); err != nil {
+			return fmt.Errorf("failed to create the service account client: %w", err)
+		}
+	}
+	if !opts.TLSVerify {
+		config.TLSClientConfig = rest.TLSClientConfig{Insecure: true}
+	}
+	config.QPS = clientQPS
+	config.Burst = clientBurst
+	config.Timeout = clientTimeout
+	config.WrapTransport = func(rt http.RoundTripper) http.RoundTripper { return tokenTransport{next: rt} }
+	user, err := kubernetes.NewForConfig(config)
 	if err != nil {
-		return false, fmt.Errorf("failed to create SelfSubjectAccessReview: %w", err)
+		return fmt.Errorf("failed to create the Kubernetes client: %w", err)
+	}
+
+	clientLock.Lock()
+	userClient = user
+	serviceClient = service
+	serviceDynamic = serviceDyn
+	clientLock.Unlock()
+	return nil
+}
+
+// loadKubeconfig returns the client configuration of the current context of the kubeconfig
+// files in path, separated like KUBECONFIG, or of ~/.kube/config when path is empty, and
+// the files it was read from. It returns nil without an error when path is empty and
+// ~/.kube/config does not exist.
+func loadKubeconfig(path string) (*rest.Config, string, error) {
+	rules := clientcmd.NewDefaultClientConfigLoadingRules()
+	if path != "" {
+		rules.Precedence = filepath.SplitList(path)
+		for _, file := range rules.Precedence {
+			if _, err := os.Stat(file); err != nil {
+				return nil, "", fmt.Errorf("KUBECONFIG: %w", err)
+			}
+		}
+	} else {
+		if _, err := os.Stat(clientcmd.RecommendedHomeFile); errors.Is(err, fs.ErrNotExist) {
+			return nil, "", nil
+		} else if err != nil {
+			return nil, "", fmt.Errorf("failed to read the kubeconfig: %w", err)
+		}
+		rules.Precedence = []string{clientcmd.RecommendedHomeFile}
+	}
+	source := strings.Join(rules.Precedence, string(filepath.ListSeparator))
+
+	config, err := clientcmd.NewNonInteractiveDeferredLoadingClientConfig(rules, &clientcmd.ConfigOverrides{}).ClientConfig()
+	if clientcmd.IsEmptyConfig(err) {
+		return nil, "", fmt.Errorf("the kubeconfig %s has no current context; log in with 'oc login' or select one with 'oc config use-context'", source)
+	}
+	if err != nil {
+		return nil, "", fmt.Errorf("invalid kubeconfig %s: %w", source, err)
+	}
+	return config, source, nil
+}
+
+// CheckAccessWithToken checks if token is allowed every one of checks, stopping at the
+// first denied one.
+func CheckAccessWithToken(ctx context.Context, token string, checks ...v1.ResourceAttributes) (bool, error) {
+	clientLock.Lock()
+	clientset := userClient
+	clientLock.Unlock()
+	if clientset == nil {
+		return false, errors.New("kubernetes client is not configured")
 	}
 
-	return result.Status.Allowed, nil
+	ctx = context.WithValue(ctx, tokenKey{}, token)
+	for _, attributes := range checks {
+		sar := &v1.SelfSubjectAccessReview{
+			Spec: v1.SelfSubjectAccessReviewSpec{
+				ResourceAttributes: &attributes,
+			},
+		}
+
+		result, err := clientset.AuthorizationV1().SelfSubjectAccessReviews().Create(ctx, sar, metav1.CreateOptions{})
+		if err != nil {
+			return false, fmt.Errorf("failed to create SelfSubjectAccessReview: %w", err)
+		}
+		if !result.Status.Allowed {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// CheckAccessForUser checks with SubjectAccessReviews made with the builder's own service
+// account if identity is allowed every one of checks, stopping at the first denied one. It
+// serves tokens the API server does not accept itself, such as ones bound to another audience.
+func CheckAccessForUser(ctx context.Context, identity Identity, checks ...v1.ResourceAttributes) (bool, error) {
+	clientLock.Lock()
+	client := serviceClient
+	clientLock.Unlock()
+	if client == nil {
+		return false, ErrReviewUnavailable
+	}
+
+	extra := make(map[string]v1.ExtraValue, len(identity.Extra))
+	for key, value := range identity.Extra {
+		extra[key] = value
+	}
+	for _, attributes := range checks {
+		sar := &v1.SubjectAccessReview{
+			Spec: v1.SubjectAccessReviewSpec{
+				ResourceAttributes: &attributes,
+				User:               identity.Username,
+				UID:                identity.UID,
+				Groups:             identity.Groups,
+				Extra:              extra,
+			},
+		}
+
+		result, err := client.AuthorizationV1().SubjectAccessReviews().Create(ctx, sar, metav1.CreateOptions{})
+		if err != nil {
+			return false, fmt.Errorf("failed to create SubjectAccessReview: %w", err)
+		}
+		if !result.Status.Allowed {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// Identity is the user a token authenticates as.
+type Identity struct {
+	Username string
+	UID      string
+	Groups   []string
+	Extra    map[string][]string // Further attributes, such as the scopes of OpenShift tokens
+}
+
+var (
+	// ErrUnauthenticated reports a token the API server does not accept.
+	ErrUnauthenticated = errors.New("token is not authenticated")
+	// ErrReviewUnavailable reports that tokens cannot be reviewed: outside a cluster, or
+	// when the service account may not create tokenreviews.
+	ErrReviewUnavailable = errors.New("token reviews are unavailable")
+	// ErrAudienceMismatch reports a token that is valid, but not for the required audience.
+	ErrAudienceMismatch = errors.New("token is not bound to the required audience")
+)
+
+// ReviewToken resolves the identity of token with a TokenReview made with the builder's own
+// service account. A non-empty audience is requested in the review and must be among the
+// audiences the API server finds the token valid for. It returns ErrUnauthenticated for a
+// token the API server rejects, ErrAudienceMismatch for a token of other audiences and
+// ErrReviewUnavailable when no review can be made.
+func ReviewToken(ctx context.Context, token, audience string) (Identity, error) {
+	clientLock.Lock()
+	client := serviceClient
+	clientLock.Unlock()
+	if client == nil {
+		return Identity{}, ErrReviewUnavailable
+	}
+
+	review := &authenticationv1.TokenReview{Spec: authenticationv1.TokenReviewSpec{Token: token}}
+	if audience != "" {
+		review.Spec.Audiences = []string{audience}
+	}
+	result, err := client.AuthenticationV1().TokenReviews().Create(ctx, review, metav1.CreateOptions{})
+	if apierrors.IsForbidden(err) {
+		return Identity{}, fmt.Errorf("%w: %v", ErrReviewUnavailable, err)
+	}
+	if err != nil {
+		return Identity{}, fmt.Errorf("failed to create TokenReview: %w", err)
+	}
+	if !result.Status.Authenticated {
+		// The API server names the audiences when it rejects a token minted for others
+		if audience != "" && strings.Contains(result.Status.Error, "audience") {
+			return Identity{}, fmt.Errorf("%w %q: %s", ErrAudienceMismatch, audience, result.Status.Error)
+		}
+		return Identity{}, ErrUnauthenticated
+	}
+	if audience != "" && !slices.Contains(result.Status.Audiences, audience) {
+		valid := "no audience"
+		if len(result.Status.Audiences) > 0 {
+			valid = strings.Join(result.Status.Audiences, ", ")
+		}
+		return Identity{}, fmt.Errorf("%w %q, it is valid for %s", ErrAudienceMismatch, audience, valid)
+	}
+	user := result.Status.User
+	identity := Identity{Username: user.Username, UID: user.UID, Groups: user.Groups}
+	if len(user.Extra) > 0 {
+		identity.Extra = make(map[string][]string, len(user.Extra))
+		for key, value := range user.Extra {
+			identity.Extra[key] = value
+		}
+	}
+	return identity, nil
 }
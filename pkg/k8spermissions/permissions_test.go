@@ -0,0 +1,267 @@
+package k8spermissions
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	authenticationv1 "k8s.io/api/authentication/v1"
+	v1 "k8s.io/api/authorization/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/clientcmd"
+)
+
+// fakeTokenReviews serves TokenReviews from a table of token statuses, like the API server
+// does: a token bound to other audiences than the requested ones is unauthenticated.
+type fakeTokenReviews struct {
+	tokens    map[string]authenticationv1.TokenReviewStatus
+	audiences [][]string // Audiences of each review received
+}
+
+func (f *fakeTokenReviews) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost || r.URL.Path != "/apis/authentication.k8s.io/v1/tokenreviews" {
+		http.NotFound(w, r)
+		return
+	}
+	var review authenticationv1.TokenReview
+	if err := json.NewDecoder(r.Body).Decode(&review); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	f.audiences = append(f.audiences, review.Spec.Audiences)
+
+	status := f.tokens[review.Spec.Token]
+	requested := review.Spec.Audiences
+	if status.Authenticated && len(requested) > 0 && len(status.Audiences) > 0 && !slices.ContainsFunc(status.Audiences, func(a string) bool { return slices.Contains(requested, a) }) {
+		status = authenticationv1.TokenReviewStatus{Error: "[invalid bearer token, token audiences " + strings.Join(status.Audiences, ",") + " is invalid for the target audiences " + strings.Join(requested, ",") + "]"}
+	}
+	review.Status = status
+	review.APIVersion, review.Kind = "authentication.k8s.io/v1", "TokenReview"
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(review)
+}
+
+// useTokenReviews points the service client at f until the test ends.
+func useTokenReviews(t *testing.T, f *fakeTokenReviews) {
+	t.Helper()
+	server := httptest.NewServer(f)
+	t.Cleanup(server.Close)
+	client, err := kubernetes.NewForConfig(&rest.Config{Host: server.URL, ContentConfig: rest.ContentConfig{ContentType: "application/json"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	clientLock.Lock()
+	previous := serviceClient
+	serviceClient = client
+	clientLock.Unlock()
+	t.Cleanup(func() {
+		clientLock.Lock()
+		serviceClient = previous
+		clientLock.Unlock()
+	})
+}
+
+func TestReviewToken(t *testing.T) {
+	user := authenticationv1.UserInfo{Username: "system:serviceaccount:ci:uploader", UID: "1234", Groups: []string{"system:serviceaccounts"}}
+	reviews := &fakeTokenReviews{tokens: map[string]authenticationv1.TokenReviewStatus{
+		"bound":  {Authenticated: true, User: user, Audiences: []string{"vddk-builder"}},
+		"legacy": {Authenticated: true, User: user},
+	}}
+	useTokenReviews(t, reviews)
+
+	tests := []struct {
+		name     string
+		token    string
+		audience string
+		wantErr  error
+		wantMsg  string
+	}{
+		{name: "matching audience", token: "bound", audience: "vddk-builder"},
+		{name: "wrong audience", token: "bound", audience: "other", wantErr: ErrAudienceMismatch, wantMsg: "token audiences vddk-builder"},
+		{name: "unauthenticated", token: "expired", audience: "vddk-builder", wantErr: ErrUnauthenticated},
+		{name: "legacy token without required audience", token: "legacy"},
+		{name: "legacy token with required audience", token: "legacy", audience: "vddk-builder", wantErr: ErrAudienceMismatch, wantMsg: "it is valid for no audience"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			reviews.audiences = nil
+			identity, err := ReviewToken(context.Background(), tt.token, tt.audience)
+
+			var want []string
+			if tt.audience != "" {
+				want = []string{tt.audience}
+			}
+			if len(reviews.audiences) != 1 || !slices.Equal(reviews.audiences[0], want) {
+				t.Errorf("reviews requested audiences %q, want one review for %q", reviews.audiences, want)
+			}
+			if tt.wantErr != nil {
+				if !errors.Is(err, tt.wantErr) || !strings.Contains(err.Error(), tt.wantMsg) {
+					t.Fatalf("ReviewToken() error = %v, want %v containing %q", err, tt.wantErr, tt.wantMsg)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ReviewToken() error = %v", err)
+			}
+			if identity.Username != user.Username || identity.UID != user.UID || !slices.Equal(identity.Groups, user.Groups) {
+				t.Errorf("ReviewToken() = %+v, want the user %+v", identity, user)
+			}
+		})
+	}
+}
+
+func TestReviewTokenUnavailable(t *testing.T) {
+	clientLock.Lock()
+	previous := serviceClient
+	serviceClient = nil
+	clientLock.Unlock()
+	t.Cleanup(func() {
+		clientLock.Lock()
+		serviceClient = previous
+		clientLock.Unlock()
+	})
+
+	if _, err := ReviewToken(context.Background(), "bound", ""); !errors.Is(err, ErrReviewUnavailable) {
+		t.Errorf("ReviewToken() error = %v, want %v", err, ErrReviewUnavailable)
+	}
+}
+
+// fakeAccessReviews allows every SelfSubjectAccessReview and SubjectAccessReview and records
+// the path and Authorization header of each one.
+type fakeAccessReviews struct {
+	mu       sync.Mutex
+	requests []string
+}
+
+func (f *fakeAccessReviews) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	f.requests = append(f.requests, r.URL.Path+" "+r.Header.Get("Authorization"))
+	f.mu.Unlock()
+	kind := strings.TrimPrefix(r.URL.Path, "/apis/authorization.k8s.io/v1/")
+	if r.Method != http.MethodPost || (kind != "selfsubjectaccessreviews" && kind != "subjectaccessreviews") {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	fmt.Fprintf(w, `{"apiVersion":"authorization.k8s.io/v1","kind":%q,"status":{"allowed":true}}`, map[string]string{
+		"selfsubjectaccessreviews": "SelfSubjectAccessReview", "subjectaccessreviews": "SubjectAccessReview",
+	}[kind])
+}
+
+func (f *fakeAccessReviews) received() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return slices.Clone(f.requests)
+}
+
+// outsideCluster makes Configure see neither a pod nor ~/.kube/config and restores the
+// clients it sets up when the test ends.
+func outsideCluster(t *testing.T) {
+	t.Setenv("KUBERNETES_SERVICE_HOST", "")
+	previousHome := clientcmd.RecommendedHomeFile
+	clientcmd.RecommendedHomeFile = filepath.Join(t.TempDir(), "config")
+	clientLock.Lock()
+	previousUser, previousService, previousDynamic := userClient, serviceClient, serviceDynamic
+	clientLock.Unlock()
+	t.Cleanup(func() {
+		clientcmd.RecommendedHomeFile = previousHome
+		clientLock.Lock()
+		userClient, serviceClient, serviceDynamic = previousUser, previousService, previousDynamic
+		clientLock.Unlock()
+	})
+}
+
+func TestConfigureUsesAPIServer(t *testing.T) {
+	reviews := &fakeAccessReviews{}
+	apiServer := httptest.NewTLSServer(reviews)
+	defer apiServer.Close()
+	var registryRequests atomic.Int32
+	registry := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { registryRequests.Add(1) }))
+	defer registry.Close()
+	apiHost := apiServer.Listener.Addr().String()
+	check := v1.ResourceAttributes{Namespace: "ci", Verb: "create", Resource: "imagestreams"}
+
+	t.Run("KUBE_API_SERVER", func(t *testing.T) {
+		outsideCluster(t)
+		reviews.requests = nil
+		if err := Configure(Options{APIServer: apiServer.URL}); err != nil {
+			t.Fatalf("Configure() error = %v", err)
+		}
+		if host := userClient.AuthorizationV1().RESTClient().Get().URL().Host; host != apiHost {
+			t.Errorf("user client host = %s, want %s", host, apiHost)
+		}
+		if serviceClient != nil {
+			t.Errorf("service client with host %s, want none without a kubeconfig", serviceClient.AuthorizationV1().RESTClient().Get().URL().Host)
+		}
+
+		if allowed, err := CheckAccessWithToken(context.Background(), "caller-token", check); err != nil || !allowed {
+			t.Fatalf("CheckAccessWithToken() = %t, %v; want allowed", allowed, err)
+		}
+		if _, err := CheckAccessForUser(context.Background(), Identity{Username: "uploader"}, check); !errors.Is(err, ErrReviewUnavailable) {
+			t.Errorf("CheckAccessForUser() error = %v, want %v", err, ErrReviewUnavailable)
+		}
+		want := []string{"/apis/authorization.k8s.io/v1/selfsubjectaccessreviews Bearer caller-token"}
+		if got := reviews.received(); !slices.Equal(got, want) {
+			t.Errorf("API server received %q, want %q", got, want)
+		}
+	})
+
+	t.Run("kubeconfig", func(t *testing.T) {
+		outsideCluster(t)
+		reviews.requests = nil
+		kubeconfig := filepath.Join(t.TempDir(), "kubeconfig")
+		if err := os.WriteFile(kubeconfig, []byte(`apiVersion: v1
+kind: Config
+clusters:
+- name: test
+  cluster: {server: "`+apiServer.URL+`", insecure-skip-tls-verify: true}
+users:
+- name: builder
+  user: {token: service-token}
+contexts:
+- name: test
+  context: {cluster: test, user: builder}
+current-context: test
+`), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		if err := Configure(Options{Kubeconfig: kubeconfig, APIServer: "https://" + registry.Listener.Addr().String()}); err != nil {
+			t.Fatalf("Configure() error = %v", err)
+		}
+		for name, client := range map[string]*kubernetes.Clientset{"user": userClient, "service": serviceClient} {
+			if host := client.AuthorizationV1().RESTClient().Get().URL().Host; host != apiHost {
+				t.Errorf("%s client host = %s, want %s", name, host, apiHost)
+			}
+		}
+
+		if allowed, err := CheckAccessWithToken(context.Background(), "caller-token", check); err != nil || !allowed {
+			t.Fatalf("CheckAccessWithToken() = %t, %v; want allowed", allowed, err)
+		}
+		if allowed, err := CheckAccessForUser(context.Background(), Identity{Username: "uploader"}, check); err != nil || !allowed {
+			t.Fatalf("CheckAccessForUser() = %t, %v; want allowed", allowed, err)
+		}
+		want := []string{
+			"/apis/authorization.k8s.io/v1/selfsubjectaccessreviews Bearer caller-token",
+			"/apis/authorization.k8s.io/v1/subjectaccessreviews Bearer service-token",
+		}
+		if got := reviews.received(); !slices.Equal(got, want) {
+			t.Errorf("API server received %q, want %q", got, want)
+		}
+	})
+
+	if n := registryRequests.Load(); n > 0 {
+		t.Errorf("registry received %d requests, want none", n)
+	}
+}
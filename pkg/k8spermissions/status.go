@@ -0,0 +1,183 @@
+package k8spermissions
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"time"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/dynamic"
+)
+
+// Labels of the build status objects. ImageNameLabel holds the image name with the
+// characters a label value cannot hold, such as '/', replaced by '.'.
+const (
+	StatusLabel    = "io.github.yaacov.vddk-builder/build-status"
+	ImageNameLabel = "io.github.yaacov.vddk-builder/image-name"
+)
+
+// statusKind is the kind of the custom resource the status is written to with useResource.
+const statusKind = "VDDKBuild"
+
+var (
+	configMapResource = schema.GroupVersionResource{Version: "v1", Resource: "configmaps"}
+	statusResource    = schema.GroupVersionResource{Group: "vddk-builder.yaacov.github.io", Version: "v1alpha1", Resource: "vddkbuilds"}
+)
+
+// BuildStatus is the state of one build as written to its status object.
+type BuildStatus struct {
+	BuildID    string
+	ImageName  string // Image name without registry and tag, the ImageNameLabel
+	Reference  string
+	Digest     string
+	State      string
+	Phase      string
+	Error      string
+	StartedAt  time.Time
+	FinishedAt *time.Time
+}
+
+// StatusWriter writes build status objects with the builder's service account.
+type StatusWriter struct {
+	client    dynamic.Interface
+	resource  schema.GroupVersionResource
+	namespace string
+}
+
+// NewStatusWriter returns a StatusWriter for ConfigMaps in namespace, the builder's
+// namespace if empty, or for VDDKBuild resources when useResource is set. Without the
+// VDDKBuild CRD installed ConfigMaps are written instead.
+func NewStatusWriter(namespace string, useResource bool) (*StatusWriter, error) {
+	clientLock.Lock()
+	client, discovery := serviceDynamic, serviceClient
+	clientLock.Unlock()
+	if client == nil {
+		return nil, errors.New("status objects need the builder to run in a cluster or with a kubeconfig")
+	}
+	if namespace == "" {
+		var err error
+		if namespace, err = ownNamespace(); err != nil {
+			return nil, err
+		}
+	}
+
+	w := &StatusWriter{client: client, resource: configMapResource, namespace: namespace}
+	if useResource {
+		if installed, err := resourceInstalled(discovery.Discovery().ServerResourcesForGroupVersion(statusResource.GroupVersion().String())); installed {
+			w.resource = statusResource
+		} else {
+			log.Printf("The %s CRD is not installed (%v), writing the build status to ConfigMaps\n", statusResource.GroupResource(), err)
+		}
+	}
+	return w, nil
+}
+
+// resourceInstalled reports whether the discovered resources list statusResource.
+func resourceInstalled(resources *metav1.APIResourceList, err error) (bool, error) {
+	if err != nil {
+		return false, err
+	}
+	for _, resource := range resources.APIResources {
+		if resource.Name == statusResource.Resource {
+			return true, nil
+		}
+	}
+	return false, fmt.Errorf("%s does not serve %s", statusResource.GroupVersion(), statusResource.Resource)
+}
+
+// Apply creates or updates the status object name with status, using server-side apply as
+// FieldManager. The fields of status that are empty are removed from the object.
+func (w *StatusWriter) Apply(ctx context.Context, name string, status BuildStatus) error {
+	fields := map[string]any{}
+	for key, value := range map[string]string{
+		"buildID":   status.BuildID,
+		"imageName": status.ImageName,
+		"reference": status.Reference,
+		"digest":    status.Digest,
+		"state":     status.State,
+		"phase":     status.Phase,
+		"error":     status.Error,
+		"startedAt": status.StartedAt.Format(time.RFC3339),
+	} {
+		if value != "" {
+			fields[key] = value
+		}
+	}
+	if status.FinishedAt != nil {
+		fields["finishedAt"] = status.FinishedAt.Format(time.RFC3339)
+	}
+
+	object := &unstructured.Unstructured{Object: map[string]any{}}
+	if w.resource == statusResource {
+		object.SetAPIVersion(statusResource.GroupVersion().String())
+		object.SetKind(statusKind)
+		object.Object["status"] = fields
+	} else {
+		object.SetAPIVersion("v1")
+		object.SetKind("ConfigMap")
+		object.Object["data"] = fields
+	}
+	object.SetNamespace(w.namespace)
+	object.SetName(name)
+	object.SetLabels(map[string]string{
+		StatusLabel:                    "true",
+		BuildIDLabel:                   status.BuildID,
+		ImageNameLabel:                 labelValue(status.ImageName),
+		"app.kubernetes.io/managed-by": FieldManager,
+	})
+
+	_, err := w.client.Resource(w.resource).Namespace(w.namespace).Apply(ctx, name, object, metav1.ApplyOptions{FieldManager: FieldManager, Force: true})
+	if err != nil {
+		return fmt.Errorf("failed to apply %s %s/%s: %w", w.resource.Resource, w.namespace, name, err)
+	}
+	return nil
+}
+
+// Prune deletes the oldest status objects until keep are left.
+func (w *StatusWriter) Prune(ctx context.Context, keep int) error {
+	resource := w.client.Resource(w.resource).Namespace(w.namespace)
+	list, err := resource.List(ctx, metav1.ListOptions{LabelSelector: StatusLabel + "=true"})
+	if err != nil {
+		return fmt.Errorf("failed to list the %s of the build status: %w", w.resource.Resource, err)
+	}
+	items := list.Items
+	if len(items) <= keep {
+		return nil
+	}
+	sort.Slice(items, func(i, j int) bool {
+		ti, tj := items[i].GetCreationTimestamp(), items[j].GetCreationTimestamp()
+		if ti.Equal(&tj) {
+			return items[i].GetName() < items[j].GetName()
+		}
+		return ti.Before(&tj)
+	})
+	for _, item := range items[:len(items)-keep] {
+		err := resource.Delete(ctx, item.GetName(), metav1.DeleteOptions{})
+		if err != nil && !apierrors.IsNotFound(err) {
+			return fmt.Errorf("failed to delete %s %s/%s: %w", w.resource.Resource, w.namespace, item.GetName(), err)
+		}
+	}
+	return nil
+}
+
+// labelValue returns s as a label value: at most 63 letters, digits, '-', '_' and '.',
+// starting and ending with a letter or digit. Other characters are replaced by '.'.
+func labelValue(s string) string {
+	value := strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-' || r == '_' || r == '.' {
+			return r
+		}
+		return '.'
+	}, s)
+	if len(value) > 63 {
+		value = value[:63]
+	}
+	return strings.Trim(value, "-_.")
+}
@@ -0,0 +1,101 @@
+package k8spermissions
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+// FieldManager owns the fields the builder sets with server-side apply.
+const FieldManager = "vddk-builder"
+
+// UpdateTarget is the field of a Kubernetes object that holds the VDDK image reference.
+type UpdateTarget struct {
+	Resource  schema.GroupVersionResource // Resource of the object
+	Namespace string                      // Namespace of the object
+	Name      string                      // Name of the object
+	Path      []string                    // Fields leading to the image reference, such as data and a ConfigMap key
+}
+
+// String returns the target as resource namespace/name field.path.
+func (t UpdateTarget) String() string {
+	resource := t.Resource.Resource
+	if t.Resource.Group != "" {
+		resource += "." + t.Resource.Group
+	}
+	return fmt.Sprintf("%s %s/%s %s", resource, t.Namespace, t.Name, strings.Join(t.Path, "."))
+}
+
+// ParseUpdateTarget parses "configmap:namespace/name:key" or
+// "group/version/resource:namespace/name:field.path", such as
+// "forklift.konveyor.io/v1beta1/providers:openshift-mtv/vcenter:spec.settings.vddkInitImage".
+func ParseUpdateTarget(s string) (UpdateTarget, error) {
+	parts := strings.Split(s, ":")
+	if len(parts) != 3 {
+		return UpdateTarget{}, fmt.Errorf("%q is not of the form resource:namespace/name:field", s)
+	}
+	var target UpdateTarget
+	namespace, name, found := strings.Cut(parts[1], "/")
+	if !found || namespace == "" || name == "" || strings.Contains(name, "/") {
+		return UpdateTarget{}, fmt.Errorf("%q does not name the object as namespace/name", s)
+	}
+	target.Namespace, target.Name = namespace, name
+	if parts[2] == "" {
+		return UpdateTarget{}, fmt.Errorf("%q names no field", s)
+	}
+
+	if strings.EqualFold(parts[0], "configmap") {
+		target.Resource = schema.GroupVersionResource{Version: "v1", Resource: "configmaps"}
+		target.Path = []string{"data", parts[2]}
+		return target, nil
+	}
+	gvr := strings.Split(parts[0], "/")
+	if len(gvr) != 3 || gvr[0] == "" || gvr[1] == "" || gvr[2] == "" {
+		return UpdateTarget{}, fmt.Errorf("%q names neither configmap nor group/version/resource", s)
+	}
+	target.Resource = schema.GroupVersionResource{Group: gvr[0], Version: gvr[1], Resource: gvr[2]}
+	target.Path = strings.Split(parts[2], ".")
+	for _, field := range target.Path {
+		if field == "" {
+			return UpdateTarget{}, fmt.Errorf("%q has an empty field name", s)
+		}
+	}
+	return target, nil
+}
+
+// ApplyImageReference sets the field of target to image with server-side apply as
+// FieldManager, using the builder's service account. Conflicting owners of the field,
+// such as an earlier manual edit, are overridden.
+func ApplyImageReference(ctx context.Context, target UpdateTarget, image string) error {
+	clientLock.Lock()
+	client := serviceDynamic
+	clientLock.Unlock()
+	if client == nil {
+		return errors.New("the builder has no service account outside a cluster")
+	}
+
+	resource := client.Resource(target.Resource).Namespace(target.Namespace)
+	current, err := resource.Get(ctx, target.Name, metav1.GetOptions{})
+	if err != nil {
+		return fmt.Errorf("failed to get %s: %w", target, err)
+	}
+
+	patch := &unstructured.Unstructured{Object: map[string]any{}}
+	patch.SetAPIVersion(current.GetAPIVersion())
+	patch.SetKind(current.GetKind())
+	patch.SetNamespace(target.Namespace)
+	patch.SetName(target.Name)
+	if err := unstructured.SetNestedField(patch.Object, image, target.Path...); err != nil {
+		return fmt.Errorf("failed to set %s: %w", target, err)
+	}
+	_, err = resource.Apply(ctx, target.Name, patch, metav1.ApplyOptions{FieldManager: FieldManager, Force: true})
+	if err != nil {
+		return fmt.Errorf("failed to apply %s: %w", target, err)
+	}
+	return nil
+}
@@ -0,0 +1,386 @@
+package registry
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"math/rand/v2"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// tokenUser is the user name paired with the caller's token when it is exchanged at a token
+// service, matching the auth files written for skopeo.
+const tokenUser = "serviceaccount"
+
+// minRateLimitWait is the shortest wait after a 429 answer without a Retry-After.
+const minRateLimitWait = time.Second
+
+// defaultTokenLifetime is how long a token is cached when the token service omits expires_in.
+const defaultTokenLifetime = 60 * time.Second
+
+// Transport limits of the shared client.
+const (
+	maxIdleConnsPerHost = 8
+	tlsHandshakeTimeout = 10 * time.Second
+	idleConnTimeout     = 90 * time.Second
+)
+
+// The client shared by every registry operation and its retry policy, set by Configure.
+// Until then certificates are verified against the system roots and requests are not retried.
+var (
+	httpClient       = newClient(&tls.Config{}, 30*time.Second)
+	retries          = 1
+	retryBackoff     time.Duration
+	rateLimitMaxWait time.Duration
+)
+
+// newClient returns an HTTP client verifying certificates with tlsConfig that keeps
+// connections to each registry open for reuse.
+func newClient(tlsConfig *tls.Config, timeout time.Duration) *http.Client {
+	return &http.Client{
+		Timeout: timeout,
+		Transport: &http.Transport{
+			Proxy:               http.ProxyFromEnvironment,
+			TLSClientConfig:     tlsConfig,
+			TLSHandshakeTimeout: tlsHandshakeTimeout,
+			MaxIdleConnsPerHost: maxIdleConnsPerHost,
+			IdleConnTimeout:     idleConnTimeout,
+		},
+	}
+}
+
+// RateLimitedError reports a registry that kept answering 429 Too Many Requests for longer
+// than the configured maximum wait.
+type RateLimitedError struct {
+	Registry   string
+	RetryAfter time.Duration // What the last answer asked to wait, 0 if it did not say
+}
+
+func (e *RateLimitedError) Error() string {
+	if e.RetryAfter > 0 {
+		return fmt.Sprintf("registry %s is rate limiting requests, retry after %s", e.Registry, e.RetryAfter)
+	}
+	return fmt.Sprintf("registry %s is rate limiting requests", e.Registry)
+}
+
+// retryAfter parses a Retry-After header given in seconds or as an HTTP date. It returns 0
+// when the header is absent or invalid.
+func retryAfter(header string) time.Duration {
+	if header == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(header); err == nil && seconds >= 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	if at, err := http.ParseTime(header); err == nil {
+		return max(time.Until(at), 0)
+	}
+	return 0
+}
+
+// send sends req with the shared client, retrying network errors and 5xx answers up to the
+// configured number of attempts, waiting the backoff with up to 50% jitter in between.
+// Certificate errors and a cancelled request context are not retried. A 429 answer is
+// retried after its Retry-After, or the backoff, for up to the configured maximum wait in
+// total, and then reported as a *RateLimitedError.
+func send(req *http.Request) (*http.Response, error) {
+	backoff := retryBackoff
+	var rateLimitWait time.Duration
+	for attempt := 1; ; attempt++ {
+		resp, err := roundTrip(req)
+		if err == nil && resp.StatusCode == http.StatusTooManyRequests {
+			rateLimitedTotal.Inc(req.URL.Host)
+			wait := retryAfter(resp.Header.Get("Retry-After"))
+			asked := wait
+			if wait == 0 {
+				wait = max(backoff+rand.N(backoff/2+1), minRateLimitWait)
+				backoff *= 2
+			}
+			io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+			if rateLimitWait+wait > rateLimitMaxWait {
+				return nil, &RateLimitedError{Registry: req.URL.Host, RetryAfter: asked}
+			}
+			rateLimitWait += wait
+			log.Printf("Registry %s rate limited %s %s, retrying in %s\n", req.URL.Host, req.Method, req.URL.Redacted(), wait.Round(time.Millisecond))
+			select {
+			case <-time.After(wait):
+			case <-req.Context().Done():
+				return nil, req.Context().Err()
+			}
+			attempt--
+			continue
+		}
+		transient := err != nil && req.Context().Err() == nil && !isCertificateError(err) ||
+			err == nil && resp.StatusCode >= http.StatusInternalServerError
+		if !transient || attempt >= retries {
+			return resp, err
+		}
+		if err == nil {
+			io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+			err = fmt.Errorf("HTTP status code %d", resp.StatusCode)
+		}
+
+		wait := backoff
+		if backoff > 0 {
+			wait += rand.N(backoff/2 + 1)
+		}
+		log.Printf("Attempt %d/%d of %s %s failed, retrying in %s: %v\n", attempt, retries, req.Method, req.URL.Redacted(), wait.Round(time.Millisecond), err)
+		select {
+		case <-time.After(wait):
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		}
+		backoff *= 2
+	}
+}
+
+// authConfigs holds the basic credentials per registry read from REGISTRY_AUTH_CONFIG.
+var (
+	authLock    sync.RWMutex
+	authConfigs map[string]string
+)
+
+// cachedToken is a token issued by a token service and the time it stops being used.
+type cachedToken struct {
+	token   string
+	expires time.Time
+}
+
+var (
+	tokensLock sync.Mutex
+	tokens     = map[string]cachedToken{}
+)
+
+// ConfigureAuth reads the containers-auth.json at path, whose credentials are offered to
+// token services of registries the caller's token is not meant for. An empty path clears
+// them. It may be called again to pick up rotated credentials.
+func ConfigureAuth(path string) error {
+	if path == "" {
+		authLock.Lock()
+		authConfigs = nil
+		authLock.Unlock()
+		return nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read registry auth config: %w", err)
+	}
+	var file struct {
+		Auths map[string]struct {
+			Auth string `json:"auth"`
+		} `json:"auths"`
+	}
+	if err := json.Unmarshal(data, &file); err != nil {
+		return fmt.Errorf("failed to parse registry auth config %s: %w", path, err)
+	}
+	configs := make(map[string]string, len(file.Auths))
+	for registryURL, entry := range file.Auths {
+		if entry.Auth != "" {
+			configs[normalizeAuthHost(registryURL)] = entry.Auth
+		}
+	}
+	authLock.Lock()
+	authConfigs = configs
+	authLock.Unlock()
+	return nil
+}
+
+// HasCredentials reports whether REGISTRY_AUTH_CONFIG holds credentials for registryURL.
+// Those are used instead of the caller's token, which then never reaches the registry.
+func HasCredentials(registryURL string) bool {
+	authLock.RLock()
+	defer authLock.RUnlock()
+	_, ok := authConfigs[registryURL]
+	return ok
+}
+
+// basicAuth returns the base64 user:password offered to host, the registry itself or its
+// token service: the configured credentials of the registry, else the caller's token if
+// host is the registry, else none. The caller's token is never handed to a third-party
+// token service.
+func basicAuth(registryURL, authToken, host string) string {
+	authLock.RLock()
+	auth, ok := authConfigs[registryURL]
+	authLock.RUnlock()
+	if ok {
+		return auth
+	}
+	if authToken != "" && host == registryURL {
+		return base64.StdEncoding.EncodeToString([]byte(tokenUser + ":" + authToken))
+	}
+	return ""
+}
+
+// do sends req to registryURL with the caller's token, unless REGISTRY_AUTH_CONFIG has
+// credentials for the registry. When the registry answers 401 with a challenge it retries
+// once: a Bearer challenge is answered with a token from the named token service, cached
+// until it expires, and a Basic challenge with the configured credentials. scope is
+// requested when the challenge does not name one.
+func do(req *http.Request, registryURL, authToken, scope string) (*http.Response, error) {
+	return authorize(send, req, registryURL, authToken, scope)
+}
+
+// authorize is do with send replaced, so a Ping can skip the retries.
+func authorize(send func(*http.Request) (*http.Response, error), req *http.Request, registryURL, authToken, scope string) (*http.Response, error) {
+	if HasCredentials(registryURL) {
+		authToken = ""
+	}
+	if authToken != "" {
+		req.Header.Set("Authorization", "Bearer "+authToken)
+	}
+	resp, err := send(req)
+	if err != nil || resp.StatusCode != http.StatusUnauthorized {
+		return resp, err
+	}
+
+	scheme, params := parseChallenge(resp.Header.Get("WWW-Authenticate"))
+	var authorization string
+	switch scheme {
+	case "bearer":
+		if params["scope"] == "" {
+			params["scope"] = scope
+		}
+		var realmHost string
+		if realm, err := url.Parse(params["realm"]); err == nil {
+			realmHost = realm.Host
+		}
+		token, err := fetchToken(req.Context(), params, basicAuth(registryURL, authToken, realmHost))
+		if err != nil {
+			resp.Body.Close()
+			return nil, fmt.Errorf("registry %s: %w", registryURL, err)
+		}
+		authorization = "Bearer " + token
+	case "basic":
+		auth := basicAuth(registryURL, authToken, registryURL)
+		if auth == "" {
+			return resp, nil
+		}
+		authorization = "Basic " + auth
+	default:
+		return resp, nil
+	}
+	resp.Body.Close()
+
+	retry := req.Clone(req.Context())
+	retry.Header.Set("Authorization", authorization)
+	return send(retry)
+}
+
+// parseChallenge splits a WWW-Authenticate header into its lower-cased scheme and parameters.
+func parseChallenge(header string) (string, map[string]string) {
+	scheme, rest, _ := strings.Cut(strings.TrimSpace(header), " ")
+	params := map[string]string{}
+	for rest = strings.TrimSpace(rest); rest != ""; rest = strings.TrimLeft(strings.TrimSpace(rest), ",") {
+		key, value, found := strings.Cut(rest, "=")
+		if !found {
+			break
+		}
+		key = strings.ToLower(strings.TrimSpace(key))
+		value = strings.TrimSpace(value)
+		if strings.HasPrefix(value, `"`) {
+			end := strings.Index(value[1:], `"`)
+			if end < 0 {
+				params[key] = value[1:]
+				break
+			}
+			params[key] = value[1 : end+1]
+			rest = value[end+2:]
+		} else {
+			params[key], rest, _ = strings.Cut(value, ",")
+		}
+		rest = strings.TrimSpace(rest)
+	}
+	return strings.ToLower(scheme), params
+}
+
+// fetchToken returns a token from the token service at params["realm"] for the service and
+// scope in params, authenticating with basic when set and anonymously otherwise.
+func fetchToken(ctx context.Context, params map[string]string, basic string) (string, error) {
+	realm := params["realm"]
+	if realm == "" {
+		return "", fmt.Errorf("bearer challenge names no token service")
+	}
+	sum := sha256.Sum256([]byte(basic))
+	key := strings.Join([]string{realm, params["service"], params["scope"], hex.EncodeToString(sum[:])}, "\x00")
+
+	tokensLock.Lock()
+	cached, ok := tokens[key]
+	tokensLock.Unlock()
+	if ok && time.Now().Before(cached.expires) {
+		return cached.token, nil
+	}
+
+	tokenURL, err := url.Parse(realm)
+	if err != nil {
+		return "", fmt.Errorf("invalid token service %q: %w", realm, err)
+	}
+	query := tokenURL.Query()
+	if service := params["service"]; service != "" {
+		query.Set("service", service)
+	}
+	if scope := params["scope"]; scope != "" {
+		query.Set("scope", scope)
+	}
+	tokenURL.RawQuery = query.Encode()
+
+	req, err := http.NewRequestWithContext(ctx, "GET", tokenURL.String(), nil)
+	if err != nil {
+		return "", err
+	}
+	if basic != "" {
+		req.Header.Set("Authorization", "Basic "+basic)
+	}
+	resp, err := send(req)
+	if err != nil {
+		return "", fmt.Errorf("token service %s: %w", tokenURL.Host, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("token service %s: %w", tokenURL.Host, responseError(resp))
+	}
+
+	var body struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return "", fmt.Errorf("token service %s: %w", tokenURL.Host, err)
+	}
+	token := body.Token
+	if token == "" {
+		token = body.AccessToken
+	}
+	if token == "" {
+		return "", fmt.Errorf("token service %s returned no token", tokenURL.Host)
+	}
+
+	lifetime := defaultTokenLifetime
+	if body.ExpiresIn > 0 {
+		lifetime = time.Duration(body.ExpiresIn) * time.Second
+	}
+	tokensLock.Lock()
+	// Stop using the token a little before it expires so it is not rejected in flight
+	tokens[key] = cachedToken{token: token, expires: time.Now().Add(lifetime * 9 / 10)}
+	tokensLock.Unlock()
+	return token, nil
+}
+
+// repositoryScope returns the token scope granting actions on repository.
+func repositoryScope(repository, actions string) string {
+	return "repository:" + repository + ":" + actions
+}
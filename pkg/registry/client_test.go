@@ -0,0 +1,125 @@
+package registry
+
+import (
+	"context"
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// stubRegistry serves handler over HTTPS and returns its host:port, trusted by the shared
+// client until the test ends. Cached tokens do not outlive the test.
+func stubRegistry(t *testing.T, handler http.Handler) string {
+	t.Helper()
+	server := httptest.NewTLSServer(handler)
+	t.Cleanup(server.Close)
+
+	previous := httpClient
+	httpClient = server.Client()
+	t.Cleanup(func() {
+		httpClient = previous
+		tokensLock.Lock()
+		tokens = map[string]cachedToken{}
+		tokensLock.Unlock()
+	})
+	return server.Listener.Addr().String()
+}
+
+// tokenService records the requests of a stub token service issuing issuedToken.
+type tokenService struct {
+	mu       sync.Mutex
+	requests []*http.Request
+}
+
+const issuedToken = "issued-token"
+
+func (s *tokenService) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	s.requests = append(s.requests, r.Clone(context.Background()))
+	s.mu.Unlock()
+	w.Header().Set("Content-Type", "application/json")
+	w.Write([]byte(`{"token":"` + issuedToken + `","expires_in":300}`))
+}
+
+func (s *tokenService) received() []*http.Request {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]*http.Request(nil), s.requests...)
+}
+
+// bearerRegistry answers manifest requests without the issued token with a Bearer
+// challenge naming the token service at realm.
+func bearerRegistry(realm *string, scope string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer "+issuedToken {
+			challenge := `Bearer realm="` + *realm + `",service="registry.test"`
+			if scope != "" {
+				challenge += `,scope="` + scope + `"`
+			}
+			w.Header().Set("WWW-Authenticate", challenge)
+			http.Error(w, `{"errors":[{"code":"UNAUTHORIZED","message":"authentication required"}]}`, http.StatusUnauthorized)
+			return
+		}
+		w.Header().Set("Docker-Content-Digest", "sha256:"+strings.Repeat("a", 64))
+		w.Header().Set("Content-Type", MediaTypeOCIManifest)
+	}
+}
+
+func TestBearerChallengeSameHost(t *testing.T) {
+	var realm string
+	tokens := &tokenService{}
+	mux := http.NewServeMux()
+	mux.Handle("/token", tokens)
+	mux.Handle("/v2/", bearerRegistry(&realm, ""))
+	registryURL := stubRegistry(t, mux)
+	realm = "https://" + registryURL + "/token"
+
+	for range 2 {
+		manifest, err := DescribeImage(context.Background(), "ns/vddk:8.0.3", registryURL, "caller-token")
+		if err != nil || !manifest.Exists {
+			t.Fatalf("DescribeImage() = %+v, %v; want the manifest", manifest, err)
+		}
+	}
+
+	requests := tokens.received()
+	if len(requests) != 1 {
+		t.Fatalf("token service got %d requests, want 1 with the token reused", len(requests))
+	}
+	query := requests[0].URL.Query()
+	if got := query.Get("service"); got != "registry.test" {
+		t.Errorf("service = %q, want the challenge's registry.test", got)
+	}
+	if got, want := query.Get("scope"), "repository:ns/vddk:pull"; got != want {
+		t.Errorf("scope = %q, want %q", got, want)
+	}
+	want := "Basic " + base64.StdEncoding.EncodeToString([]byte(tokenUser+":caller-token"))
+	if got := requests[0].Header.Get("Authorization"); got != want {
+		t.Errorf("token service got Authorization %q, want the caller's token %q", got, want)
+	}
+}
+
+func TestBearerChallengeOtherHost(t *testing.T) {
+	tokens := &tokenService{}
+	tokenHost := stubRegistry(t, tokens)
+	realm := "https://" + tokenHost + "/token"
+	registryURL := stubRegistry(t, bearerRegistry(&realm, "repository:ns/vddk:pull,push"))
+
+	manifest, err := DescribeImage(context.Background(), "ns/vddk:8.0.3", registryURL, "caller-token")
+	if err != nil || !manifest.Exists {
+		t.Fatalf("DescribeImage() = %+v, %v; want the manifest", manifest, err)
+	}
+
+	requests := tokens.received()
+	if len(requests) != 1 {
+		t.Fatalf("token service got %d requests, want 1", len(requests))
+	}
+	if got := requests[0].URL.Query().Get("scope"); got != "repository:ns/vddk:pull,push" {
+		t.Errorf("scope = %q, want the challenge's scope", got)
+	}
+	if got := requests[0].Header.Get("Authorization"); got != "" {
+		t.Errorf("token service on another host got Authorization %q, want none", got)
+	}
+}
@@ -0,0 +1,118 @@
+package registry
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// dockercfgNames are the keys of a dockercfg secret, in the order they are looked for when
+// the secret is mounted as a directory.
+var dockercfgNames = []string{".dockerconfigjson", ".dockercfg"}
+
+// ReadDockercfg returns the base64 user:password per registry host of a mounted dockercfg
+// secret. path is a .dockerconfigjson file, with an "auths" object, a legacy .dockercfg file
+// mapping hosts directly, or a directory holding either.
+func ReadDockercfg(path string) (map[string]string, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if info.IsDir() {
+		dir := path
+		path = ""
+		for _, name := range dockercfgNames {
+			candidate := filepath.Join(dir, name)
+			if _, err := os.Stat(candidate); err == nil {
+				path = candidate
+				break
+			} else if !errors.Is(err, fs.ErrNotExist) {
+				return nil, err
+			}
+		}
+		if path == "" {
+			return nil, fmt.Errorf("%s holds neither %s", dir, strings.Join(dockercfgNames, " nor "))
+		}
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var entries map[string]json.RawMessage
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %w", path, err)
+	}
+	if auths, ok := entries["auths"]; ok {
+		entries = nil
+		if err := json.Unmarshal(auths, &entries); err != nil {
+			return nil, fmt.Errorf("failed to parse the auths of %s: %w", path, err)
+		}
+	}
+
+	creds := make(map[string]string, len(entries))
+	for host, raw := range entries {
+		var entry struct {
+			Auth string `json:"auth"`
+		}
+		if err := json.Unmarshal(raw, &entry); err != nil {
+			return nil, fmt.Errorf("failed to parse the entry of %s in %s: %w", host, path, err)
+		}
+		if entry.Auth != "" {
+			creds[normalizeAuthHost(host)] = entry.Auth
+		}
+	}
+	return creds, nil
+}
+
+// WriteAuthConfig writes the credentials of base, a containers-auth.json that is skipped when
+// empty, overridden by creds to a containers-auth.json at dest, readable by the server user
+// only. The file is replaced atomically so skopeo never reads half of it.
+func WriteAuthConfig(dest, base string, creds map[string]string) error {
+	auths := map[string]any{}
+	if base != "" {
+		data, err := os.ReadFile(base)
+		if err != nil {
+			return fmt.Errorf("failed to read registry auth config: %w", err)
+		}
+		var file struct {
+			Auths map[string]any `json:"auths"`
+		}
+		if err := json.Unmarshal(data, &file); err != nil {
+			return fmt.Errorf("failed to parse registry auth config %s: %w", base, err)
+		}
+		for host, entry := range file.Auths {
+			auths[host] = entry
+		}
+	}
+	for host, auth := range creds {
+		auths[host] = map[string]string{"auth": auth}
+	}
+	content, err := json.Marshal(map[string]any{"auths": auths})
+	if err != nil {
+		return err
+	}
+
+	file, err := os.CreateTemp(filepath.Dir(dest), filepath.Base(dest)+".*")
+	if err != nil {
+		return fmt.Errorf("create auth file: %w", err)
+	}
+	defer os.Remove(file.Name())
+	if _, err := file.Write(content); err != nil {
+		file.Close()
+		return fmt.Errorf("write auth file: %w", err)
+	}
+	if err := file.Close(); err != nil {
+		return fmt.Errorf("write auth file: %w", err)
+	}
+	return os.Rename(file.Name(), dest)
+}
+
+// normalizeAuthHost strips the scheme and trailing slash some auth files put around hosts.
+func normalizeAuthHost(host string) string {
+	return strings.TrimSuffix(strings.TrimPrefix(host, "https://"), "/")
+}
@@ -0,0 +1,64 @@
+package registry
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// maxErrorBody bounds the error response body read from a registry.
+const maxErrorBody = 64 << 10
+
+// maxErrorDetail bounds the registry's error messages included in a ResponseError.
+const maxErrorDetail = 512
+
+// ErrorDetail is one entry of the errors array of a registry error response.
+type ErrorDetail struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// ResponseError reports an unexpected answer from a registry, with the codes and messages
+// of its error response when it sent one.
+type ResponseError struct {
+	StatusCode int
+	Errors     []ErrorDetail
+}
+
+func (e *ResponseError) Error() string {
+	msg := fmt.Sprintf("unexpected HTTP status code: %d", e.StatusCode)
+	var details []string
+	for _, detail := range e.Errors {
+		switch {
+		case detail.Code != "" && detail.Message != "":
+			details = append(details, detail.Code+": "+detail.Message)
+		case detail.Code != "":
+			details = append(details, detail.Code)
+		case detail.Message != "":
+			details = append(details, detail.Message)
+		}
+	}
+	if len(details) == 0 {
+		return msg
+	}
+	text := strings.Join(details, "; ")
+	if len(text) > maxErrorDetail {
+		text = text[:maxErrorDetail] + "..."
+	}
+	return msg + " (" + text + ")"
+}
+
+// responseError reads the error response in resp, which the caller still closes, into a
+// *ResponseError. A body that is not a registry error response is left out.
+func responseError(resp *http.Response) error {
+	err := &ResponseError{StatusCode: resp.StatusCode}
+	var body struct {
+		Errors []ErrorDetail `json:"errors"`
+	}
+	if json.NewDecoder(io.LimitReader(resp.Body, maxErrorBody)).Decode(&body) == nil {
+		err.Errors = body.Errors
+	}
+	return err
+}
@@ -0,0 +1,82 @@
+package registry
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestResponseError(t *testing.T) {
+	tests := []struct {
+		name       string
+		body       string
+		wantErrors []ErrorDetail
+		want       string
+	}{
+		{
+			name:       "registry errors",
+			body:       `{"errors":[{"code":"DENIED","message":"requested access to the resource is denied"},{"code":"UNAUTHORIZED"}]}`,
+			wantErrors: []ErrorDetail{{Code: "DENIED", Message: "requested access to the resource is denied"}, {Code: "UNAUTHORIZED"}},
+			want:       "unexpected HTTP status code: 403 (DENIED: requested access to the resource is denied; UNAUTHORIZED)",
+		},
+		{
+			name:       "message only",
+			body:       `{"errors":[{"message":"quota exceeded"}]}`,
+			wantErrors: []ErrorDetail{{Message: "quota exceeded"}},
+			want:       "unexpected HTTP status code: 403 (quota exceeded)",
+		},
+		{
+			name: "not a registry error",
+			body: "<html>Forbidden</html>",
+			want: "unexpected HTTP status code: 403",
+		},
+		{
+			name: "empty body",
+			want: "unexpected HTTP status code: 403",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp := &http.Response{StatusCode: http.StatusForbidden, Body: io.NopCloser(strings.NewReader(tt.body))}
+			err := responseError(resp)
+			var respErr *ResponseError
+			if !errors.As(err, &respErr) {
+				t.Fatalf("responseError() = %T, want a *ResponseError", err)
+			}
+			if respErr.StatusCode != http.StatusForbidden || !slices.Equal(respErr.Errors, tt.wantErrors) {
+				t.Errorf("responseError() = %+v, want status 403 and errors %+v", respErr, tt.wantErrors)
+			}
+			if err.Error() != tt.want {
+				t.Errorf("Error() = %q, want %q", err.Error(), tt.want)
+			}
+		})
+	}
+}
+
+func TestResponseErrorTruncatesDetails(t *testing.T) {
+	long := strings.Repeat("x", 2*maxErrorDetail)
+	err := &ResponseError{StatusCode: http.StatusBadRequest, Errors: []ErrorDetail{{Code: "MANIFEST_INVALID", Message: long}}}
+	if got := err.Error(); !strings.HasSuffix(got, "...)") || len(got) > maxErrorDetail+64 {
+		t.Errorf("Error() = %d bytes ending %q, want the details cut at %d bytes", len(got), got[len(got)-8:], maxErrorDetail)
+	}
+}
+
+func TestDescribeImageReportsRegistryError(t *testing.T) {
+	registryURL := stubRegistry(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusForbidden)
+		if r.Method == http.MethodGet {
+			io.WriteString(w, `{"errors":[{"code":"DENIED","message":"pull access denied"}]}`)
+		}
+	}))
+
+	_, err := DescribeImage(context.Background(), "ns/vddk:8.0.3", registryURL, "")
+	var respErr *ResponseError
+	if !errors.As(err, &respErr) || !strings.Contains(err.Error(), "DENIED: pull access denied") {
+		t.Errorf("DescribeImage() error = %v, want the registry's error from the GET body", err)
+	}
+}
@@ -0,0 +1,156 @@
+package registry
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// insecureRegistry is an INSECURE_REGISTRIES entry: a host, a host:port or a CIDR.
+type insecureRegistry struct {
+	host      string     // Host, with the port if the entry names one
+	network   *net.IPNet // Network of a CIDR entry
+	plainHTTP bool       // Entry given as http://..., skipping the HTTPS attempt
+}
+
+// insecureRegistries and insecureClient are set by Configure. Requests to matching
+// registries skip certificate verification and fall back to plain HTTP.
+var (
+	insecureRegistries []insecureRegistry
+	insecureClient     *http.Client
+
+	// schemes records the scheme settled on per insecure host, so it is logged and probed once
+	schemesLock sync.Mutex
+	schemes     = map[string]string{}
+)
+
+// parseInsecureRegistries parses INSECURE_REGISTRIES entries: host, host:port or CIDR, each
+// optionally prefixed with http:// to use plain HTTP without trying HTTPS first.
+func parseInsecureRegistries(entries []string) ([]insecureRegistry, error) {
+	var parsed []insecureRegistry
+	for _, entry := range entries {
+		value, plainHTTP := strings.CutPrefix(entry, "http://")
+		if value == "" || strings.ContainsAny(value, "@?#") || strings.Contains(value, "://") {
+			return nil, fmt.Errorf("invalid INSECURE_REGISTRIES entry %q: must be a host, host:port or CIDR", entry)
+		}
+		registry := insecureRegistry{host: value, plainHTTP: plainHTTP}
+		if strings.Contains(value, "/") {
+			_, network, err := net.ParseCIDR(value)
+			if err != nil {
+				return nil, fmt.Errorf("invalid INSECURE_REGISTRIES entry %q: %v", entry, err)
+			}
+			registry = insecureRegistry{network: network, plainHTTP: plainHTTP}
+		}
+		parsed = append(parsed, registry)
+	}
+	return parsed, nil
+}
+
+// matchInsecure returns the INSECURE_REGISTRIES entry matching host, a registry host with
+// an optional port, or nil.
+func matchInsecure(host string) *insecureRegistry {
+	hostname := host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		hostname = h
+	}
+	for i, entry := range insecureRegistries {
+		if entry.network != nil {
+			if ip := net.ParseIP(hostname); ip != nil && entry.network.Contains(ip) {
+				return &insecureRegistries[i]
+			}
+			continue
+		}
+		if entry.host == host || !strings.Contains(entry.host, ":") && entry.host == hostname {
+			return &insecureRegistries[i]
+		}
+	}
+	return nil
+}
+
+// IsInsecure reports whether registryURL is listed in INSECURE_REGISTRIES.
+func IsInsecure(registryURL string) bool {
+	return matchInsecure(registryURL) != nil
+}
+
+// IsPlainHTTP reports whether registryURL is listed in INSECURE_REGISTRIES with http://.
+func IsPlainHTTP(registryURL string) bool {
+	entry := matchInsecure(registryURL)
+	return entry != nil && entry.plainHTTP
+}
+
+// roundTrip sends req once. Requests to an insecure registry skip certificate verification
+// and, when HTTPS fails to connect, are sent again over plain HTTP; the scheme that worked is
+// kept for the host and logged the first time.
+func roundTrip(req *http.Request) (*http.Response, error) {
+	entry := matchInsecure(req.URL.Host)
+	if entry == nil {
+		return httpClient.Do(req)
+	}
+
+	schemesLock.Lock()
+	scheme, settled := schemes[req.URL.Host]
+	if !settled && entry.plainHTTP {
+		scheme, settled = "http", true
+		schemes[req.URL.Host] = scheme
+		log.Printf("Registry %s is insecure, using plain HTTP\n", req.URL.Host)
+	}
+	schemesLock.Unlock()
+	if settled {
+		req.URL.Scheme = scheme
+		return insecureClient.Do(req)
+	}
+
+	req.URL.Scheme = "https"
+	resp, err := insecureClient.Do(req)
+	switch {
+	case err == nil:
+		scheme = "https"
+	case req.Context().Err() == nil && !isTimeout(err):
+		log.Printf("HTTPS to insecure registry %s failed, trying plain HTTP: %v\n", req.URL.Host, err)
+		plain := req.Clone(req.Context())
+		plain.URL.Scheme = "http"
+		if resp, err = insecureClient.Do(plain); err != nil {
+			return nil, err
+		}
+		scheme = "http"
+	default:
+		return nil, err
+	}
+
+	schemesLock.Lock()
+	if _, settled := schemes[req.URL.Host]; !settled {
+		schemes[req.URL.Host] = scheme
+		if scheme == "http" {
+			log.Printf("Registry %s is insecure, using plain HTTP\n", req.URL.Host)
+		} else {
+			log.Printf("Registry %s is insecure, using HTTPS without certificate verification\n", req.URL.Host)
+		}
+	}
+	schemesLock.Unlock()
+	return resp, nil
+}
+
+// isTimeout reports whether err is a timeout, which plain HTTP would not fix.
+func isTimeout(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+// configureInsecure sets the INSECURE_REGISTRIES entries and their client.
+func configureInsecure(entries []string, opts Options) error {
+	parsed, err := parseInsecureRegistries(entries)
+	if err != nil {
+		return err
+	}
+	insecureRegistries = parsed
+	insecureClient = newClient(&tls.Config{InsecureSkipVerify: true}, opts.Timeout)
+	schemesLock.Lock()
+	schemes = map[string]string{}
+	schemesLock.Unlock()
+	return nil
+}
@@ -0,0 +1,138 @@
+package registry
+
+import (
+	"context"
+	"crypto/tls"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// useInsecureRegistries configures entries as INSECURE_REGISTRIES and the shared client to
+// verify certificates against the system roots until the test ends.
+func useInsecureRegistries(t *testing.T, entries ...string) {
+	t.Helper()
+	previousClient, previousRegistries, previousInsecure := httpClient, insecureRegistries, insecureClient
+	httpClient = newClient(&tls.Config{}, 5*time.Second)
+	if err := configureInsecure(entries, Options{Timeout: 5 * time.Second}); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		httpClient, insecureRegistries, insecureClient = previousClient, previousRegistries, previousInsecure
+		schemesLock.Lock()
+		schemes = map[string]string{}
+		schemesLock.Unlock()
+	})
+}
+
+// pingServer answers the /v2/ endpoint and records whether requests came over TLS.
+func pingServer(tlsUsed *[]bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		*tlsUsed = append(*tlsUsed, r.TLS != nil)
+		w.Header().Set("Docker-Distribution-API-Version", "registry/2.0")
+	}
+}
+
+func TestInsecureRegistries(t *testing.T) {
+	var tlsRequests, plainRequests []bool
+	tlsServer := httptest.NewTLSServer(pingServer(&tlsRequests))
+	defer tlsServer.Close()
+	plainServer := httptest.NewServer(pingServer(&plainRequests))
+	defer plainServer.Close()
+	tlsHost, plainHost := tlsServer.Listener.Addr().String(), plainServer.Listener.Addr().String()
+
+	t.Run("self-signed HTTPS", func(t *testing.T) {
+		useInsecureRegistries(t, tlsHost)
+		tlsRequests = nil
+		for range 2 {
+			if status, err := Ping(context.Background(), tlsHost, ""); err != nil || status.APIVersion != "registry/2.0" {
+				t.Fatalf("Ping() = %+v, %v; want the registry without certificate verification", status, err)
+			}
+		}
+		if len(tlsRequests) != 2 || !tlsRequests[0] || !tlsRequests[1] {
+			t.Errorf("requests over TLS = %v, want both over HTTPS", tlsRequests)
+		}
+		if schemes[tlsHost] != "https" {
+			t.Errorf("settled on scheme %q for %s, want https", schemes[tlsHost], tlsHost)
+		}
+	})
+
+	t.Run("plain HTTP fallback", func(t *testing.T) {
+		useInsecureRegistries(t, plainHost)
+		plainRequests = nil
+		for range 2 {
+			if _, err := Ping(context.Background(), plainHost, ""); err != nil {
+				t.Fatalf("Ping() error = %v, want the registry over plain HTTP", err)
+			}
+		}
+		if len(plainRequests) != 2 {
+			t.Errorf("plain HTTP requests = %d, want 2", len(plainRequests))
+		}
+		if schemes[plainHost] != "http" {
+			t.Errorf("settled on scheme %q for %s, want http", schemes[plainHost], plainHost)
+		}
+	})
+
+	t.Run("http:// entry", func(t *testing.T) {
+		useInsecureRegistries(t, "http://"+plainHost)
+		if !IsPlainHTTP(plainHost) {
+			t.Errorf("IsPlainHTTP(%s) = false", plainHost)
+		}
+		if _, err := Ping(context.Background(), plainHost, ""); err != nil {
+			t.Fatalf("Ping() error = %v", err)
+		}
+	})
+
+	t.Run("CIDR entry", func(t *testing.T) {
+		useInsecureRegistries(t, "127.0.0.0/8")
+		if _, err := Ping(context.Background(), tlsHost, ""); err != nil {
+			t.Fatalf("Ping() error = %v, want %s matched by the network", err, tlsHost)
+		}
+	})
+
+	t.Run("secure registries", func(t *testing.T) {
+		useInsecureRegistries(t, "registry.example.com")
+		if IsInsecure(tlsHost) || IsInsecure(plainHost) {
+			t.Fatal("registries not listed are insecure")
+		}
+		if _, err := Ping(context.Background(), tlsHost, ""); err == nil {
+			t.Error("Ping() of a registry with a self-signed certificate succeeded, want a certificate error")
+		}
+		plainRequests = nil
+		if _, err := Ping(context.Background(), plainHost, ""); err == nil || len(plainRequests) > 0 {
+			t.Errorf("Ping() error = %v after %d plain HTTP requests, want no fallback", err, len(plainRequests))
+		}
+	})
+}
+
+func TestParseInsecureRegistries(t *testing.T) {
+	useInsecureRegistries(t, "registry.local", "mirror.local:5000", "http://10.1.0.0/16")
+	tests := []struct {
+		host            string
+		insecure, plain bool
+	}{
+		{host: "registry.local", insecure: true},
+		{host: "registry.local:443", insecure: true},
+		{host: "mirror.local:5000", insecure: true},
+		{host: "mirror.local", insecure: false},
+		{host: "mirror.local:5001", insecure: false},
+		{host: "10.1.2.3:5000", insecure: true, plain: true},
+		{host: "10.2.0.1", insecure: false},
+		{host: "quay.io", insecure: false},
+	}
+	for _, tt := range tests {
+		if got := IsInsecure(tt.host); got != tt.insecure {
+			t.Errorf("IsInsecure(%s) = %t, want %t", tt.host, got, tt.insecure)
+		}
+		if got := IsPlainHTTP(tt.host); got != tt.plain {
+			t.Errorf("IsPlainHTTP(%s) = %t, want %t", tt.host, got, tt.plain)
+		}
+	}
+
+	for _, entry := range []string{"", "https://registry.local", "user@registry.local", "10.1.0.0/33"} {
+		if _, err := parseInsecureRegistries([]string{entry}); err == nil {
+			t.Errorf("parseInsecureRegistries(%q) succeeded, want an error", entry)
+		}
+	}
+}
@@ -0,0 +1,10 @@
+package registry
+
+import "vddk-builder/pkg/metrics"
+
+var (
+	headFallbacksTotal = metrics.NewCounter("vddk_builder_registry_head_fallbacks_total",
+		"Manifest lookups repeated with GET because HEAD was rejected or incomplete, by registry.", "registry")
+	rateLimitedTotal = metrics.NewCounter("vddk_builder_registry_rate_limited_total",
+		"Registry requests answered with 429 Too Many Requests, by registry.", "registry")
+)
@@ -0,0 +1,107 @@
+package registry
+
+import (
+	"fmt"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// Grammar of the parts of an image reference, following the distribution reference spec.
+var (
+	pathComponentPattern = regexp.MustCompile(`^[a-z0-9]+(?:(?:[._]|__|-+)[a-z0-9]+)*$`)
+	tagPattern           = regexp.MustCompile(`^[A-Za-z0-9_][A-Za-z0-9_.-]{0,127}$`)
+	digestPattern        = regexp.MustCompile(`^[a-z0-9]+(?:[.+_-][a-z0-9]+)*:[A-Fa-f0-9]{32,}$`)
+)
+
+// Reference is an image reference split into its parts, such as
+// myregistry:5000/ns/vddk:v1 or openshift-mtv/vddk@sha256:abc...
+type Reference struct {
+	Registry   string // Registry host with optional port, empty if the reference names none
+	Repository string // Repository path, possibly of several segments
+	Tag        string // Tag, empty if not given
+	Digest     string // Manifest digest, empty if not given
+}
+
+// ParseReference splits s into registry, repository, tag and digest. The first path segment
+// is the registry when it contains a '.' or a ':' or is localhost, as with podman.
+func ParseReference(s string) (Reference, error) {
+	var ref Reference
+	rest := s
+	if name, digest, found := strings.Cut(rest, "@"); found {
+		if !digestPattern.MatchString(digest) {
+			return Reference{}, fmt.Errorf("invalid image reference %q: invalid digest %q", s, digest)
+		}
+		ref.Digest = digest
+		rest = name
+	}
+	if i := strings.LastIndex(rest, ":"); i >= 0 && !strings.Contains(rest[i+1:], "/") {
+		ref.Tag = rest[i+1:]
+		rest = rest[:i]
+		if !tagPattern.MatchString(ref.Tag) {
+			return Reference{}, fmt.Errorf("invalid image reference %q: invalid tag %q", s, ref.Tag)
+		}
+	}
+	if host, path, found := strings.Cut(rest, "/"); found && (strings.ContainsAny(host, ".:") || host == "localhost") {
+		ref.Registry = host
+		rest = path
+	}
+	if rest == "" {
+		return Reference{}, fmt.Errorf("invalid image reference %q: missing repository", s)
+	}
+	for _, component := range strings.Split(rest, "/") {
+		if !pathComponentPattern.MatchString(component) {
+			return Reference{}, fmt.Errorf("invalid image reference %q: invalid repository component %q", s, component)
+		}
+	}
+	ref.Repository = rest
+	return ref, nil
+}
+
+// ManifestRef returns what the manifest is looked up by: the digest if given, else the tag,
+// else latest.
+func (r Reference) ManifestRef() string {
+	switch {
+	case r.Digest != "":
+		return r.Digest
+	case r.Tag != "":
+		return r.Tag
+	}
+	return "latest"
+}
+
+// String joins the parts back into a reference.
+func (r Reference) String() string {
+	s := r.Repository
+	if r.Registry != "" {
+		s = r.Registry + "/" + s
+	}
+	if r.Tag != "" {
+		s += ":" + r.Tag
+	}
+	if r.Digest != "" {
+		s += "@" + r.Digest
+	}
+	return s
+}
+
+// dockerHubRegistries are the names of Docker Hub, which serves single-segment repositories
+// such as vddk as library/vddk.
+var dockerHubRegistries = []string{"docker.io", "index.docker.io", "registry-1.docker.io"}
+
+// resolveReference parses imageName for a query to registryURL. A registry named in the
+// reference must be registryURL, so credentials for it are never sent elsewhere. On Docker
+// Hub a bare name such as vddk defaults to library/vddk.
+func resolveReference(imageName, registryURL string) (Reference, error) {
+	ref, err := ParseReference(imageName)
+	if err != nil {
+		return Reference{}, err
+	}
+	if ref.Registry != "" && ref.Registry != registryURL {
+		return Reference{}, fmt.Errorf("image %s is not in registry %s", imageName, registryURL)
+	}
+	if slices.Contains(dockerHubRegistries, registryURL) && !strings.Contains(ref.Repository, "/") {
+		ref.Repository = "library/" + ref.Repository
+	}
+	return ref, nil
+}
@@ -0,0 +1,83 @@
+package registry
+
+import "testing"
+
+const testDigest = "sha256:0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef"
+
+func TestParseReference(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    Reference
+		wantRef string // ManifestRef of the reference
+	}{
+		{in: "vddk", want: Reference{Repository: "vddk"}, wantRef: "latest"},
+		{in: "openshift-mtv/vddk:8.0.3", want: Reference{Repository: "openshift-mtv/vddk", Tag: "8.0.3"}, wantRef: "8.0.3"},
+		{in: "localhost/vddk", want: Reference{Registry: "localhost", Repository: "vddk"}, wantRef: "latest"},
+		{in: "localhost:5000/vddk:v1", want: Reference{Registry: "localhost:5000", Repository: "vddk", Tag: "v1"}, wantRef: "v1"},
+		{in: "myregistry:5000/ns/vddk:v1", want: Reference{Registry: "myregistry:5000", Repository: "ns/vddk", Tag: "v1"}, wantRef: "v1"},
+		{in: "quay.example.com/team/sub/vddk", want: Reference{Registry: "quay.example.com", Repository: "team/sub/vddk"}, wantRef: "latest"},
+		{in: "openshift-mtv/vddk@" + testDigest, want: Reference{Repository: "openshift-mtv/vddk", Digest: testDigest}, wantRef: testDigest},
+		{in: "myregistry:5000/ns/vddk:v1@" + testDigest, want: Reference{Registry: "myregistry:5000", Repository: "ns/vddk", Tag: "v1", Digest: testDigest}, wantRef: testDigest},
+		{in: "ns/vddk_v2.x__b-c:V1_2.3-rc", want: Reference{Repository: "ns/vddk_v2.x__b-c", Tag: "V1_2.3-rc"}, wantRef: "V1_2.3-rc"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			got, err := ParseReference(tt.in)
+			if err != nil {
+				t.Fatalf("ParseReference() error = %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("ParseReference() = %+v, want %+v", got, tt.want)
+			}
+			if ref := got.ManifestRef(); ref != tt.wantRef {
+				t.Errorf("ManifestRef() = %q, want %q", ref, tt.wantRef)
+			}
+			if s := got.String(); s != tt.in {
+				t.Errorf("String() = %q, want %q", s, tt.in)
+			}
+		})
+	}
+}
+
+func TestParseReferenceInvalid(t *testing.T) {
+	for _, in := range []string{
+		"",
+		"Vddk",
+		"ns/VDDK:8.0.3",
+		"myregistry:5000/",
+		"ns//vddk",
+		"ns/vddk:",
+		"ns/vddk:-tag",
+		"ns/vddk:a/b",
+		"ns/vddk@sha256:short",
+		"ns/vddk@" + testDigest + "x",
+		"ns/-vddk",
+		"ns/vddk.",
+		"ns/vd dk",
+	} {
+		if ref, err := ParseReference(in); err == nil {
+			t.Errorf("ParseReference(%q) = %+v, want an error", in, ref)
+		}
+	}
+}
+
+func TestResolveReference(t *testing.T) {
+	tests := []struct {
+		imageName, registryURL string
+		wantRepository         string
+		wantErr                bool
+	}{
+		{imageName: "vddk", registryURL: "docker.io", wantRepository: "library/vddk"},
+		{imageName: "docker.io/vddk:8.0.3", registryURL: "docker.io", wantRepository: "library/vddk"},
+		{imageName: "yaacov/vddk", registryURL: "docker.io", wantRepository: "yaacov/vddk"},
+		{imageName: "vddk", registryURL: "localhost:5000", wantRepository: "vddk"},
+		{imageName: "localhost:5000/ns/vddk", registryURL: "localhost:5000", wantRepository: "ns/vddk"},
+		{imageName: "quay.example.com/ns/vddk", registryURL: "localhost:5000", wantErr: true},
+	}
+	for _, tt := range tests {
+		ref, err := resolveReference(tt.imageName, tt.registryURL)
+		if (err != nil) != tt.wantErr || err == nil && ref.Repository != tt.wantRepository {
+			t.Errorf("resolveReference(%q, %q) = %+v, %v; want repository %q, error %t", tt.imageName, tt.registryURL, ref, err, tt.wantRepository, tt.wantErr)
+		}
+	}
+}
@@ -1,12 +1,86 @@
 package registry
 
 import (
+	"context"
+	"crypto/sha256"
 	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strconv"
 	"strings"
+	"time"
 )
 
+// Options configures the HTTP client shared by every registry operation.
+type Options struct {
+	TLSVerify    bool          // Verify registry certificates against the system roots plus CABundle
+	CABundle     string        // PEM file with additional trusted CAs, none if empty
+	Timeout      time.Duration // Overall limit of a single request, none if zero
+	Retries      int           // Attempts for a request failing with a network error or a 5xx answer
+	RetryBackoff time.Duration // Wait before the second attempt, doubled for each further one
+	RateLimitMax time.Duration // Total wait for a registry answering 429 before giving up
+
+	InsecureRegistries []string // Hosts, host:ports or CIDRs reached without certificate verification, falling back to plain HTTP
+}
+
+// Configure builds the client shared by every registry operation from opts. Without
+// TLSVerify certificates are not checked at all. It must be called before the first request.
+func Configure(opts Options) error {
+	tlsConfig := &tls.Config{InsecureSkipVerify: !opts.TLSVerify}
+	if opts.TLSVerify && opts.CABundle != "" {
+		pool, err := LoadCABundle(opts.CABundle)
+		if err != nil {
+			return fmt.Errorf("REGISTRY_CA_BUNDLE: %w", err)
+		}
+		tlsConfig.RootCAs = pool
+	}
+	httpClient = newClient(tlsConfig, opts.Timeout)
+	retries = max(opts.Retries, 1)
+	retryBackoff = opts.RetryBackoff
+	rateLimitMaxWait = opts.RateLimitMax
+	return configureInsecure(opts.InsecureRegistries, opts)
+}
+
+// LoadCABundle adds the PEM certificates in path to a copy of the system roots.
+func LoadCABundle(path string) (*x509.CertPool, error) {
+	pem, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read CA bundle: %w", err)
+	}
+	pool, err := x509.SystemCertPool()
+	if err != nil {
+		pool = x509.NewCertPool()
+	}
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("CA bundle %s contains no PEM certificates", path)
+	}
+	return pool, nil
+}
+
+// isCertificateError reports whether err is a failure to verify a registry certificate.
+func isCertificateError(err error) bool {
+	var unknownAuthority x509.UnknownAuthorityError
+	var hostname x509.HostnameError
+	var invalid x509.CertificateInvalidError
+	return errors.As(err, &unknownAuthority) || errors.As(err, &hostname) || errors.As(err, &invalid)
+}
+
+// explainTLSError turns a certificate verification failure talking to registryURL into an
+// error naming the settings to check, and returns any other err unchanged.
+func explainTLSError(registryURL string, err error) error {
+	if isCertificateError(err) {
+		return fmt.Errorf("certificate of registry %s could not be verified, check REGISTRY_CA_BUNDLE and REGISTRY_TLS_VERIFY: %w", registryURL, err)
+	}
+	return err
+}
+
 // CheckImageExists checks if a Docker image exists in the specified registry.
 // It sends a HEAD request to the image manifest URL and checks the HTTP status code.
 //
@@ -18,54 +92,627 @@ import (
 // Returns:
 //   - bool: True if the image exists, false otherwise.
 //   - error: An error if the request fails or an unexpected status code is returned.
-func CheckImageExists(imageName, registryURL, authToken string) (bool, error) {
-	// Split image name into name and tag
-	name, tag := splitImageName(imageName)
+func CheckImageExists(ctx context.Context, imageName, registryURL, authToken string) (bool, error) {
+	_, exists, err := ImageDigest(ctx, imageName, registryURL, authToken)
+	return exists, err
+}
+
+// Manifest media types accepted from the registry, manifest lists included.
+const (
+	MediaTypeDockerManifest     = "application/vnd.docker.distribution.manifest.v2+json"
+	MediaTypeDockerManifestList = "application/vnd.docker.distribution.manifest.list.v2+json"
+	MediaTypeOCIManifest        = "application/vnd.oci.image.manifest.v1+json"
+	MediaTypeOCIIndex           = "application/vnd.oci.image.index.v1+json"
+)
+
+// maxManifestSize bounds the manifest read to compute a digest the registry did not report.
+const maxManifestSize = 4 << 20
+
+// Manifest describes the manifest a registry serves for an image reference.
+type Manifest struct {
+	Exists    bool   // Whether the registry serves the reference at all
+	Digest    string // Value of the Docker-Content-Digest header, computed from the manifest if the registry omits it
+	MediaType string // Value of the Content-Type header
+	Size      int64  // Size of the manifest in bytes, 0 if unknown
+}
+
+// IsList reports whether m is a manifest list or OCI index covering several platforms.
+func (m Manifest) IsList() bool {
+	return m.MediaType == MediaTypeDockerManifestList || m.MediaType == MediaTypeOCIIndex
+}
+
+// ImageDigest looks up a Docker image manifest in the specified registry and returns its
+// digest as described by DescribeImage.
+//
+// Parameters:
+//   - imageName: The name of the Docker image to check.
+//   - registryURL: The URL of the Docker registry.
+//   - authToken: The authentication token for the registry (optional).
+//
+// Returns:
+//   - string: The manifest digest, empty if the image does not exist or the registry omits it.
+//   - bool: True if the image exists, false otherwise.
+//   - error: An error if the request fails or an unexpected status code is returned.
+func ImageDigest(ctx context.Context, imageName, registryURL, authToken string) (string, bool, error) {
+	manifest, err := DescribeImage(ctx, imageName, registryURL, authToken)
+	return manifest.Digest, manifest.Exists, err
+}
+
+// errHeadUnsupported reports a registry answering 405 or 501 to HEAD on a manifest.
+var errHeadUnsupported = errors.New("registry does not support HEAD on manifests")
+
+// DescribeImage looks up the manifest of a Docker image, which may be a manifest list, in
+// the specified registry. Exists is false if the image does not exist. Registries that
+// reject HEAD, or omit the digest or media type header on it, are asked again with a GET,
+// and the digest is computed from the manifest if they omit it there as well. A HEAD
+// answered with an error status is repeated as a GET, whose body explains the error.
+func DescribeImage(ctx context.Context, imageName, registryURL, authToken string) (Manifest, error) {
+	// Split image name into repository and tag or digest
+	ref, err := resolveReference(imageName, registryURL)
+	if err != nil {
+		return Manifest{}, err
+	}
 
 	// Construct the image manifest URL
-	url := fmt.Sprintf("https://%s/v2/%s/manifests/%s", registryURL, name, tag)
+	url := fmt.Sprintf("https://%s/v2/%s/manifests/%s", registryURL, ref.Repository, ref.ManifestRef())
 
+	manifest, err := requestManifest(ctx, "HEAD", url, ref, registryURL, authToken)
+	var respErr *ResponseError
+	if errors.As(err, &respErr) {
+		return requestManifest(ctx, "GET", url, ref, registryURL, authToken)
+	}
+	if !errors.Is(err, errHeadUnsupported) && (err != nil || !manifest.Exists || manifest.Digest != "" && manifest.MediaType != "") {
+		return manifest, err
+	}
+	headFallbacksTotal.Inc(registryURL)
+	return requestManifest(ctx, "GET", url, ref, registryURL, authToken)
+}
+
+// requestManifest sends a HEAD or GET for the manifest at url and describes the answer. For a
+// GET the digest and size are taken from the manifest when the headers omit them.
+func requestManifest(ctx context.Context, method, url string, ref Reference, registryURL, authToken string) (Manifest, error) {
 	// Create a new HTTP request
-	req, err := http.NewRequest("HEAD", url, nil)
+	req, err := http.NewRequestWithContext(ctx, method, url, nil)
 	if err != nil {
-		return false, err
+		return Manifest{}, err
+	}
+
+	// Set Accept header to request image manifest, including OCI support and manifest lists
+	req.Header.Set("Accept", strings.Join([]string{MediaTypeDockerManifest, MediaTypeOCIManifest, MediaTypeDockerManifestList, MediaTypeOCIIndex}, ", "))
+
+	// Send the HTTP request, answering an authentication challenge if needed
+	resp, err := do(req, registryURL, authToken, repositoryScope(ref.Repository, "pull"))
+	if err != nil {
+		return Manifest{}, explainTLSError(registryURL, err)
+	}
+	defer resp.Body.Close()
+
+	// Check HTTP status code
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return Manifest{}, nil // Image does not exist
+	case http.StatusMethodNotAllowed, http.StatusNotImplemented:
+		if method == "HEAD" {
+			return Manifest{}, errHeadUnsupported
+		}
+		return Manifest{}, responseError(resp)
+	default:
+		return Manifest{}, responseError(resp)
+	}
+
+	manifest := Manifest{
+		Exists:    true,
+		Digest:    resp.Header.Get("Docker-Content-Digest"),
+		MediaType: resp.Header.Get("Content-Type"),
+		Size:      max(resp.ContentLength, 0),
+	}
+	if method == "GET" {
+		body, err := io.ReadAll(io.LimitReader(resp.Body, maxManifestSize+1))
+		if err != nil {
+			return Manifest{}, fmt.Errorf("failed to read manifest: %w", err)
+		}
+		if len(body) > maxManifestSize {
+			return Manifest{}, fmt.Errorf("manifest of %s is larger than %d bytes", ref, maxManifestSize)
+		}
+		manifest.Size = int64(len(body))
+		if manifest.Digest == "" {
+			manifest.Digest = fmt.Sprintf("sha256:%x", sha256.Sum256(body))
+		}
+	}
+	return manifest, nil
+}
+
+// ImagePlatforms returns the platforms, as os/architecture[/variant], listed in the manifest
+// list or OCI index of imageName, with the manifest described by DescribeImage. It returns
+// nil for an image that is a single manifest. Placeholder entries without a platform, such
+// as attestations, are left out.
+func ImagePlatforms(ctx context.Context, imageName, registryURL, authToken string, manifest Manifest) ([]string, error) {
+	if !manifest.Exists || !manifest.IsList() {
+		return nil, nil
+	}
+	ref, err := resolveReference(imageName, registryURL)
+	if err != nil {
+		return nil, err
+	}
+
+	var index struct {
+		Manifests []struct {
+			Platform struct {
+				OS           string `json:"os"`
+				Architecture string `json:"architecture"`
+				Variant      string `json:"variant"`
+			} `json:"platform"`
+		} `json:"manifests"`
+	}
+	manifestRef := ref.ManifestRef()
+	if manifest.Digest != "" {
+		manifestRef = manifest.Digest
+	}
+	url := fmt.Sprintf("https://%s/v2/%s/manifests/%s", registryURL, ref.Repository, manifestRef)
+	found, err := getJSON(ctx, url, manifest.MediaType, registryURL, authToken, ref.Repository, &index)
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		return nil, fmt.Errorf("manifest list of %s disappeared while reading it", imageName)
+	}
+
+	platforms := []string{}
+	for _, entry := range index.Manifests {
+		platform := entry.Platform
+		if platform.OS == "" || platform.OS == "unknown" || platform.Architecture == "" || platform.Architecture == "unknown" {
+			continue
+		}
+		name := platform.OS + "/" + platform.Architecture
+		if platform.Variant != "" {
+			name += "/" + platform.Variant
+		}
+		platforms = append(platforms, name)
+	}
+	return platforms, nil
+}
+
+// HasPlatform reports whether platforms lists platform. A platform given without a variant
+// matches any variant of its architecture.
+func HasPlatform(platforms []string, platform string) bool {
+	for _, candidate := range platforms {
+		if candidate == platform || strings.Count(platform, "/") == 1 && strings.HasPrefix(candidate, platform+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// ImageLabels returns the labels in the image config of imageName in the specified
+// registry, and false if the image does not exist. For a manifest list the labels of the
+// first listed image are returned.
+func ImageLabels(ctx context.Context, imageName, registryURL, authToken string) (map[string]string, bool, error) {
+	ref, err := resolveReference(imageName, registryURL)
+	if err != nil {
+		return nil, false, err
+	}
+	name := ref.Repository
+	accept := strings.Join([]string{MediaTypeDockerManifest, MediaTypeOCIManifest, MediaTypeDockerManifestList, MediaTypeOCIIndex}, ", ")
+
+	var manifest struct {
+		Config struct {
+			Digest string `json:"digest"`
+		} `json:"config"`
+		Manifests []struct {
+			Digest string `json:"digest"`
+		} `json:"manifests"`
+	}
+	url := fmt.Sprintf("https://%s/v2/%s/manifests/%s", registryURL, name, ref.ManifestRef())
+	if found, err := getJSON(ctx, url, accept, registryURL, authToken, name, &manifest); !found || err != nil {
+		return nil, found, err
+	}
+	if len(manifest.Manifests) > 0 {
+		url = fmt.Sprintf("https://%s/v2/%s/manifests/%s", registryURL, name, manifest.Manifests[0].Digest)
+		if found, err := getJSON(ctx, url, accept, registryURL, authToken, name, &manifest); !found || err != nil {
+			return nil, found, err
+		}
+	}
+	if manifest.Config.Digest == "" {
+		return nil, true, fmt.Errorf("manifest of %s has no config", imageName)
 	}
 
-	// Set Authorization header if needed
-	if authToken != "" {
-		req.Header.Set("Authorization", "Bearer "+authToken)
+	var config struct {
+		Config struct {
+			Labels map[string]string `json:"Labels"`
+		} `json:"config"`
+	}
+	url = fmt.Sprintf("https://%s/v2/%s/blobs/%s", registryURL, name, manifest.Config.Digest)
+	if found, err := getJSON(ctx, url, "", registryURL, authToken, name, &config); !found || err != nil {
+		return nil, found, err
 	}
-	// Set Accept header to request image manifest, including OCI support
-	req.Header.Set("Accept", "application/vnd.docker.distribution.manifest.v2+json, application/vnd.oci.image.manifest.v1+json")
+	return config.Config.Labels, true, nil
+}
+
+// DefaultPlatform is the platform GetImageInfo resolves a manifest list to when none is asked for.
+const DefaultPlatform = "linux/amd64"
+
+// ImageInfo describes an image as stored in a registry.
+type ImageInfo struct {
+	Exists    bool
+	Digest    string // Of the image manifest, within the manifest list if there is one
+	MediaType string
+	Platform  string // Set when the image was resolved from a manifest list
+	Created   time.Time
+	Layers    int
+	Size      int64 // Compressed size of the layers, in bytes
+	Labels    map[string]string
+}
 
-	// Send the HTTP request
-	client := &http.Client{
-		Transport: &http.Transport{
-			TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
-		},
+// GetImageInfo reads the manifest and config of imageName in the specified registry. A
+// manifest list is resolved to platform, or to DefaultPlatform when platform is empty;
+// platform matching follows HasPlatform. Exists is false if the image does not exist.
+func GetImageInfo(ctx context.Context, imageName, registryURL, authToken, platform string) (ImageInfo, error) {
+	ref, err := resolveReference(imageName, registryURL)
+	if err != nil {
+		return ImageInfo{}, err
+	}
+	if platform == "" {
+		platform = DefaultPlatform
 	}
-	resp, err := client.Do(req)
+
+	manifest, err := DescribeImage(ctx, imageName, registryURL, authToken)
+	if err != nil || !manifest.Exists {
+		return ImageInfo{}, err
+	}
+	info := ImageInfo{Exists: true, Digest: manifest.Digest, MediaType: manifest.MediaType}
+
+	var index struct {
+		Manifests []struct {
+			MediaType string `json:"mediaType"`
+			Digest    string `json:"digest"`
+			Platform  struct {
+				OS           string `json:"os"`
+				Architecture string `json:"architecture"`
+				Variant      string `json:"variant"`
+			} `json:"platform"`
+		} `json:"manifests"`
+	}
+	manifestRef := ref.ManifestRef()
+	if manifest.Digest != "" {
+		manifestRef = manifest.Digest
+	}
+	if manifest.IsList() {
+		url := fmt.Sprintf("https://%s/v2/%s/manifests/%s", registryURL, ref.Repository, manifestRef)
+		found, err := getJSON(ctx, url, manifest.MediaType, registryURL, authToken, ref.Repository, &index)
+		if err != nil {
+			return ImageInfo{}, err
+		}
+		if !found {
+			return ImageInfo{}, fmt.Errorf("manifest list of %s disappeared while reading it", imageName)
+		}
+		info.Digest = ""
+		var platforms []string
+		for _, entry := range index.Manifests {
+			if entry.Platform.OS == "" || entry.Platform.OS == "unknown" || entry.Platform.Architecture == "" || entry.Platform.Architecture == "unknown" {
+				continue
+			}
+			name := entry.Platform.OS + "/" + entry.Platform.Architecture
+			if entry.Platform.Variant != "" {
+				name += "/" + entry.Platform.Variant
+			}
+			if HasPlatform([]string{name}, platform) {
+				info.Digest, info.MediaType, info.Platform = entry.Digest, entry.MediaType, name
+				break
+			}
+			platforms = append(platforms, name)
+		}
+		if info.Digest == "" {
+			return ImageInfo{}, &PlatformNotFoundError{Image: imageName, Platform: platform, Platforms: platforms}
+		}
+		manifestRef = info.Digest
+	}
+
+	var image struct {
+		MediaType string `json:"mediaType"`
+		Config    struct {
+			Digest string `json:"digest"`
+		} `json:"config"`
+		Layers []struct {
+			Size int64 `json:"size"`
+		} `json:"layers"`
+	}
+	url := fmt.Sprintf("https://%s/v2/%s/manifests/%s", registryURL, ref.Repository, manifestRef)
+	accept := strings.Join([]string{MediaTypeDockerManifest, MediaTypeOCIManifest}, ", ")
+	if found, err := getJSON(ctx, url, accept, registryURL, authToken, ref.Repository, &image); err != nil || !found {
+		if err == nil {
+			err = fmt.Errorf("manifest of %s disappeared while reading it", imageName)
+		}
+		return ImageInfo{}, err
+	}
+	if info.MediaType == "" {
+		info.MediaType = image.MediaType
+	}
+	info.Layers = len(image.Layers)
+	for _, layer := range image.Layers {
+		info.Size += layer.Size
+	}
+	if image.Config.Digest == "" {
+		return ImageInfo{}, fmt.Errorf("manifest of %s has no config", imageName)
+	}
+
+	var config struct {
+		Created time.Time `json:"created"`
+		Config  struct {
+			Labels map[string]string `json:"Labels"`
+		} `json:"config"`
+	}
+	url = fmt.Sprintf("https://%s/v2/%s/blobs/%s", registryURL, ref.Repository, image.Config.Digest)
+	if found, err := getJSON(ctx, url, "", registryURL, authToken, ref.Repository, &config); err != nil || !found {
+		if err == nil {
+			err = fmt.Errorf("config of %s disappeared while reading it", imageName)
+		}
+		return ImageInfo{}, err
+	}
+	info.Created = config.Created
+	info.Labels = config.Config.Labels
+	return info, nil
+}
+
+// getJSON fetches url of repository name from registryURL and decodes the JSON response
+// into v. It reports false if the registry answers 404.
+func getJSON(ctx context.Context, url, accept, registryURL, authToken, name string, v any) (bool, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
 	if err != nil {
 		return false, err
 	}
+	if accept != "" {
+		req.Header.Set("Accept", accept)
+	}
+
+	resp, err := do(req, registryURL, authToken, repositoryScope(name, "pull"))
+	if err != nil {
+		return false, explainTLSError(registryURL, err)
+	}
 	defer resp.Body.Close()
 
-	// Check HTTP status code
-	if resp.StatusCode == http.StatusOK {
-		return true, nil // Image exists
-	} else if resp.StatusCode == http.StatusNotFound {
-		return false, nil // Image does not exist
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return true, json.NewDecoder(resp.Body).Decode(v)
+	case http.StatusNotFound:
+		return false, nil
+	}
+	return false, responseError(resp)
+}
+
+// tagsPageSize is the number of tags requested per page from the tags list endpoint.
+const tagsPageSize = 100
+
+// ListTags returns the tags of the repository of imageName in the specified registry, in
+// the order the registry lists them and without duplicates. It follows the rel="next" Link
+// header of every page, or asks for the tags after the last one with the n and last query
+// parameters when a registry returns a full page without one. It reports false if the
+// repository does not exist, and true with no tags for an empty repository.
+func ListTags(ctx context.Context, imageName, registryURL, authToken string) ([]string, bool, error) {
+	ref, err := resolveReference(imageName, registryURL)
+	if err != nil {
+		return nil, false, err
+	}
+	name := ref.Repository
+	first := fmt.Sprintf("/v2/%s/tags/list?n=%d", name, tagsPageSize)
+
+	tags := []string{}
+	seen := map[string]bool{}
+	requested := map[string]bool{}
+	for next := first; next != "" && !requested[next]; {
+		requested[next] = true
+		var page struct {
+			Tags []string `json:"tags"`
+		}
+		req, err := http.NewRequestWithContext(ctx, "GET", "https://"+registryURL+next, nil)
+		if err != nil {
+			return nil, false, err
+		}
+		resp, err := do(req, registryURL, authToken, repositoryScope(name, "pull"))
+		if err != nil {
+			return nil, false, explainTLSError(registryURL, err)
+		}
+		switch resp.StatusCode {
+		case http.StatusOK:
+			err = json.NewDecoder(resp.Body).Decode(&page)
+		case http.StatusNotFound:
+			resp.Body.Close()
+			if next != first {
+				return nil, false, fmt.Errorf("repository %s disappeared while listing its tags", name)
+			}
+			return nil, false, nil
+		default:
+			err = responseError(resp)
+		}
+		resp.Body.Close()
+		if err != nil {
+			return nil, false, err
+		}
+
+		added := 0
+		for _, tag := range page.Tags {
+			if !seen[tag] {
+				seen[tag] = true
+				tags = append(tags, tag)
+				added++
+			}
+		}
+
+		next = nextPage(resp.Header.Values("Link"))
+		if next == "" && added > 0 && len(page.Tags) >= tagsPageSize {
+			next = fmt.Sprintf("/v2/%s/tags/list?%s", name, url.Values{"n": {strconv.Itoa(tagsPageSize)}, "last": {page.Tags[len(page.Tags)-1]}}.Encode())
+		}
 	}
+	return tags, true, nil
+}
 
-	return false, fmt.Errorf("unexpected HTTP status code: %d", resp.StatusCode)
+// nextPage returns the path and query of the rel="next" target in the Link headers, or "".
+// The host of an absolute target is dropped so credentials only go to the registry asked.
+func nextPage(links []string) string {
+	for _, header := range links {
+		for _, link := range strings.Split(header, ",") {
+			target, params, found := strings.Cut(link, ";")
+			if !found || !slices.ContainsFunc(strings.Split(params, ";"), func(param string) bool {
+				key, value, _ := strings.Cut(strings.TrimSpace(param), "=")
+				return key == "rel" && strings.Trim(value, `"`) == "next"
+			}) {
+				continue
+			}
+			parsed, err := url.Parse(strings.Trim(strings.TrimSpace(target), "<>"))
+			if err != nil || !strings.HasPrefix(parsed.Path, "/v2/") {
+				continue
+			}
+			return parsed.RequestURI()
+		}
+	}
+	return ""
 }
 
-// splitImageName splits the image name into name and tag.
-// If no tag is provided, it defaults to "latest".
-func splitImageName(imageName string) (string, string) {
-	parts := strings.Split(imageName, ":")
-	if len(parts) == 2 {
-		return parts[0], parts[1]
+// NotFoundError reports that the image to delete does not exist in the registry.
+type NotFoundError struct {
+	Image    string
+	Registry string
+}
+
+func (e *NotFoundError) Error() string {
+	return fmt.Sprintf("image %s not found in registry %s", e.Image, e.Registry)
+}
+
+// PlatformNotFoundError reports a manifest list without an image for the requested platform.
+type PlatformNotFoundError struct {
+	Image     string
+	Platform  string
+	Platforms []string // The platforms the manifest list has
+}
+
+func (e *PlatformNotFoundError) Error() string {
+	return fmt.Sprintf("manifest list of %s has no %s image (it has %s)", e.Image, e.Platform, strings.Join(e.Platforms, ", "))
+}
+
+// DeletesDisabledError reports that the registry does not allow deleting manifests, which
+// it answers with 405 Method Not Allowed.
+type DeletesDisabledError struct {
+	Registry string
+}
+
+func (e *DeletesDisabledError) Error() string {
+	return fmt.Sprintf("registry %s does not allow deleting images", e.Registry)
+}
+
+// DeleteImage deletes the manifest imageName points at from the specified registry and
+// returns its digest. The tag is resolved to the digest first since registries only delete
+// manifests by digest, so every tag of the same manifest goes with it. It returns a
+// *NotFoundError if the image does not exist and a *DeletesDisabledError if the registry
+// refuses deletes.
+func DeleteImage(ctx context.Context, imageName, registryURL, authToken string) (string, error) {
+	digest, exists, err := ImageDigest(ctx, imageName, registryURL, authToken)
+	if err != nil {
+		return "", err
+	}
+	if !exists {
+		return "", &NotFoundError{Image: imageName, Registry: registryURL}
+	}
+
+	ref, err := resolveReference(imageName, registryURL)
+	if err != nil {
+		return "", err
+	}
+	name := ref.Repository
+	req, err := http.NewRequestWithContext(ctx, "DELETE", fmt.Sprintf("https://%s/v2/%s/manifests/%s", registryURL, name, digest), nil)
+	if err != nil {
+		return "", err
+	}
+	resp, err := do(req, registryURL, authToken, repositoryScope(name, "pull,delete"))
+	if err != nil {
+		return "", explainTLSError(registryURL, err)
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusAccepted, http.StatusOK:
+		return digest, nil
+	case http.StatusNotFound:
+		return "", &NotFoundError{Image: imageName, Registry: registryURL}
+	case http.StatusMethodNotAllowed:
+		return "", &DeletesDisabledError{Registry: registryURL}
+	}
+	return "", responseError(resp)
+}
+
+// pingTimeout bounds a Ping, which is not retried so readiness reflects the registry as it is.
+const pingTimeout = 10 * time.Second
+
+// Status describes how a registry answered a Ping.
+type Status struct {
+	APIVersion   string // Value of the Docker-Distribution-API-Version header, empty if the registry omits it
+	AuthRequired bool   // The registry requires authentication the credentials offered did not satisfy
+}
+
+// Ping checks that the registry answers on its /v2/ API endpoint, authenticating like every
+// other query when authToken or REGISTRY_AUTH_CONFIG credentials are available. A 401
+// response counts as reachable and is reported as AuthRequired.
+func Ping(ctx context.Context, registryURL, authToken string) (Status, error) {
+	ctx, cancel := context.WithTimeout(ctx, pingTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "GET", fmt.Sprintf("https://%s/v2/", registryURL), nil)
+	if err != nil {
+		return Status{}, err
+	}
+	resp, err := authorize(roundTrip, req, registryURL, authToken, "")
+	if err != nil {
+		return Status{}, explainTLSError(registryURL, err)
+	}
+	defer resp.Body.Close()
+
+	status := Status{APIVersion: resp.Header.Get("Docker-Distribution-API-Version")}
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusUnauthorized:
+		status.AuthRequired = true
+	default:
+		return status, responseError(resp)
+	}
+	return status, nil
+}
+
+// Catalog returns up to limit repository names from the /v2/_catalog endpoint of the
+// specified registry, following its pagination, and whether more were left out. A limit of
+// 0 returns every repository.
+func Catalog(ctx context.Context, registryURL, authToken string, limit int) ([]string, bool, error) {
+	first := fmt.Sprintf("/v2/_catalog?n=%d", tagsPageSize)
+	repositories := []string{}
+	requested := map[string]bool{}
+	for next := first; next != "" && !requested[next]; {
+		requested[next] = true
+		var page struct {
+			Repositories []string `json:"repositories"`
+		}
+		req, err := http.NewRequestWithContext(ctx, "GET", "https://"+registryURL+next, nil)
+		if err != nil {
+			return nil, false, err
+		}
+		resp, err := do(req, registryURL, authToken, "registry:catalog:*")
+		if err != nil {
+			return nil, false, explainTLSError(registryURL, err)
+		}
+		if resp.StatusCode == http.StatusOK {
+			err = json.NewDecoder(resp.Body).Decode(&page)
+		} else {
+			err = responseError(resp)
+		}
+		resp.Body.Close()
+		if err != nil {
+			return nil, false, err
+		}
+
+		repositories = append(repositories, page.Repositories...)
+		if limit > 0 && len(repositories) > limit {
+			return repositories[:limit], true, nil
+		}
+		next = nextPage(resp.Header.Values("Link"))
+		if next == "" && len(page.Repositories) >= tagsPageSize {
+			next = "/v2/_catalog?" + url.Values{"n": {strconv.Itoa(tagsPageSize)}, "last": {page.Repositories[len(page.Repositories)-1]}}.Encode()
+		}
 	}
-	return parts[0], "latest"
+	return repositories, false, nil
 }
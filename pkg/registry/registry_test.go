@@ -0,0 +1,192 @@
+package registry
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"testing"
+)
+
+// pagedList serves items two at a time under key, starting after the last query
+// parameter. The first page links to the next with a relative URL, the second with an
+// absolute URL on another host, and the last page has no Link header.
+func pagedList(t *testing.T, key string, items []string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		start := 0
+		if last := r.URL.Query().Get("last"); last != "" {
+			start = slices.Index(items, last) + 1
+		}
+		end := min(start+2, len(items))
+		if end < len(items) {
+			next := r.URL.Path + "?n=2&last=" + items[end-1]
+			if start > 0 {
+				next = "https://elsewhere.example.com" + next
+			}
+			w.Header().Set("Link", "<"+next+`>; rel="next"`)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(map[string][]string{key: items[start:end]}); err != nil {
+			t.Error(err)
+		}
+	}
+}
+
+func TestListTagsPages(t *testing.T) {
+	want := []string{"7.0.3", "8.0.1", "8.0.2", "8.0.3", "latest"}
+	var requests []string
+	registryURL := stubRegistry(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests = append(requests, r.URL.RequestURI())
+		if r.URL.Path != "/v2/ns/vddk/tags/list" {
+			http.NotFound(w, r)
+			return
+		}
+		pagedList(t, "tags", want)(w, r)
+	}))
+
+	tags, exists, err := ListTags(context.Background(), "ns/vddk", registryURL, "")
+	if err != nil || !exists {
+		t.Fatalf("ListTags() = %q, %t, %v", tags, exists, err)
+	}
+	if !slices.Equal(tags, want) {
+		t.Errorf("ListTags() = %q, want %q", tags, want)
+	}
+	if wantRequests := []string{"/v2/ns/vddk/tags/list?n=100", "/v2/ns/vddk/tags/list?n=2&last=8.0.1", "/v2/ns/vddk/tags/list?n=2&last=8.0.3"}; !slices.Equal(requests, wantRequests) {
+		t.Errorf("requested %q, want %q", requests, wantRequests)
+	}
+}
+
+func TestListTagsMissingRepository(t *testing.T) {
+	registryURL := stubRegistry(t, http.NotFoundHandler())
+	tags, exists, err := ListTags(context.Background(), "ns/missing", registryURL, "")
+	if err != nil || exists || tags != nil {
+		t.Errorf("ListTags() = %q, %t, %v; want a missing repository", tags, exists, err)
+	}
+}
+
+func TestCatalogPages(t *testing.T) {
+	all := []string{"ns/a", "ns/b", "ns/c", "ns/d", "ns/e"}
+	registryURL := stubRegistry(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v2/_catalog" {
+			http.NotFound(w, r)
+			return
+		}
+		pagedList(t, "repositories", all)(w, r)
+	}))
+
+	tests := []struct {
+		limit     int
+		want      []string
+		truncated bool
+	}{
+		{limit: 0, want: all},
+		{limit: 5, want: all},
+		{limit: 3, want: all[:3], truncated: true},
+	}
+	for _, tt := range tests {
+		repositories, truncated, err := Catalog(context.Background(), registryURL, "", tt.limit)
+		if err != nil {
+			t.Fatalf("Catalog(%d) error = %v", tt.limit, err)
+		}
+		if !slices.Equal(repositories, tt.want) || truncated != tt.truncated {
+			t.Errorf("Catalog(%d) = %q, %t; want %q, %t", tt.limit, repositories, truncated, tt.want, tt.truncated)
+		}
+	}
+}
+
+func TestDeleteImage(t *testing.T) {
+	const digest = testDigest
+	tests := []struct {
+		name    string
+		status  int
+		wantErr func(err error) bool
+	}{
+		{name: "accepted", status: http.StatusAccepted, wantErr: func(err error) bool { return err == nil }},
+		{name: "not found", status: http.StatusNotFound, wantErr: func(err error) bool {
+			var notFound *NotFoundError
+			return errors.As(err, &notFound) && notFound.Image == "ns/vddk:8.0.3"
+		}},
+		{name: "deletes disabled", status: http.StatusMethodNotAllowed, wantErr: func(err error) bool {
+			var disabled *DeletesDisabledError
+			return errors.As(err, &disabled)
+		}},
+		{name: "server error", status: http.StatusInternalServerError, wantErr: func(err error) bool {
+			var respErr *ResponseError
+			return errors.As(err, &respErr) && respErr.StatusCode == http.StatusInternalServerError
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var deleted string
+			registryURL := stubRegistry(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				switch r.Method {
+				case http.MethodHead:
+					if r.URL.Path != "/v2/ns/vddk/manifests/8.0.3" {
+						http.NotFound(w, r)
+						return
+					}
+					w.Header().Set("Docker-Content-Digest", digest)
+					w.Header().Set("Content-Type", MediaTypeOCIManifest)
+				case http.MethodDelete:
+					deleted = r.URL.Path
+					w.WriteHeader(tt.status)
+				default:
+					w.WriteHeader(http.StatusMethodNotAllowed)
+				}
+			}))
+
+			got, err := DeleteImage(context.Background(), "ns/vddk:8.0.3", registryURL, "")
+			if !tt.wantErr(err) {
+				t.Fatalf("DeleteImage() error = %v (%T)", err, err)
+			}
+			if deleted != "/v2/ns/vddk/manifests/"+digest {
+				t.Errorf("deleted %q, want the manifest by digest", deleted)
+			}
+			if err == nil && got != digest {
+				t.Errorf("DeleteImage() = %q, want %q", got, digest)
+			}
+		})
+	}
+}
+
+func TestDeleteImageMissing(t *testing.T) {
+	registryURL := stubRegistry(t, http.NotFoundHandler())
+	_, err := DeleteImage(context.Background(), "ns/vddk:8.0.3", registryURL, "")
+	var notFound *NotFoundError
+	if !errors.As(err, &notFound) {
+		t.Errorf("DeleteImage() error = %v, want a NotFoundError", err)
+	}
+}
+
+func TestDescribeImageHeadFallback(t *testing.T) {
+	body := `{"schemaVersion":2,"mediaType":"` + MediaTypeOCIManifest + `"}`
+	for _, status := range []int{http.StatusMethodNotAllowed, http.StatusNotImplemented} {
+		t.Run(http.StatusText(status), func(t *testing.T) {
+			var methods []string
+			registryURL := stubRegistry(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				methods = append(methods, r.Method)
+				if r.Method == http.MethodHead {
+					w.WriteHeader(status)
+					return
+				}
+				w.Header().Set("Content-Type", MediaTypeOCIManifest)
+				w.Write([]byte(body))
+			}))
+
+			manifest, err := DescribeImage(context.Background(), "ns/vddk:8.0.3", registryURL, "")
+			if err != nil {
+				t.Fatalf("DescribeImage() error = %v", err)
+			}
+			want := Manifest{Exists: true, Digest: fmt.Sprintf("sha256:%x", sha256.Sum256([]byte(body))), MediaType: MediaTypeOCIManifest, Size: int64(len(body))}
+			if manifest != want {
+				t.Errorf("DescribeImage() = %+v, want %+v with the digest computed from the manifest", manifest, want)
+			}
+			if !slices.Equal(methods, []string{http.MethodHead, http.MethodGet}) {
+				t.Errorf("requests %q, want HEAD then GET", methods)
+			}
+		})
+	}
+}
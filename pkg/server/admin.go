@@ -0,0 +1,127 @@
+package server
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+
+	authorizationv1 "k8s.io/api/authorization/v1"
+
+	"vddk-builder/pkg/audit"
+	"vddk-builder/pkg/config"
+	"vddk-builder/pkg/k8spermissions"
+)
+
+// authenticateAdmin authorizes a request for the /admin endpoints. When an ADMIN_TOKEN is
+// configured the bearer token must match it; otherwise, in kubernetes auth mode, the
+// caller must be allowed every verb on every resource. With neither, admin endpoints are
+// disabled.
+func authenticateAdmin(cfg *config.Config, r *http.Request) (int, error) {
+	authToken := bearerToken(r)
+
+	if cfg.AdminToken != "" {
+		if subtle.ConstantTimeCompare([]byte(authToken), []byte(cfg.AdminToken)) != 1 {
+			return http.StatusUnauthorized, fmt.Errorf("Invalid admin token")
+		}
+		return http.StatusOK, nil
+	}
+
+	if cfg.AuthMode != config.AuthModeKubernetes {
+		return http.StatusForbidden, fmt.Errorf("Admin endpoints are disabled; set ADMIN_TOKEN or AUTH_MODE=kubernetes")
+	}
+	if authToken == "" {
+		return http.StatusUnauthorized, fmt.Errorf("Missing bearer token")
+	}
+	clusterAdmin := authorizationv1.ResourceAttributes{Verb: "*", Group: "*", Resource: "*"}
+	access := cfg.AuthRequiredAudience + " " + describeAccess([]authorizationv1.ResourceAttributes{clusterAdmin})
+	_, err := authDecisions.decide(authCacheKey(authToken, access), cfg.AuthCacheTTL, func() (string, error) {
+		var identity k8spermissions.Identity
+		if cfg.AuthRequiredAudience != "" {
+			var err error
+			if identity, err = reviewIdentity(r.Context(), cfg, authToken); err != nil {
+				return "", err
+			}
+		}
+		return "", checkAccess(r.Context(), cfg, authToken, identity, clusterAdmin)
+	})
+	if err != nil {
+		return http.StatusForbidden, err
+	}
+	return http.StatusOK, nil
+}
+
+// adminResetHandler force-clears the busy slot, marks the stuck build as failed and
+// removes its workspace. It responds with the ID of the build that was reset, if any.
+func adminResetHandler(cfg *config.Config) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		if status, err := authenticateAdmin(cfg, r); err != nil {
+			http.Error(w, err.Error(), status)
+			return
+		}
+
+		buildLock.Lock()
+		stuck := activeBuild
+		isBusy = false
+		activeBuild = nil
+		buildLock.Unlock()
+
+		if stuck == nil {
+			fmt.Fprintln(w, "Busy state cleared; no build was running.")
+			return
+		}
+
+		auditLog.Record(audit.Entry{
+			Identity: "admin",
+			ClientIP: clientAddr(r),
+			Action:   "admin-reset",
+			Image:    stuck.Reference,
+			BuildID:  stuck.ID,
+			Outcome:  "reset",
+		})
+		finishBuild(stuck, BuildFailed, "reset by administrator")
+		cleanupBuild(stuck)
+		log.Printf("Admin reset cleared build %s (%s)\n", stuck.ID, stuck.Image)
+		fmt.Fprintf(w, "Busy state cleared; build %s marked as failed.\n", stuck.ID)
+	}
+}
+
+// defaultAuditEntries is the number of entries returned by /admin/audit without 'limit'.
+const defaultAuditEntries = 100
+
+// adminAuditHandler returns the most recent audit entries as JSON, oldest first.
+func adminAuditHandler(cfg *config.Config) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		if status, err := authenticateAdmin(cfg, r); err != nil {
+			http.Error(w, err.Error(), status)
+			return
+		}
+
+		limit := defaultAuditEntries
+		if v := r.URL.Query().Get("limit"); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n <= 0 {
+				http.Error(w, "Invalid 'limit' query parameter", http.StatusBadRequest)
+				return
+			}
+			limit = n
+		}
+
+		entries := auditLog.Recent(limit)
+		if entries == nil {
+			entries = []audit.Entry{}
+		}
+		writeJSON(w, http.StatusOK, entries)
+	}
+}
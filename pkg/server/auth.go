@@ -0,0 +1,391 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	authorizationv1 "k8s.io/api/authorization/v1"
+
+	"vddk-builder/pkg/config"
+	"vddk-builder/pkg/k8spermissions"
+)
+
+// authenticateRequest authorizes r according to the configured AUTH_MODE. It returns the
+// token that may be forwarded to the registry, which is only ever the caller's token in
+// kubernetes mode, and the identity of the caller. In kubernetes mode the identity is
+// resolved with a TokenReview, which also rejects unauthenticated tokens before the access
+// reviews run; it is "unknown" when the builder may not review tokens. Decisions are cached
+// for AUTH_CACHE_TTL, denials for a few seconds only. A caller rejected by the allow-lists
+// gets a *forbiddenError.
+func authenticateRequest(cfg *config.Config, r *http.Request) (string, string, error) {
+	switch cfg.AuthMode {
+	case config.AuthModeToken:
+		authToken := bearerToken(r)
+		if authToken == "" {
+			return "", "", fmt.Errorf("Missing bearer token")
+		}
+		if err := staticTokens.check(cfg.AuthTokensFile, authToken); err != nil {
+			return "", "", err
+		}
+		return "", identityFor(cfg, r), nil
+
+	case config.AuthModeKubernetes:
+		authToken := bearerToken(r)
+		if authToken == "" {
+			return "", "", fmt.Errorf("Missing bearer token")
+		}
+		identity, err := authorizeCached(r.Context(), cfg, authToken, requiredAccess(cfg))
+		if err != nil {
+			return "", "", err
+		}
+		return authToken, identity, nil
+
+	default:
+		return "", identityFor(cfg, r), nil
+	}
+}
+
+// authorizeCached runs authorizeKubernetes for authToken and checks through authDecisions.
+func authorizeCached(ctx context.Context, cfg *config.Config, authToken string, checks []authorizationv1.ResourceAttributes) (string, error) {
+	p := currentPolicy(cfg)
+	access := cfg.AuthRequiredAudience + " " + cfg.AuthPolicy + " " + describeAccess(checks) + " " + strings.Join(p.AuthAllowedSubjects, ",") + " " + strings.Join(p.AuthAllowedGroups, ",")
+	return authDecisions.decide(authCacheKey(authToken, access), cfg.AuthCacheTTL, func() (string, error) {
+		return authorizeKubernetes(ctx, cfg, authToken, checks)
+	})
+}
+
+// forbiddenError reports an authenticated caller that is not allowed to use the builder.
+type forbiddenError struct {
+	msg string
+}
+
+func (e *forbiddenError) Error() string { return e.msg }
+
+// authorizeKubernetes resolves the identity of authToken and authorizes it with the access
+// reviews in checks and the subject and group allow-lists of the current policy, as
+// combined by AUTH_POLICY. It returns the caller's user name.
+func authorizeKubernetes(ctx context.Context, cfg *config.Config, authToken string, checks []authorizationv1.ResourceAttributes) (string, error) {
+	identity, err := reviewIdentity(ctx, cfg, authToken)
+	if err != nil {
+		return "", err
+	}
+	p := currentPolicy(cfg)
+	if len(p.AuthAllowedSubjects) == 0 && len(p.AuthAllowedGroups) == 0 {
+		return identity.Username, checkAccess(ctx, cfg, authToken, identity, checks...)
+	}
+
+	listed := identity.Username != "unknown" && slices.Contains(p.AuthAllowedSubjects, identity.Username)
+	for _, group := range identity.Groups {
+		listed = listed || slices.Contains(p.AuthAllowedGroups, group)
+	}
+	switch {
+	case cfg.AuthPolicy == config.AuthPolicyAllowList && listed:
+		return identity.Username, nil
+	case cfg.AuthPolicy == config.AuthPolicyAny && (listed || checkAccess(ctx, cfg, authToken, identity, checks...) == nil):
+		return identity.Username, nil
+	case cfg.AuthPolicy == config.AuthPolicyAll && listed:
+		return identity.Username, checkAccess(ctx, cfg, authToken, identity, checks...)
+	}
+	return "", &forbiddenError{msg: fmt.Sprintf("User %s is not in AUTH_ALLOWED_SUBJECTS or AUTH_ALLOWED_GROUPS", identity.Username)}
+}
+
+// reviewUnavailableOnce limits the warning about unavailable token reviews to one.
+var reviewUnavailableOnce sync.Once
+
+// reviewIdentity returns the identity authToken authenticates as, with the user name
+// "unknown" if it cannot be resolved. A token the API server rejects, or one that is not
+// bound to AUTH_REQUIRED_AUDIENCE when set, is an error.
+func reviewIdentity(ctx context.Context, cfg *config.Config, authToken string) (k8spermissions.Identity, error) {
+	identity, err := k8spermissions.ReviewToken(ctx, authToken, cfg.AuthRequiredAudience)
+	switch {
+	case err == nil:
+		return identity, nil
+	case errors.Is(err, k8spermissions.ErrUnauthenticated):
+		return k8spermissions.Identity{}, fmt.Errorf("Invalid bearer token")
+	case errors.Is(err, k8spermissions.ErrAudienceMismatch):
+		return k8spermissions.Identity{}, fmt.Errorf("Bearer token was not issued for this service: %v", err)
+	case cfg.AuthRequiredAudience != "":
+		// Without a review the audience cannot be checked, so the token is not trusted
+		log.Printf("Failed to review token for AUTH_REQUIRED_AUDIENCE: %v\n", err)
+		return k8spermissions.Identity{}, fmt.Errorf("The audience of the bearer token cannot be verified")
+	case errors.Is(err, k8spermissions.ErrReviewUnavailable):
+		reviewUnavailableOnce.Do(func() {
+			log.Printf("WARNING: caller identities are unknown, grant the service account create on tokenreviews: %v\n", err)
+		})
+	default:
+		log.Printf("Failed to review token: %v\n", err)
+	}
+	return k8spermissions.Identity{Username: "unknown"}, nil
+}
+
+type (
+	registryTokenKey struct{}
+	identityKey      struct{}
+)
+
+// withAuth wraps handler with the authentication policy for the route pattern. Routes
+// listed in AUTH_EXEMPT_PATHS skip authorization, but in kubernetes mode a bearer token
+// sent with the request is still forwarded to the registry for private-image checks.
+func withAuth(cfg *config.Config, pattern string, handler http.HandlerFunc) http.HandlerFunc {
+	if isExemptPath(pattern, cfg.AuthExemptPaths) {
+		return func(w http.ResponseWriter, r *http.Request) {
+			token := ""
+			if cfg.AuthMode == config.AuthModeKubernetes {
+				token = bearerToken(r)
+			}
+			handler(w, withRegistryToken(r, pushToken(cfg, token), "anonymous"))
+		}
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		token, identity, err := authenticateRequest(cfg, r)
+		var forbidden *forbiddenError
+		if errors.As(err, &forbidden) {
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+		handler(w, withRegistryToken(r, pushToken(cfg, token), identity))
+	}
+}
+
+// withPushAuth wraps the handler of a route that pushes images. In kubernetes mode only the
+// presence of a bearer token is checked, the handler authorizes the push with authorizePush
+// once it knows the namespace of the image; other modes are handled by withAuth.
+func withPushAuth(cfg *config.Config, pattern string, handler http.HandlerFunc) http.HandlerFunc {
+	if cfg.AuthMode != config.AuthModeKubernetes || isExemptPath(pattern, cfg.AuthExemptPaths) {
+		return withAuth(cfg, pattern, handler)
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		if bearerToken(r) == "" {
+			http.Error(w, "Missing bearer token", http.StatusUnauthorized)
+			return
+		}
+		handler(w, r)
+	}
+}
+
+// authorizePush authorizes the caller of a route wrapped by withPushAuth to push imageName,
+// with the AUTH_SAR_* access review made in the namespace of the image instead of
+// AUTH_SAR_NAMESPACE. It returns r carrying the registry token and identity, or answers the
+// request and returns false; a caller that may not write to the namespace gets 403. Requests
+// withAuth already authorized are returned unchanged.
+func authorizePush(w http.ResponseWriter, r *http.Request, cfg *config.Config, imageName string) (*http.Request, bool) {
+	if _, done := r.Context().Value(identityKey{}).(string); done {
+		return r, true
+	}
+	namespace := config.ImageNamespace(imageName)
+	checks := requiredAccess(cfg)
+	if namespace != "" {
+		checks[0].Namespace = namespace
+	}
+
+	authToken := bearerToken(r)
+	identity, err := authorizeCached(r.Context(), cfg, authToken, checks)
+	var forbidden *forbiddenError
+	switch {
+	case errors.Is(err, errAccessDenied) && namespace != "":
+		http.Error(w, fmt.Sprintf("Not allowed to push to namespace %s: %v", namespace, err), http.StatusForbidden)
+		return nil, false
+	case errors.Is(err, errAccessDenied), errors.As(err, &forbidden):
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return nil, false
+	case err != nil:
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return nil, false
+	}
+	return withRegistryToken(r, pushToken(cfg, authToken), identity), true
+}
+
+// isExemptPath reports whether pattern equals, or is nested below, one of the exempt paths.
+func isExemptPath(pattern string, exempt []string) bool {
+	for _, path := range exempt {
+		if pattern == path || strings.HasPrefix(pattern, strings.TrimSuffix(path, "/")+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+func withRegistryToken(r *http.Request, token, identity string) *http.Request {
+	ctx := context.WithValue(r.Context(), registryTokenKey{}, token)
+	ctx = context.WithValue(ctx, identityKey{}, identity)
+	return r.WithContext(ctx)
+}
+
+// identityFor names the authenticated caller of r without revealing its credentials.
+func identityFor(cfg *config.Config, r *http.Request) string {
+	switch cfg.AuthMode {
+	case config.AuthModeToken:
+		sum := sha256.Sum256([]byte(bearerToken(r)))
+		return "token:" + hex.EncodeToString(sum[:6])
+	default:
+		return "anonymous"
+	}
+}
+
+// requestIdentity returns the caller identity withAuth resolved for r.
+func requestIdentity(r *http.Request) string {
+	if identity, ok := r.Context().Value(identityKey{}).(string); ok {
+		return identity
+	}
+	return "anonymous"
+}
+
+// registryToken returns the token withAuth resolved for forwarding to the registry.
+func registryToken(r *http.Request) string {
+	token, _ := r.Context().Value(registryTokenKey{}).(string)
+	return token
+}
+
+// bearerToken returns the bearer token from the Authorization header, or "".
+func bearerToken(r *http.Request) string {
+	authHeader := r.Header.Get("Authorization")
+	if strings.HasPrefix(authHeader, "Bearer ") {
+		return strings.TrimPrefix(authHeader, "Bearer ")
+	}
+	return ""
+}
+
+// errAccessDenied is wrapped by the errors of access reviews that were not allowed.
+var errAccessDenied = errors.New("Insufficient permissions")
+
+// checkAccess runs a SelfSubjectAccessReview for each of checks with the caller's token,
+// all of which must be allowed. With AUTH_REQUIRED_AUDIENCE, whose tokens the API server
+// need not accept, SubjectAccessReviews of the reviewed identity are made instead.
+func checkAccess(ctx context.Context, cfg *config.Config, authToken string, identity k8spermissions.Identity, checks ...authorizationv1.ResourceAttributes) error {
+	var allowed bool
+	var err error
+	if cfg.AuthRequiredAudience != "" {
+		allowed, err = k8spermissions.CheckAccessForUser(ctx, identity, checks...)
+	} else {
+		allowed, err = k8spermissions.CheckAccessWithToken(ctx, authToken, checks...)
+	}
+	if err != nil {
+		log.Printf("Access review failed: %v\n", err)
+	}
+	if err != nil || !allowed {
+		return fmt.Errorf("%w: %s", errAccessDenied, describeAccess(checks))
+	}
+	return nil
+}
+
+// requiredAccess returns the access reviews AUTH_SAR_* and AUTH_SAR_CHECKS require of callers.
+func requiredAccess(cfg *config.Config) []authorizationv1.ResourceAttributes {
+	checks, _ := cfg.AccessChecks() // Checked by Validate
+	attributes := make([]authorizationv1.ResourceAttributes, len(checks))
+	for i, check := range checks {
+		attributes[i] = authorizationv1.ResourceAttributes{
+			Verb:        check.Verb,
+			Group:       check.Group,
+			Resource:    check.Resource,
+			Subresource: check.Subresource,
+			Namespace:   check.Namespace,
+		}
+	}
+	return attributes
+}
+
+// describeAccess names checks as "verb resource.group/subresource in namespace", joined by "and".
+func describeAccess(checks []authorizationv1.ResourceAttributes) string {
+	names := make([]string, len(checks))
+	for i, check := range checks {
+		name := check.Verb + " " + check.Resource
+		if check.Group != "" {
+			name += "." + check.Group
+		}
+		if check.Subresource != "" {
+			name += "/" + check.Subresource
+		}
+		if check.Namespace != "" {
+			name += " in " + check.Namespace
+		}
+		names[i] = name
+	}
+	return strings.Join(names, " and ")
+}
+
+// staticTokens holds the tokens accepted in token mode.
+var staticTokens tokenFile
+
+// tokenFile caches the tokens listed in AUTH_TOKENS_FILE and reloads them when the
+// file's modification time or size changes.
+type tokenFile struct {
+	mu      sync.Mutex
+	modTime time.Time
+	size    int64
+	tokens  [][]byte
+}
+
+// check returns nil if token matches one of the tokens in path.
+func (t *tokenFile) check(path, token string) error {
+	tokens, err := t.load(path)
+	if err != nil {
+		log.Printf("Failed to load auth tokens: %v\n", err)
+		return fmt.Errorf("Authentication is unavailable")
+	}
+
+	// Compare against every token so timing does not reveal which one matched
+	match := 0
+	for _, candidate := range tokens {
+		match |= subtle.ConstantTimeCompare([]byte(token), candidate)
+	}
+	if match != 1 {
+		return fmt.Errorf("Invalid bearer token")
+	}
+	return nil
+}
+
+// load returns the cached tokens, re-reading path if it changed since the last load.
+func (t *tokenFile) load(path string) ([][]byte, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.tokens != nil && info.ModTime().Equal(t.modTime) && info.Size() == t.size {
+		return t.tokens, nil
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var tokens [][]byte
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		tokens = append(tokens, []byte(line))
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	t.tokens = tokens
+	t.modTime = info.ModTime()
+	t.size = info.Size()
+	log.Printf("Loaded %d auth tokens from %s\n", len(tokens), path)
+	return tokens, nil
+}
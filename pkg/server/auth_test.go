@@ -0,0 +1,67 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"vddk-builder/pkg/config"
+)
+
+func TestAuthenticateRequestTokenFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tokens")
+	if err := os.WriteFile(path, []byte("# CI uploaders\nfirst-token\n\n  second-token  \n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	cfg := &config.Config{AuthMode: config.AuthModeToken, AuthTokensFile: path}
+	staticTokens = tokenFile{}
+	t.Cleanup(func() { staticTokens = tokenFile{} })
+
+	authenticate := func(token string) error {
+		r := httptest.NewRequest(http.MethodPost, "/upload", nil)
+		if token != "" {
+			r.Header.Set("Authorization", "Bearer "+token)
+		}
+		registryToken, _, err := authenticateRequest(cfg, r)
+		if registryToken != "" {
+			t.Errorf("authenticateRequest() forwards %q to the registry in token mode", registryToken)
+		}
+		return err
+	}
+	for token, wantOK := range map[string]bool{
+		"first-token":    true,
+		"second-token":   true,
+		"# CI uploaders": false,
+		"other-token":    false,
+		"":               false,
+	} {
+		if err := authenticate(token); (err == nil) != wantOK {
+			t.Errorf("authenticateRequest() with token %q error = %v, want ok = %t", token, err, wantOK)
+		}
+	}
+
+	// A rewritten file replaces the tokens without a restart
+	if err := os.WriteFile(path, []byte("rotated-token\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	later := time.Now().Add(time.Minute)
+	if err := os.Chtimes(path, later, later); err != nil {
+		t.Fatal(err)
+	}
+	if err := authenticate("first-token"); err == nil {
+		t.Error("a token removed from the file is still accepted")
+	}
+	if err := authenticate("rotated-token"); err != nil {
+		t.Errorf("a token added to the file is refused: %v", err)
+	}
+
+	if err := os.Remove(path); err != nil {
+		t.Fatal(err)
+	}
+	if err := authenticate("rotated-token"); err == nil || err.Error() != "Authentication is unavailable" {
+		t.Errorf("authenticateRequest() without the file error = %v, want authentication to be unavailable", err)
+	}
+}
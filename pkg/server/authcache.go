@@ -0,0 +1,79 @@
+package server
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"sync"
+	"time"
+)
+
+// authCacheSize bounds the authorization decisions kept by authDecisions.
+const authCacheSize = 1024
+
+// negativeAuthCacheTTL bounds how long a denied or failed authorization is remembered, so a
+// caller granted access does not wait for AUTH_CACHE_TTL.
+const negativeAuthCacheTTL = 5 * time.Second
+
+// authDecisions remembers the outcome of recent kubernetes authorizations.
+var authDecisions = authCache{entries: map[[sha256.Size]byte]*list.Element{}, order: list.New()}
+
+// authCache is an LRU cache of authorization decisions keyed by a hash of the token and
+// the access reviews it was checked against, so tokens are never kept.
+type authCache struct {
+	mu      sync.Mutex
+	entries map[[sha256.Size]byte]*list.Element
+	order   *list.List // Most recently used first
+}
+
+type authCacheEntry struct {
+	key      [sha256.Size]byte
+	identity string
+	err      error
+	expires  time.Time
+}
+
+// authCacheKey hashes token together with what it is authorized for.
+func authCacheKey(token, access string) [sha256.Size]byte {
+	return sha256.Sum256([]byte(access + "\x00" + token))
+}
+
+// decide returns the cached decision for key, or runs authorize and caches its outcome: an
+// identity for ttl, an error for at most negativeAuthCacheTTL. A ttl of 0 disables caching.
+func (c *authCache) decide(key [sha256.Size]byte, ttl time.Duration, authorize func() (string, error)) (string, error) {
+	if ttl <= 0 {
+		return authorize()
+	}
+
+	now := time.Now()
+	c.mu.Lock()
+	if elem, ok := c.entries[key]; ok {
+		entry := elem.Value.(*authCacheEntry)
+		if now.Before(entry.expires) {
+			c.order.MoveToFront(elem)
+			c.mu.Unlock()
+			authCacheTotal.Inc("hit")
+			return entry.identity, entry.err
+		}
+		c.order.Remove(elem)
+		delete(c.entries, key)
+	}
+	c.mu.Unlock()
+	authCacheTotal.Inc("miss")
+
+	identity, err := authorize()
+	if err != nil {
+		ttl = min(ttl, negativeAuthCacheTTL)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if elem, ok := c.entries[key]; ok {
+		c.order.Remove(elem)
+	}
+	c.entries[key] = c.order.PushFront(&authCacheEntry{key: key, identity: identity, err: err, expires: now.Add(ttl)})
+	for c.order.Len() > authCacheSize {
+		oldest := c.order.Remove(c.order.Back()).(*authCacheEntry)
+		delete(c.entries, oldest.key)
+	}
+	return identity, err
+}
@@ -0,0 +1,533 @@
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"runtime/debug"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"vddk-builder/pkg/audit"
+	"vddk-builder/pkg/builder"
+	"vddk-builder/pkg/config"
+)
+
+// BuildState is the lifecycle state of a build record.
+type BuildState string
+
+const (
+	BuildRunning   BuildState = "running"
+	BuildSucceeded BuildState = "succeeded"
+	BuildFailed    BuildState = "failed"
+	BuildTimeout   BuildState = "timeout"
+	BuildSkipped   BuildState = "skipped" // The registry already held the image built from the same archive
+
+	BuildDryRunSucceeded BuildState = "succeeded (dry-run)" // The image built but was not pushed
+)
+
+// Build is the record of a single upload and the image build it triggered.
+type Build struct {
+	ID         string       `json:"id"`
+	Image      string       `json:"image"`
+	Reference  string       `json:"reference"`
+	Identity   string       `json:"identity,omitempty"`
+	State      BuildState   `json:"state"`
+	Phase      string       `json:"phase,omitempty"`    // Phase the build is in, or failed in
+	Progress   float64      `json:"progress,omitempty"` // Completed fraction of the phase, between 0 and 1
+	Error      string       `json:"error,omitempty"`
+	StartedAt  time.Time    `json:"startedAt"`
+	FinishedAt *time.Time   `json:"finishedAt,omitempty"`
+	Inputs     []BuildInput `json:"inputs,omitempty"`
+	Digest     string       `json:"digest,omitempty"`  // Manifest digest of the pushed image, if known
+	Version    string       `json:"version,omitempty"` // VDDK version detected in the archive
+	Tags       []string     `json:"tags,omitempty"`    // Registry references the image was pushed as
+
+	PhaseSeconds map[string]float64  `json:"phaseSeconds,omitempty"` // Time spent in each builder phase
+	Stats        *builder.BuildStats `json:"stats,omitempty"`        // Work done in the builder phases
+
+	LogPath string `json:"logPath,omitempty"` // File in LOG_DIR holding the build output
+	LogSize int64  `json:"logSize,omitempty"` // Size of the log file once the build ended
+
+	OutputPath string `json:"outputPath,omitempty"` // OCI archive in OUTPUT_DIR the image was written to instead of pushed
+	OutputSize int64  `json:"outputSize,omitempty"` // Size of the OCI archive
+
+	Checksums string `json:"checksums,omitempty"` // Outcome of the CHECKSUM_MANIFEST verification: verified, not-present or failed
+
+	RetainedWorkDir string `json:"retainedWorkDir,omitempty"` // Work directory kept after the failure with KEEP_WORKDIR_ON_FAILURE
+
+	Job string `json:"job,omitempty"` // Namespace/name of the Kubernetes Job that ran the build with BUILD_MODE=job
+
+	ContainerfileUploaded  bool   `json:"containerfileUploaded,omitempty"`  // Built with the Containerfile uploaded in the 'containerfile' part
+	EffectiveContainerfile string `json:"effectiveContainerfile,omitempty"` // File in LOG_DIR holding the Containerfile the image was built with
+
+	ArchiveDigest string                  `json:"archiveDigest,omitempty"` // Digest of the source archive, the key for rebuilds
+	RebuildOf     string                  `json:"rebuildOf,omitempty"`     // ID of the build whose inputs were reused
+	PromotedFrom  string                  `json:"promotedFrom,omitempty"`  // Image copied by /promote instead of building
+	Containerfile string                  `json:"containerfile,omitempty"` // Containerfile path inside the archive requested by the upload
+	BuildArgs     []string                `json:"buildArgs,omitempty"`     // Build args passed to podman, with secret values redacted
+	Platforms     []string                `json:"platforms,omitempty"`     // Platforms of the pushed manifest list, unset for single-platform builds
+	Platform      string                  `json:"platform,omitempty"`      // Platform of a single-platform cross-build
+	NoCache       bool                    `json:"noCache,omitempty"`       // Built with podman build --no-cache
+	Squash        bool                    `json:"squash,omitempty"`        // Built with podman build --squash-all
+	Limits        *builder.ResourceLimits `json:"limits,omitempty"`        // Resources the build containers were limited to
+	DryRun        bool                    `json:"dryRun,omitempty"`        // Built without pushing
+	ImageIDs      []string                `json:"imageIDs,omitempty"`      // IDs of the locally built images
+	ImageSize     int64                   `json:"imageSize,omitempty"`     // Total size of the locally built images, for dry runs
+	Pushes        []BuildPush             `json:"pushes,omitempty"`        // Outcome of the push to each registry
+	Compression   string                  `json:"compression,omitempty"`   // Layer compression format of the pushed image
+
+	SkipReason string `json:"skipReason,omitempty"` // Why the build was skipped
+
+	Signature      string `json:"signature,omitempty"`      // "signed" or "failed", unset when signing is disabled
+	SignatureError string `json:"signatureError,omitempty"` // Why signing failed
+
+	SBOMPath   string `json:"sbomPath,omitempty"`   // File in LOG_DIR holding the SPDX SBOM of the image
+	SBOMDigest string `json:"sbomDigest,omitempty"` // Digest of the SBOM file
+	SBOMError  string `json:"sbomError,omitempty"`  // Why the SBOM could not be generated or attached
+
+	ImageStreamError string `json:"imageStreamError,omitempty"` // Why the ImageStreamTags could not be verified or annotated
+
+	UpdatedRef  string `json:"updatedRef,omitempty"`  // Reference pinned by digest the UPDATE_TARGET field was set to
+	UpdateError string `json:"updateError,omitempty"` // Why the UPDATE_TARGET field could not be set
+
+	ScanReportPath string         `json:"scanReportPath,omitempty"` // File in LOG_DIR holding the vulnerability scan report
+	ScanCounts     map[string]int `json:"scanCounts,omitempty"`     // Vulnerabilities found by severity
+
+	filePath  string        // Uploaded archive backing the build, empty if extracted while streaming
+	extrasDir string        // Directory holding the extra files
+	workDir   string        // Private work directory of the build
+	clientIP  string        // Address the upload came from
+	done      chan struct{} // Closed when the build reaches a terminal state
+}
+
+// BuildPush describes the push of a build's image to one registry.
+type BuildPush struct {
+	Registry string `json:"registry"`
+	Image    string `json:"image"`
+	Digest   string `json:"digest,omitempty"`
+	Retries  int    `json:"retries,omitempty"`
+	Error    string `json:"error,omitempty"`
+}
+
+// BuildInput describes one uploaded file that went into a build context.
+type BuildInput struct {
+	Name   string `json:"name"`
+	Role   string `json:"role"` // "archive" or "extra"
+	Size   int64  `json:"size"`
+	Digest string `json:"digest"`
+}
+
+var (
+	buildsLock sync.Mutex            // Protects builds and inFlight
+	builds     = map[string]*Build{} // Build records by ID
+	inFlight   = map[string]*Build{} // Running builds by normalized image reference
+)
+
+// newBuild registers b, filled in with the request details, as a new running build. An
+// ID is assigned unless the caller already picked one. If
+// another build for the same reference is still running, that build is returned instead
+// together with false.
+func newBuild(b *Build) (*Build, bool) {
+	if b.ID == "" {
+		b.ID = newBuildID()
+	}
+	b.State = BuildRunning
+	b.StartedAt = time.Now().UTC()
+	b.done = make(chan struct{})
+	for _, input := range b.Inputs {
+		if input.Role == "archive" {
+			b.ArchiveDigest = input.Digest
+		}
+	}
+
+	buildsLock.Lock()
+	defer buildsLock.Unlock()
+	if existing := inFlight[b.Reference]; existing != nil {
+		return existing, false
+	}
+	builds[b.ID] = b
+	inFlight[b.Reference] = b
+	markStateDirty()
+	markStatusDirty(b.ID)
+	return b, true
+}
+
+// setProgress records the phase and progress reported by the builder while b is running.
+func (b *Build) setProgress(phase string, progress float64) {
+	buildsLock.Lock()
+	defer buildsLock.Unlock()
+	if b.State == BuildRunning {
+		if b.Phase != phase {
+			markStatusDirty(b.ID)
+		}
+		b.Phase = phase
+		b.Progress = progress
+	}
+}
+
+// setResult records the pushed digest and the phase durations reported by the builder.
+func (b *Build) setResult(result builder.BuildResult) {
+	buildsLock.Lock()
+	defer buildsLock.Unlock()
+	b.Digest = result.Digest
+	b.Version = result.Version
+	b.Tags = result.Tags
+	b.PhaseSeconds = make(map[string]float64, len(result.PhaseDurations))
+	for phase, d := range result.PhaseDurations {
+		b.PhaseSeconds[phase] = d.Seconds()
+	}
+	stats := result.Stats
+	b.Stats = &stats
+	b.Pushes = nil
+	for _, push := range result.Pushes {
+		p := BuildPush{Registry: push.Registry, Image: push.Image, Digest: push.Digest, Retries: push.Retries}
+		if push.Err != nil {
+			p.Error = push.Err.Error()
+		}
+		b.Pushes = append(b.Pushes, p)
+	}
+	b.ImageIDs = result.ImageIDs
+	b.ImageSize = result.ImageSize
+	b.Compression = result.Compression
+	b.Checksums = result.Checksums
+	b.RetainedWorkDir = result.RetainedWorkDir
+	b.OutputPath = result.OutputPath
+	if info, err := os.Stat(result.OutputPath); err == nil {
+		b.OutputSize = info.Size()
+	}
+	b.Signature = result.Signature
+	b.SignatureError = ""
+	if result.SignErr != nil {
+		b.SignatureError = result.SignErr.Error()
+	}
+	b.ScanCounts = result.ScanCounts
+	b.SBOMDigest = result.SBOMDigest
+	b.SBOMError = ""
+	if result.SBOMErr != nil {
+		b.SBOMError = result.SBOMErr.Error()
+	}
+	b.ImageStreamError = ""
+	if result.ImageStreamErr != nil {
+		b.ImageStreamError = result.ImageStreamErr.Error()
+	}
+	b.UpdatedRef = result.UpdatedRef
+	b.UpdateError = ""
+	if result.UpdateErr != nil {
+		b.UpdateError = result.UpdateErr.Error()
+	}
+}
+
+// parseBuildArgs validates the repeated 'build_arg' query parameters against
+// BUILD_ARGS_ALLOWED and merges them over the BUILD_ARGS defaults.
+func parseBuildArgs(cfg *config.Config, r *http.Request) ([]string, error) {
+	requested := r.URL.Query()["build_arg"]
+	if err := builder.ValidateBuildArgs(requested, cfg.BuildArgsAllowed); err != nil {
+		return nil, err
+	}
+	return builder.MergeBuildArgs(cfg.BuildArgs, requested), nil
+}
+
+// parsePlatforms returns the platforms named by the comma-separated 'platforms' query
+// parameter, or fallback when it is absent.
+func parsePlatforms(r *http.Request, fallback []string) ([]string, error) {
+	value := r.URL.Query().Get("platforms")
+	if value == "" {
+		return fallback, nil
+	}
+	var platforms []string
+	for _, platform := range strings.Split(value, ",") {
+		if platform = strings.TrimSpace(platform); platform != "" {
+			platforms = append(platforms, platform)
+		}
+	}
+	if err := builder.ValidatePlatforms(platforms); err != nil {
+		return nil, err
+	}
+	return platforms, nil
+}
+
+// queryFlag returns whether the name query parameter is "true", or fallback when it is absent.
+func queryFlag(r *http.Request, name string, fallback bool) bool {
+	if v := r.URL.Query().Get(name); v != "" {
+		return v == "true"
+	}
+	return fallback
+}
+
+// parsePlatform returns the platform named by the 'platform' query parameter, which must
+// be listed in TARGET_PLATFORMS_ALLOWED, or an empty string when it is absent.
+func parsePlatform(cfg *config.Config, r *http.Request) (string, error) {
+	platform := r.URL.Query().Get("platform")
+	if platform != "" && !slices.Contains(cfg.TargetPlatformsAllowed, platform) {
+		return "", fmt.Errorf("platform %s is not allowed, must be one of %s", platform, strings.Join(cfg.TargetPlatformsAllowed, ", "))
+	}
+	return platform, nil
+}
+
+// failedPhase returns the builder phase err originated in, or an empty string.
+func failedPhase(err error) string {
+	var extractErr *builder.ExtractError
+	var buildErr *builder.BuildError
+	var pushErr *builder.PushError
+	var signErr *builder.SignError
+	var sbomErr *builder.SBOMError
+	var scanErr *builder.ScanError
+	switch {
+	case errors.As(err, &extractErr):
+		return builder.PhaseExtracting
+	case errors.As(err, &buildErr):
+		return builder.PhaseBuilding
+	case errors.As(err, &pushErr):
+		return builder.PhasePushing
+	case errors.As(err, &signErr):
+		return builder.PhaseSigning
+	case errors.As(err, &sbomErr):
+		return builder.PhaseSBOM
+	case errors.As(err, &scanErr):
+		return builder.PhaseScanning
+	}
+	return ""
+}
+
+// inFlightBuild returns the running build pushing reference, or nil.
+func inFlightBuild(reference string) *Build {
+	buildsLock.Lock()
+	defer buildsLock.Unlock()
+	return inFlight[reference]
+}
+
+// normalizeReference applies the default "latest" tag to references without a tag or digest.
+func normalizeReference(reference string) string {
+	lastSegment := reference[strings.LastIndex(reference, "/")+1:]
+	if strings.ContainsAny(lastSegment, ":@") {
+		return reference
+	}
+	return reference + ":latest"
+}
+
+// finishBuild moves a running build into a terminal state. Builds that were already
+// finished (for example by an admin reset) are left untouched.
+func finishBuild(b *Build, state BuildState, errMsg string) bool {
+	buildsLock.Lock()
+	defer buildsLock.Unlock()
+
+	if b.State != BuildRunning {
+		return false
+	}
+	action := "build"
+	if b.PromotedFrom != "" {
+		action = "promote"
+	}
+	auditLog.Record(audit.Entry{
+		Identity:      b.Identity,
+		ClientIP:      b.clientIP,
+		Action:        action,
+		Image:         b.Reference,
+		BuildID:       b.ID,
+		ArchiveDigest: b.ArchiveDigest,
+		Outcome:       string(state),
+		Detail:        errMsg,
+	})
+
+	now := time.Now().UTC()
+	if state == BuildSucceeded {
+		b.Phase, b.Progress = "", 1
+	}
+	buildsTotal.Inc(string(state))
+	buildDuration.Observe(now.Sub(b.StartedAt).Seconds(), string(state))
+	observePhases(b, state)
+	b.State = state
+	b.Error = errMsg
+	b.FinishedAt = &now
+	if inFlight[b.Reference] == b {
+		delete(inFlight, b.Reference)
+	}
+	close(b.done)
+	markStateDirty()
+	markStatusDirty(b.ID)
+	return true
+}
+
+// runBuild executes build for b and always releases the busy slot afterwards. When
+// timeout is positive the build context expires after it and the build ends in the
+// timeout state. A panic in build is recovered, logged with its stack, recorded on b and
+// followed by cleanup of the workspace and the uploaded archive, so the server keeps serving.
+func runBuild(b *Build, timeout time.Duration, build func(ctx context.Context) error) {
+	defer releaseBuild(b)
+
+	ctx, cancel := context.Background(), context.CancelFunc(func() {})
+	if timeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+	}
+	defer cancel()
+	defer func() {
+		if rec := recover(); rec != nil {
+			log.Printf("Build %s panicked: %v\n%s", b.ID, rec, debug.Stack())
+			finishBuild(b, BuildFailed, fmt.Sprintf("panic: %v", rec))
+			emitBuildEvent(b, eventBuildFailed, fmt.Errorf("panic: %v", rec))
+			cleanupBuild(b)
+		}
+	}()
+
+	emitBuildEvent(b, eventBuildStarted, nil)
+	err := build(ctx)
+	switch {
+	case err == nil && b.DryRun:
+		finishBuild(b, BuildDryRunSucceeded, "")
+		emitBuildEvent(b, eventBuildSucceeded, nil)
+	case err == nil:
+		finishBuild(b, BuildSucceeded, "")
+		emitBuildEvent(b, eventBuildSucceeded, nil)
+	case ctx.Err() == context.DeadlineExceeded:
+		log.Printf("Build %s timed out after %s: %v\n", b.ID, timeout, err)
+		finishBuild(b, BuildTimeout, fmt.Sprintf("build timed out after %s: %v", timeout, err))
+		emitBuildEvent(b, eventBuildFailed, fmt.Errorf("timed out after %s: %w", timeout, err))
+	default:
+		phase := failedPhase(err)
+		if phase != "" {
+			buildsLock.Lock()
+			b.Phase = phase
+			buildsLock.Unlock()
+		}
+		log.Printf("Build %s failed in phase %q: %v\n", b.ID, phase, err)
+		finishBuild(b, BuildFailed, err.Error())
+		if phase == builder.PhasePushing {
+			emitBuildEvent(b, eventPushFailed, err)
+		} else {
+			emitBuildEvent(b, eventBuildFailed, err)
+		}
+	}
+}
+
+// cleanupBuild removes the work directory, uploaded archive and extra files of b.
+func cleanupBuild(b *Build) {
+	builder.CleanupWorkspace(b.workDir, b.filePath)
+	if b.extrasDir != "" {
+		os.RemoveAll(b.extrasDir)
+	}
+}
+
+// snapshotBuild returns a copy of b that is safe to serialize without holding the lock.
+func snapshotBuild(b *Build) Build {
+	buildsLock.Lock()
+	defer buildsLock.Unlock()
+	return *b
+}
+
+// newBuildID returns a random 16-character hex identifier.
+func newBuildID() string {
+	buf := make([]byte, 8)
+	if _, err := rand.Read(buf); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(buf)
+}
+
+// listBuildsHandler returns every known build record as JSON, newest first.
+func listBuildsHandler(cfg *config.Config) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		buildsLock.Lock()
+		list := make([]Build, 0, len(builds))
+		for _, b := range builds {
+			list = append(list, *b)
+		}
+		buildsLock.Unlock()
+
+		sort.Slice(list, func(i, j int) bool { return list[i].StartedAt.After(list[j].StartedAt) })
+		writeJSON(w, http.StatusOK, list)
+	}
+}
+
+// getBuildHandler returns the build record named by the {id} path value as JSON.
+func getBuildHandler(cfg *config.Config) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		b := lookupBuild(r.PathValue("id"))
+		if b == nil {
+			http.Error(w, "Build not found", http.StatusNotFound)
+			return
+		}
+		writeJSON(w, http.StatusOK, snapshotBuild(b))
+	}
+}
+
+// Bounds for the timeout accepted by the wait endpoint.
+const (
+	defaultWaitTimeout = 300 * time.Second
+	maxWaitTimeout     = time.Hour
+)
+
+// waitBuildHandler blocks until the build named by the {id} path value reaches a terminal
+// state and returns its record. It answers 408 when the 'timeout' query parameter elapses
+// first and 503 when the server shuts down while waiting.
+func waitBuildHandler(cfg *config.Config) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		timeout := defaultWaitTimeout
+		if v := r.URL.Query().Get("timeout"); v != "" {
+			d, err := time.ParseDuration(v)
+			if err != nil || d <= 0 {
+				http.Error(w, "Invalid 'timeout' query parameter", http.StatusBadRequest)
+				return
+			}
+			timeout = min(d, maxWaitTimeout)
+		}
+
+		b := lookupBuild(r.PathValue("id"))
+		if b == nil {
+			http.Error(w, "Build not found", http.StatusNotFound)
+			return
+		}
+
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+
+		select {
+		case <-b.done:
+			writeJSON(w, http.StatusOK, snapshotBuild(b))
+		case <-timer.C:
+			http.Error(w, fmt.Sprintf("Build %s did not finish within %s", b.ID, timeout), http.StatusRequestTimeout)
+		case <-serverStopping:
+			http.Error(w, "Server is shutting down", http.StatusServiceUnavailable)
+		case <-r.Context().Done():
+		}
+	}
+}
+
+// lookupBuild returns the build record with the given ID, or nil.
+func lookupBuild(id string) *Build {
+	buildsLock.Lock()
+	defer buildsLock.Unlock()
+	return builds[id]
+}
+
+// writeJSON writes v as an indented JSON response with the given status code.
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(v); err != nil {
+		log.Printf("Failed to encode JSON response: %v\n", err)
+	}
+}
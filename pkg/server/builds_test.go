@@ -0,0 +1,129 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"vddk-builder/pkg/builder"
+	"vddk-builder/pkg/config"
+)
+
+// uploadRequest returns a POST of /upload carrying content as the archive.
+func uploadRequest(t *testing.T, url string, content []byte) *http.Request {
+	t.Helper()
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	part, err := form.CreateFormFile("file", "vddk.tar.gz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	part.Write(content)
+	form.Close()
+	r, err := http.NewRequest(http.MethodPost, url+"/upload?image=vddk-panic:8.0.3&overwrite=true", &body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Header.Set("Content-Type", form.FormDataContentType())
+	return r
+}
+
+func TestUploadRecoversBuildPanic(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv("CONFIG_FILE", "")
+	t.Setenv("AUTH_MODE", config.AuthModeNone)
+	t.Setenv("IMAGE_REGISTRY", "registry.test")
+	t.Setenv("UPLOAD_DIR", filepath.Join(dir, "uploads"))
+	t.Setenv("WORK_DIR", filepath.Join(dir, "work"))
+	t.Setenv("ALLOW_OVERWRITE", "true")
+	t.Setenv("SKIP_IF_EXISTS", "false")
+	cfg, err := config.LoadConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(cfg.UploadDir, 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	panics := true
+	previous := buildAndPushImage
+	buildAndPushImage = func(ctx context.Context, cfg *config.Config, req builder.BuildRequest) (builder.BuildResult, error) {
+		if panics {
+			panic("nil map")
+		}
+		return builder.BuildResult{Image: "registry.test/vddk-panic:8.0.3"}, nil
+	}
+	t.Cleanup(func() { buildAndPushImage = previous })
+
+	// Register the routes like StartServer
+	mux := http.NewServeMux()
+	mux.HandleFunc("/upload", withPushAuth(cfg, "/upload", uploadHandler(cfg)))
+	mux.HandleFunc("/builds/{id}", withAuth(cfg, "/builds/{id}", getBuildHandler(cfg)))
+	mux.HandleFunc("/builds/{id}/wait", withAuth(cfg, "/builds/{id}/wait", waitBuildHandler(cfg)))
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	// upload starts a build and returns its record once it is done
+	upload := func() (*http.Response, Build) {
+		t.Helper()
+		resp, err := http.DefaultClient.Do(uploadRequest(t, server.URL, []byte("archive")))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		id := resp.Header.Get("X-Build-ID")
+		if id == "" {
+			return resp, Build{}
+		}
+		t.Cleanup(func() {
+			buildsLock.Lock()
+			delete(builds, id)
+			buildsLock.Unlock()
+		})
+
+		wait, err := http.Get(server.URL + "/builds/" + id + "/wait?timeout=30s")
+		if err != nil {
+			t.Fatal(err)
+		}
+		wait.Body.Close()
+		get, err := http.Get(server.URL + "/builds/" + id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer get.Body.Close()
+		var record Build
+		if err := json.NewDecoder(get.Body).Decode(&record); err != nil {
+			t.Fatalf("GET /builds/%s: %v", id, err)
+		}
+		return resp, record
+	}
+
+	resp, record := upload()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("upload = %d, want %d", resp.StatusCode, http.StatusOK)
+	}
+	if record.State != BuildFailed {
+		t.Errorf("state = %q, want %q", record.State, BuildFailed)
+	}
+	if !strings.HasPrefix(record.Error, "panic: ") || !strings.Contains(record.Error, "nil map") {
+		t.Errorf("error = %q, want the panic value prefixed with \"panic: \"", record.Error)
+	}
+	for _, pattern := range []string{filepath.Join(cfg.UploadDir, "*"), filepath.Join(cfg.WorkDir, "*")} {
+		if left, _ := filepath.Glob(pattern); len(left) > 0 {
+			t.Errorf("%q left behind after the panic", left)
+		}
+	}
+
+	panics = false
+	resp, record = upload()
+	if resp.StatusCode != http.StatusOK || record.State != BuildSucceeded {
+		t.Errorf("upload after the panic = %d with build state %q, want %d and %q", resp.StatusCode, record.State, http.StatusOK, BuildSucceeded)
+	}
+}
@@ -0,0 +1,144 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"vddk-builder/pkg/config"
+	"vddk-builder/pkg/registry"
+)
+
+// checkImageResponse is the JSON answer of /check-image for clients accepting application/json.
+type checkImageResponse struct {
+	Image        string   `json:"image"`
+	Exists       bool     `json:"exists"`
+	Digest       string   `json:"digest,omitempty"`
+	MediaType    string   `json:"mediaType,omitempty"`
+	Size         int64    `json:"size,omitempty"`
+	ManifestList bool     `json:"manifestList,omitempty"`
+	Platforms    []string `json:"platforms,omitempty"`
+}
+
+// platformPattern matches the 'platform' query parameter of /check-image.
+var platformPattern = regexp.MustCompile(`^[a-z0-9]+/[a-z0-9_]+(/[a-z0-9]+)?$`)
+
+// checkImageHandler reports whether the image named by the 'image' query parameter
+// exists in the configured registry. The manifest digest is returned as the ETag, and a
+// request whose If-None-Match still matches it is answered with 304 Not Modified. Multi-arch
+// images are reported as manifest lists. Clients accepting application/json get the
+// digest, media type and size of the manifest as a checkImageResponse. With the 'platform'
+// query parameter a manifest list only counts as existing if it lists that platform; a
+// single-manifest image is reported as before.
+func checkImageHandler(cfg *config.Config) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		imageName := r.URL.Query().Get("image")
+		if imageName == "" {
+			http.Error(w, "Missing 'image' query parameter", http.StatusBadRequest)
+			return
+		}
+		if _, err := registry.ParseReference(imageName); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		platform := r.URL.Query().Get("platform")
+		if platform != "" && !platformPattern.MatchString(platform) {
+			http.Error(w, fmt.Sprintf("Invalid 'platform' query parameter %q: must be os/architecture[/variant]", platform), http.StatusBadRequest)
+			return
+		}
+
+		// Check image in the registry
+		manifest, err := registry.DescribeImage(r.Context(), imageName, cfg.ImageRegistry, registryToken(r))
+		imageExists := manifest.Exists
+		if err != nil {
+			registryError(w, "Error checking image", err)
+			return
+		}
+
+		// List the platforms of a manifest list when a platform is asked for
+		var platforms []string
+		if platform != "" && manifest.IsList() {
+			platforms, err = registry.ImagePlatforms(r.Context(), imageName, cfg.ImageRegistry, registryToken(r), manifest)
+			if err != nil {
+				registryError(w, "Error reading the manifest list", err)
+				return
+			}
+			imageExists = registry.HasPlatform(platforms, platform)
+		}
+
+		if imageExists && manifest.MediaType != "" {
+			w.Header().Set("X-Manifest-Media-Type", manifest.MediaType)
+		}
+		if imageExists && manifest.Digest != "" {
+			etag := `"` + manifest.Digest + `"`
+			w.Header().Set("ETag", etag)
+			if etagMatches(r.Header.Get("If-None-Match"), etag) {
+				w.WriteHeader(http.StatusNotModified)
+				return
+			}
+		}
+
+		if strings.Contains(r.Header.Get("Accept"), "application/json") {
+			status := http.StatusOK
+			if !imageExists {
+				status = http.StatusNotFound
+			}
+			writeJSON(w, status, checkImageResponse{
+				Image:        imageName,
+				Exists:       imageExists,
+				Digest:       manifest.Digest,
+				MediaType:    manifest.MediaType,
+				Size:         manifest.Size,
+				ManifestList: manifest.IsList(),
+				Platforms:    platforms,
+			})
+			return
+		}
+
+		if imageExists && manifest.IsList() && platform != "" {
+			fmt.Fprintf(w, "Image %s exists in the registry as a multi-arch manifest list including %s.\n", imageName, platform)
+		} else if imageExists && manifest.IsList() {
+			fmt.Fprintf(w, "Image %s exists in the registry as a multi-arch manifest list.\n", imageName)
+		} else if manifest.Exists && platform != "" {
+			http.Error(w, fmt.Sprintf("Image %s exists in the registry but its manifest list has no %s image (it has %s).", imageName, platform, strings.Join(platforms, ", ")), http.StatusNotFound)
+		} else if imageExists {
+			fmt.Fprintf(w, "Image %s exists in the registry.\n", imageName)
+		} else {
+			http.Error(w, fmt.Sprintf("Image %s not found in the registry.", imageName), http.StatusNotFound)
+		}
+	}
+}
+
+// registryError answers a failed registry query. A rate-limited registry is answered with
+// 429 and its Retry-After, anything else with 500.
+func registryError(w http.ResponseWriter, what string, err error) {
+	var rateLimited *registry.RateLimitedError
+	if errors.As(err, &rateLimited) {
+		if rateLimited.RetryAfter > 0 {
+			w.Header().Set("Retry-After", strconv.Itoa(int(rateLimited.RetryAfter.Round(time.Second).Seconds())))
+		}
+		http.Error(w, fmt.Sprintf("%s: %v", what, err), http.StatusTooManyRequests)
+		return
+	}
+	http.Error(w, fmt.Sprintf("%s: %v", what, err), http.StatusInternalServerError)
+}
+
+// etagMatches reports whether an If-None-Match header value matches etag.
+func etagMatches(ifNoneMatch, etag string) bool {
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+		if candidate == etag || candidate == "*" {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,118 @@
+package server
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"vddk-builder/pkg/config"
+	"vddk-builder/pkg/registry"
+)
+
+func TestCheckImageETag(t *testing.T) {
+	var digest atomic.Value
+	digest.Store("sha256:" + strings.Repeat("1", 64))
+	stub := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v2/ns/vddk/manifests/8.0.3" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Docker-Content-Digest", digest.Load().(string))
+		w.Header().Set("Content-Type", registry.MediaTypeOCIManifest)
+	}))
+	defer stub.Close()
+	if err := registry.Configure(registry.Options{TLSVerify: false}); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { registry.Configure(registry.Options{TLSVerify: true, Timeout: 30 * time.Second}) })
+	handler := checkImageHandler(&config.Config{ImageRegistry: stub.Listener.Addr().String()})
+
+	check := func(image, ifNoneMatch string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodGet, "/check-image?image="+image, nil)
+		if ifNoneMatch != "" {
+			r.Header.Set("If-None-Match", ifNoneMatch)
+		}
+		w := httptest.NewRecorder()
+		handler(w, r)
+		return w
+	}
+
+	first := check("ns/vddk:8.0.3", "")
+	etag := first.Header().Get("ETag")
+	if first.Code != http.StatusOK || etag != `"`+digest.Load().(string)+`"` {
+		t.Fatalf("first check = %d with ETag %q, want 200 with the digest", first.Code, etag)
+	}
+
+	unchanged := check("ns/vddk:8.0.3", etag)
+	if unchanged.Code != http.StatusNotModified || unchanged.Body.Len() != 0 {
+		t.Errorf("check with a matching If-None-Match = %d with %q, want 304 without a body", unchanged.Code, unchanged.Body.String())
+	}
+	if got := unchanged.Header().Get("ETag"); got != etag {
+		t.Errorf("304 ETag = %q, want %q", got, etag)
+	}
+
+	digest.Store("sha256:" + strings.Repeat("2", 64))
+	changed := check("ns/vddk:8.0.3", etag)
+	if changed.Code != http.StatusOK || changed.Header().Get("ETag") != `"`+digest.Load().(string)+`"` {
+		t.Errorf("check after the digest changed = %d with ETag %q, want 200 with the new digest", changed.Code, changed.Header().Get("ETag"))
+	}
+	if !strings.Contains(changed.Body.String(), "exists in the registry") {
+		t.Errorf("body = %q, want the image reported as existing", changed.Body.String())
+	}
+
+	missing := check("ns/missing:1", "*")
+	if missing.Code != http.StatusNotFound || missing.Header().Get("ETag") != "" {
+		t.Errorf("check of a missing image = %d with ETag %q, want 404 without an ETag", missing.Code, missing.Header().Get("ETag"))
+	}
+}
+
+func TestETagMatches(t *testing.T) {
+	const etag = `"sha256:abc"`
+	for header, want := range map[string]bool{
+		`"sha256:abc"`:               true,
+		`W/"sha256:abc"`:             true,
+		`"sha256:def", "sha256:abc"`: true,
+		`*`:                          true,
+		`"sha256:def"`:               false,
+		`sha256:abc`:                 false,
+		``:                           false,
+	} {
+		if got := etagMatches(header, etag); got != want {
+			t.Errorf("etagMatches(%q) = %t, want %t", header, got, want)
+		}
+	}
+}
+
+// unauthorizedRegistry answers every request like a registry rejecting the caller's
+// credentials, with its error in the body.
+func unauthorizedRegistry(t *testing.T) string {
+	t.Helper()
+	stub := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusUnauthorized)
+		io.WriteString(w, `{"errors":[{"code":"UNAUTHORIZED","message":"authentication required"}]}`)
+	}))
+	t.Cleanup(stub.Close)
+	if err := registry.Configure(registry.Options{TLSVerify: false}); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { registry.Configure(registry.Options{TLSVerify: true, Timeout: 30 * time.Second}) })
+	return stub.Listener.Addr().String()
+}
+
+func TestCheckImageReportsRegistryError(t *testing.T) {
+	handler := checkImageHandler(&config.Config{ImageRegistry: unauthorizedRegistry(t)})
+	w := httptest.NewRecorder()
+	handler(w, httptest.NewRequest(http.MethodGet, "/check-image?image=ns/vddk:8.0.3", nil))
+
+	if w.Code != http.StatusInternalServerError {
+		t.Errorf("status = %d, want %d", w.Code, http.StatusInternalServerError)
+	}
+	if body := w.Body.String(); !strings.Contains(body, "UNAUTHORIZED") || !strings.Contains(body, "authentication required") {
+		t.Errorf("body = %q, want the registry's error code and message", body)
+	}
+}
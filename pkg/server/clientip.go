@@ -0,0 +1,113 @@
+package server
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+type clientAddrKey struct{}
+
+// clientAddrMiddleware resolves the client address of every request and stores it in the
+// request context. X-Forwarded-For is only consulted when the immediate peer is a trusted
+// proxy, so spoofed headers from other peers are ignored.
+func clientAddrMiddleware(trustedProxies []netip.Prefix, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		addr := resolveClientAddr(r.RemoteAddr, r.Header.Values("X-Forwarded-For"), trustedProxies)
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), clientAddrKey{}, addr)))
+	})
+}
+
+// clientAddr returns the client address resolved by clientAddrMiddleware, falling back to
+// the peer address for requests that did not pass through it.
+func clientAddr(r *http.Request) string {
+	if addr, ok := r.Context().Value(clientAddrKey{}).(string); ok {
+		return addr
+	}
+	return peerAddr(r.RemoteAddr)
+}
+
+// resolveClientAddr walks X-Forwarded-For from right to left, starting at the immediate
+// peer, and returns the first hop that is not a trusted proxy. Hops may carry a port, as in
+// [2001:db8::1]:443, and empty list elements are skipped. A garbage hop stops the walk
+// since nothing to its left can be trusted.
+func resolveClientAddr(remoteAddr string, forwardedFor []string, trustedProxies []netip.Prefix) string {
+	peer := peerAddr(remoteAddr)
+	if len(trustedProxies) == 0 || !isTrusted(peer, trustedProxies) {
+		return peer
+	}
+
+	var hops []string
+	for _, header := range forwardedFor {
+		for _, hop := range strings.Split(header, ",") {
+			if hop = strings.TrimSpace(hop); hop != "" {
+				hops = append(hops, hop)
+			}
+		}
+	}
+
+	client := peer
+	for i := len(hops) - 1; i >= 0; i-- {
+		addr, err := parseHop(hops[i])
+		if err != nil {
+			break
+		}
+		client = addr.Unmap().String()
+		if !isTrusted(client, trustedProxies) {
+			break
+		}
+	}
+	return client
+}
+
+// parseHop returns the address of an X-Forwarded-For hop, an IP address with an optional
+// port and brackets around an IPv6 address.
+func parseHop(hop string) (netip.Addr, error) {
+	if addrPort, err := netip.ParseAddrPort(hop); err == nil {
+		return addrPort.Addr(), nil
+	}
+	return netip.ParseAddr(strings.Trim(hop, "[]"))
+}
+
+// peerAddr strips the port from a RemoteAddr value.
+func peerAddr(remoteAddr string) string {
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		host = remoteAddr
+	}
+	if addr, err := netip.ParseAddr(host); err == nil {
+		return addr.Unmap().String()
+	}
+	return host
+}
+
+// isTrusted reports whether addr falls inside one of the prefixes.
+func isTrusted(addr string, prefixes []netip.Prefix) bool {
+	ip, err := netip.ParseAddr(addr)
+	if err != nil {
+		return false
+	}
+	for _, prefix := range prefixes {
+		if prefix.Contains(ip.Unmap()) {
+			return true
+		}
+	}
+	return false
+}
+
+// allowFrom rejects requests whose client address lies outside prefixes with 403. With no
+// prefixes every client is allowed.
+func allowFrom(prefixes []netip.Prefix, next http.HandlerFunc) http.HandlerFunc {
+	if len(prefixes) == 0 {
+		return next
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !isTrusted(clientAddr(r), prefixes) {
+			http.Error(w, "Client address not allowed", http.StatusForbidden)
+			return
+		}
+		next(w, r)
+	}
+}
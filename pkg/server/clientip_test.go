@@ -0,0 +1,95 @@
+package server
+
+import (
+	"net/netip"
+	"testing"
+)
+
+func TestResolveClientAddr(t *testing.T) {
+	trusted := []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8"), netip.MustParsePrefix("fd00::/8")}
+	tests := []struct {
+		name         string
+		remoteAddr   string
+		forwardedFor []string
+		trusted      []netip.Prefix
+		want         string
+	}{
+		{
+			name:       "no trusted proxies",
+			remoteAddr: "10.0.0.1:4711", forwardedFor: []string{"203.0.113.7"},
+			want: "10.0.0.1",
+		},
+		{
+			name:       "direct client",
+			remoteAddr: "198.51.100.4:4711", trusted: trusted,
+			want: "198.51.100.4",
+		},
+		{
+			name:       "trusted proxy",
+			remoteAddr: "10.0.0.1:4711", forwardedFor: []string{"203.0.113.7"}, trusted: trusted,
+			want: "203.0.113.7",
+		},
+		{
+			name:       "trusted proxies over several hops",
+			remoteAddr: "10.0.0.1:4711", forwardedFor: []string{"198.51.100.9, 203.0.113.7, 10.1.2.3"}, trusted: trusted,
+			want: "203.0.113.7",
+		},
+		{
+			name:       "hops over several headers",
+			remoteAddr: "10.0.0.1:4711", forwardedFor: []string{"198.51.100.9", "203.0.113.7", "10.1.2.3"}, trusted: trusted,
+			want: "203.0.113.7",
+		},
+		{
+			name:       "untrusted peer with a spoofed header",
+			remoteAddr: "198.51.100.4:4711", forwardedFor: []string{"203.0.113.7"}, trusted: trusted,
+			want: "198.51.100.4",
+		},
+		{
+			name:       "only trusted hops",
+			remoteAddr: "10.0.0.1:4711", forwardedFor: []string{"10.9.9.9, 10.1.2.3"}, trusted: trusted,
+			want: "10.9.9.9",
+		},
+		{
+			name:       "spaces and empty elements",
+			remoteAddr: "10.0.0.1:4711", forwardedFor: []string{"  203.0.113.7 ,, 10.1.2.3 ,"}, trusted: trusted,
+			want: "203.0.113.7",
+		},
+		{
+			name:       "invalid hop stops the walk",
+			remoteAddr: "10.0.0.1:4711", forwardedFor: []string{"203.0.113.7, unknown, 10.1.2.3"}, trusted: trusted,
+			want: "10.1.2.3",
+		},
+		{
+			name:       "invalid last hop",
+			remoteAddr: "10.0.0.1:4711", forwardedFor: []string{"203.0.113.7, not an address"}, trusted: trusted,
+			want: "10.0.0.1",
+		},
+		{
+			name:       "IPv4 with a port",
+			remoteAddr: "10.0.0.1:4711", forwardedFor: []string{"203.0.113.7:51234"}, trusted: trusted,
+			want: "203.0.113.7",
+		},
+		{
+			name:       "IPv6 with a port",
+			remoteAddr: "[fd00::1]:4711", forwardedFor: []string{"[2001:db8::7]:51234, [fd00::2]:443"}, trusted: trusted,
+			want: "2001:db8::7",
+		},
+		{
+			name:       "bracketed IPv6",
+			remoteAddr: "[fd00::1]:4711", forwardedFor: []string{"[2001:db8::7]"}, trusted: trusted,
+			want: "2001:db8::7",
+		},
+		{
+			name:       "IPv4-mapped IPv6 peer",
+			remoteAddr: "[::ffff:10.0.0.1]:4711", forwardedFor: []string{"::ffff:203.0.113.7"}, trusted: trusted,
+			want: "203.0.113.7",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := resolveClientAddr(tt.remoteAddr, tt.forwardedFor, tt.trusted); got != tt.want {
+				t.Errorf("resolveClientAddr(%q, %q) = %q, want %q", tt.remoteAddr, tt.forwardedFor, got, tt.want)
+			}
+		})
+	}
+}
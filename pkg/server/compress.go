@@ -0,0 +1,169 @@
+package server
+
+import (
+	"bytes"
+	"compress/gzip"
+	"net/http"
+	"strings"
+)
+
+// gzipMinSize is the smallest response body worth compressing.
+const gzipMinSize = 1024
+
+// uncompressibleTypes lists content types that are streamed or already compressed
+// and are therefore never gzip-encoded by the middleware.
+var uncompressibleTypes = []string{
+	"text/event-stream",
+	"application/octet-stream",
+	"application/gzip",
+	"application/x-gzip",
+	"application/x-tar",
+	"application/zstd",
+	"application/zip",
+}
+
+// gzipMiddleware compresses responses larger than gzipMinSize for clients that
+// advertise gzip in Accept-Encoding. Event streams, binary downloads and responses
+// that already carry a Content-Encoding are passed through untouched.
+func gzipMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Vary", "Accept-Encoding")
+
+		if r.Method == http.MethodHead || !acceptsGzip(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		gw := &gzipResponseWriter{ResponseWriter: w}
+		defer gw.Close()
+		next.ServeHTTP(gw, r)
+	})
+}
+
+// acceptsGzip reports whether the request's Accept-Encoding allows gzip.
+func acceptsGzip(r *http.Request) bool {
+	for _, enc := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		name, params, _ := strings.Cut(strings.TrimSpace(enc), ";")
+		if strings.TrimSpace(name) != "gzip" {
+			continue
+		}
+		return strings.ReplaceAll(strings.TrimSpace(params), " ", "") != "q=0"
+	}
+	return false
+}
+
+// gzipResponseWriter buffers the start of a response until it knows whether the
+// body is large enough and of a type worth compressing.
+type gzipResponseWriter struct {
+	http.ResponseWriter
+	buf         bytes.Buffer
+	gz          *gzip.Writer
+	status      int
+	decided     bool
+	passthrough bool
+}
+
+func (g *gzipResponseWriter) WriteHeader(status int) {
+	if g.status == 0 {
+		g.status = status
+	}
+}
+
+func (g *gzipResponseWriter) Write(p []byte) (int, error) {
+	if g.decided {
+		if g.passthrough {
+			return g.ResponseWriter.Write(p)
+		}
+		return g.gz.Write(p)
+	}
+
+	if !g.compressible() {
+		g.decide(false)
+		return g.ResponseWriter.Write(p)
+	}
+
+	g.buf.Write(p)
+	if g.buf.Len() >= gzipMinSize {
+		if err := g.decide(true); err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
+
+// Flush commits to the current decision so streamed responses are not held back.
+func (g *gzipResponseWriter) Flush() {
+	if !g.decided {
+		g.decide(false)
+	}
+	if g.gz != nil {
+		g.gz.Flush()
+	}
+	if f, ok := g.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Close writes any buffered data and terminates the gzip stream.
+func (g *gzipResponseWriter) Close() error {
+	if !g.decided {
+		if err := g.decide(false); err != nil {
+			return err
+		}
+	}
+	if g.gz != nil {
+		return g.gz.Close()
+	}
+	return nil
+}
+
+// compressible reports whether the headers set so far allow compression.
+func (g *gzipResponseWriter) compressible() bool {
+	h := g.Header()
+	if h.Get("Content-Encoding") != "" || h.Get("Content-Range") != "" {
+		return false
+	}
+	if g.status != 0 && (g.status < http.StatusOK || g.status == http.StatusNoContent || g.status == http.StatusNotModified) {
+		return false
+	}
+
+	contentType := strings.ToLower(h.Get("Content-Type"))
+	for _, t := range uncompressibleTypes {
+		if strings.HasPrefix(contentType, t) {
+			return false
+		}
+	}
+	return true
+}
+
+// decide sends the headers and the buffered body, compressed or not.
+func (g *gzipResponseWriter) decide(compress bool) error {
+	g.decided = true
+	g.passthrough = !compress
+
+	// Sniff the type from the plain body; net/http would otherwise sniff the gzip bytes
+	if g.Header().Get("Content-Type") == "" && g.buf.Len() > 0 {
+		g.Header().Set("Content-Type", http.DetectContentType(g.buf.Bytes()))
+	}
+	if compress {
+		g.Header().Set("Content-Encoding", "gzip")
+		g.Header().Del("Content-Length")
+		g.gz = gzip.NewWriter(g.ResponseWriter)
+	}
+
+	if g.status != 0 {
+		g.ResponseWriter.WriteHeader(g.status)
+	}
+
+	if g.buf.Len() == 0 {
+		return nil
+	}
+	var err error
+	if compress {
+		_, err = g.gz.Write(g.buf.Bytes())
+	} else {
+		_, err = g.ResponseWriter.Write(g.buf.Bytes())
+	}
+	g.buf.Reset()
+	return err
+}
@@ -0,0 +1,102 @@
+package server
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// serveGzip serves handler through gzipMiddleware to a request sending acceptEncoding.
+func serveGzip(t *testing.T, acceptEncoding string, handler http.HandlerFunc) *httptest.ResponseRecorder {
+	t.Helper()
+	r := httptest.NewRequest(http.MethodGet, "/builds", nil)
+	if acceptEncoding != "" {
+		r.Header.Set("Accept-Encoding", acceptEncoding)
+	}
+	w := httptest.NewRecorder()
+	gzipMiddleware(handler).ServeHTTP(w, r)
+	return w
+}
+
+func TestGzipMiddlewareCompresses(t *testing.T) {
+	body := `{"builds":[` + strings.Repeat(`{"state":"succeeded"},`, 200) + `{}]}`
+	w := serveGzip(t, "br, gzip;q=0.8", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusAccepted)
+		io.WriteString(w, body)
+	})
+
+	if got := w.Header().Get("Content-Encoding"); got != "gzip" {
+		t.Fatalf("Content-Encoding = %q, want gzip", got)
+	}
+	if got := w.Header().Values("Vary"); len(got) != 1 || got[0] != "Accept-Encoding" {
+		t.Errorf("Vary = %q, want Accept-Encoding", got)
+	}
+	if w.Code != http.StatusAccepted {
+		t.Errorf("status = %d, want %d", w.Code, http.StatusAccepted)
+	}
+	if got := w.Header().Get("Content-Type"); got != "application/json" {
+		t.Errorf("Content-Type = %q, want application/json", got)
+	}
+	gz, err := gzip.NewReader(w.Body)
+	if err != nil {
+		t.Fatalf("gzip.NewReader() error = %v", err)
+	}
+	decoded, err := io.ReadAll(gz)
+	if err != nil {
+		t.Fatalf("reading the gzip body: %v", err)
+	}
+	if string(decoded) != body {
+		t.Errorf("decoded body differs from the uncompressed one: got %d bytes, want %d", len(decoded), len(body))
+	}
+}
+
+func TestGzipMiddlewarePassesThrough(t *testing.T) {
+	large := strings.Repeat("x", 2*gzipMinSize)
+	var compressed bytes.Buffer
+	gz := gzip.NewWriter(&compressed)
+	io.WriteString(gz, large)
+	gz.Close()
+
+	tests := []struct {
+		name           string
+		acceptEncoding string
+		contentType    string
+		encoding       string
+		body           string
+	}{
+		{name: "client without gzip", acceptEncoding: "br", body: large},
+		{name: "gzip refused", acceptEncoding: "gzip;q=0", body: large},
+		{name: "small body", acceptEncoding: "gzip", body: "ok"},
+		{name: "already encoded", acceptEncoding: "gzip", encoding: "gzip", body: compressed.String()},
+		{name: "compressed archive", acceptEncoding: "gzip", contentType: "application/gzip", body: compressed.String()},
+		{name: "event stream", acceptEncoding: "gzip", contentType: "text/event-stream", body: large},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := serveGzip(t, tt.acceptEncoding, func(w http.ResponseWriter, r *http.Request) {
+				if tt.contentType != "" {
+					w.Header().Set("Content-Type", tt.contentType)
+				}
+				if tt.encoding != "" {
+					w.Header().Set("Content-Encoding", tt.encoding)
+				}
+				io.WriteString(w, tt.body)
+			})
+
+			if got := w.Header().Get("Content-Encoding"); got != tt.encoding {
+				t.Errorf("Content-Encoding = %q, want %q", got, tt.encoding)
+			}
+			if got := w.Header().Get("Vary"); got != "Accept-Encoding" {
+				t.Errorf("Vary = %q, want Accept-Encoding", got)
+			}
+			if w.Body.String() != tt.body {
+				t.Errorf("body was changed: got %d bytes, want %d", w.Body.Len(), len(tt.body))
+			}
+		})
+	}
+}
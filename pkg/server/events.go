@@ -0,0 +1,47 @@
+package server
+
+import (
+	corev1 "k8s.io/api/core/v1"
+
+	"vddk-builder/pkg/k8spermissions"
+)
+
+// Reasons of the Events emitted with EVENTS_ENABLED. They are part of the interface
+// operators filter on and must not change.
+const (
+	eventBuildStarted   = "BuildStarted"
+	eventBuildSucceeded = "BuildSucceeded"
+	eventBuildFailed    = "BuildFailed"
+	eventPushFailed     = "PushFailed"
+	eventPolicyUpdated  = "PolicyUpdated"
+	eventPolicyRejected = "PolicyRejected"
+)
+
+// maxEventError bounds the length of the error quoted in an Event message.
+const maxEventError = 512
+
+// emitBuildEvent records an Event with reason for b, a warning when err is set. It is a
+// no-op unless EVENTS_ENABLED is set and never fails the build.
+func emitBuildEvent(b *Build, reason string, err error) {
+	snap := snapshotBuild(b)
+	what := "Build"
+	if snap.PromotedFrom != "" {
+		what = "Promotion"
+	}
+	message := what + " " + snap.ID + " of " + snap.Reference
+	eventType := corev1.EventTypeNormal
+	switch reason {
+	case eventBuildStarted:
+		message += " started"
+	case eventBuildSucceeded:
+		message += " succeeded"
+	default:
+		eventType = corev1.EventTypeWarning
+		detail := err.Error()
+		if len(detail) > maxEventError {
+			detail = detail[:maxEventError] + "..."
+		}
+		message += " failed: " + detail
+	}
+	k8spermissions.RecordEvent(eventType, reason, message)
+}
@@ -0,0 +1,157 @@
+package server
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"vddk-builder/pkg/audit"
+	"vddk-builder/pkg/builder"
+	"vddk-builder/pkg/config"
+)
+
+// exportImageHandler streams the image of a succeeded build back to the client as an OCI
+// archive. Builds written to OUTPUT_DIR are served from their archive; otherwise it
+// answers 410 when the image is no longer in local storage. Each request exports into its
+// own temporary file, so concurrent downloads are independent.
+func exportImageHandler(cfg *config.Config) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if b := lookupBuild(r.PathValue("id")); b != nil {
+			if build := snapshotBuild(b); build.OutputPath != "" {
+				serveOutputArchive(w, r, build)
+				return
+			}
+		}
+		if !cfg.ExportEnabled {
+			http.Error(w, "Image export is disabled", http.StatusNotFound)
+			return
+		}
+		b := lookupBuild(r.PathValue("id"))
+		if b == nil {
+			http.Error(w, "Build not found", http.StatusNotFound)
+			return
+		}
+		build := snapshotBuild(b)
+		if build.State != BuildSucceeded {
+			http.Error(w, fmt.Sprintf("Build %s is %s; only succeeded builds can be exported", build.ID, build.State), http.StatusConflict)
+			return
+		}
+
+		imageTag := builder.ImageReference(cfg, build.Image)
+		if len(build.Tags) > 0 {
+			imageTag = build.Tags[0]
+		}
+		exists, err := builder.LocalImageExists(r.Context(), cfg, imageTag)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Error checking local image: %v", err), http.StatusInternalServerError)
+			return
+		}
+		if !exists {
+			http.Error(w, fmt.Sprintf("Image %s is no longer available locally", imageTag), http.StatusGone)
+			return
+		}
+
+		exportDir, err := builder.NewWorkDir(cfg, "export")
+		if err != nil {
+			http.Error(w, "Failed to create export directory", http.StatusInternalServerError)
+			return
+		}
+		defer os.RemoveAll(exportDir)
+
+		exportPath := filepath.Join(exportDir, "image.tar")
+		if err := builder.ExportImage(r.Context(), cfg, imageTag, exportPath); err != nil {
+			log.Printf("Failed to export build %s: %v\n", build.ID, err)
+			http.Error(w, "Failed to export image", http.StatusInternalServerError)
+			return
+		}
+
+		archive, err := os.Open(exportPath)
+		if err != nil {
+			http.Error(w, "Failed to open export file", http.StatusInternalServerError)
+			return
+		}
+		defer archive.Close()
+
+		fileName := strings.NewReplacer("/", "_", ":", "_").Replace(build.Image) + ".tar"
+		w.Header().Set("Content-Type", "application/x-tar")
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", fileName))
+		if info, err := archive.Stat(); err == nil {
+			w.Header().Set("Content-Length", fmt.Sprint(info.Size()))
+		}
+		outcome := "succeeded"
+		if _, err := io.Copy(w, archive); err != nil {
+			log.Printf("Failed to stream export of build %s: %v\n", build.ID, err)
+			outcome = "failed"
+		}
+		auditLog.Record(audit.Entry{
+			Identity: requestIdentity(r),
+			ClientIP: clientAddr(r),
+			Action:   "export",
+			Image:    build.Reference,
+			BuildID:  build.ID,
+			Outcome:  outcome,
+		})
+	}
+}
+
+// serveOutputArchive serves the OCI archive a build wrote to OUTPUT_DIR, with support for
+// range requests so large archives can be resumed.
+func serveOutputArchive(w http.ResponseWriter, r *http.Request, build Build) {
+	if build.Digest != "" {
+		w.Header().Set("Docker-Content-Digest", build.Digest)
+	}
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filepath.Base(build.OutputPath)))
+	serveBuildFile(w, r, build.OutputPath, "application/x-tar", "OCI archive")
+	auditLog.Record(audit.Entry{
+		Identity: requestIdentity(r),
+		ClientIP: clientAddr(r),
+		Action:   "export",
+		Image:    build.Reference,
+		BuildID:  build.ID,
+		Outcome:  "succeeded",
+	})
+}
+
+// runOutputSweeper removes OCI archives older than OUTPUT_RETENTION.
+func runOutputSweeper(cfg *config.Config) {
+	for {
+		sweepOutputs(cfg)
+		time.Sleep(logSweepInterval)
+	}
+}
+
+// sweepOutputs deletes every OCI archive in OUTPUT_DIR, complete or left partial by an
+// interrupted export, last written before the retention window.
+func sweepOutputs(cfg *config.Config) {
+	entries, err := os.ReadDir(cfg.OutputDir)
+	if err != nil {
+		log.Printf("Failed to read output directory: %v\n", err)
+		return
+	}
+
+	cutoff := time.Now().Add(-cfg.OutputRetention)
+	for _, entry := range entries {
+		name := entry.Name()
+		if !strings.HasSuffix(name, ".tar") && !strings.HasSuffix(name, ".tar"+builder.PartialSuffix) {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil || info.IsDir() || !info.ModTime().Before(cutoff) {
+			continue
+		}
+		if err := os.Remove(filepath.Join(cfg.OutputDir, name)); err != nil {
+			log.Printf("Failed to remove OCI archive %s: %v\n", name, err)
+			continue
+		}
+		log.Printf("Removed OCI archive %s after %s of retention\n", name, cfg.OutputRetention)
+	}
+}
@@ -0,0 +1,103 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+
+	"vddk-builder/pkg/config"
+	"vddk-builder/pkg/k8spermissions"
+)
+
+// leaderRetryAfter is the Retry-After, in seconds, of builds refused by a follower that
+// cannot redirect them.
+const leaderRetryAfter = "5"
+
+var (
+	haLock    sync.Mutex
+	haEnabled bool
+	haLeading bool
+	haHolder  string // Identity of the current leader, empty until one is observed
+
+	haDone = make(chan struct{}) // Closed once the Lease is released after shutdown
+)
+
+// startLeaderElection campaigns for the HA_LEASE_NAME Lease in the background until the
+// server stops. Builds in flight when leadership is lost run to completion, but no new
+// ones are accepted.
+func startLeaderElection(cfg *config.Config) {
+	haEnabled = true
+	opts := k8spermissions.LeaderOptions{LeaseName: cfg.HALeaseName, LeaseNamespace: cfg.HALeaseNamespace, AdvertiseURL: cfg.HAAdvertiseURL}
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-serverStopping
+		cancel()
+	}()
+	go func() {
+		defer close(haDone)
+		err := k8spermissions.RunLeaderElection(ctx, opts, func(leading bool, holder string) {
+			haLock.Lock()
+			changed := leading != haLeading
+			haLeading, haHolder = leading, holder
+			haLock.Unlock()
+			switch {
+			case leading && changed:
+				log.Println("Became the leader, accepting builds")
+			case changed:
+				log.Println("Lost the leadership, no longer accepting builds")
+			case holder != "":
+				pod, _ := k8spermissions.SplitLeaderIdentity(holder)
+				log.Printf("The leader is %s\n", pod)
+			}
+		})
+		if err != nil {
+			log.Fatalf("Leader election failed: %v", err)
+		}
+	}()
+}
+
+// stopLeaderElection waits until the Lease is released once the server is stopping.
+func stopLeaderElection() {
+	if haEnabled {
+		<-haDone
+	}
+}
+
+// leaderState reports whether HA_ENABLED is set, whether this replica leads, and the pod
+// name of the leader.
+func leaderState() (enabled, leading bool, leader string) {
+	haLock.Lock()
+	defer haLock.Unlock()
+	leader, _ = k8spermissions.SplitLeaderIdentity(haHolder)
+	return haEnabled, haLeading, leader
+}
+
+// leaderOnly wraps handler so that, with HA_ENABLED, only the leader serves it. Followers
+// redirect with 307, which keeps the method and body, to the leader's HA_ADVERTISE_URL, or
+// answer 503 naming the leader when it advertises none.
+func leaderOnly(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		haLock.Lock()
+		enabled, leading, holder := haEnabled, haLeading, haHolder
+		haLock.Unlock()
+		if !enabled || leading {
+			handler(w, r)
+			return
+		}
+
+		pod, url := k8spermissions.SplitLeaderIdentity(holder)
+		if url != "" {
+			http.Redirect(w, r, strings.TrimSuffix(url, "/")+r.URL.RequestURI(), http.StatusTemporaryRedirect)
+			return
+		}
+		w.Header().Set("Retry-After", leaderRetryAfter)
+		if pod == "" {
+			http.Error(w, "No leader has been elected yet. Please try again later.", http.StatusServiceUnavailable)
+			return
+		}
+		http.Error(w, fmt.Sprintf("This replica is not the leader, send builds to pod %s", pod), http.StatusServiceUnavailable)
+	}
+}
@@ -0,0 +1,80 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"vddk-builder/pkg/config"
+	"vddk-builder/pkg/registry"
+)
+
+// imageInfoResponse is the answer of /image-info.
+type imageInfoResponse struct {
+	Image     string            `json:"image"`
+	Digest    string            `json:"digest,omitempty"`
+	MediaType string            `json:"mediaType,omitempty"`
+	Platform  string            `json:"platform,omitempty"` // Set when resolved from a manifest list
+	Created   *time.Time        `json:"created,omitempty"`
+	Layers    int               `json:"layers"`
+	Size      int64             `json:"size"` // Compressed size of the layers, in bytes
+	Labels    map[string]string `json:"labels,omitempty"`
+}
+
+// imageInfoHandler describes the image named by the 'image' query parameter in the
+// configured registry: its creation time, layer count, compressed size and labels. A
+// manifest list is resolved to the 'platform' query parameter, linux/amd64 by default.
+func imageInfoHandler(cfg *config.Config) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		imageName := r.URL.Query().Get("image")
+		if imageName == "" {
+			http.Error(w, "Missing 'image' query parameter", http.StatusBadRequest)
+			return
+		}
+		if _, err := registry.ParseReference(imageName); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		platform := r.URL.Query().Get("platform")
+		if platform != "" && !platformPattern.MatchString(platform) {
+			http.Error(w, fmt.Sprintf("Invalid 'platform' query parameter %q: must be os/architecture[/variant]", platform), http.StatusBadRequest)
+			return
+		}
+
+		info, err := registry.GetImageInfo(r.Context(), imageName, cfg.ImageRegistry, registryToken(r), platform)
+		var noPlatform *registry.PlatformNotFoundError
+		if errors.As(err, &noPlatform) {
+			http.Error(w, fmt.Sprintf("Image %s exists in the registry but its manifest list has no %s image (it has %s).", imageName, noPlatform.Platform, strings.Join(noPlatform.Platforms, ", ")), http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			registryError(w, "Error reading image", err)
+			return
+		}
+		if !info.Exists {
+			http.Error(w, fmt.Sprintf("Image %s not found in the registry.", imageName), http.StatusNotFound)
+			return
+		}
+
+		resp := imageInfoResponse{
+			Image:     imageName,
+			Digest:    info.Digest,
+			MediaType: info.MediaType,
+			Platform:  info.Platform,
+			Layers:    info.Layers,
+			Size:      info.Size,
+			Labels:    info.Labels,
+		}
+		if !info.Created.IsZero() {
+			resp.Created = &info.Created
+		}
+		writeJSON(w, http.StatusOK, resp)
+	}
+}
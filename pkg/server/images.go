@@ -0,0 +1,28 @@
+package server
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"vddk-builder/pkg/builder"
+	"vddk-builder/pkg/config"
+)
+
+// imagePruneInterval is how often local images older than LOCAL_IMAGE_RETENTION are pruned.
+const imagePruneInterval = time.Hour
+
+// runImagePruner prunes old local images every imagePruneInterval, skipping rounds in which
+// a build holds the busy slot so its intermediate images are left alone.
+func runImagePruner(cfg *config.Config) {
+	for {
+		time.Sleep(imagePruneInterval)
+		if !acquireBusy() {
+			continue
+		}
+		if err := builder.PruneLocalImages(context.Background(), cfg, commandRunner); err != nil {
+			log.Printf("Failed to prune local images: %v\n", err)
+		}
+		resetBusy()
+	}
+}
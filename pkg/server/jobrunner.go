@@ -0,0 +1,186 @@
+package server
+
+import (
+	"archive/tar"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+
+	"vddk-builder/pkg/builder"
+	"vddk-builder/pkg/config"
+	"vddk-builder/pkg/k8spermissions"
+	"vddk-builder/pkg/registry"
+)
+
+// jobTerminationLog is the file a build Job writes its jobResult to, read by Kubernetes into
+// the termination message of the container.
+const jobTerminationLog = "/dev/termination-log"
+
+// RunBuildJob runs the build of a Job created with BUILD_MODE=job: it downloads the bundle
+// named by the job environment, builds and pushes the image with runner as the server would,
+// and writes the outcome to the termination message of the container. Build output is
+// printed to stdout, together with the progress lines the server reads from the pod log.
+// The build is cancelled when the Job is deleted.
+func RunBuildJob(runner builder.Runner) error {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	result, err := runBuildJob(ctx, runner)
+	outcome, marshalErr := json.Marshal(newJobResult(result, err))
+	if marshalErr != nil {
+		return marshalErr
+	}
+	if writeErr := os.WriteFile(jobTerminationLog, outcome, 0644); writeErr != nil {
+		log.Printf("Failed to report the build result: %v\n", writeErr)
+	}
+	return err
+}
+
+// runBuildJob downloads the bundle of the Job and runs its build.
+func runBuildJob(ctx context.Context, runner builder.Runner) (builder.BuildResult, error) {
+	inputDir, err := os.MkdirTemp(k8spermissions.JobWorkDir, "inputs-")
+	if err != nil {
+		return builder.BuildResult{}, err
+	}
+	defer os.RemoveAll(inputDir)
+	cfg, req, err := downloadJobBundle(ctx, inputDir)
+	if err != nil {
+		return builder.BuildResult{}, fmt.Errorf("failed to download the build inputs: %w", err)
+	}
+
+	if err := registry.Configure(registryOptions(cfg)); err != nil {
+		return builder.BuildResult{}, err
+	}
+	if err := registry.ConfigureAuth(cfg.RegistryAuthConfig); err != nil {
+		return builder.BuildResult{}, fmt.Errorf("REGISTRY_AUTH_CONFIG: %w", err)
+	}
+	if cfg.ImageStreamEnabled || cfg.UpdateTarget != "" {
+		if err := k8spermissions.Configure(kubeOptions(cfg)); err != nil {
+			return builder.BuildResult{}, err
+		}
+	}
+
+	if req.WorkDir, err = builder.NewWorkDir(cfg, req.BuildID); err != nil {
+		return builder.BuildResult{}, err
+	}
+	req.Runner = runner
+	req.Output = os.Stdout
+	req.Progress = func(phase string, progress float64) {
+		fmt.Printf("%s %s %.3f\n", jobProgressPrefix, phase, progress)
+	}
+	log.Printf("Building %s for build %s\n", builder.ImageReference(cfg, req.ImageName), req.BuildID)
+	return builder.BuildAndPushImage(ctx, cfg, req)
+}
+
+// downloadJobBundle fetches the bundle of the Job into dir and returns the configuration and
+// request of its build, whose files are in dir.
+func downloadJobBundle(ctx context.Context, dir string) (*config.Config, builder.BuildRequest, error) {
+	url, token := os.Getenv(jobURLEnv), os.Getenv(jobTokenEnv)
+	if url == "" || token == "" {
+		return nil, builder.BuildRequest{}, fmt.Errorf("%s and %s must be set", jobURLEnv, jobTokenEnv)
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if ca := os.Getenv(jobCAEnv); ca != "" {
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM([]byte(ca)) {
+			return nil, builder.BuildRequest{}, fmt.Errorf("%s holds no PEM certificate", jobCAEnv)
+		}
+		transport.TLSClientConfig = &tls.Config{RootCAs: pool, MinVersion: tls.VersionTLS12}
+	}
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, builder.BuildRequest{}, err
+	}
+	request.Header.Set("Authorization", "Bearer "+token)
+	resp, err := (&http.Client{Transport: transport}).Do(request)
+	if err != nil {
+		return nil, builder.BuildRequest{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return nil, builder.BuildRequest{}, fmt.Errorf("%s answered %s: %s", url, resp.Status, body)
+	}
+
+	var spec *jobSpec
+	tr := tar.NewReader(resp.Body)
+	for {
+		header, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, builder.BuildRequest{}, err
+		}
+		if header.Name == bundleSpec {
+			spec = &jobSpec{}
+			if err := json.NewDecoder(tr).Decode(spec); err != nil {
+				return nil, builder.BuildRequest{}, fmt.Errorf("failed to parse %s: %w", bundleSpec, err)
+			}
+			continue
+		}
+		if err := saveBundleFile(tr, dir, header.Name); err != nil {
+			return nil, builder.BuildRequest{}, err
+		}
+	}
+	if spec == nil {
+		return nil, builder.BuildRequest{}, fmt.Errorf("the bundle holds no %s", bundleSpec)
+	}
+
+	r := spec.Request
+	req := builder.BuildRequest{
+		BuildID:       r.BuildID,
+		ImageName:     r.ImageName,
+		AuthToken:     r.AuthToken,
+		Containerfile: r.Containerfile,
+		UnpackNested:  r.UnpackNested,
+		BuildArgs:     r.BuildArgs,
+		Platforms:     r.Platforms,
+		Platform:      r.Platform,
+		ArchiveDigest: r.ArchiveDigest,
+		NoCache:       r.NoCache,
+		Squash:        r.Squash,
+		DryRun:        r.DryRun,
+		UpdateRefs:    r.UpdateRefs,
+	}
+	if r.Archive {
+		req.FilePath = filepath.Join(dir, bundleArchive)
+	}
+	if r.ContainerfileOverride {
+		req.ContainerfileOverride = filepath.Join(dir, bundleContainerfile)
+	}
+	for _, name := range r.ExtraFiles {
+		req.ExtraFiles = append(req.ExtraFiles, filepath.Join(dir, bundleExtraDir, name))
+	}
+	return &spec.Config, req, nil
+}
+
+// saveBundleFile writes the bundle entry name read from r below dir.
+func saveBundleFile(r io.Reader, dir, name string) error {
+	if !filepath.IsLocal(name) {
+		return fmt.Errorf("bundle entry %q is outside the bundle", name)
+	}
+	path := filepath.Join(dir, name)
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, r); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
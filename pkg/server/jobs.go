@@ -0,0 +1,509 @@
+package server
+
+import (
+	"archive/tar"
+	"bufio"
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"vddk-builder/pkg/builder"
+	"vddk-builder/pkg/config"
+	"vddk-builder/pkg/k8spermissions"
+)
+
+// jobNamePrefix starts the name of every build Job, followed by the build ID.
+const jobNamePrefix = "vddk-build-"
+
+// Environment of the build container telling it where to download its bundle from.
+const (
+	jobURLEnv   = "VDDK_BUILDER_JOB_URL"
+	jobTokenEnv = "VDDK_BUILDER_JOB_TOKEN"
+	jobCAEnv    = "VDDK_BUILDER_JOB_CA"
+)
+
+// jobProgressPrefix starts the lines a build Job prints to report its phase and progress.
+const jobProgressPrefix = "##vddk-builder-progress"
+
+// phaseScheduling is the phase of a build whose Job pod has not started yet.
+const phaseScheduling = "scheduling"
+
+// jobPoll is the delay between two reads of the state of a build Job pod.
+const jobPoll = 2 * time.Second
+
+// jobDeleteTimeout bounds the deletion of the Job of a cancelled build.
+const jobDeleteTimeout = 30 * time.Second
+
+// maxJobError bounds each error of the result a Job reports in its termination message,
+// which Kubernetes limits to 4096 bytes.
+const maxJobError = 512
+
+// pendingJob is a build whose Job has not downloaded its bundle yet.
+type pendingJob struct {
+	token string
+	req   builder.BuildRequest
+}
+
+var (
+	pendingJobsLock sync.Mutex
+	pendingJobs     = map[string]pendingJob{}
+)
+
+// jobSpec is the first entry of a bundle: the configuration and the request of the build.
+type jobSpec struct {
+	Config  config.Config `json:"config"`
+	Request jobRequest    `json:"request"`
+}
+
+// jobRequest is the part of a builder.BuildRequest that does not name files on the server.
+type jobRequest struct {
+	BuildID               string   `json:"buildID"`
+	ImageName             string   `json:"imageName"`
+	AuthToken             string   `json:"authToken,omitempty"`
+	Archive               bool     `json:"archive"`              // The bundle holds archive.tar.gz
+	ExtraFiles            []string `json:"extraFiles,omitempty"` // Names of the files in extra/
+	ContainerfileOverride bool     `json:"containerfileOverride,omitempty"`
+	Containerfile         string   `json:"containerfile,omitempty"`
+	UnpackNested          bool     `json:"unpackNested,omitempty"`
+	BuildArgs             []string `json:"buildArgs,omitempty"`
+	Platforms             []string `json:"platforms,omitempty"`
+	Platform              string   `json:"platform,omitempty"`
+	ArchiveDigest         string   `json:"archiveDigest,omitempty"`
+	NoCache               bool     `json:"noCache,omitempty"`
+	Squash                bool     `json:"squash,omitempty"`
+	DryRun                bool     `json:"dryRun,omitempty"`
+	UpdateRefs            bool     `json:"updateRefs,omitempty"`
+}
+
+// Names of the entries of a bundle.
+const (
+	bundleSpec          = "job.json"
+	bundleArchive       = "archive.tar.gz"
+	bundleExtraDir      = "extra"
+	bundleContainerfile = "Containerfile"
+)
+
+// jobResult is the outcome of a build Job, written to its termination message.
+type jobResult struct {
+	Image        string             `json:"image"`
+	Tags         []string           `json:"tags,omitempty"`
+	Version      string             `json:"version,omitempty"`
+	Digest       string             `json:"digest,omitempty"`
+	PhaseSeconds map[string]float64 `json:"phaseSeconds,omitempty"`
+	Pushes       []BuildPush        `json:"pushes,omitempty"`
+	Signature    string             `json:"signature,omitempty"`
+	SignError    string             `json:"signError,omitempty"`
+	SBOMDigest   string             `json:"sbomDigest,omitempty"`
+	SBOMError    string             `json:"sbomError,omitempty"`
+	ScanCounts   map[string]int     `json:"scanCounts,omitempty"`
+	ImageIDs     []string           `json:"imageIDs,omitempty"`
+	ImageSize    int64              `json:"imageSize,omitempty"`
+	Compression  string             `json:"compression,omitempty"`
+	Checksums    string             `json:"checksums,omitempty"`
+	Stats        builder.BuildStats `json:"stats"`
+
+	ImageStreamError string `json:"imageStreamError,omitempty"`
+	UpdatedRef       string `json:"updatedRef,omitempty"`
+	UpdateError      string `json:"updateError,omitempty"`
+
+	Phase string `json:"phase,omitempty"` // Phase the build failed in, as reported by failedPhase
+	Error string `json:"error,omitempty"` // Why the build failed, without the prefix of the phase
+}
+
+// runJobBuild is the builder entry point of BUILD_MODE=job. It runs the build of req in a
+// Kubernetes Job, which downloads the inputs of req from the jobBundleHandler with a
+// one-time token, and waits for the Job to finish. Until the pod starts the build is in the
+// scheduling phase; afterwards the pod's log is copied to req.Output and the phases it
+// reports to req.Progress. The Job is deleted when ctx is done first. The inputs of req are
+// removed from the server when the build ends, as builder.BuildAndPushImage does.
+func runJobBuild(ctx context.Context, cfg *config.Config, req builder.BuildRequest) (builder.BuildResult, error) {
+	result := builder.BuildResult{Image: builder.ImageReference(cfg, req.ImageName), PhaseDurations: map[string]time.Duration{}}
+	defer builder.CleanupWorkspace(req.WorkDir, req.FilePath)
+
+	token, err := newJobToken()
+	if err != nil {
+		return result, err
+	}
+	pendingJobsLock.Lock()
+	pendingJobs[req.BuildID] = pendingJob{token: token, req: req}
+	pendingJobsLock.Unlock()
+	defer func() {
+		pendingJobsLock.Lock()
+		delete(pendingJobs, req.BuildID)
+		pendingJobsLock.Unlock()
+	}()
+
+	env := map[string]string{
+		jobURLEnv:   strings.TrimSuffix(cfg.JobBuilderURL, "/") + "/jobs/" + req.BuildID + "/bundle",
+		jobTokenEnv: token,
+	}
+	if strings.HasPrefix(cfg.JobBuilderURL, "https:") {
+		ca, err := os.ReadFile(cfg.CAPublicKey)
+		if err != nil {
+			return result, fmt.Errorf("failed to read the certificate the build Job verifies the server with: %w", err)
+		}
+		env[jobCAEnv] = string(ca)
+	}
+	nodeSelector, _ := config.ParseNodeSelector(cfg.JobNodeSelector) // Checked by Validate
+	name := jobNamePrefix + req.BuildID
+	reportJobProgress(req.Progress, phaseScheduling, 0)
+	namespace, err := k8spermissions.CreateJob(ctx, k8spermissions.BuildJob{
+		Name:           name,
+		Namespace:      cfg.JobNamespace,
+		BuildID:        req.BuildID,
+		Image:          cfg.JobImage,
+		ServiceAccount: cfg.JobServiceAccount,
+		CPU:            cfg.JobCPU,
+		Memory:         cfg.JobMemory,
+		NodeSelector:   nodeSelector,
+		Privileged:     cfg.JobPrivileged,
+		Deadline:       int64(cfg.BuildTimeout.Seconds()),
+		Args:           []string{"job"},
+		Env:            env,
+	})
+	if err != nil {
+		return result, err
+	}
+	if b := lookupBuild(req.BuildID); b != nil {
+		buildsLock.Lock()
+		b.Job = namespace + "/" + name
+		buildsLock.Unlock()
+	}
+	log.Printf("Build %s runs in Job %s/%s\n", req.BuildID, namespace, name)
+	defer func() {
+		if ctx.Err() == nil {
+			return
+		}
+		deleteCtx, cancel := context.WithTimeout(context.Background(), jobDeleteTimeout)
+		defer cancel()
+		if err := k8spermissions.DeleteJob(deleteCtx, namespace, name); err != nil {
+			log.Printf("Failed to delete the Job of cancelled build %s: %v\n", req.BuildID, err)
+		}
+	}()
+
+	pod, err := waitForJobPod(ctx, namespace, name, func(pod k8spermissions.JobPod) bool { return pod.Running || pod.Finished })
+	if err != nil {
+		return result, err
+	}
+	if pod.Running {
+		if err := copyJobLogs(ctx, namespace, pod.Name, req); err != nil {
+			log.Printf("Failed to follow the log of build Job pod %s/%s: %v\n", namespace, pod.Name, err)
+		}
+		if pod, err = waitForJobPod(ctx, namespace, name, func(pod k8spermissions.JobPod) bool { return pod.Finished }); err != nil {
+			return result, err
+		}
+	}
+	return jobOutcome(result, pod)
+}
+
+// waitForJobPod polls the pod of the Job name in namespace until done accepts its state.
+func waitForJobPod(ctx context.Context, namespace, name string, done func(k8spermissions.JobPod) bool) (k8spermissions.JobPod, error) {
+	for {
+		pod, err := k8spermissions.GetJobPod(ctx, namespace, name)
+		if err != nil {
+			return pod, err
+		}
+		if done(pod) {
+			return pod, nil
+		}
+		select {
+		case <-ctx.Done():
+			return pod, fmt.Errorf("build Job %s/%s did not finish: %w", namespace, name, ctx.Err())
+		case <-time.After(jobPoll):
+		}
+	}
+}
+
+// copyJobLogs follows the log of the Job pod in namespace until the build container exits,
+// passing progress lines to req.Progress and the others to req.Output.
+func copyJobLogs(ctx context.Context, namespace, pod string, req builder.BuildRequest) error {
+	logs, err := k8spermissions.OpenPodLogs(ctx, namespace, pod)
+	if err != nil {
+		return err
+	}
+	defer logs.Close()
+
+	scanner := bufio.NewScanner(logs)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if report, ok := strings.CutPrefix(line, jobProgressPrefix+" "); ok {
+			phase, value, _ := strings.Cut(report, " ")
+			progress, _ := strconv.ParseFloat(value, 64)
+			reportJobProgress(req.Progress, phase, progress)
+			continue
+		}
+		if req.Output == nil {
+			log.Println(line)
+		} else {
+			fmt.Fprintln(req.Output, line)
+		}
+	}
+	return scanner.Err()
+}
+
+// reportJobProgress passes phase and progress to report if it is set.
+func reportJobProgress(report builder.ProgressFunc, phase string, progress float64) {
+	if report != nil {
+		report(phase, progress)
+	}
+}
+
+// jobOutcome returns the result and error a finished Job pod reported in its termination
+// message, or why it failed without reporting any.
+func jobOutcome(result builder.BuildResult, pod k8spermissions.JobPod) (builder.BuildResult, error) {
+	var outcome jobResult
+	if pod.Message == "" || json.Unmarshal([]byte(pod.Message), &outcome) != nil {
+		if pod.ExitCode == 0 && pod.Reason == "" {
+			return result, fmt.Errorf("build Job pod %s exited without reporting a result", pod.Name)
+		}
+		return result, fmt.Errorf("build Job pod %s failed: %s (exit code %d)", pod.Name, pod.Reason, pod.ExitCode)
+	}
+	return outcome.buildResult()
+}
+
+// newJobResult returns the outcome of a build for the termination message of its Job.
+func newJobResult(result builder.BuildResult, err error) jobResult {
+	outcome := jobResult{
+		Image:        result.Image,
+		Tags:         result.Tags,
+		Version:      result.Version,
+		Digest:       result.Digest,
+		PhaseSeconds: make(map[string]float64, len(result.PhaseDurations)),
+		Signature:    result.Signature,
+		SignError:    jobError(result.SignErr),
+		SBOMDigest:   result.SBOMDigest,
+		SBOMError:    jobError(result.SBOMErr),
+		ScanCounts:   result.ScanCounts,
+		ImageIDs:     result.ImageIDs,
+		ImageSize:    result.ImageSize,
+		Compression:  result.Compression,
+		Checksums:    result.Checksums,
+		Stats:        result.Stats,
+
+		ImageStreamError: jobError(result.ImageStreamErr),
+		UpdatedRef:       result.UpdatedRef,
+		UpdateError:      jobError(result.UpdateErr),
+	}
+	for phase, d := range result.PhaseDurations {
+		outcome.PhaseSeconds[phase] = d.Seconds()
+	}
+	for _, push := range result.Pushes {
+		outcome.Pushes = append(outcome.Pushes, BuildPush{Registry: push.Registry, Image: push.Image, Digest: push.Digest, Retries: push.Retries, Error: jobError(push.Err)})
+	}
+	if err != nil {
+		outcome.Phase = failedPhase(err)
+		// The server wraps the error again for its phase
+		if inner := errors.Unwrap(err); outcome.Phase != "" && inner != nil {
+			err = inner
+		}
+		outcome.Error = jobError(err)
+	}
+	return outcome
+}
+
+// buildResult returns the result and error of the build r reports, the error being of the
+// type builder.BuildAndPushImage returns for the phase it failed in.
+func (r jobResult) buildResult() (builder.BuildResult, error) {
+	result := builder.BuildResult{
+		Image:          r.Image,
+		Tags:           r.Tags,
+		Version:        r.Version,
+		Digest:         r.Digest,
+		PhaseDurations: make(map[string]time.Duration, len(r.PhaseSeconds)),
+		Signature:      r.Signature,
+		SignErr:        jobErr(r.SignError),
+		SBOMDigest:     r.SBOMDigest,
+		SBOMErr:        jobErr(r.SBOMError),
+		ScanCounts:     r.ScanCounts,
+		ImageIDs:       r.ImageIDs,
+		ImageSize:      r.ImageSize,
+		Compression:    r.Compression,
+		Checksums:      r.Checksums,
+		Stats:          r.Stats,
+		ImageStreamErr: jobErr(r.ImageStreamError),
+		UpdatedRef:     r.UpdatedRef,
+		UpdateErr:      jobErr(r.UpdateError),
+	}
+	for phase, seconds := range r.PhaseSeconds {
+		result.PhaseDurations[phase] = time.Duration(seconds * float64(time.Second))
+	}
+	for _, push := range r.Pushes {
+		result.Pushes = append(result.Pushes, builder.PushResult{Registry: push.Registry, Image: push.Image, Digest: push.Digest, Retries: push.Retries, Err: jobErr(push.Error)})
+	}
+
+	err := jobErr(r.Error)
+	switch r.Phase {
+	case builder.PhaseExtracting:
+		err = &builder.ExtractError{Err: err}
+	case builder.PhaseBuilding:
+		err = &builder.BuildError{Err: err}
+	case builder.PhasePushing:
+		err = &builder.PushError{Err: err}
+	case builder.PhaseSigning:
+		err = &builder.SignError{Err: err}
+	case builder.PhaseSBOM:
+		err = &builder.SBOMError{Err: err}
+	case builder.PhaseScanning:
+		err = &builder.ScanError{Err: err}
+	}
+	if r.Error == "" {
+		err = nil
+	}
+	return result, err
+}
+
+// jobError returns the message of err cut to maxJobError, or "" for nil.
+func jobError(err error) string {
+	if err == nil {
+		return ""
+	}
+	message := err.Error()
+	if len(message) > maxJobError {
+		message = message[:maxJobError] + "..."
+	}
+	return message
+}
+
+// jobErr returns an error with message, or nil for "".
+func jobErr(message string) error {
+	if message == "" {
+		return nil
+	}
+	return errors.New(message)
+}
+
+// newJobToken returns a random token a build Job downloads its bundle with.
+func newJobToken() (string, error) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(buf), nil
+}
+
+// jobBundleHandler serves the bundle of the build named by the {id} path value to its Job:
+// a tar stream of the jobSpec followed by the archive, the extra files and the uploaded
+// Containerfile. It is authenticated by the one-time token of the Job instead of AUTH_MODE,
+// and answers 401 once the bundle was downloaded.
+func jobBundleHandler(cfg *config.Config) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		id := r.PathValue("id")
+		token := bearerToken(r)
+		pendingJobsLock.Lock()
+		job, ok := pendingJobs[id]
+		ok = ok && token != "" && subtle.ConstantTimeCompare([]byte(token), []byte(job.token)) == 1
+		if ok {
+			job.token = "" // The token is only good for one download
+			pendingJobs[id] = job
+		}
+		pendingJobsLock.Unlock()
+		if !ok {
+			http.Error(w, "Invalid job token", http.StatusUnauthorized)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/x-tar")
+		if err := writeJobBundle(w, cfg, job.req); err != nil {
+			log.Printf("Failed to send the bundle of build %s: %v\n", id, err)
+		}
+	}
+}
+
+// writeJobBundle writes the bundle of req to w.
+func writeJobBundle(w io.Writer, cfg *config.Config, req builder.BuildRequest) error {
+	spec := jobSpec{Config: jobConfig(cfg), Request: jobRequest{
+		BuildID:               req.BuildID,
+		ImageName:             req.ImageName,
+		AuthToken:             req.AuthToken,
+		Archive:               req.FilePath != "",
+		ContainerfileOverride: req.ContainerfileOverride != "",
+		Containerfile:         req.Containerfile,
+		UnpackNested:          req.UnpackNested,
+		BuildArgs:             req.BuildArgs,
+		Platforms:             req.Platforms,
+		Platform:              req.Platform,
+		ArchiveDigest:         req.ArchiveDigest,
+		NoCache:               req.NoCache,
+		Squash:                req.Squash,
+		DryRun:                req.DryRun,
+		UpdateRefs:            req.UpdateRefs,
+	}}
+	files := map[string]string{}
+	if req.FilePath != "" {
+		files[bundleArchive] = req.FilePath
+	}
+	if req.ContainerfileOverride != "" {
+		files[bundleContainerfile] = req.ContainerfileOverride
+	}
+	for _, path := range req.ExtraFiles {
+		spec.Request.ExtraFiles = append(spec.Request.ExtraFiles, filepath.Base(path))
+		files[bundleExtraDir+"/"+filepath.Base(path)] = path
+	}
+	data, err := json.Marshal(spec)
+	if err != nil {
+		return err
+	}
+
+	tw := tar.NewWriter(w)
+	if err := tw.WriteHeader(&tar.Header{Name: bundleSpec, Mode: 0600, Size: int64(len(data)), Typeflag: tar.TypeReg}); err != nil {
+		return err
+	}
+	if _, err := tw.Write(data); err != nil {
+		return err
+	}
+	for name, path := range files {
+		if err := addBundleFile(tw, name, path); err != nil {
+			return err
+		}
+	}
+	return tw.Close()
+}
+
+// addBundleFile copies the file at path into tw as name.
+func addBundleFile(tw *tar.Writer, name, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if err := tw.WriteHeader(&tar.Header{Name: name, Mode: 0600, Size: info.Size(), Typeflag: tar.TypeReg}); err != nil {
+		return err
+	}
+	_, err = io.Copy(tw, f)
+	return err
+}
+
+// jobConfig returns the configuration a build Job runs with: cfg building locally in the
+// Job's own directories, without the settings only the server needs.
+func jobConfig(cfg *config.Config) config.Config {
+	c := *cfg
+	c.BuildMode = config.BuildModeLocal
+	c.AdminToken = ""
+	c.WorkDir, c.UploadDir = k8spermissions.JobWorkDir, k8spermissions.JobWorkDir
+	c.KeepWorkDirOnFailure = false
+	c.KeepLocalImage = false
+	c.StateDir, c.LogDir = "", ""
+	return c
+}
@@ -0,0 +1,383 @@
+package server
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"maps"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"vddk-builder/pkg/builder"
+	"vddk-builder/pkg/config"
+)
+
+// Timing of the log endpoints and the retention sweep.
+const (
+	logSweepInterval = time.Hour
+	logFollowPoll    = 500 * time.Millisecond
+)
+
+// buildLog is the on-disk log of one build. Output beyond LOG_MAX_SIZE is dropped after
+// a truncation marker.
+type buildLog struct {
+	mu        sync.Mutex
+	file      *os.File
+	size      int64
+	max       int64
+	truncated bool
+}
+
+// logPath returns where the log of the build with the given ID is written.
+func logPath(cfg *config.Config, id string) string {
+	return filepath.Join(cfg.LogDir, id+".log")
+}
+
+// sbomPath returns where the SBOM of the build with the given ID is written.
+func sbomPath(cfg *config.Config, id string) string {
+	return filepath.Join(cfg.LogDir, id+".spdx.json")
+}
+
+// buildSBOMPath records and returns where the builder writes the SBOM of b, or returns an
+// empty path when SBOM_ENABLED is unset.
+func buildSBOMPath(cfg *config.Config, b *Build) string {
+	if !cfg.SBOMEnabled {
+		return ""
+	}
+	path := sbomPath(cfg, b.ID)
+	buildsLock.Lock()
+	b.SBOMPath = path
+	buildsLock.Unlock()
+	return path
+}
+
+// buildContainerfileCopy records and returns where the builder stores the Containerfile b
+// is built with, or returns an empty path when LOG_DIR is unset.
+func buildContainerfileCopy(cfg *config.Config, b *Build) string {
+	if cfg.LogDir == "" {
+		return ""
+	}
+	path := filepath.Join(cfg.LogDir, b.ID+".Containerfile")
+	buildsLock.Lock()
+	b.EffectiveContainerfile = path
+	buildsLock.Unlock()
+	return path
+}
+
+// buildScanReportPath records and returns where the builder writes the vulnerability scan
+// report of b, or returns an empty path when SCAN_ENABLED is unset.
+func buildScanReportPath(cfg *config.Config, b *Build) string {
+	if !cfg.ScanEnabled {
+		return ""
+	}
+	path := filepath.Join(cfg.LogDir, b.ID+".scan.json")
+	buildsLock.Lock()
+	b.ScanReportPath = path
+	buildsLock.Unlock()
+	return path
+}
+
+// openBuildLog creates the log file of b and records its path, or returns nil when
+// LOG_DIR is unset or the file cannot be created.
+func openBuildLog(cfg *config.Config, b *Build) *buildLog {
+	if cfg.LogDir == "" {
+		return nil
+	}
+	path := logPath(cfg, b.ID)
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		log.Printf("Failed to create log of build %s: %v\n", b.ID, err)
+		return nil
+	}
+
+	buildsLock.Lock()
+	b.LogPath = path
+	buildsLock.Unlock()
+	return &buildLog{file: f, max: cfg.LogMaxSize}
+}
+
+// Write appends p to the log until it reaches its size cap. Errors are logged instead of
+// returned so a full volume does not fail the build.
+func (l *buildLog) Write(p []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.truncated {
+		return len(p), nil
+	}
+	data := p
+	if l.max > 0 && l.size+int64(len(data)) > l.max {
+		data = []byte(fmt.Sprintf("... log truncated at %d bytes (LOG_MAX_SIZE) ...\n", l.max))
+		l.truncated = true
+	}
+	n, err := l.file.Write(data)
+	l.size += int64(n)
+	if err != nil {
+		log.Printf("Failed to write build log %s: %v\n", l.file.Name(), err)
+	}
+	return len(p), nil
+}
+
+// writer returns where the builder sends its output: the log and the server log, or
+// nil (the server log only) without a log file.
+func (l *buildLog) writer() io.Writer {
+	if l == nil {
+		return nil
+	}
+	return io.MultiWriter(l, serverLogWriter{})
+}
+
+// close syncs the log to disk, closes it and records its final size in b.
+func (l *buildLog) close(b *Build) {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.writeSummary(b)
+	if err := l.file.Sync(); err != nil {
+		log.Printf("Failed to sync build log %s: %v\n", l.file.Name(), err)
+	}
+	if err := l.file.Close(); err != nil {
+		log.Printf("Failed to close build log %s: %v\n", l.file.Name(), err)
+	}
+
+	buildsLock.Lock()
+	b.LogSize = l.size
+	buildsLock.Unlock()
+}
+
+// writeSummary appends the phase durations and counters of b to the log, past the size
+// cap so the footer is always there. The caller holds l.mu.
+func (l *buildLog) writeSummary(b *Build) {
+	buildsLock.Lock()
+	seconds := maps.Clone(b.PhaseSeconds)
+	stats := b.Stats
+	buildsLock.Unlock()
+	if len(seconds) == 0 && stats == nil {
+		return
+	}
+
+	var summary strings.Builder
+	summary.WriteString("--- build summary ---\n")
+	for _, phase := range slices.Sorted(maps.Keys(seconds)) {
+		fmt.Fprintf(&summary, "phase %s: %.1fs\n", phase, seconds[phase])
+	}
+	if stats != nil {
+		fmt.Fprintf(&summary, "extracted: %d bytes in %d entries\n", stats.ExtractedBytes, stats.ExtractedEntries)
+		fmt.Fprintf(&summary, "build steps: %d\n", stats.BuildSteps)
+		fmt.Fprintf(&summary, "pushed: %d bytes, %d retries\n", stats.PushedBytes, stats.PushRetries)
+	}
+	n, err := l.file.WriteString(summary.String())
+	l.size += int64(n)
+	if err != nil {
+		log.Printf("Failed to write build log %s: %v\n", l.file.Name(), err)
+	}
+}
+
+// serverLogWriter writes every line it receives to the server log.
+type serverLogWriter struct{}
+
+func (serverLogWriter) Write(p []byte) (int, error) {
+	log.Print(string(p))
+	return len(p), nil
+}
+
+// buildLogsHandler returns the stored log of the build named by the {id} path value.
+// Range requests are honored; with follow=true the response instead streams the log
+// until the build ends.
+func buildLogsHandler(cfg *config.Config) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		b := lookupBuild(r.PathValue("id"))
+		if b == nil {
+			http.Error(w, "Build not found", http.StatusNotFound)
+			return
+		}
+		path := snapshotBuild(b).LogPath
+		if path == "" {
+			http.Error(w, "Build has no log file", http.StatusNotFound)
+			return
+		}
+		f, err := os.Open(path)
+		if os.IsNotExist(err) {
+			http.Error(w, "Log file was removed after LOG_RETENTION", http.StatusGone)
+			return
+		}
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Unable to open log: %v", err), http.StatusInternalServerError)
+			return
+		}
+		defer f.Close()
+
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		if r.URL.Query().Get("follow") != "true" {
+			info, err := f.Stat()
+			if err != nil {
+				http.Error(w, fmt.Sprintf("Unable to stat log: %v", err), http.StatusInternalServerError)
+				return
+			}
+			http.ServeContent(w, r, filepath.Base(path), info.ModTime(), f)
+			return
+		}
+		followLog(w, r, b, f)
+	}
+}
+
+// followLog copies f to w as it grows until b reaches a terminal state.
+func followLog(w http.ResponseWriter, r *http.Request, b *Build, f *os.File) {
+	flusher, _ := w.(http.Flusher)
+	ticker := time.NewTicker(logFollowPoll)
+	defer ticker.Stop()
+	for {
+		if _, err := io.Copy(w, f); err != nil {
+			return
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+		select {
+		case <-b.done:
+			// Pick up what was written between the last copy and the end of the build
+			io.Copy(w, f)
+			return
+		case <-r.Context().Done():
+			return
+		case <-serverStopping:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// buildSBOMHandler returns the SPDX SBOM generated for the build named by the {id} path value.
+func buildSBOMHandler(cfg *config.Config) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		b := lookupBuild(r.PathValue("id"))
+		if b == nil {
+			http.Error(w, "Build not found", http.StatusNotFound)
+			return
+		}
+		snapshot := snapshotBuild(b)
+		if snapshot.SBOMDigest == "" {
+			http.Error(w, "Build has no SBOM", http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Docker-Content-Digest", snapshot.SBOMDigest)
+		serveBuildFile(w, r, snapshot.SBOMPath, builder.SPDXMediaType, "SBOM")
+	}
+}
+
+// buildScanHandler returns the vulnerability scan report of the build named by the {id}
+// path value.
+func buildScanHandler(cfg *config.Config) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		b := lookupBuild(r.PathValue("id"))
+		if b == nil {
+			http.Error(w, "Build not found", http.StatusNotFound)
+			return
+		}
+		snapshot := snapshotBuild(b)
+		if snapshot.ScanCounts == nil {
+			http.Error(w, "Build has no scan report", http.StatusNotFound)
+			return
+		}
+		serveBuildFile(w, r, snapshot.ScanReportPath, "application/json", "Scan report")
+	}
+}
+
+// buildContainerfileHandler returns the Containerfile the build named by the {id} path
+// value was built with.
+func buildContainerfileHandler(cfg *config.Config) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		b := lookupBuild(r.PathValue("id"))
+		if b == nil {
+			http.Error(w, "Build not found", http.StatusNotFound)
+			return
+		}
+		snapshot := snapshotBuild(b)
+		if snapshot.EffectiveContainerfile == "" {
+			http.Error(w, "Build has no stored Containerfile", http.StatusNotFound)
+			return
+		}
+		serveBuildFile(w, r, snapshot.EffectiveContainerfile, "text/plain; charset=utf-8", "Containerfile")
+	}
+}
+
+// serveBuildFile serves the build artifact at path, answering 410 once the retention
+// sweep removed it. what names the artifact in error messages.
+func serveBuildFile(w http.ResponseWriter, r *http.Request, path, contentType, what string) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		http.Error(w, fmt.Sprintf("%s was removed after its retention period", what), http.StatusGone)
+		return
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Unable to open %s: %v", strings.ToLower(what), err), http.StatusInternalServerError)
+		return
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Unable to stat %s: %v", strings.ToLower(what), err), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", contentType)
+	http.ServeContent(w, r, filepath.Base(path), info.ModTime(), f)
+}
+
+// artifactSuffixes name the files in LOG_DIR the retention sweep removes.
+var artifactSuffixes = []string{".log", ".spdx.json", ".scan.json", ".Containerfile"}
+
+// runLogSweeper removes build logs, SBOMs and scan reports older than LOG_RETENTION.
+func runLogSweeper(cfg *config.Config) {
+	for {
+		sweepLogs(cfg)
+		time.Sleep(logSweepInterval)
+	}
+}
+
+// sweepLogs deletes every build artifact last written before the retention window.
+func sweepLogs(cfg *config.Config) {
+	entries, err := os.ReadDir(cfg.LogDir)
+	if err != nil {
+		log.Printf("Failed to read log directory: %v\n", err)
+		return
+	}
+
+	cutoff := time.Now().Add(-cfg.LogRetention)
+	for _, entry := range entries {
+		if !slices.ContainsFunc(artifactSuffixes, func(suffix string) bool { return strings.HasSuffix(entry.Name(), suffix) }) {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil || info.IsDir() || !info.ModTime().Before(cutoff) {
+			continue
+		}
+		if err := os.Remove(filepath.Join(cfg.LogDir, entry.Name())); err != nil {
+			log.Printf("Failed to remove build log %s: %v\n", entry.Name(), err)
+			continue
+		}
+		log.Printf("Removed build log %s after %s of retention\n", entry.Name(), cfg.LogRetention)
+	}
+}
@@ -0,0 +1,51 @@
+package server
+
+import "vddk-builder/pkg/metrics"
+
+// Build duration buckets in seconds, from a quick rebuild to the default build timeout.
+var buildDurationBuckets = []float64{30, 60, 120, 300, 600, 1200, 1800, 3600}
+
+// Phase duration buckets in seconds, from a cached step to a slow push.
+var phaseDurationBuckets = []float64{1, 5, 15, 30, 60, 120, 300, 600, 1800}
+
+var (
+	buildsTotal = metrics.NewCounter("vddk_builder_builds_total",
+		"Finished builds by terminal state.", "state")
+	buildDuration = metrics.NewHistogram("vddk_builder_build_duration_seconds",
+		"Wall-clock duration of finished builds by terminal state.", buildDurationBuckets, "state")
+	uploadsTotal = metrics.NewCounter("vddk_builder_uploads_total",
+		"Accepted uploads that started a build.")
+	uploadBytesTotal = metrics.NewCounter("vddk_builder_upload_bytes_total",
+		"Bytes received in accepted uploads.")
+	phaseDuration = metrics.NewHistogram("vddk_builder_phase_duration_seconds",
+		"Wall-clock duration of build phases by phase and outcome.", phaseDurationBuckets, "phase", "outcome")
+	extractedBytesTotal = metrics.NewCounter("vddk_builder_extracted_bytes_total",
+		"Bytes extracted from uploaded archives.")
+	buildStepsTotal = metrics.NewCounter("vddk_builder_build_steps_total",
+		"Containerfile steps run by the build engine.")
+	pushedBytesTotal = metrics.NewCounter("vddk_builder_pushed_bytes_total",
+		"Local size of the images pushed, once per registry, or of the OCI archives written.")
+	pushRetriesTotal = metrics.NewCounter("vddk_builder_push_retries_total",
+		"Push attempts repeated after transient failures.")
+	authCacheTotal = metrics.NewCounter("vddk_builder_auth_cache_total",
+		"Kubernetes authorizations answered from the cache (hit) or the API server (miss).", "result")
+)
+
+// observePhases records the phase durations and counters of b, which is ending in state.
+// The phase a failed or timed-out build ended in gets that state as its outcome, every
+// other phase succeeded. The caller holds buildsLock.
+func observePhases(b *Build, state BuildState) {
+	for phase, seconds := range b.PhaseSeconds {
+		outcome := string(BuildSucceeded)
+		if phase == b.Phase && (state == BuildFailed || state == BuildTimeout) {
+			outcome = string(state)
+		}
+		phaseDuration.Observe(seconds, phase, outcome)
+	}
+	if b.Stats != nil {
+		extractedBytesTotal.Add(float64(b.Stats.ExtractedBytes))
+		buildStepsTotal.Add(float64(b.Stats.BuildSteps))
+		pushedBytesTotal.Add(float64(b.Stats.PushedBytes))
+		pushRetriesTotal.Add(float64(b.Stats.PushRetries))
+	}
+}
@@ -0,0 +1,71 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/pprof"
+
+	"vddk-builder/pkg/builder"
+	"vddk-builder/pkg/config"
+	"vddk-builder/pkg/metrics"
+	"vddk-builder/pkg/registry"
+	"vddk-builder/pkg/version"
+)
+
+// monitorHandler returns the handler of the plain HTTP admin listener. It serves
+// operational endpoints only and is meant to be reachable from inside the cluster.
+func monitorHandler(cfg *config.Config) http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", metrics.Handler())
+	mux.HandleFunc("/healthz", healthzHandler)
+	mux.HandleFunc("/readyz", readyzHandler(cfg))
+	mux.HandleFunc("/version", versionHandler)
+
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	return mux
+}
+
+// healthzHandler reports that the process is alive and, with HA_ENABLED, whether this
+// replica leads and which pod does.
+func healthzHandler(w http.ResponseWriter, r *http.Request) {
+	fmt.Fprintln(w, "ok")
+	if enabled, leading, leader := leaderState(); enabled {
+		fmt.Fprintf(w, "leading: %t\nleader: %s\n", leading, leader)
+	}
+}
+
+// readyzHandler reports whether the server can accept builds: it is not shutting down,
+// the registry answers unless images are written to OUTPUT_DIR, and so does the remote
+// podman service if CONTAINER_HOST is set.
+func readyzHandler(cfg *config.Config) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-serverStopping:
+			http.Error(w, "Server is shutting down", http.StatusServiceUnavailable)
+			return
+		default:
+		}
+		if cfg.OutputMode != config.OutputModeArchive {
+			if _, err := registry.Ping(r.Context(), cfg.ImageRegistry, ""); err != nil {
+				http.Error(w, fmt.Sprintf("Registry unavailable: %v", err), http.StatusServiceUnavailable)
+				return
+			}
+		}
+		if cfg.ContainerHost != "" {
+			if err := builder.PingEngine(r.Context(), cfg); err != nil {
+				http.Error(w, fmt.Sprintf("Podman service unavailable: %v", err), http.StatusServiceUnavailable)
+				return
+			}
+		}
+		fmt.Fprintln(w, "ok")
+	}
+}
+
+// versionHandler returns the build version as JSON.
+func versionHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]string{"version": version.Version})
+}
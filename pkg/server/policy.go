@@ -0,0 +1,209 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+
+	"vddk-builder/pkg/config"
+	"vddk-builder/pkg/k8spermissions"
+)
+
+// policyKey is the key of the POLICY_CONFIGMAP holding the policy.
+const policyKey = "policy.json"
+
+// Sources of the effective policy.
+const (
+	policySourceEnvironment = "environment"
+	policySourceConfigMap   = "configmap"
+)
+
+// policy holds the settings POLICY_CONFIGMAP can change while the server runs. Settings
+// missing from the ConfigMap keep the values of their environment variables.
+type policy struct {
+	AllowedImagePrefixes  []string               `json:"allowedImagePrefixes"`  // ALLOWED_IMAGE_PREFIXES
+	AllowedRegistries     []string               `json:"allowedRegistries"`     // PROMOTE_REGISTRIES
+	QuotaUploadsPerDay    int                    `json:"quotaUploadsPerDay"`    // QUOTA_UPLOADS_PER_DAY
+	QuotaBytesPerDay      int64                  `json:"quotaBytesPerDay"`      // QUOTA_BYTES_PER_DAY
+	QuotaExemptIdentities []string               `json:"quotaExemptIdentities"` // QUOTA_EXEMPT_IDENTITIES
+	QuotaOverrides        map[string]quotaLimits `json:"quotaOverrides"`        // Limits replacing the daily quotas of single identities
+	AuthAllowedSubjects   []string               `json:"authAllowedSubjects"`   // AUTH_ALLOWED_SUBJECTS
+	AuthAllowedGroups     []string               `json:"authAllowedGroups"`     // AUTH_ALLOWED_GROUPS
+}
+
+// quotaLimits are the daily quotas of one identity; 0 is unlimited.
+type quotaLimits struct {
+	UploadsPerDay int   `json:"uploadsPerDay"`
+	BytesPerDay   int64 `json:"bytesPerDay"`
+}
+
+// effectivePolicy is the policy in force and where it came from, as served by /admin/policy.
+type effectivePolicy struct {
+	policy
+	Source          string    `json:"source"`                    // environment or configmap
+	ConfigMap       string    `json:"configMap,omitempty"`       // POLICY_CONFIGMAP
+	ResourceVersion string    `json:"resourceVersion,omitempty"` // Revision of the ConfigMap the policy was read from
+	LoadedAt        time.Time `json:"loadedAt"`
+
+	RejectedVersion string `json:"rejectedVersion,omitempty"` // Revision of the ConfigMap last refused
+	RejectedError   string `json:"rejectedError,omitempty"`   // Why it was refused
+}
+
+var (
+	activePolicy atomic.Pointer[effectivePolicy]
+	policyLock   sync.Mutex // Serializes the updates of activePolicy
+)
+
+// policyFromConfig returns the policy of the environment variables in cfg.
+func policyFromConfig(cfg *config.Config) policy {
+	return policy{
+		AllowedImagePrefixes:  cfg.AllowedImagePrefixes,
+		AllowedRegistries:     cfg.PromoteRegistries,
+		QuotaUploadsPerDay:    cfg.QuotaUploadsPerDay,
+		QuotaBytesPerDay:      cfg.QuotaBytesPerDay,
+		QuotaExemptIdentities: cfg.QuotaExemptIdentities,
+		AuthAllowedSubjects:   cfg.AuthAllowedSubjects,
+		AuthAllowedGroups:     cfg.AuthAllowedGroups,
+	}
+}
+
+// currentPolicy returns the policy in force, the one of cfg until the server installed one.
+func currentPolicy(cfg *config.Config) policy {
+	if active := activePolicy.Load(); active != nil {
+		return active.policy
+	}
+	return policyFromConfig(cfg)
+}
+
+// parsePolicy returns the policy in the policy.json of data, starting from defaults.
+func parsePolicy(data map[string]string, defaults policy) (policy, error) {
+	raw, ok := data[policyKey]
+	if !ok {
+		return policy{}, fmt.Errorf("the ConfigMap has no %s key", policyKey)
+	}
+	p := defaults
+	p.QuotaOverrides = nil
+	decoder := json.NewDecoder(strings.NewReader(raw))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&p); err != nil {
+		return policy{}, fmt.Errorf("invalid %s: %w", policyKey, err)
+	}
+	if decoder.More() {
+		return policy{}, fmt.Errorf("invalid %s: more than one JSON object", policyKey)
+	}
+
+	for name, list := range map[string][]string{
+		"allowedImagePrefixes":  p.AllowedImagePrefixes,
+		"allowedRegistries":     p.AllowedRegistries,
+		"quotaExemptIdentities": p.QuotaExemptIdentities,
+		"authAllowedSubjects":   p.AuthAllowedSubjects,
+		"authAllowedGroups":     p.AuthAllowedGroups,
+	} {
+		if slices.Contains(list, "") {
+			return policy{}, fmt.Errorf("%s lists an empty entry", name)
+		}
+	}
+	if p.QuotaUploadsPerDay < 0 || p.QuotaBytesPerDay < 0 {
+		return policy{}, fmt.Errorf("quotaUploadsPerDay and quotaBytesPerDay must not be negative")
+	}
+	for identity, limits := range p.QuotaOverrides {
+		if identity == "" || limits.UploadsPerDay < 0 || limits.BytesPerDay < 0 {
+			return policy{}, fmt.Errorf("quotaOverrides entry %q must name an identity and not have negative limits", identity)
+		}
+	}
+	return p, nil
+}
+
+// startPolicyWatch installs the policy of the environment, then watches POLICY_CONFIGMAP
+// until the server stops and swaps in each valid revision of it. An invalid revision is
+// logged, reported as a warning Event and otherwise ignored, keeping the previous policy;
+// deleting the ConfigMap restores the policy of the environment.
+func startPolicyWatch(cfg *config.Config) error {
+	defaults := policyFromConfig(cfg)
+	activePolicy.Store(&effectivePolicy{policy: defaults, Source: policySourceEnvironment, LoadedAt: time.Now().UTC()})
+	if cfg.PolicyConfigMap == "" {
+		return nil
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-serverStopping
+		cancel()
+	}()
+	namespace, name, _ := strings.Cut(cfg.PolicyConfigMap, "/") // Checked by Validate
+	return k8spermissions.WatchConfigMap(ctx, namespace, name, func(cm *corev1.ConfigMap) {
+		policyLock.Lock()
+		defer policyLock.Unlock()
+
+		if cm == nil {
+			activePolicy.Store(&effectivePolicy{policy: defaults, Source: policySourceEnvironment, LoadedAt: time.Now().UTC()})
+			log.Printf("Policy ConfigMap %s was deleted, using the policy of the environment\n", cfg.PolicyConfigMap)
+			k8spermissions.RecordEvent(corev1.EventTypeNormal, eventPolicyUpdated, "Policy ConfigMap "+cfg.PolicyConfigMap+" was deleted, using the policy of the environment")
+			return
+		}
+		p, err := parsePolicy(cm.Data, defaults)
+		if err != nil {
+			rejected := *activePolicy.Load()
+			rejected.RejectedVersion, rejected.RejectedError = cm.ResourceVersion, err.Error()
+			activePolicy.Store(&rejected)
+			log.Printf("Rejected revision %s of policy ConfigMap %s, keeping the previous policy: %v\n", cm.ResourceVersion, cfg.PolicyConfigMap, err)
+			k8spermissions.RecordEvent(corev1.EventTypeWarning, eventPolicyRejected, fmt.Sprintf("Revision %s of policy ConfigMap %s was rejected: %v", cm.ResourceVersion, cfg.PolicyConfigMap, err))
+			return
+		}
+		activePolicy.Store(&effectivePolicy{
+			policy:          p,
+			Source:          policySourceConfigMap,
+			ConfigMap:       cfg.PolicyConfigMap,
+			ResourceVersion: cm.ResourceVersion,
+			LoadedAt:        time.Now().UTC(),
+		})
+		log.Printf("Applied revision %s of policy ConfigMap %s\n", cm.ResourceVersion, cfg.PolicyConfigMap)
+		k8spermissions.RecordEvent(corev1.EventTypeNormal, eventPolicyUpdated, fmt.Sprintf("Applied revision %s of policy ConfigMap %s", cm.ResourceVersion, cfg.PolicyConfigMap))
+	})
+}
+
+// checkImageAllowed refuses imageName, a namespaced image name or repository, unless it
+// starts with one of the allowed image prefixes of the policy.
+func checkImageAllowed(cfg *config.Config, imageName string) error {
+	prefixes := currentPolicy(cfg).AllowedImagePrefixes
+	if len(prefixes) == 0 {
+		return nil
+	}
+	for _, prefix := range prefixes {
+		if strings.HasPrefix(imageName, prefix) {
+			return nil
+		}
+	}
+	return fmt.Errorf("Image %s does not start with any of the allowed image prefixes %s", imageName, strings.Join(prefixes, ", "))
+}
+
+// adminPolicyHandler returns the effective policy, its source and the revision of the
+// POLICY_CONFIGMAP it was read from as JSON.
+func adminPolicyHandler(cfg *config.Config) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		if status, err := authenticateAdmin(cfg, r); err != nil {
+			http.Error(w, err.Error(), status)
+			return
+		}
+
+		effective := activePolicy.Load()
+		if effective == nil {
+			effective = &effectivePolicy{policy: policyFromConfig(cfg), Source: policySourceEnvironment}
+		}
+		writeJSON(w, http.StatusOK, effective)
+	}
+}
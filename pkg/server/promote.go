@@ -0,0 +1,216 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"slices"
+	"time"
+
+	"vddk-builder/pkg/audit"
+	"vddk-builder/pkg/builder"
+	"vddk-builder/pkg/config"
+	"vddk-builder/pkg/registry"
+)
+
+// maxPromoteBody bounds the JSON body of /promote.
+const maxPromoteBody = 4 << 10
+
+// promoteRequest is the JSON body of /promote.
+type promoteRequest struct {
+	Source      string `json:"source"`
+	Destination string `json:"destination"`
+}
+
+// promoteImage is the builder entry point of promotions, replaceable for testing.
+var promoteImage = builder.PromoteImage
+
+// promoteHandler copies an image between two of the PROMOTE_REGISTRIES without rebuilding
+// it, such as from staging to production after validation. The copy runs like a build:
+// it gets a build record, whose digest is the destination digest once it succeeds, and
+// its skopeo output goes to the build log. The source may be pinned by digest; the
+// destination must be tagged and is not overwritten unless overwrite=true is passed and
+// allowed, as for uploads. With wait=true the response is the finished build record.
+func promoteHandler(cfg *config.Config) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		if cfg.OutputMode == config.OutputModeArchive {
+			http.Error(w, "Images are written to OUTPUT_DIR, no registry is used", http.StatusNotFound)
+			return
+		}
+
+		var req promoteRequest
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxPromoteBody)).Decode(&req); err != nil {
+			http.Error(w, fmt.Sprintf("Invalid request body: %v", err), http.StatusBadRequest)
+			return
+		}
+		source, err := parsePromoteReference(cfg, "source", req.Source)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		dest, err := parsePromoteReference(cfg, "destination", req.Destination)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if dest.Digest != "" || dest.Tag == "" {
+			http.Error(w, "The destination must be tagged and not pinned by digest", http.StatusBadRequest)
+			return
+		}
+		if source.String() == dest.String() {
+			http.Error(w, "The source and destination are the same image", http.StatusBadRequest)
+			return
+		}
+		// Only the repositories of IMAGE_REGISTRY name the namespaces of the cluster
+		destImage := ""
+		if dest.Registry == cfg.ImageRegistry {
+			destImage = dest.Repository
+		}
+		var ok bool
+		if r, ok = authorizePush(w, r, cfg, destImage); !ok {
+			return
+		}
+		if err := checkImageAllowed(cfg, dest.Repository); err != nil {
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+
+		reference := dest.String()
+		if existing := inFlightBuild(reference); existing != nil {
+			w.Header().Set("X-Build-ID", existing.ID)
+			http.Error(w, fmt.Sprintf("Image %s is already being built by build %s", reference, existing.ID), http.StatusConflict)
+			return
+		}
+
+		if !acquireBusy() {
+			http.Error(w, "Server is busy processing another build. Please try again later.", http.StatusServiceUnavailable)
+			return
+		}
+
+		// The caller's token is only ever offered to the primary registry
+		authToken := registryToken(r)
+		destToken := ""
+		if dest.Registry == cfg.ImageRegistry {
+			destToken = authToken
+		}
+		if !checkOverwrite(w, cfg, r, dest.Registry, reference, destToken) {
+			resetBusy()
+			return
+		}
+
+		buildID := newBuildID()
+		workDir, err := builder.NewWorkDir(cfg, buildID)
+		if err != nil {
+			log.Printf("Failed to create work directory: %v\n", err)
+			http.Error(w, "Failed to create work directory", http.StatusInternalServerError)
+			resetBusy()
+			return
+		}
+
+		build, created := newBuild(&Build{
+			ID:           buildID,
+			Image:        reference,
+			Reference:    reference,
+			PromotedFrom: source.String(),
+			Identity:     requestIdentity(r),
+			workDir:      workDir,
+			clientIP:     clientAddr(r),
+		})
+		if !created {
+			w.Header().Set("X-Build-ID", build.ID)
+			http.Error(w, fmt.Sprintf("Image %s is already being built by build %s", reference, build.ID), http.StatusConflict)
+			os.RemoveAll(workDir)
+			resetBusy()
+			return
+		}
+		buildLock.Lock()
+		activeBuild = build
+		buildLock.Unlock()
+
+		log.Printf("Build %s started promoting %s to %s\n", build.ID, build.PromotedFrom, reference)
+		auditLog.Record(audit.Entry{
+			Identity: build.Identity,
+			ClientIP: build.clientIP,
+			Action:   "promote",
+			Image:    reference,
+			BuildID:  build.ID,
+			Outcome:  "accepted",
+			Detail:   build.PromotedFrom,
+		})
+
+		go runBuild(build, cfg.BuildTimeout, func(ctx context.Context) error {
+			defer os.RemoveAll(workDir)
+			buildLog := openBuildLog(cfg, build)
+			defer buildLog.close(build)
+			result, err := promoteImage(ctx, cfg, builder.PromoteRequest{
+				WorkDir:     workDir,
+				Source:      build.PromotedFrom,
+				Destination: reference,
+				AuthToken:   authToken,
+				Progress:    build.setProgress,
+				Output:      buildLog.writer(),
+				Runner:      commandRunner,
+			})
+			build.setPromoteResult(dest.Registry, result, err)
+			return err
+		})
+
+		w.Header().Set("X-Build-ID", build.ID)
+		if r.URL.Query().Get("wait") != "true" {
+			writeJSON(w, http.StatusAccepted, snapshotBuild(build))
+			return
+		}
+		timer := time.NewTimer(maxWaitTimeout)
+		defer timer.Stop()
+		select {
+		case <-build.done:
+			writeJSON(w, http.StatusOK, snapshotBuild(build))
+		case <-timer.C:
+			writeJSON(w, http.StatusAccepted, snapshotBuild(build))
+		case <-serverStopping:
+			http.Error(w, "Server is shutting down", http.StatusServiceUnavailable)
+		case <-r.Context().Done():
+		}
+	}
+}
+
+// parsePromoteReference parses the what reference of a promotion, which must name one of
+// the allowed registries of the current policy, PROMOTE_REGISTRIES by default.
+func parsePromoteReference(cfg *config.Config, what, s string) (registry.Reference, error) {
+	if s == "" {
+		return registry.Reference{}, fmt.Errorf("Missing '%s' in the request body", what)
+	}
+	ref, err := registry.ParseReference(s)
+	if err != nil {
+		return registry.Reference{}, fmt.Errorf("Invalid %s: %v", what, err)
+	}
+	if ref.Registry == "" {
+		return registry.Reference{}, fmt.Errorf("The %s %s must name its registry", what, s)
+	}
+	if !slices.Contains(currentPolicy(cfg).AllowedRegistries, ref.Registry) {
+		return registry.Reference{}, fmt.Errorf("Registry %s of the %s is not one of the allowed registries", ref.Registry, what)
+	}
+	return ref, nil
+}
+
+// setPromoteResult records the destination digest of a promotion and the outcome of its copy
+// to registryURL.
+func (b *Build) setPromoteResult(registryURL string, result builder.PromoteResult, err error) {
+	buildsLock.Lock()
+	defer buildsLock.Unlock()
+	b.Digest = result.Digest
+	b.Tags = []string{b.Reference}
+	push := BuildPush{Registry: registryURL, Image: b.Reference, Digest: result.Digest, Retries: result.Retries}
+	if err != nil {
+		push.Error = err.Error()
+	}
+	b.Pushes = []BuildPush{push}
+}
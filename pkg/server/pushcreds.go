@@ -0,0 +1,76 @@
+package server
+
+import (
+	"fmt"
+	"log"
+	"path/filepath"
+	"time"
+
+	"vddk-builder/pkg/config"
+	"vddk-builder/pkg/registry"
+)
+
+// pushAuthFile is the containers-auth.json in WORK_DIR the dockercfg secret is converted to.
+const pushAuthFile = "push-auth.json"
+
+// configurePushCredentials sets up the credentials of PUSH_CREDENTIALS_MODE and logs the
+// mode. In serviceaccount mode the dockercfg secret, merged over REGISTRY_AUTH_CONFIG, is
+// written to WORK_DIR and replaces REGISTRY_AUTH_CONFIG, and is re-read every
+// PUSH_CREDENTIALS_REFRESH. Both non-caller modes need credentials for IMAGE_REGISTRY.
+func configurePushCredentials(cfg *config.Config) error {
+	switch cfg.PushCredentialsMode {
+	case config.PushCredentialsServiceAccount:
+		base, dest := cfg.RegistryAuthConfig, filepath.Join(cfg.WorkDir, pushAuthFile)
+		if err := loadPushCredentials(cfg, base, dest); err != nil {
+			return err
+		}
+		cfg.RegistryAuthConfig = dest
+		if !registry.HasCredentials(cfg.ImageRegistry) {
+			return fmt.Errorf("the dockercfg secret %s has no credentials for IMAGE_REGISTRY %s", cfg.PushDockercfgPath, cfg.ImageRegistry)
+		}
+		log.Printf("Push credentials: service account dockercfg secret %s, the caller's token is only used for authorization\n", cfg.PushDockercfgPath)
+		if cfg.PushCredentialsRefresh > 0 {
+			go runPushCredentialsRefresher(cfg, base, dest)
+		}
+	case config.PushCredentialsAuthFile:
+		if !registry.HasCredentials(cfg.ImageRegistry) {
+			return fmt.Errorf("REGISTRY_AUTH_CONFIG %s has no credentials for IMAGE_REGISTRY %s", cfg.RegistryAuthConfig, cfg.ImageRegistry)
+		}
+		log.Printf("Push credentials: REGISTRY_AUTH_CONFIG %s, the caller's token is only used for authorization\n", cfg.RegistryAuthConfig)
+	default:
+		log.Println("Push credentials: the caller's token")
+	}
+	return nil
+}
+
+// loadPushCredentials converts the dockercfg secret into the auth file dest and loads it.
+func loadPushCredentials(cfg *config.Config, base, dest string) error {
+	creds, err := registry.ReadDockercfg(cfg.PushDockercfgPath)
+	if err != nil {
+		return fmt.Errorf("failed to read the dockercfg secret: %w", err)
+	}
+	if err := registry.WriteAuthConfig(dest, base, creds); err != nil {
+		return err
+	}
+	return registry.ConfigureAuth(dest)
+}
+
+// runPushCredentialsRefresher re-reads the dockercfg secret, which OpenShift rotates, every
+// PUSH_CREDENTIALS_REFRESH. The previous credentials stay in use when it cannot be read.
+func runPushCredentialsRefresher(cfg *config.Config, base, dest string) {
+	for {
+		time.Sleep(cfg.PushCredentialsRefresh)
+		if err := loadPushCredentials(cfg, base, dest); err != nil {
+			log.Printf("Failed to refresh the push credentials, keeping the previous ones: %v\n", err)
+		}
+	}
+}
+
+// pushToken returns the caller's token to forward to the registry, none unless
+// PUSH_CREDENTIALS_MODE is caller.
+func pushToken(cfg *config.Config, token string) string {
+	if cfg.PushCredentialsMode != config.PushCredentialsCaller {
+		return ""
+	}
+	return token
+}
@@ -0,0 +1,101 @@
+package server
+
+import (
+	"fmt"
+	"slices"
+	"sync"
+	"time"
+
+	"vddk-builder/pkg/config"
+)
+
+// quotaUsage counts the uploads of one identity during one UTC day.
+type quotaUsage struct {
+	Day     string `json:"day"`
+	Uploads int    `json:"uploads"`
+	Bytes   int64  `json:"bytes"`
+}
+
+var (
+	quotaLock sync.Mutex                 // Protects quotas
+	quotas    = map[string]*quotaUsage{} // Daily usage by identity
+)
+
+// quotaExceededError reports an identity over its daily quota and when the quota resets.
+type quotaExceededError struct {
+	reason  string
+	resetAt time.Time
+}
+
+func (e *quotaExceededError) Error() string {
+	return fmt.Sprintf("Daily upload quota exceeded: %s; quota resets at %s", e.reason, e.resetAt.Format(time.RFC3339))
+}
+
+// checkQuota returns a *quotaExceededError if another upload of size bytes would push
+// identity over its daily limits. A negative size skips the byte check.
+func checkQuota(cfg *config.Config, identity string, size int64) error {
+	limits, ok := quotaFor(cfg, identity)
+	if !ok {
+		return nil
+	}
+
+	now := time.Now().UTC()
+	quotaLock.Lock()
+	defer quotaLock.Unlock()
+
+	usage := currentUsage(identity, now)
+	resetAt := nextQuotaReset(now)
+	if limits.UploadsPerDay > 0 && usage.Uploads >= limits.UploadsPerDay {
+		return &quotaExceededError{fmt.Sprintf("%d uploads per day", limits.UploadsPerDay), resetAt}
+	}
+	if limits.BytesPerDay > 0 && (usage.Bytes >= limits.BytesPerDay || (size > 0 && usage.Bytes+size > limits.BytesPerDay)) {
+		return &quotaExceededError{fmt.Sprintf("%d bytes per day", limits.BytesPerDay), resetAt}
+	}
+	return nil
+}
+
+// recordQuota adds an accepted upload of size bytes to identity's daily usage.
+func recordQuota(cfg *config.Config, identity string, size int64) {
+	if _, ok := quotaFor(cfg, identity); !ok {
+		return
+	}
+
+	quotaLock.Lock()
+	usage := currentUsage(identity, time.Now().UTC())
+	usage.Uploads++
+	usage.Bytes += size
+	quotaLock.Unlock()
+	markStateDirty()
+}
+
+// quotaFor returns the daily limits of identity under the current policy, its quota
+// override or the daily quotas, and whether any limit applies to it.
+func quotaFor(cfg *config.Config, identity string) (quotaLimits, bool) {
+	p := currentPolicy(cfg)
+	if slices.Contains(p.QuotaExemptIdentities, identity) {
+		return quotaLimits{}, false
+	}
+	limits, ok := p.QuotaOverrides[identity]
+	if !ok {
+		limits = quotaLimits{UploadsPerDay: p.QuotaUploadsPerDay, BytesPerDay: p.QuotaBytesPerDay}
+	}
+	return limits, limits.UploadsPerDay > 0 || limits.BytesPerDay > 0
+}
+
+// currentUsage returns identity's counters for the day of now, resetting stale ones.
+// The caller must hold quotaLock.
+func currentUsage(identity string, now time.Time) *quotaUsage {
+	day := now.Format(time.DateOnly)
+	usage := quotas[identity]
+	if usage == nil || usage.Day != day {
+		usage = &quotaUsage{Day: day}
+		quotas[identity] = usage
+	}
+	return usage
+}
+
+// nextQuotaReset returns the next UTC midnight after now.
+func nextQuotaReset(now time.Time) time.Time {
+	year, month, day := now.Date()
+	return time.Date(year, month, day+1, 0, 0, 0, 0, time.UTC)
+}
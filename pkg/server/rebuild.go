@@ -0,0 +1,271 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"vddk-builder/pkg/audit"
+	"vddk-builder/pkg/builder"
+	"vddk-builder/pkg/config"
+)
+
+// rebuildHandler re-runs a build from uploads retained in the store, so a build that
+// failed on a transient error does not need the archive to be uploaded again. The source
+// is either a previous build, named by the 'build' query parameter, whose archive and
+// extra files are reused, or a stored archive named by the 'digest' query parameter.
+// The optional 'image' query parameter replaces the image name; it defaults to the
+// source build's image. It answers 410 when the stored files were already swept.
+func rebuildHandler(cfg *config.Config) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if !cfg.KeepUploads {
+			http.Error(w, "Rebuilds are disabled", http.StatusNotFound)
+			return
+		}
+
+		query := r.URL.Query()
+		imageName := query.Get("image")
+		unpackNested := query.Get("unpack_nested") != "false"
+		updateRefs := query.Get("update_refs") != "false"
+		containerfile := query.Get("containerfile")
+		if containerfile != "" {
+			if err := builder.ValidateContainerfilePath(containerfile); err != nil {
+				http.Error(w, fmt.Sprintf("Invalid 'containerfile' query parameter: %v", err), http.StatusBadRequest)
+				return
+			}
+		}
+		buildArgs, err := parseBuildArgs(cfg, r)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Invalid 'build_arg' query parameter: %v", err), http.StatusBadRequest)
+			return
+		}
+		noCache := queryFlag(r, "no_cache", cfg.NoCache)
+		squash := queryFlag(r, "squash", cfg.Squash)
+		platform, err := parsePlatform(cfg, r)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Invalid 'platform' query parameter: %v", err), http.StatusBadRequest)
+			return
+		}
+		platforms, err := parsePlatforms(r, nil)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Invalid 'platforms' query parameter: %v", err), http.StatusBadRequest)
+			return
+		}
+		if platform != "" && platforms != nil {
+			http.Error(w, "The 'platform' and 'platforms' query parameters are mutually exclusive", http.StatusBadRequest)
+			return
+		}
+		var inputs []BuildInput
+		var rebuildOf string
+		switch {
+		case query.Get("build") != "":
+			b := lookupBuild(query.Get("build"))
+			if b == nil {
+				http.Error(w, "Build not found", http.StatusNotFound)
+				return
+			}
+			source := snapshotBuild(b)
+			if source.State == BuildRunning {
+				http.Error(w, fmt.Sprintf("Build %s is still running", source.ID), http.StatusConflict)
+				return
+			}
+			if source.ArchiveDigest == "" {
+				http.Error(w, fmt.Sprintf("Build %s has no recorded archive", source.ID), http.StatusGone)
+				return
+			}
+			inputs = append([]BuildInput(nil), source.Inputs...)
+			rebuildOf = source.ID
+			if imageName == "" {
+				imageName = source.Image
+			}
+			if containerfile == "" {
+				containerfile = source.Containerfile
+			}
+			if platform == "" && platforms == nil {
+				platform, platforms = source.Platform, source.Platforms
+			}
+		case query.Get("digest") != "":
+			digest := query.Get("digest")
+			if _, err := storePath(cfg, digest); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			inputs = []BuildInput{{
+				Name:   strings.TrimPrefix(digest, "sha256:") + ".tar.gz",
+				Role:   "archive",
+				Digest: digest,
+			}}
+		default:
+			http.Error(w, "Missing 'build' or 'digest' query parameter", http.StatusBadRequest)
+			return
+		}
+		if imageName == "" {
+			imageName = cfg.ImageName
+		}
+		imageName = cfg.QualifiedImageName(imageName)
+		var ok bool
+		if r, ok = authorizePush(w, r, cfg, imageName); !ok {
+			return
+		}
+		if err := checkImageAllowed(cfg, imageName); err != nil {
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+		if platform == "" && platforms == nil {
+			platform, platforms = cfg.TargetPlatform, cfg.Platforms
+		}
+
+		for i, input := range inputs {
+			info, err := statStoredInput(cfg, input.Digest)
+			if err != nil {
+				http.Error(w, fmt.Sprintf("Upload %s (%s) is no longer stored", input.Name, input.Digest), http.StatusGone)
+				return
+			}
+			inputs[i].Size = info.Size()
+		}
+
+		reference := normalizeReference(builder.ImageReference(cfg, imageName))
+		if existing := inFlightBuild(reference); existing != nil {
+			w.Header().Set("X-Build-ID", existing.ID)
+			http.Error(w, fmt.Sprintf("Image %s is already being built by build %s", reference, existing.ID), http.StatusConflict)
+			return
+		}
+
+		if !acquireBusy() {
+			http.Error(w, "Server is busy processing another build. Please try again later.", http.StatusServiceUnavailable)
+			return
+		}
+
+		authToken := registryToken(r)
+		if !checkOverwrite(w, cfg, r, cfg.ImageRegistry, imageName, authToken) {
+			resetBusy()
+			return
+		}
+
+		buildID := newBuildID()
+		workDir, err := builder.NewWorkDir(cfg, buildID)
+		if err != nil {
+			log.Printf("Failed to create work directory: %v\n", err)
+			http.Error(w, "Failed to create work directory", http.StatusInternalServerError)
+			resetBusy()
+			return
+		}
+		upload, err := restoreUpload(cfg, inputs, workDir)
+		if err != nil {
+			log.Printf("Failed to restore stored uploads: %v\n", err)
+			http.Error(w, "Failed to restore stored uploads", http.StatusInternalServerError)
+			os.RemoveAll(workDir)
+			resetBusy()
+			return
+		}
+
+		build, created := newBuild(&Build{
+			ID:            buildID,
+			Image:         imageName,
+			Reference:     reference,
+			Containerfile: containerfile,
+			BuildArgs:     builder.RedactBuildArgs(buildArgs),
+			Platforms:     platforms,
+			Platform:      platform,
+			NoCache:       noCache,
+			Squash:        squash,
+			Limits:        builder.LimitsFor(cfg),
+			Identity:      requestIdentity(r),
+			Inputs:        inputs,
+			RebuildOf:     rebuildOf,
+			filePath:      upload.filePath,
+			extrasDir:     upload.extrasDir,
+			workDir:       workDir,
+			clientIP:      clientAddr(r),
+		})
+		if !created {
+			w.Header().Set("X-Build-ID", build.ID)
+			http.Error(w, fmt.Sprintf("Image %s is already being built by build %s", reference, build.ID), http.StatusConflict)
+			upload.discard()
+			resetBusy()
+			return
+		}
+		buildLock.Lock()
+		activeBuild = build
+		buildLock.Unlock()
+
+		log.Printf("Build %s started for %s from stored archive %s\n", build.ID, imageName, build.ArchiveDigest)
+		auditLog.Record(audit.Entry{
+			Identity:      build.Identity,
+			ClientIP:      build.clientIP,
+			Action:        "rebuild",
+			Image:         reference,
+			BuildID:       build.ID,
+			ArchiveDigest: build.ArchiveDigest,
+			Outcome:       "accepted",
+			Detail:        rebuildOf,
+		})
+
+		w.Header().Set("X-Build-ID", build.ID)
+		fmt.Fprintf(w, "Rebuilding %s from stored archive %s\n", reference, build.ArchiveDigest)
+		fmt.Fprintf(w, "Build ID: %s\n", build.ID)
+
+		go runBuild(build, cfg.BuildTimeout, func(ctx context.Context) error {
+			defer os.RemoveAll(upload.extrasDir)
+			buildLog := openBuildLog(cfg, build)
+			defer buildLog.close(build)
+			result, err := buildAndPushImage(ctx, cfg, builder.BuildRequest{
+				WorkDir:           workDir,
+				BuildID:           build.ID,
+				FilePath:          upload.filePath,
+				ImageName:         imageName,
+				AuthToken:         authToken,
+				ExtraFiles:        upload.extraFiles,
+				Containerfile:     containerfile,
+				UnpackNested:      unpackNested,
+				BuildArgs:         buildArgs,
+				Platforms:         platforms,
+				Platform:          platform,
+				ArchiveDigest:     build.ArchiveDigest,
+				NoCache:           noCache,
+				Squash:            squash,
+				Progress:          build.setProgress,
+				Output:            buildLog.writer(),
+				SBOMPath:          buildSBOMPath(cfg, build),
+				ScanReportPath:    buildScanReportPath(cfg, build),
+				UpdateRefs:        updateRefs,
+				ContainerfileCopy: buildContainerfileCopy(cfg, build),
+				Runner:            commandRunner,
+			})
+			build.setResult(result)
+			return err
+		})
+	}
+}
+
+// restoreUpload places the stored inputs, archive first, in UploadDir the way a fresh
+// upload would have left them.
+func restoreUpload(cfg *config.Config, inputs []BuildInput, workDir string) (*receivedUpload, error) {
+	filePath := filepath.Join(cfg.UploadDir, inputs[0].Name)
+	upload := &receivedUpload{workDir: workDir, filePath: filePath, extrasDir: builder.ExtrasDir(filePath), inputs: inputs}
+	if err := restoreInput(cfg, inputs[0].Digest, filePath); err != nil {
+		return nil, err
+	}
+
+	for _, input := range inputs[1:] {
+		if err := os.MkdirAll(upload.extrasDir, 0755); err != nil {
+			upload.discard()
+			return nil, err
+		}
+		path := filepath.Join(upload.extrasDir, input.Name)
+		if err := restoreInput(cfg, input.Digest, path); err != nil {
+			upload.discard()
+			return nil, err
+		}
+		upload.extraFiles = append(upload.extraFiles, path)
+	}
+	return upload, nil
+}
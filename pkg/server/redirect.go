@@ -0,0 +1,20 @@
+package server
+
+import (
+	"net"
+	"net/http"
+)
+
+// redirectHandler returns a handler that permanently redirects every request to the
+// equivalent https:// URL on httpsPort. It never serves any of the real endpoints.
+func redirectHandler(httpsPort string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host := r.Host
+		if h, _, err := net.SplitHostPort(r.Host); err == nil {
+			host = h
+		}
+
+		target := "https://" + net.JoinHostPort(host, httpsPort) + r.URL.RequestURI()
+		http.Redirect(w, r, target, http.StatusPermanentRedirect)
+	})
+}
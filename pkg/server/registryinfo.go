@@ -0,0 +1,64 @@
+package server
+
+import (
+	"net/http"
+
+	"vddk-builder/pkg/config"
+	"vddk-builder/pkg/registry"
+)
+
+// maxCatalogRepositories caps the repositories listed by /registry/info?catalog=true.
+const maxCatalogRepositories = 1000
+
+// registryInfo is the answer of /registry/info.
+type registryInfo struct {
+	Registry     string   `json:"registry"`
+	Reachable    bool     `json:"reachable"`
+	AuthRequired bool     `json:"authRequired,omitempty"`
+	APIVersion   string   `json:"apiVersion,omitempty"`
+	Error        string   `json:"error,omitempty"`
+	Repositories []string `json:"repositories,omitempty"`
+	Truncated    bool     `json:"truncated,omitempty"` // More than maxCatalogRepositories repositories exist
+	CatalogError string   `json:"catalogError,omitempty"`
+}
+
+// registryInfoHandler reports whether the primary registry answers, with the caller's
+// credentials, so a failing build can be pinned on the builder or the registry. With
+// catalog=true and REGISTRY_INFO_CATALOG set the repositories of the registry are listed too.
+func registryInfoHandler(cfg *config.Config) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if cfg.OutputMode == config.OutputModeArchive {
+			http.Error(w, "Images are written to OUTPUT_DIR, no registry is used", http.StatusNotFound)
+			return
+		}
+
+		wantCatalog := r.URL.Query().Get("catalog") == "true"
+		if wantCatalog && !cfg.RegistryInfoCatalog {
+			http.Error(w, "Listing the registry catalog is disabled, set REGISTRY_INFO_CATALOG=true", http.StatusForbidden)
+			return
+		}
+
+		info := registryInfo{Registry: cfg.ImageRegistry}
+		status, err := registry.Ping(r.Context(), cfg.ImageRegistry, registryToken(r))
+		if err != nil {
+			info.Error = err.Error()
+			writeJSON(w, http.StatusOK, info)
+			return
+		}
+		info.Reachable = true
+		info.AuthRequired = status.AuthRequired
+		info.APIVersion = status.APIVersion
+
+		if wantCatalog && !status.AuthRequired {
+			info.Repositories, info.Truncated, err = registry.Catalog(r.Context(), cfg.ImageRegistry, registryToken(r), maxCatalogRepositories)
+			if err != nil {
+				info.CatalogError = err.Error()
+			}
+		}
+		writeJSON(w, http.StatusOK, info)
+	}
+}
@@ -1,14 +1,17 @@
 package server
 
 import (
+	"context"
 	"fmt"
-	"io"
+	"log"
 	"net/http"
 	"os"
-	"path/filepath"
-	"strings"
+	"os/signal"
 	"sync"
+	"syscall"
+	"time"
 
+	"vddk-builder/pkg/audit"
 	"vddk-builder/pkg/builder"
 	"vddk-builder/pkg/config"
 	"vddk-builder/pkg/k8spermissions"
@@ -16,163 +19,336 @@ import (
 )
 
 var (
-	buildLock sync.Mutex // Mutex for controlling access
-	isBusy    bool       // Global flag indicating if the server is busy
+	buildLock   sync.Mutex // Mutex for controlling access
+	isBusy      bool       // Global flag indicating if the server is busy
+	activeBuild *Build     // Build currently holding the busy slot
+
+	auditLog *audit.Logger // Audit trail of uploads and builds
+
+	commandRunner builder.Runner // Runs the podman and skopeo commands of builds
+
+	serverStopping = make(chan struct{}) // Closed when shutdown begins
+	stopOnce       sync.Once
 )
 
+// buildAndPushImage is the builder entry point, replaceable for testing.
+var buildAndPushImage = builder.BuildAndPushImage
+
+// shutdownTimeout bounds how long in-flight requests may take to finish on shutdown.
+const shutdownTimeout = 30 * time.Second
+
 // StartServer initializes and starts the HTTPS server with the provided configuration.
 // It sets up the necessary endpoints and handles file uploads and image checks.
 //
 // Parameters:
 //   - cfg: A pointer to the configuration struct containing server settings.
+//   - runner: Runs the podman and skopeo commands of every build.
 //
 // The function performs the following tasks:
 //   - Creates the upload directory if it doesn't exist.
+//   - Runs the startup checks and exits non-zero if any of them fails.
 //   - Adds an endpoint to check the availability of an image in the registry.
 //   - Adds an endpoint to handle file uploads and initiate the build process.
 //   - Starts the HTTPS server using the provided certificate and private key.
+//   - Optionally starts a plain HTTP listener that redirects every request to HTTPS.
+//   - Optionally starts a plain HTTP admin listener serving /metrics, /healthz, /readyz, /version and pprof.
+//   - Optionally elects a leader among the replicas, the only one accepting builds.
 //
 // Endpoints:
 //   - /check-image: Checks if an image exists in the registry. Accepts GET requests with an 'image' query parameter.
+//   - /registry/info: Reports whether the registry answers and, when enabled, lists its repositories.
+//   - /image-info: Returns the creation time, layer count, compressed size and labels of an image.
 //   - /upload: Handles file uploads and initiates the build process. Accepts POST requests with a 'file' form field and an optional 'image' query parameter.
+//   - /builds, /builds/{id}: Lists build records or returns a single one as JSON.
+//   - /builds/{id}/wait: Blocks until a build finishes and returns its record.
+//   - /builds/{id}/image.tar: Downloads the built image as an OCI archive when exports are enabled.
+//   - /rebuild: Re-runs a build from a retained archive when uploads are kept.
+//   - /promote: Copies an image between two of the PROMOTE_REGISTRIES without rebuilding it.
+//   - /admin/reset: Force-clears a stuck busy state.
+//   - /admin/audit: Returns the most recent audit log entries.
+//   - /admin/workdirs/{id}: Removes the work directory kept after a build failed.
+//   - /admin/policy: Returns the effective policy and the ConfigMap revision it came from.
+//   - /jobs/{id}/bundle: Sends a build Job its inputs with BUILD_MODE=job.
+//   - /: Serves the embedded HTML upload form when enabled.
 //
 // The server will respond with appropriate HTTP status codes and messages based on the request and processing results.
-func StartServer(cfg *config.Config) {
+func StartServer(cfg *config.Config, runner builder.Runner) {
+	commandRunner = runner
+
 	// Create upload directory
 	if err := os.MkdirAll(cfg.UploadDir, 0755); err != nil {
 		panic(fmt.Sprintf("Unable to create upload directory: %v", err))
 	}
 
-	// Add new endpoint to check image availability
-	http.HandleFunc("/check-image", func(w http.ResponseWriter, r *http.Request) {
-		if r.Method != http.MethodGet {
-			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
-			return
+	// Build Jobs bring their own build engine
+	if cfg.BuildMode == config.BuildModeJob {
+		if err := k8spermissions.CheckJobResources(cfg.JobCPU, cfg.JobMemory); err != nil {
+			log.Fatalf("Refusing to start: BUILD_JOB_CPU or BUILD_JOB_MEMORY: %v", err)
 		}
-
-		imageName := r.URL.Query().Get("image")
-		if imageName == "" {
-			http.Error(w, "Missing 'image' query parameter", http.StatusBadRequest)
-			return
+		buildAndPushImage = runJobBuild
+	} else if err := builder.CheckEngine(cfg); err != nil {
+		log.Fatalf("Refusing to start: %v", err)
+	}
+	if err := registry.Configure(registryOptions(cfg)); err != nil {
+		log.Fatalf("Refusing to start: %v", err)
+	}
+	if !cfg.RegistryTLSVerify {
+		log.Println("WARNING: REGISTRY_TLS_VERIFY=false, registry certificates are NOT verified when pushing, signing or querying; anyone on the network path can impersonate the registry")
+	}
+	if err := registry.ConfigureAuth(cfg.RegistryAuthConfig); err != nil {
+		log.Fatalf("Refusing to start: REGISTRY_AUTH_CONFIG: %v", err)
+	}
+	if err := configurePushCredentials(cfg); err != nil {
+		log.Fatalf("Refusing to start: PUSH_CREDENTIALS_MODE: %v", err)
+	}
+	if cfg.AuthMode == config.AuthModeKubernetes || cfg.ImageStreamEnabled || cfg.EventsEnabled || cfg.UpdateTarget != "" || cfg.HAEnabled || cfg.BuildMode == config.BuildModeJob || cfg.PolicyConfigMap != "" || cfg.StatusReporting != "" {
+		if err := k8spermissions.Configure(kubeOptions(cfg)); err != nil {
+			log.Fatalf("Refusing to start: %v", err)
 		}
-
-		authToken, err := authenticateRequest(cfg, r)
-		if err != nil {
-			http.Error(w, err.Error(), http.StatusUnauthorized)
-			return
+		if !cfg.KubeTLSVerify {
+			log.Println("WARNING: KUBE_TLS_VERIFY=false, the Kubernetes API server certificate is NOT verified; authorization decisions can be forged by anyone on the network path")
 		}
-
-		// Check image in the registry
-		imageExists, err := registry.CheckImageExists(imageName, cfg.ImageRegistry, authToken)
-		if err != nil {
-			http.Error(w, fmt.Sprintf("Error checking image: %v", err), http.StatusInternalServerError)
-			return
+	}
+	if cfg.UpdateTarget != "" {
+		if _, err := k8spermissions.ParseUpdateTarget(cfg.UpdateTarget); err != nil {
+			log.Fatalf("Refusing to start: UPDATE_TARGET: %v", err)
 		}
-
-		if imageExists {
-			fmt.Fprintf(w, "Image %s exists in the registry.\n", imageName)
-		} else {
-			http.Error(w, fmt.Sprintf("Image %s not found in the registry.", imageName), http.StatusNotFound)
+	}
+	if cfg.EventsEnabled {
+		if err := k8spermissions.ConfigureEvents(cfg.EventsTarget); err != nil {
+			log.Fatalf("Refusing to start: EVENTS_ENABLED: %v", err)
 		}
-	})
+	}
 
-	http.HandleFunc("/upload", func(w http.ResponseWriter, r *http.Request) {
-		// Allow only POST requests
-		if r.Method != http.MethodPost {
-			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
-			return
-		}
+	// Fail fast so a broken deployment surfaces as CrashLoopBackOff
+	if err := runStartupChecks(cfg); err != nil {
+		log.Fatalf("Refusing to start: %v", err)
+	}
 
-		// Check if the server is busy
-		buildLock.Lock()
-		if isBusy {
-			buildLock.Unlock()
-			http.Error(w, "Server is busy processing another build. Please try again later.", http.StatusServiceUnavailable)
-			return
-		}
-		isBusy = true
-		buildLock.Unlock()
+	// Nothing is building yet, so every leftover work directory and partial upload is an orphan
+	builder.SweepWorkDirs(cfg)
+	sweepPartialUploads(cfg)
 
-		// Parse the optional image query parameter
-		imageName := r.URL.Query().Get("image")
-		if imageName == "" {
-			imageName = cfg.ImageName // Use default image name from config
+	// Restore build history and quota counters from the state store
+	if cfg.StateDir != "" {
+		if err := os.MkdirAll(cfg.StateDir, 0755); err != nil {
+			panic(fmt.Sprintf("Unable to create state directory: %v", err))
+		}
+		if err := loadState(cfg.StateDir); err != nil {
+			panic(fmt.Sprintf("Unable to load state: %v", err))
 		}
+		go runStateWriter(cfg.StateDir)
+	}
+
+	// Expire retained uploads
+	if cfg.KeepUploads && cfg.UploadRetention > 0 {
+		go runStoreSweeper(cfg)
+	}
 
-		authToken, err := authenticateRequest(cfg, r)
-		if err != nil {
-			http.Error(w, err.Error(), http.StatusUnauthorized)
-			resetBusy()
-			return
+	// Expire the work directories kept after failed builds
+	if cfg.KeepWorkDirOnFailure && cfg.WorkDirRetention > 0 {
+		go runWorkDirSweeper(cfg)
+	}
+
+	// Expire build logs
+	if cfg.LogDir != "" {
+		if err := os.MkdirAll(cfg.LogDir, 0755); err != nil {
+			panic(fmt.Sprintf("Unable to create log directory: %v", err))
+		}
+		if cfg.LogRetention > 0 {
+			go runLogSweeper(cfg)
 		}
+	}
 
-		// Parse the uploaded file
-		file, header, err := r.FormFile("file")
-		if err != nil {
-			http.Error(w, "Failed to parse file", http.StatusBadRequest)
-			resetBusy()
-			return
+	// Write OCI archives to OUTPUT_DIR and expire them
+	if cfg.OutputMode == config.OutputModeArchive {
+		if err := os.MkdirAll(cfg.OutputDir, 0755); err != nil {
+			panic(fmt.Sprintf("Unable to create output directory: %v", err))
 		}
-		defer file.Close()
-
-		// Save the uploaded file
-		filePath := filepath.Join(cfg.UploadDir, header.Filename)
-		dst, err := os.Create(filePath)
-		if err != nil {
-			http.Error(w, "Failed to save file", http.StatusInternalServerError)
-			resetBusy()
-			return
+		if cfg.OutputRetention > 0 {
+			go runOutputSweeper(cfg)
 		}
-		defer dst.Close()
+	}
+
+	// Expire local images
+	if cfg.PruneLocalImages {
+		go runImagePruner(cfg)
+	}
+
+	// Apply the policy of the environment until POLICY_CONFIGMAP provides one
+	if err := startPolicyWatch(cfg); err != nil {
+		log.Fatalf("Refusing to start: POLICY_CONFIGMAP: %v", err)
+	}
+
+	// Mirror the build records into status objects
+	if err := startStatusReporting(cfg); err != nil {
+		log.Fatalf("Refusing to start: STATUS_REPORTING: %v", err)
+	}
+
+	// Only the elected replica accepts builds
+	if cfg.HAEnabled {
+		startLeaderElection(cfg)
+	}
+
+	var err error
+	auditLog, err = audit.NewLogger(cfg.AuditLogFile, cfg.AuditRecentEntries)
+	if err != nil {
+		panic(fmt.Sprintf("Unable to open audit log: %v", err))
+	}
+
+	mux := http.NewServeMux()
+
+	// Register the functional API behind the per-endpoint authentication policy
+	handle := func(pattern string, handler http.HandlerFunc) {
+		mux.HandleFunc(pattern, withAuth(cfg, pattern, handler))
+	}
+	uploadCIDRs, err := config.ParseCIDRs(cfg.UploadAllowedCIDRs)
+	if err != nil {
+		panic(fmt.Sprintf("Invalid upload allowed CIDRs: %v", err))
+	}
+	handleUpload := func(pattern string, handler http.HandlerFunc) {
+		mux.HandleFunc(pattern, allowFrom(uploadCIDRs, leaderOnly(withPushAuth(cfg, pattern, handler))))
+	}
+	handle("/check-image", checkImageHandler(cfg))
+	handle("/registry/info", registryInfoHandler(cfg))
+	handle("/image-info", imageInfoHandler(cfg))
+	handle("/tags", tagsHandler(cfg))
+	handleUpload("/upload", uploadHandler(cfg))
+	handle("/builds", listBuildsHandler(cfg))
+	handle("/builds/{id}", getBuildHandler(cfg))
+	handle("/builds/{id}/wait", waitBuildHandler(cfg))
+	handle("/builds/{id}/logs", buildLogsHandler(cfg))
+	handle("/builds/{id}/sbom", buildSBOMHandler(cfg))
+	handle("/builds/{id}/scan", buildScanHandler(cfg))
+	handle("/builds/{id}/containerfile", buildContainerfileHandler(cfg))
+	handle("/builds/{id}/image.tar", exportImageHandler(cfg))
+	handleUpload("/rebuild", rebuildHandler(cfg))
+	handleUpload("/promote", promoteHandler(cfg))
+
+	// Admin endpoints apply their own, stricter authorization
+	mux.HandleFunc("/admin/reset", adminResetHandler(cfg))
+	mux.HandleFunc("/admin/audit", adminAuditHandler(cfg))
+	mux.HandleFunc("/admin/workdirs/{id}", adminPurgeWorkDirHandler(cfg))
+	mux.HandleFunc("/admin/policy", adminPolicyHandler(cfg))
+
+	// Build Jobs download their inputs with a one-time token instead of AUTH_MODE
+	if cfg.BuildMode == config.BuildModeJob {
+		mux.HandleFunc("/jobs/{id}/bundle", jobBundleHandler(cfg))
+	}
+
+	// Serve the embedded upload form unless disabled
+	if cfg.ServeUI {
+		mux.HandleFunc("/{$}", uiHandler)
+	}
+
+	trustedProxies, err := config.ParseCIDRs(cfg.TrustedProxies)
+	if err != nil {
+		panic(fmt.Sprintf("Invalid trusted proxies: %v", err))
+	}
+
+	handler := corsMiddleware(cfg.CORSAllowedOrigins, cfg.CORSAllowCredentials, gzipMiddleware(mux))
+	handler = clientAddrMiddleware(trustedProxies, handler)
+	servers := []*http.Server{{Addr: ":" + cfg.ServerPort, Handler: handler}}
 
-		io.Copy(dst, file)
-		fmt.Fprintf(w, "File uploaded successfully: %s\n", filePath)
+	// Start the optional HTTP-to-HTTPS redirect listener
+	if cfg.RedirectHTTPPort != "" {
+		redirectSrv := &http.Server{Addr: ":" + cfg.RedirectHTTPPort, Handler: redirectHandler(cfg.ServerPort)}
+		servers = append(servers, redirectSrv)
 
-		// Run the builder in a Goroutine
 		go func() {
-			builder.BuildAndPushImage(cfg, filePath, imageName, authToken)
-			resetBusy()
+			fmt.Printf("Starting HTTP redirect listener on port %s\n", cfg.RedirectHTTPPort)
+			if err := redirectSrv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				panic(fmt.Sprintf("Failed to start HTTP redirect listener: %v", err))
+			}
 		}()
-	})
+	}
+
+	// Start the optional plain HTTP listener for metrics, health checks and profiling
+	if cfg.AdminPort != "" {
+		adminSrv := &http.Server{Addr: ":" + cfg.AdminPort, Handler: monitorHandler(cfg)}
+		servers = append(servers, adminSrv)
+
+		go func() {
+			fmt.Printf("Starting admin listener on port %s\n", cfg.AdminPort)
+			if err := adminSrv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				panic(fmt.Sprintf("Failed to start admin listener: %v", err))
+			}
+		}()
+	}
+
+	// Shut down all listeners together on SIGINT/SIGTERM
+	go func() {
+		stop := make(chan os.Signal, 1)
+		signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+		<-stop
+		shutdownServers(servers)
+	}()
 
 	// Start HTTPS server
 	fmt.Printf("Starting HTTPS server on port %s\n", cfg.ServerPort)
-	err := http.ListenAndServeTLS(":"+cfg.ServerPort, cfg.CAPublicKey, cfg.PrivateKey, nil)
-	if err != nil {
+	err = servers[0].ListenAndServeTLS(cfg.CAPublicKey, cfg.PrivateKey)
+	if err != nil && err != http.ErrServerClosed {
 		panic(fmt.Sprintf("Failed to start HTTPS server: %v", err))
 	}
-}
+	shutdownServers(servers)
 
-func authenticateRequest(cfg *config.Config, r *http.Request) (string, error) {
-	if !cfg.RequireAuth {
-		return "", nil
-	}
+	stopLeaderElection()
+	k8spermissions.StopEvents()
 
-	authHeader := r.Header.Get("Authorization")
-	authToken := ""
-	if strings.HasPrefix(authHeader, "Bearer ") {
-		authToken = strings.TrimPrefix(authHeader, "Bearer ")
+	// Flush pending audit entries before exiting
+	if err := auditLog.Close(); err != nil {
+		log.Printf("Failed to close audit log: %v\n", err)
 	}
+}
 
-	if authToken == "" {
-		return "", fmt.Errorf("Missing bearer token")
-	}
+// shutdownServers releases long-polling waiters and gracefully stops every listener,
+// waiting at most shutdownTimeout.
+func shutdownServers(servers []*http.Server) {
+	stopOnce.Do(func() { close(serverStopping) })
 
-	clientset, err := k8spermissions.CreateClientWithToken(cfg.ImageRegistry, authToken)
-	if err != nil {
-		return "", fmt.Errorf("Failed to create Kubernetes client")
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+
+	for _, srv := range servers {
+		if err := srv.Shutdown(ctx); err != nil {
+			log.Printf("Failed to shut down listener %s: %v\n", srv.Addr, err)
+		}
 	}
+}
 
-	allowed, err := k8spermissions.CheckAccessWithToken(clientset, "list", "namespaces")
-	if err != nil || !allowed {
-		return "", fmt.Errorf("Insufficient permissions to list namespaces")
+// registryOptions returns the settings of the registry client from cfg.
+func registryOptions(cfg *config.Config) registry.Options {
+	return registry.Options{
+		TLSVerify:    cfg.RegistryTLSVerify,
+		CABundle:     cfg.RegistryCABundle,
+		Timeout:      cfg.RegistryTimeout,
+		Retries:      cfg.RegistryRetries,
+		RetryBackoff: cfg.RegistryRetryBackoff,
+		RateLimitMax: cfg.RegistryRateLimitMax,
+
+		InsecureRegistries: cfg.InsecureRegistries,
 	}
+}
 
-	return authToken, nil
+// kubeOptions returns the settings of the Kubernetes clients from cfg.
+func kubeOptions(cfg *config.Config) k8spermissions.Options {
+	return k8spermissions.Options{Kubeconfig: cfg.Kubeconfig, APIServer: cfg.KubeAPIServer, CABundle: cfg.KubeCABundle, TLSVerify: cfg.KubeTLSVerify}
 }
 
 func resetBusy() {
 	buildLock.Lock()
 	isBusy = false
+	activeBuild = nil
 	buildLock.Unlock()
 }
+
+// releaseBuild frees the busy slot if it is still held by b. A slot that was
+// force-cleared and handed to a newer build is left alone.
+func releaseBuild(b *Build) {
+	buildLock.Lock()
+	defer buildLock.Unlock()
+	if activeBuild == b {
+		isBusy = false
+		activeBuild = nil
+	}
+}
@@ -0,0 +1,82 @@
+package server
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+
+	"vddk-builder/pkg/builder"
+	"vddk-builder/pkg/config"
+	"vddk-builder/pkg/registry"
+)
+
+// skipReason reports why building archiveDigest for reference can be skipped, together with
+// the digest the registry serves for reference, or an empty reason when the build must run.
+// The build is skipped when an earlier build pushed the same archive to reference and the
+// registry still serves its digest, or when the remote image carries the archive digest label.
+// SKIP_IF_EXISTS=false and the force=true query parameter disable the check, and dry runs
+// and builds written to OUTPUT_DIR never skip.
+func skipReason(cfg *config.Config, r *http.Request, reference, archiveDigest, authToken string) (string, string) {
+	query := r.URL.Query()
+	if !cfg.SkipIfExists || cfg.OutputMode == config.OutputModeArchive || query.Get("force") == "true" || query.Get("dry_run") == "true" || archiveDigest == "" {
+		return "", ""
+	}
+
+	imageName := strings.TrimPrefix(reference, cfg.ImageRegistry+"/")
+	remote, exists, err := registry.ImageDigest(r.Context(), imageName, cfg.ImageRegistry, authToken)
+	if err != nil {
+		log.Printf("Failed to look up %s, building anyway: %v\n", reference, err)
+		return "", ""
+	}
+	if !exists {
+		return "", ""
+	}
+
+	if previous := lastPushOf(reference, archiveDigest); previous != nil && remote != "" && previous.Digest == remote {
+		return remote, fmt.Sprintf("build %s already pushed archive %s to %s", previous.ID, archiveDigest, reference)
+	}
+	labels, _, err := registry.ImageLabels(r.Context(), imageName, cfg.ImageRegistry, authToken)
+	if err != nil {
+		log.Printf("Failed to read the labels of %s, building anyway: %v\n", reference, err)
+		return "", ""
+	}
+	if labels[builder.ArchiveDigestLabel] == archiveDigest {
+		return remote, fmt.Sprintf("image %s is already built from archive %s", reference, archiveDigest)
+	}
+	return "", ""
+}
+
+// lastPushOf returns the most recent succeeded build that pushed archiveDigest to reference, or nil.
+func lastPushOf(reference, archiveDigest string) *Build {
+	buildsLock.Lock()
+	defer buildsLock.Unlock()
+
+	var last *Build
+	for _, b := range builds {
+		if b.State != BuildSucceeded || b.Reference != reference || b.ArchiveDigest != archiveDigest {
+			continue
+		}
+		if last == nil || b.StartedAt.After(last.StartedAt) {
+			last = b
+		}
+	}
+	if last == nil {
+		return nil
+	}
+	snapshot := *last
+	return &snapshot
+}
+
+// skipBuild ends the running build b as skipped, recording the existing digest and the
+// reason, and frees the busy slot.
+func skipBuild(b *Build, digest, reason string) {
+	buildsLock.Lock()
+	b.Digest = digest
+	b.SkipReason = reason
+	buildsLock.Unlock()
+
+	log.Printf("Build %s skipped: %s\n", b.ID, reason)
+	finishBuild(b, BuildSkipped, "")
+	releaseBuild(b)
+}
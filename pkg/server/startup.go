@@ -0,0 +1,113 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"slices"
+	"time"
+
+	"vddk-builder/pkg/builder"
+	"vddk-builder/pkg/config"
+	"vddk-builder/pkg/registry"
+)
+
+// startupCheckTimeout bounds each external command run by a startup check.
+const startupCheckTimeout = 30 * time.Second
+
+// startupCheck is a named precondition verified before the server starts listening.
+type startupCheck struct {
+	name string
+	run  func(cfg *config.Config) error
+}
+
+// startupChecks lists every check; names can be disabled with STARTUP_CHECKS_SKIP.
+var startupChecks = []startupCheck{
+	{"build-engine", checkEngine},
+	{"skopeo", func(cfg *config.Config) error { return runCheckCommand("skopeo", "--version") }},
+	{"upload-dir", func(cfg *config.Config) error { return checkWritable(cfg.UploadDir) }},
+	{"work-dir", func(cfg *config.Config) error { return checkWritable(cfg.WorkDir) }},
+	{"log-dir", func(cfg *config.Config) error {
+		if cfg.LogDir == "" {
+			return nil
+		}
+		return checkWritable(cfg.LogDir)
+	}},
+	{"output-dir", func(cfg *config.Config) error {
+		if cfg.OutputMode != config.OutputModeArchive {
+			return nil
+		}
+		return checkWritable(cfg.OutputDir)
+	}},
+	{"registry", func(cfg *config.Config) error {
+		if cfg.OutputMode == config.OutputModeArchive {
+			return nil
+		}
+		_, err := registry.Ping(context.Background(), cfg.ImageRegistry, "")
+		return err
+	}},
+}
+
+// runStartupChecks runs every enabled startup check and returns an error naming all that failed.
+func runStartupChecks(cfg *config.Config) error {
+	if !cfg.StartupChecks {
+		return nil
+	}
+
+	var failed []string
+	for _, check := range startupChecks {
+		if slices.Contains(cfg.StartupChecksSkip, check.name) {
+			log.Printf("Startup check %s skipped\n", check.name)
+			continue
+		}
+		if err := check.run(cfg); err != nil {
+			log.Printf("Startup check %s failed: %v\n", check.name, err)
+			failed = append(failed, check.name)
+			continue
+		}
+		log.Printf("Startup check %s passed\n", check.name)
+	}
+
+	if len(failed) > 0 {
+		return fmt.Errorf("startup checks failed: %v", failed)
+	}
+	return nil
+}
+
+// runCheckCommand runs name with args and includes its output in the returned error.
+func runCheckCommand(name string, args ...string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), startupCheckTimeout)
+	defer cancel()
+
+	output, err := exec.CommandContext(ctx, name, args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%s %v: %w\n%s", name, args, err, output)
+	}
+	return nil
+}
+
+// checkEngine verifies that the build engine, or the remote podman service, answers. Build
+// Jobs bring their own, so there is nothing to check with BUILD_MODE=job.
+func checkEngine(cfg *config.Config) error {
+	if cfg.BuildMode == config.BuildModeJob {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), startupCheckTimeout)
+	defer cancel()
+	return builder.PingEngine(ctx, cfg)
+}
+
+// checkWritable verifies that dir exists (creating it if needed) and accepts new files.
+func checkWritable(dir string) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(dir, ".write-check-*")
+	if err != nil {
+		return err
+	}
+	f.Close()
+	return os.Remove(f.Name())
+}
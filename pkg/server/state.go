@@ -0,0 +1,119 @@
+package server
+
+import (
+	"encoding/json"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// stateFileName is the file inside STATE_DIR holding build history and quota counters.
+const stateFileName = "state.json"
+
+// persistedState is the on-disk form of the server's state store.
+type persistedState struct {
+	Builds []Build               `json:"builds"`
+	Quotas map[string]quotaUsage `json:"quotas"`
+}
+
+// stateDirty signals the state writer that something changed.
+var stateDirty = make(chan struct{}, 1)
+
+// loadState restores build history and quota counters from dir. Builds that were still
+// running when the server stopped are marked failed. A missing file is not an error.
+func loadState(dir string) error {
+	data, err := os.ReadFile(filepath.Join(dir, stateFileName))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var state persistedState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return err
+	}
+
+	buildsLock.Lock()
+	for i := range state.Builds {
+		b := state.Builds[i]
+		b.done = make(chan struct{})
+		if b.State == BuildRunning {
+			now := time.Now().UTC()
+			b.State = BuildFailed
+			b.Error = "interrupted by server restart"
+			b.FinishedAt = &now
+		}
+		close(b.done)
+		builds[b.ID] = &b
+	}
+	buildsLock.Unlock()
+
+	quotaLock.Lock()
+	for identity, usage := range state.Quotas {
+		quotas[identity] = &usage
+	}
+	quotaLock.Unlock()
+
+	log.Printf("Restored %d builds and %d quota counters from %s\n", len(state.Builds), len(state.Quotas), dir)
+	return nil
+}
+
+// markStateDirty schedules a write of the state store without blocking the caller.
+func markStateDirty() {
+	select {
+	case stateDirty <- struct{}{}:
+	default:
+	}
+}
+
+// runStateWriter writes the state store to dir whenever it is marked dirty.
+func runStateWriter(dir string) {
+	for range stateDirty {
+		if err := saveState(dir); err != nil {
+			log.Printf("Failed to save state: %v\n", err)
+		}
+	}
+}
+
+// saveState atomically replaces the state file in dir with the current state.
+func saveState(dir string) error {
+	state := persistedState{Quotas: map[string]quotaUsage{}}
+
+	buildsLock.Lock()
+	for _, b := range builds {
+		state.Builds = append(state.Builds, *b)
+	}
+	buildsLock.Unlock()
+
+	quotaLock.Lock()
+	for identity, usage := range quotas {
+		state.Quotas[identity] = *usage
+	}
+	quotaLock.Unlock()
+
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(dir, stateFileName+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), filepath.Join(dir, stateFileName))
+}
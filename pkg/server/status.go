@@ -0,0 +1,110 @@
+package server
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+
+	"vddk-builder/pkg/config"
+	"vddk-builder/pkg/k8spermissions"
+	"vddk-builder/pkg/registry"
+)
+
+// statusTimeout bounds each write of a status object, so a slow API server delays only
+// the status reports.
+const statusTimeout = 30 * time.Second
+
+var (
+	statusWriter *k8spermissions.StatusWriter // Writes the status objects, nil unless STATUS_REPORTING is set
+	statusLock   sync.Mutex                   // Protects statusQueue
+	statusQueue  = map[string]bool{}          // IDs of the builds whose status object is stale
+	statusDirty  = make(chan struct{}, 1)
+)
+
+// startStatusReporting starts writing the status of every build to a ConfigMap or
+// VDDKBuild resource as chosen by STATUS_REPORTING.
+func startStatusReporting(cfg *config.Config) error {
+	if cfg.StatusReporting == "" {
+		return nil
+	}
+	writer, err := k8spermissions.NewStatusWriter(cfg.StatusNamespace, cfg.StatusReporting == config.StatusReportingResource)
+	if err != nil {
+		return err
+	}
+	statusWriter = writer
+	go runStatusReporter(cfg)
+	return nil
+}
+
+// markStatusDirty schedules a write of the status object of build id without blocking the
+// caller, which may hold buildsLock. It is a no-op unless STATUS_REPORTING is set.
+func markStatusDirty(id string) {
+	if statusWriter == nil {
+		return
+	}
+	statusLock.Lock()
+	statusQueue[id] = true
+	statusLock.Unlock()
+	select {
+	case statusDirty <- struct{}{}:
+	default:
+	}
+}
+
+// runStatusReporter writes the current status of each build marked dirty, then deletes
+// the status objects past STATUS_RETENTION. Failures are logged and never fail a build;
+// the next transition of the build writes its status again.
+func runStatusReporter(cfg *config.Config) {
+	for range statusDirty {
+		statusLock.Lock()
+		ids := statusQueue
+		statusQueue = map[string]bool{}
+		statusLock.Unlock()
+
+		for id := range ids {
+			buildsLock.Lock()
+			b, ok := builds[id]
+			var snap Build
+			if ok {
+				snap = *b
+			}
+			buildsLock.Unlock()
+			if !ok {
+				continue
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), statusTimeout)
+			if err := statusWriter.Apply(ctx, cfg.StatusNamePrefix+id, buildStatus(snap)); err != nil {
+				log.Printf("Failed to write the status of build %s: %v\n", id, err)
+			}
+			cancel()
+		}
+
+		if cfg.StatusRetention > 0 {
+			ctx, cancel := context.WithTimeout(context.Background(), statusTimeout)
+			if err := statusWriter.Prune(ctx, cfg.StatusRetention); err != nil {
+				log.Printf("Failed to delete old build status objects: %v\n", err)
+			}
+			cancel()
+		}
+	}
+}
+
+// buildStatus returns the fields of b written to its status object.
+func buildStatus(b Build) k8spermissions.BuildStatus {
+	imageName := b.Image
+	if ref, err := registry.ParseReference(b.Reference); err == nil {
+		imageName = ref.Repository
+	}
+	return k8spermissions.BuildStatus{
+		BuildID:    b.ID,
+		ImageName:  imageName,
+		Reference:  b.Reference,
+		Digest:     b.Digest,
+		State:      string(b.State),
+		Phase:      b.Phase,
+		Error:      b.Error,
+		StartedAt:  b.StartedAt,
+		FinishedAt: b.FinishedAt,
+	}
+}
@@ -0,0 +1,150 @@
+package server
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"vddk-builder/pkg/config"
+)
+
+// storeSweepInterval is how often the retention sweep scans the archive store.
+const storeSweepInterval = time.Hour
+
+// digestPattern matches the SHA-256 digests the store is keyed by.
+var digestPattern = regexp.MustCompile(`^sha256:[0-9a-f]{64}$`)
+
+// storeDir returns the directory of the content-addressed upload store.
+func storeDir(cfg *config.Config) string {
+	return filepath.Join(cfg.UploadDir, "store", "sha256")
+}
+
+// storePath returns where the upload with the given digest is kept in the store.
+func storePath(cfg *config.Config, digest string) (string, error) {
+	if !digestPattern.MatchString(digest) {
+		return "", fmt.Errorf("Invalid digest %q", digest)
+	}
+	return filepath.Join(storeDir(cfg), strings.TrimPrefix(digest, "sha256:")), nil
+}
+
+// retainUpload links the stored archive and extra files of upload into the store so
+// they survive the builder's cleanup. Failures are logged; the build proceeds anyway.
+func retainUpload(cfg *config.Config, upload *receivedUpload) {
+	if err := os.MkdirAll(storeDir(cfg), 0755); err != nil {
+		log.Printf("Failed to create upload store: %v\n", err)
+		return
+	}
+
+	paths := append([]string{upload.filePath}, upload.extraFiles...)
+	for i, input := range upload.inputs {
+		dst, err := storePath(cfg, input.Digest)
+		if err == nil {
+			if _, statErr := os.Stat(dst); os.IsNotExist(statErr) {
+				err = linkOrCopy(paths[i], dst)
+			}
+		}
+		if err == nil {
+			err = touch(dst)
+		}
+		if err != nil {
+			log.Printf("Failed to retain upload %s: %v\n", input.Name, err)
+		}
+	}
+}
+
+// restoreInput places the stored file with digest at path for a rebuild, replacing
+// whatever path held before.
+func restoreInput(cfg *config.Config, digest, path string) error {
+	src, err := storePath(cfg, digest)
+	if err != nil {
+		return err
+	}
+	if err := touch(src); err != nil {
+		return err
+	}
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return linkOrCopy(src, path)
+}
+
+// statStoredInput returns the file info of the stored file with digest.
+func statStoredInput(cfg *config.Config, digest string) (os.FileInfo, error) {
+	path, err := storePath(cfg, digest)
+	if err != nil {
+		return nil, err
+	}
+	return os.Stat(path)
+}
+
+// touch refreshes the modification time of path, which the retention sweep treats as
+// the time of last use.
+func touch(path string) error {
+	now := time.Now()
+	return os.Chtimes(path, now, now)
+}
+
+// linkOrCopy hard-links src to dst, copying when the two are on different filesystems.
+func linkOrCopy(src, dst string) error {
+	if err := os.Link(src, dst); err == nil {
+		return nil
+	}
+
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	tmp, err := os.CreateTemp(filepath.Dir(dst), ".copy-*")
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(tmp, in); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), dst)
+}
+
+// runStoreSweeper removes stored uploads unused for longer than UPLOAD_RETENTION.
+func runStoreSweeper(cfg *config.Config) {
+	for {
+		sweepStore(cfg)
+		time.Sleep(storeSweepInterval)
+	}
+}
+
+// sweepStore deletes every stored upload last used before the retention window.
+func sweepStore(cfg *config.Config) {
+	entries, err := os.ReadDir(storeDir(cfg))
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("Failed to read upload store: %v\n", err)
+		}
+		return
+	}
+
+	cutoff := time.Now().Add(-cfg.UploadRetention)
+	for _, entry := range entries {
+		info, err := entry.Info()
+		if err != nil || info.IsDir() || !info.ModTime().Before(cutoff) {
+			continue
+		}
+		if err := os.Remove(filepath.Join(storeDir(cfg), entry.Name())); err != nil {
+			log.Printf("Failed to remove stored upload %s: %v\n", entry.Name(), err)
+			continue
+		}
+		log.Printf("Removed stored upload sha256:%s after %s of retention\n", entry.Name(), cfg.UploadRetention)
+	}
+}
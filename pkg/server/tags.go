@@ -0,0 +1,49 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+
+	"vddk-builder/pkg/config"
+	"vddk-builder/pkg/registry"
+)
+
+// tagsResponse is the answer of /tags.
+type tagsResponse struct {
+	Repository string   `json:"repository"`
+	Tags       []string `json:"tags"`
+}
+
+// tagsHandler lists the tags of the repository named by the 'image' query parameter in the
+// configured registry, in the order the registry lists them. A tag or digest in the
+// parameter is ignored.
+func tagsHandler(cfg *config.Config) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		imageName := r.URL.Query().Get("image")
+		if imageName == "" {
+			http.Error(w, "Missing 'image' query parameter", http.StatusBadRequest)
+			return
+		}
+		ref, err := registry.ParseReference(imageName)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		tags, exists, err := registry.ListTags(r.Context(), imageName, cfg.ImageRegistry, registryToken(r))
+		if err != nil {
+			registryError(w, "Error listing tags", err)
+			return
+		}
+		if !exists {
+			http.Error(w, fmt.Sprintf("Repository %s not found in the registry.", ref.Repository), http.StatusNotFound)
+			return
+		}
+		writeJSON(w, http.StatusOK, tagsResponse{Repository: ref.Repository, Tags: tags})
+	}
+}
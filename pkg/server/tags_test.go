@@ -0,0 +1,66 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"vddk-builder/pkg/config"
+	"vddk-builder/pkg/registry"
+)
+
+func TestTags(t *testing.T) {
+	stub := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v2/ns/vddk/tags/list" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string][]string{"tags": {"8.0.3", "8.0.2"}})
+	}))
+	defer stub.Close()
+	if err := registry.Configure(registry.Options{TLSVerify: false}); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { registry.Configure(registry.Options{TLSVerify: true, Timeout: 30 * time.Second}) })
+	handler := tagsHandler(&config.Config{ImageRegistry: stub.Listener.Addr().String()})
+
+	list := func(image string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		handler(w, httptest.NewRequest(http.MethodGet, "/tags?image="+image, nil))
+		return w
+	}
+
+	w := list("ns/vddk:8.0.3")
+	var resp tagsResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); w.Code != http.StatusOK || err != nil {
+		t.Fatalf("tags = %d with %q, want 200 with JSON", w.Code, w.Body.String())
+	}
+	if resp.Repository != "ns/vddk" || !slices.Equal(resp.Tags, []string{"8.0.3", "8.0.2"}) {
+		t.Errorf("tags = %+v, want ns/vddk with 8.0.3 and 8.0.2", resp)
+	}
+
+	if w := list("ns/missing"); w.Code != http.StatusNotFound {
+		t.Errorf("tags of a missing repository = %d, want 404", w.Code)
+	}
+	if w := list(""); w.Code != http.StatusBadRequest {
+		t.Errorf("tags without an image = %d, want 400", w.Code)
+	}
+}
+
+func TestTagsReportsRegistryError(t *testing.T) {
+	handler := tagsHandler(&config.Config{ImageRegistry: unauthorizedRegistry(t)})
+	w := httptest.NewRecorder()
+	handler(w, httptest.NewRequest(http.MethodGet, "/tags?image=ns/vddk", nil))
+
+	if w.Code != http.StatusInternalServerError {
+		t.Errorf("status = %d, want %d", w.Code, http.StatusInternalServerError)
+	}
+	if body := w.Body.String(); !strings.Contains(body, "UNAUTHORIZED") || !strings.Contains(body, "authentication required") {
+		t.Errorf("body = %q, want the registry's error code and message", body)
+	}
+}
@@ -0,0 +1,20 @@
+package server
+
+import (
+	_ "embed"
+	"net/http"
+)
+
+//go:embed ui/index.html
+var uiPage []byte
+
+// uiHandler serves the self-contained HTML upload form.
+func uiHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Content-Security-Policy", "default-src 'self'; style-src 'unsafe-inline'; script-src 'unsafe-inline'")
+	w.Write(uiPage)
+}
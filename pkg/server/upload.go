@@ -0,0 +1,661 @@
+package server
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"vddk-builder/pkg/audit"
+	"vddk-builder/pkg/builder"
+	"vddk-builder/pkg/config"
+	"vddk-builder/pkg/registry"
+)
+
+// uploadHandler accepts a VDDK archive in the 'file' form field, plus any number of
+// 'extra' files copied into the build context, and starts a build in the background.
+func uploadHandler(cfg *config.Config) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// Allow only POST requests
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		// Parse the optional image query parameter
+		imageName := r.URL.Query().Get("image")
+		if imageName == "" {
+			imageName = cfg.ImageName // Use default image name from config
+		}
+		imageName = cfg.QualifiedImageName(imageName)
+		var ok bool
+		if r, ok = authorizePush(w, r, cfg, imageName); !ok {
+			return
+		}
+		if err := checkImageAllowed(cfg, imageName); err != nil {
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+		reference := normalizeReference(builder.ImageReference(cfg, imageName))
+
+		unpackNested := r.URL.Query().Get("unpack_nested") != "false"
+		updateRefs := r.URL.Query().Get("update_refs") != "false"
+
+		// Parse the optional path of the Containerfile inside the archive
+		containerfile := r.URL.Query().Get("containerfile")
+		if containerfile != "" {
+			if err := builder.ValidateContainerfilePath(containerfile); err != nil {
+				http.Error(w, fmt.Sprintf("Invalid 'containerfile' query parameter: %v", err), http.StatusBadRequest)
+				return
+			}
+		}
+		buildArgs, err := parseBuildArgs(cfg, r)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Invalid 'build_arg' query parameter: %v", err), http.StatusBadRequest)
+			return
+		}
+		dryRun := r.URL.Query().Get("dry_run") == "true"
+		if dryRun && !cfg.DryRunAllowed {
+			http.Error(w, "Dry runs are disabled", http.StatusForbidden)
+			return
+		}
+		noCache := queryFlag(r, "no_cache", cfg.NoCache)
+		squash := queryFlag(r, "squash", cfg.Squash)
+		platform, err := parsePlatform(cfg, r)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Invalid 'platform' query parameter: %v", err), http.StatusBadRequest)
+			return
+		}
+		platforms, err := parsePlatforms(r, nil)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Invalid 'platforms' query parameter: %v", err), http.StatusBadRequest)
+			return
+		}
+		if platform != "" && platforms != nil {
+			http.Error(w, "The 'platform' and 'platforms' query parameters are mutually exclusive", http.StatusBadRequest)
+			return
+		}
+		if platform == "" && platforms == nil {
+			platform, platforms = cfg.TargetPlatform, cfg.Platforms
+		}
+
+		// Point the caller at a build already pushing the same reference
+		if existing := inFlightBuild(reference); existing != nil {
+			w.Header().Set("X-Build-ID", existing.ID)
+			http.Error(w, fmt.Sprintf("Image %s is already being built by build %s", reference, existing.ID), http.StatusConflict)
+			return
+		}
+
+		// Enforce the caller's daily upload quota before accepting the body
+		if err := checkQuota(cfg, requestIdentity(r), r.ContentLength); err != nil {
+			writeQuotaExceeded(w, err)
+			return
+		}
+
+		// Check if the server is busy
+		if !acquireBusy() {
+			http.Error(w, "Server is busy processing another build. Please try again later.", http.StatusServiceUnavailable)
+			return
+		}
+
+		authToken := registryToken(r)
+
+		// Refuse to clobber an existing tag unless overwriting was requested and is allowed
+		if !dryRun && !checkOverwrite(w, cfg, r, cfg.ImageRegistry, imageName, authToken) {
+			resetBusy()
+			return
+		}
+
+		// Give the build a private work directory, which streamed uploads extract into
+		buildID := newBuildID()
+		workDir, err := builder.NewWorkDir(cfg, buildID)
+		if err != nil {
+			log.Printf("Failed to create work directory: %v\n", err)
+			http.Error(w, "Failed to create work directory", http.StatusInternalServerError)
+			resetBusy()
+			return
+		}
+
+		// Receive the archive, either stored for later extraction or extracted while streaming
+		receive := receiveStored
+		if cfg.StreamUploads {
+			receive = receiveStreamed
+		}
+		upload, status, err := receive(cfg, r, workDir)
+		if err != nil {
+			http.Error(w, err.Error(), status)
+			os.RemoveAll(workDir)
+			resetBusy()
+			return
+		}
+		inputs := upload.inputs
+		archive := inputs[0]
+		filePath, extraFiles := upload.filePath, upload.extraFiles
+
+		var uploadedBytes int64
+		for _, input := range inputs {
+			uploadedBytes += input.Size
+		}
+
+		build, created := newBuild(&Build{
+			ID:                    buildID,
+			Image:                 imageName,
+			Reference:             reference,
+			Containerfile:         containerfile,
+			BuildArgs:             builder.RedactBuildArgs(buildArgs),
+			Platforms:             platforms,
+			Platform:              platform,
+			NoCache:               noCache,
+			Squash:                squash,
+			Limits:                builder.LimitsFor(cfg),
+			ContainerfileUploaded: upload.containerfile != "",
+			DryRun:                dryRun,
+			Identity:              requestIdentity(r),
+			Inputs:                inputs,
+			filePath:              filePath,
+			extrasDir:             upload.extrasDir,
+			workDir:               workDir,
+			clientIP:              clientAddr(r),
+		})
+		if !created {
+			w.Header().Set("X-Build-ID", build.ID)
+			http.Error(w, fmt.Sprintf("Image %s is already being built by build %s", reference, build.ID), http.StatusConflict)
+			upload.discard()
+			resetBusy()
+			return
+		}
+		buildLock.Lock()
+		activeBuild = build
+		buildLock.Unlock()
+
+		// Keep the archive and extras for rebuilds before the builder deletes them
+		if cfg.KeepUploads && filePath != "" {
+			retainUpload(cfg, upload)
+		}
+
+		recordQuota(cfg, build.Identity, uploadedBytes)
+		uploadsTotal.Inc()
+		uploadBytesTotal.Add(float64(uploadedBytes))
+		log.Printf("Build %s started for %s from %s\n", build.ID, imageName, clientAddr(r))
+		auditLog.Record(audit.Entry{
+			Identity:      build.Identity,
+			ClientIP:      build.clientIP,
+			Action:        "upload",
+			Image:         reference,
+			BuildID:       build.ID,
+			ArchiveDigest: archive.Digest,
+			Outcome:       "accepted",
+		})
+
+		w.Header().Set("X-Build-ID", build.ID)
+		if filePath != "" {
+			fmt.Fprintf(w, "File uploaded successfully: %s\n", filePath)
+		} else {
+			fmt.Fprintf(w, "File uploaded and extracted successfully: %s\n", archive.Name)
+		}
+		fmt.Fprintf(w, "Build ID: %s\n", build.ID)
+
+		// Skip builds that would push exactly what the registry already holds
+		if digest, reason := skipReason(cfg, r, reference, archive.Digest, authToken); reason != "" {
+			skipBuild(build, digest, reason)
+			upload.discard()
+			fmt.Fprintf(w, "Build skipped: %s\n", reason)
+			return
+		}
+
+		// Run the builder in a Goroutine
+		go runBuild(build, cfg.BuildTimeout, func(ctx context.Context) error {
+			defer os.RemoveAll(upload.extrasDir)
+			buildLog := openBuildLog(cfg, build)
+			defer buildLog.close(build)
+			result, err := buildAndPushImage(ctx, cfg, builder.BuildRequest{
+				WorkDir:               workDir,
+				BuildID:               build.ID,
+				FilePath:              filePath,
+				ImageName:             imageName,
+				AuthToken:             authToken,
+				ExtraFiles:            extraFiles,
+				Containerfile:         containerfile,
+				UnpackNested:          unpackNested,
+				BuildArgs:             buildArgs,
+				Platforms:             platforms,
+				Platform:              platform,
+				ArchiveDigest:         build.ArchiveDigest,
+				NoCache:               noCache,
+				Squash:                squash,
+				DryRun:                dryRun,
+				Progress:              build.setProgress,
+				Output:                buildLog.writer(),
+				SBOMPath:              buildSBOMPath(cfg, build),
+				ScanReportPath:        buildScanReportPath(cfg, build),
+				UpdateRefs:            updateRefs,
+				ContainerfileOverride: upload.containerfile,
+				ContainerfileCopy:     buildContainerfileCopy(cfg, build),
+				Runner:                commandRunner,
+			})
+			build.setResult(result)
+			return err
+		})
+	}
+}
+
+// acquireBusy claims the busy slot, reporting false if another build holds it.
+func acquireBusy() bool {
+	buildLock.Lock()
+	defer buildLock.Unlock()
+	if isBusy {
+		return false
+	}
+	isBusy = true
+	return true
+}
+
+// checkOverwrite refuses to clobber an existing tag of imageName in registryURL unless
+// overwriting was requested with overwrite=true and is allowed. It writes the error response and reports false when the
+// build must not proceed; a registry error fails closed. OCI archives written to
+// OUTPUT_DIR are named after the build and never clobber each other.
+func checkOverwrite(w http.ResponseWriter, cfg *config.Config, r *http.Request, registryURL, imageName, authToken string) bool {
+	if cfg.OutputMode == config.OutputModeArchive || cfg.AllowOverwrite && r.URL.Query().Get("overwrite") == "true" {
+		return true
+	}
+	manifest, err := registry.DescribeImage(r.Context(), imageName, registryURL, authToken)
+	if err != nil {
+		status := http.StatusServiceUnavailable
+		var rateLimited *registry.RateLimitedError
+		if errors.As(err, &rateLimited) {
+			status = http.StatusTooManyRequests
+		}
+		http.Error(w, fmt.Sprintf("Unable to verify that image %s does not already exist: %v", imageName, err), status)
+		return false
+	}
+	if manifest.Exists {
+		kind := "image"
+		if manifest.IsList() {
+			kind = "multi-arch manifest list"
+		}
+		http.Error(w, fmt.Sprintf("Image %s already exists in the registry as a %s (digest %s); pass overwrite=true to replace it", imageName, kind, manifest.Digest), http.StatusConflict)
+		return false
+	}
+	return true
+}
+
+// receivedUpload is an upload accepted by either the stored or the streamed path.
+type receivedUpload struct {
+	workDir    string       // Work directory of the build, holding the extraction of streamed uploads
+	filePath   string       // Stored archive, empty when it was extracted while streaming
+	extrasDir  string       // Directory holding the extra files
+	extraFiles []string     // Paths of the extra files
+	inputs     []BuildInput // Archive first, then the extras
+
+	containerfile string // Uploaded Containerfile overriding the archive's, in workDir
+}
+
+// discard removes everything the upload left on disk.
+func (u *receivedUpload) discard() {
+	builder.CleanupWorkspace(u.workDir, u.filePath)
+	os.RemoveAll(u.extrasDir)
+}
+
+// receiveStored saves the 'file' archive and the 'extra' files into UploadDir.
+func receiveStored(cfg *config.Config, r *http.Request, workDir string) (*receivedUpload, int, error) {
+	// Parse the uploaded file
+	file, header, err := r.FormFile("file")
+	if err != nil {
+		return nil, http.StatusBadRequest, fmt.Errorf("Failed to parse file")
+	}
+	defer file.Close()
+
+	fileName, err := sanitizeFilename(header.Filename)
+	if err != nil {
+		return nil, http.StatusBadRequest, err
+	}
+	checksum, err := expectedChecksum(r)
+	if err != nil {
+		return nil, http.StatusBadRequest, err
+	}
+
+	// Save the uploaded file
+	filePath := filepath.Join(cfg.UploadDir, fileName)
+	archive, err := saveUpload(file, filePath, checksum)
+	var mismatch *checksumMismatchError
+	if errors.As(err, &mismatch) {
+		return nil, http.StatusBadRequest, err
+	}
+	if err != nil {
+		return nil, http.StatusInternalServerError, fmt.Errorf("Failed to save file")
+	}
+	archive.Name = fileName
+	archive.Role = "archive"
+
+	// Save the extra files next to the archive
+	upload := &receivedUpload{workDir: workDir, filePath: filePath, extrasDir: builder.ExtrasDir(filePath)}
+	extraInputs, extraFiles, err := saveExtras(r.MultipartForm.File["extra"], upload.extrasDir)
+	if err != nil {
+		upload.discard()
+		return nil, http.StatusBadRequest, err
+	}
+	upload.extraFiles = extraFiles
+	upload.inputs = append([]BuildInput{archive}, extraInputs...)
+
+	// Save the Containerfile override, if any
+	if headers := r.MultipartForm.File["containerfile"]; len(headers) > 0 {
+		if len(headers) > 1 {
+			upload.discard()
+			return nil, http.StatusBadRequest, fmt.Errorf("Only one 'containerfile' part is allowed")
+		}
+		src, err := headers[0].Open()
+		if err != nil {
+			upload.discard()
+			return nil, http.StatusBadRequest, fmt.Errorf("Failed to read Containerfile")
+		}
+		path, status, err := saveContainerfile(cfg, src, workDir)
+		src.Close()
+		if err != nil {
+			upload.discard()
+			return nil, status, err
+		}
+		upload.containerfile = path
+	}
+	return upload, http.StatusOK, nil
+}
+
+// maxContainerfileSize bounds the Containerfile accepted in the 'containerfile' part.
+const maxContainerfileSize = 1 << 20
+
+// saveContainerfile validates the uploaded Containerfile in src against
+// CONTAINERFILE_DENIED_PATTERNS and stores it in workDir, outside the build context.
+// A rejected instruction answers 422 naming the offending line.
+func saveContainerfile(cfg *config.Config, src io.Reader, workDir string) (string, int, error) {
+	content, err := io.ReadAll(io.LimitReader(src, maxContainerfileSize+1))
+	if err != nil {
+		return "", http.StatusBadRequest, fmt.Errorf("Failed to read Containerfile")
+	}
+	if len(content) > maxContainerfileSize {
+		return "", http.StatusRequestEntityTooLarge, fmt.Errorf("Containerfile exceeds %d bytes", maxContainerfileSize)
+	}
+	if err := builder.ValidateContainerfile(cfg, string(content)); err != nil {
+		var cfErr *builder.ContainerfileError
+		if errors.As(err, &cfErr) {
+			return "", http.StatusUnprocessableEntity, err
+		}
+		return "", http.StatusInternalServerError, err
+	}
+	path := filepath.Join(workDir, "Containerfile.upload")
+	if err := os.WriteFile(path, content, 0644); err != nil {
+		return "", http.StatusInternalServerError, fmt.Errorf("Failed to save Containerfile")
+	}
+	return path, http.StatusOK, nil
+}
+
+// receiveStreamed reads the multipart body part by part, extracting the 'file' archive
+// straight into the build context in workDir while hashing it, and storing 'extra' files in a
+// temporary directory. A client disconnect mid-stream removes the partial extraction.
+func receiveStreamed(cfg *config.Config, r *http.Request, workDir string) (*receivedUpload, int, error) {
+	reader, err := r.MultipartReader()
+	if err != nil {
+		return nil, http.StatusBadRequest, fmt.Errorf("Failed to parse file")
+	}
+	checksum, err := expectedChecksum(r)
+	if err != nil {
+		return nil, http.StatusBadRequest, err
+	}
+
+	extrasDir, err := os.MkdirTemp(cfg.UploadDir, "stream-*.extras")
+	if err != nil {
+		return nil, http.StatusInternalServerError, fmt.Errorf("Failed to save extra files")
+	}
+	upload := &receivedUpload{workDir: workDir, extrasDir: extrasDir}
+	fail := func(status int, err error) (*receivedUpload, int, error) {
+		upload.discard()
+		return nil, status, err
+	}
+
+	var archive *BuildInput
+	var extras []BuildInput
+	seen := map[string]bool{}
+	containerfileSeen := false
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fail(http.StatusBadRequest, fmt.Errorf("Failed to read upload: %v", err))
+		}
+
+		switch part.FormName() {
+		case "file":
+			if archive != nil {
+				return fail(http.StatusBadRequest, fmt.Errorf("Only one 'file' part is allowed"))
+			}
+			name, err := sanitizeFilename(part.FileName())
+			if err != nil {
+				return fail(http.StatusBadRequest, err)
+			}
+
+			hash := sha256.New()
+			counter := &countingReader{r: io.TeeReader(part, hash)}
+			if err := builder.ExtractStream(cfg, counter, workDir); err != nil {
+				status := http.StatusBadRequest
+				if errors.Is(err, builder.ErrArchiveLimits) {
+					status = http.StatusRequestEntityTooLarge
+				}
+				return fail(status, fmt.Errorf("Failed to extract archive: %v", err))
+			}
+			// Hash trailing bytes after the end of the tar stream too
+			if _, err := io.Copy(io.Discard, counter); err != nil {
+				return fail(http.StatusBadRequest, fmt.Errorf("Failed to read upload: %v", err))
+			}
+			archive = &BuildInput{
+				Name:   name,
+				Role:   "archive",
+				Size:   counter.n,
+				Digest: "sha256:" + hex.EncodeToString(hash.Sum(nil)),
+			}
+			if checksum != "" && archive.Digest != checksum {
+				return fail(http.StatusBadRequest, &checksumMismatchError{expected: checksum, actual: archive.Digest})
+			}
+
+		case "containerfile":
+			if containerfileSeen {
+				return fail(http.StatusBadRequest, fmt.Errorf("Only one 'containerfile' part is allowed"))
+			}
+			containerfileSeen = true
+			path, status, err := saveContainerfile(cfg, part, workDir)
+			if err != nil {
+				return fail(status, err)
+			}
+			upload.containerfile = path
+
+		case "extra":
+			name, err := sanitizeFilename(part.FileName())
+			if err != nil {
+				return fail(http.StatusBadRequest, err)
+			}
+			if seen[name] {
+				return fail(http.StatusBadRequest, fmt.Errorf("Duplicate extra file %q", name))
+			}
+			seen[name] = true
+
+			path := filepath.Join(extrasDir, name)
+			input, err := saveUpload(part, path, "")
+			if err != nil {
+				return fail(http.StatusBadRequest, fmt.Errorf("Failed to save extra file %q", name))
+			}
+			input.Name = name
+			input.Role = "extra"
+			extras = append(extras, input)
+			upload.extraFiles = append(upload.extraFiles, path)
+		}
+		part.Close()
+	}
+
+	if archive == nil {
+		return fail(http.StatusBadRequest, fmt.Errorf("Failed to parse file"))
+	}
+	upload.inputs = append([]BuildInput{*archive}, extras...)
+	return upload, http.StatusOK, nil
+}
+
+// countingReader counts the bytes read through it.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// writeQuotaExceeded answers 429 with headers stating when the quota resets.
+func writeQuotaExceeded(w http.ResponseWriter, err error) {
+	var quotaErr *quotaExceededError
+	if errors.As(err, &quotaErr) {
+		w.Header().Set("X-Quota-Reset", quotaErr.resetAt.Format(time.RFC3339))
+		w.Header().Set("Retry-After", strconv.Itoa(int(time.Until(quotaErr.resetAt).Seconds())+1))
+	}
+	http.Error(w, err.Error(), http.StatusTooManyRequests)
+}
+
+// saveExtras stores the extra multipart files in dir and returns their build inputs and paths.
+// Two extras with the same sanitized name are rejected.
+func saveExtras(headers []*multipart.FileHeader, dir string) ([]BuildInput, []string, error) {
+	if len(headers) == 0 {
+		return nil, nil, nil
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, nil, fmt.Errorf("Failed to save extra files")
+	}
+
+	var inputs []BuildInput
+	var paths []string
+	seen := map[string]bool{}
+	for _, header := range headers {
+		name, err := sanitizeFilename(header.Filename)
+		if err != nil {
+			return nil, nil, err
+		}
+		if seen[name] {
+			return nil, nil, fmt.Errorf("Duplicate extra file %q", name)
+		}
+		seen[name] = true
+
+		src, err := header.Open()
+		if err != nil {
+			return nil, nil, fmt.Errorf("Failed to read extra file %q", name)
+		}
+		path := filepath.Join(dir, name)
+		input, err := saveUpload(src, path, "")
+		src.Close()
+		if err != nil {
+			return nil, nil, fmt.Errorf("Failed to save extra file %q", name)
+		}
+
+		input.Name = name
+		input.Role = "extra"
+		inputs = append(inputs, input)
+		paths = append(paths, path)
+	}
+	return inputs, paths, nil
+}
+
+// saveUpload copies src to path and returns its size and SHA-256 digest. The copy is
+// written to a temporary file with builder.PartialSuffix next to path and only renamed into
+// place once it is complete, synced and, unless checksum is empty, matches checksum.
+func saveUpload(src io.Reader, path, checksum string) (BuildInput, error) {
+	dst, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*"+builder.PartialSuffix)
+	if err != nil {
+		return BuildInput{}, err
+	}
+	fail := func(err error) (BuildInput, error) {
+		dst.Close()
+		os.Remove(dst.Name())
+		return BuildInput{}, err
+	}
+
+	hash := sha256.New()
+	size, err := io.Copy(io.MultiWriter(dst, hash), src)
+	if err != nil {
+		return fail(err)
+	}
+	if err := dst.Sync(); err != nil {
+		return fail(err)
+	}
+	if err := dst.Chmod(0644); err != nil {
+		return fail(err)
+	}
+	if err := dst.Close(); err != nil {
+		return fail(err)
+	}
+	input := BuildInput{Size: size, Digest: "sha256:" + hex.EncodeToString(hash.Sum(nil))}
+	if checksum != "" && input.Digest != checksum {
+		os.Remove(dst.Name())
+		return BuildInput{}, &checksumMismatchError{expected: checksum, actual: input.Digest}
+	}
+	if err := os.Rename(dst.Name(), path); err != nil {
+		os.Remove(dst.Name())
+		return BuildInput{}, err
+	}
+	return input, nil
+}
+
+// checksumMismatchError reports an archive whose digest differs from the 'checksum' the
+// client sent.
+type checksumMismatchError struct {
+	expected, actual string
+}
+
+func (e *checksumMismatchError) Error() string {
+	return fmt.Sprintf("Archive checksum mismatch: expected %s, received %s", e.expected, e.actual)
+}
+
+// expectedChecksum returns the 'checksum' query parameter, the sha256:<hex> digest the
+// archive must have, or an empty string when it is absent.
+func expectedChecksum(r *http.Request) (string, error) {
+	checksum := r.URL.Query().Get("checksum")
+	if checksum != "" && !digestPattern.MatchString(checksum) {
+		return "", fmt.Errorf("Invalid 'checksum' query parameter, expected sha256:<64 hex digits>")
+	}
+	return checksum, nil
+}
+
+// sweepPartialUploads removes the incomplete uploads a previous process left in UploadDir.
+// It must run before any upload is accepted.
+func sweepPartialUploads(cfg *config.Config) {
+	err := filepath.WalkDir(cfg.UploadDir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() || !strings.HasSuffix(path, builder.PartialSuffix) {
+			return err
+		}
+		if err := os.Remove(path); err != nil {
+			log.Printf("Failed to remove partial upload %s: %v\n", path, err)
+			return nil
+		}
+		log.Printf("Removed partial upload %s\n", path)
+		return nil
+	})
+	if err != nil && !os.IsNotExist(err) {
+		log.Printf("Failed to sweep partial uploads: %v\n", err)
+	}
+}
+
+// sanitizeFilename reduces a client-supplied file name to a plain base name.
+func sanitizeFilename(name string) (string, error) {
+	base := filepath.Base(filepath.Clean("/" + strings.ReplaceAll(name, "\\", "/")))
+	if base == "/" || base == "." || base == ".." || strings.ContainsRune(base, 0) {
+		return "", fmt.Errorf("Invalid file name %q", name)
+	}
+	return base, nil
+}
@@ -0,0 +1,84 @@
+package server
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"slices"
+	"time"
+
+	"vddk-builder/pkg/audit"
+	"vddk-builder/pkg/builder"
+	"vddk-builder/pkg/config"
+)
+
+// workDirSweepInterval is how often the retention sweep scans WORK_DIR for kept work directories.
+const workDirSweepInterval = time.Hour
+
+// runWorkDirSweeper removes the work directories of failed builds kept for longer than
+// WORKDIR_RETENTION.
+func runWorkDirSweeper(cfg *config.Config) {
+	for {
+		if removed := builder.SweepRetainedWorkDirs(cfg); len(removed) > 0 {
+			forgetRetainedWorkDirs(removed)
+		}
+		time.Sleep(workDirSweepInterval)
+	}
+}
+
+// forgetRetainedWorkDirs clears the retained work directory of every build kept in one of dirs.
+func forgetRetainedWorkDirs(dirs []string) {
+	buildsLock.Lock()
+	defer buildsLock.Unlock()
+	for _, b := range builds {
+		if b.RetainedWorkDir != "" && slices.Contains(dirs, b.RetainedWorkDir) {
+			b.RetainedWorkDir = ""
+			markStateDirty()
+		}
+	}
+}
+
+// adminPurgeWorkDirHandler removes the work directory kept after build {id} failed.
+func adminPurgeWorkDirHandler(cfg *config.Config) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodDelete {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		if status, err := authenticateAdmin(cfg, r); err != nil {
+			http.Error(w, err.Error(), status)
+			return
+		}
+
+		b := lookupBuild(r.PathValue("id"))
+		if b == nil {
+			http.Error(w, "Build not found", http.StatusNotFound)
+			return
+		}
+		dir := snapshotBuild(b).RetainedWorkDir
+		if dir == "" {
+			http.Error(w, "Build has no kept work directory", http.StatusNotFound)
+			return
+		}
+
+		if err := os.RemoveAll(dir); err != nil {
+			log.Printf("Failed to remove kept work directory %s: %v\n", dir, err)
+			http.Error(w, "Failed to remove the work directory", http.StatusInternalServerError)
+			return
+		}
+		forgetRetainedWorkDirs([]string{dir})
+
+		auditLog.Record(audit.Entry{
+			Identity: "admin",
+			ClientIP: clientAddr(r),
+			Action:   "admin-purge-workdir",
+			Image:    b.Reference,
+			BuildID:  b.ID,
+			Outcome:  "purged",
+		})
+		log.Printf("Admin purged work directory %s of build %s\n", dir, b.ID)
+		fmt.Fprintf(w, "Work directory of build %s removed.\n", b.ID)
+	}
+}
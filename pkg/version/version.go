@@ -0,0 +1,5 @@
+package version
+
+// Version is the build version, set at link time with
+// -ldflags "-X vddk-builder/pkg/version.Version=<version>".
+var Version = "dev"